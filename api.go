@@ -15,6 +15,7 @@
 package zoekt // import "github.com/google/zoekt"
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -22,7 +23,9 @@ import (
 	"reflect"
 	"strconv"
 	"time"
+	"unicode/utf8"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/google/zoekt/query"
 )
 
@@ -31,8 +34,8 @@ type FileMatch struct {
 	// Ranking; the higher, the better.
 	Score float64 // TODO - hide this field?
 
-	// For debugging. Needs DebugScore set, but public so tests in
-	// other packages can print some diagnostics.
+	// For debugging. Only set if SearchOptions.DebugScore is true. It
+	// lists the components which make up Score.
 	Debug string
 
 	FileName string
@@ -43,6 +46,10 @@ type FileMatch struct {
 	Branches    []string
 	LineMatches []LineMatch
 
+	// FileNameMatch is set if only the file name matched, ie. there
+	// are LineMatches and all of them are file name matches.
+	FileNameMatch bool
+
 	// RepositoryID is a Sourcegraph extension. This is the ID of Repository in
 	// Sourcegraph.
 	RepositoryID uint32
@@ -54,7 +61,8 @@ type FileMatch struct {
 	// Only set if requested
 	Content []byte
 
-	// Checksum of the content.
+	// Checksum of the content. It is empty for files added with a
+	// SkipReason, whose stored content is only the reason.
 	Checksum []byte
 
 	// Detected language of the result.
@@ -70,12 +78,76 @@ type FileMatch struct {
 
 	// Commit SHA1 (hex) of the (sub)repo holding the file.
 	Version string
+
+	// DefaultBranchVersion is the version of the first branch of the
+	// repository, which is its default branch, whichever branch the
+	// file matched on. It is only set if
+	// SearchOptions.DefaultBranchVersion is set.
+	DefaultBranchVersion string
+
+	// ShardName is the base name of the index file of the shard
+	// holding the file.
+	ShardName string
+
+	// MatchStart and MatchEnd span the content matches of the file:
+	// they are the smallest start and the largest end byte offset
+	// of the fragments of LineMatches. Both are 0 if only the file
+	// name matched. Only set if SearchOptions.MatchSpan is true.
+	MatchStart uint32
+	MatchEnd   uint32
+
+	// Hunks groups the content line matches into runs of nearby
+	// lines, in line order. Only set if SearchOptions.GroupHunks is
+	// true.
+	Hunks []Hunk
+}
+
+// Hunk is a run of matched lines, see SearchOptions.GroupHunks.
+type Hunk struct {
+	// StartLine is the 1-based line number of the first line.
+	StartLine int
+
+	// LineMatches holds the indices into FileMatch.LineMatches of the
+	// lines of the hunk, ordered by line number. Lines between them
+	// that did not match, at most SearchOptions.HunkGap at a time, are
+	// not included.
+	LineMatches []int
+}
+
+// LineColumn returns the 1-based line and rune column of the byte
+// offset within the file, using the lines of m's content matches. An
+// offset at the end of a line refers to the position of its newline.
+// It returns 0, 0 if no line match covers the offset, or if the line
+// bytes were left out with SearchOptions.Minimal.
+func (m *FileMatch) LineColumn(offset uint32) (line, col int) {
+	for _, lm := range m.LineMatches {
+		if lm.FileName || int(offset) < lm.LineStart || int(offset) > lm.LineEnd {
+			continue
+		}
+		if int(offset)-lm.LineStart > len(lm.Line) {
+			continue
+		}
+
+		// A line match may span several lines if a match crosses a
+		// newline.
+		before := lm.Line[:int(offset)-lm.LineStart]
+		line = lm.LineNumber + bytes.Count(before, []byte{'\n'})
+		if i := bytes.LastIndexByte(before, '\n'); i >= 0 {
+			before = before[i+1:]
+		}
+		return line, utf8.RuneCount(before) + 1
+	}
+	return 0, 0
 }
 
 // LineMatch holds the matches within a single line in a file.
 type LineMatch struct {
 	// The line in which a match was found.
-	Line       []byte
+	Line []byte
+
+	// LineStart and LineEnd are the byte offsets of Line in the
+	// file. LineEnd is the offset of the terminating newline, or the
+	// file size if the last line has no newline.
 	LineStart  int
 	LineEnd    int
 	LineNumber int
@@ -87,10 +159,25 @@ type LineMatch struct {
 	// If set, this was a match on the filename.
 	FileName bool
 
+	// SymbolPath holds the names of the symbols enclosing the first
+	// fragment, from outermost to innermost, eg. ["Class", "method"].
+	// Only set if SearchOptions.SymbolPaths is true.
+	SymbolPath []string
+
+	// MostlyBinary is set if most of Line is not printable text, for
+	// example control characters or invalid UTF-8, so clients can
+	// de-emphasize it. Only set if SearchOptions.FlagBinaryLines is
+	// true.
+	MostlyBinary bool
+
 	// The higher the better. Only ranks the quality of the match
 	// within the file, does not take rank of file into account
 	Score         float64
 	LineFragments []LineFragmentMatch
+
+	// For debugging. Only set if SearchOptions.DebugScore is true. It
+	// lists the components which make up Score.
+	DebugScore string
 }
 
 type Symbol struct {
@@ -105,13 +192,36 @@ type LineFragmentMatch struct {
 	// Offset within the line, in bytes.
 	LineOffset int
 
-	// Offset from file start, in bytes.
+	// Offset from file start, in bytes. For file name matches, it
+	// is the offset in the file name. Together with End, it gives
+	// the absolute byte range of the match, for example for
+	// highlighting; a match spanning lines is split into one
+	// fragment per line.
 	Offset uint32
 
 	// Number bytes that match.
 	MatchLength int
 
 	SymbolInfo *Symbol
+
+	// Groups holds the capture groups of a regexp match if
+	// SearchOptions.CaptureGroups is set. Groups[i] is group i+1. A
+	// group that did not participate in the match, or that starts
+	// outside this fragment, has MatchLength -1. Groups are clipped to
+	// the end of the line.
+	Groups []LineFragmentMatch
+
+	// Token is the identifier enclosing the match, for example
+	// "getUserName" for a match of "User" in it: the match extended
+	// by the letters, digits and underscores around it. Only set if
+	// SearchOptions.MatchTokens is true.
+	Token []byte
+}
+
+// End returns the offset from file start just after the match, in
+// bytes.
+func (m *LineFragmentMatch) End() uint32 {
+	return m.Offset + uint32(m.MatchLength)
 }
 
 // Stats contains interesting numbers on the search
@@ -155,19 +265,109 @@ type Stats struct {
 	// by the bloom or ngram filter indicating it had no matches.
 	ShardsSkippedFilter int
 
+	// Shards that were searched because their bloom filter admitted
+	// a pattern, but had no matches after verifying the content of
+	// candidates. Most of these are bloom filter false positives. Only
+	// counted if
+	// SearchOptions.ReportBloomFalsePositives is set.
+	ShardsBloomFalsePositive int
+
 	// Number of non-overlapping matches
 	MatchCount int
 
 	// Number of candidate matches as a result of searching ngrams.
 	NgramMatches int
 
+	// NgramSelection lists the ngrams that substring atoms looked up
+	// in the index to find candidates. Only set if
+	// SearchOptions.DebugNgrams is set. It is a pointer so Stats
+	// stays comparable.
+	NgramSelection *NgramSelection
+
+	// Number of substring atoms matched by scanning content instead
+	// of using the ngram index, because their ngrams exceeded
+	// SearchOptions.MaxNgramCandidates.
+	SubstringsBruteForced int
+
+	// Number of times a child of an OR was not evaluated for a file,
+	// because another child already matched and only the matching
+	// files were needed, as for FileNames.
+	OrChildrenSkipped int
+
+	// Content bytes that were not loaded because OR children were
+	// skipped, see OrChildrenSkipped.
+	OrContentBytesSkipped int64
+
 	// Wall clock time for queued search.
 	Wait time.Duration
 
 	// Number of times regexp was called on files that we evaluated.
 	RegexpsConsidered int
+
+	// Number of files left out of the results by DedupeByChecksum.
+	FilesDeduplicated int
+
+	// EstimatedTotalMatches estimates the number of matches there
+	// would be without match limits. It equals MatchCount unless a
+	// limit stopped a shard early, in which case the unexamined
+	// candidate documents are assumed to match as often as the
+	// examined ones. It is only an estimate: candidates are not
+	// verified, and shards skipped entirely do not contribute.
+	EstimatedTotalMatches int64
+
+	// LimitReason is set if the search stopped early because a limit
+	// was hit, in which case the results may be incomplete. If several
+	// limits were hit, it holds the first one.
+	LimitReason LimitReason
+}
+
+// NgramSelection holds the ngrams chosen by the substring atoms of a
+// search, see SearchOptions.DebugNgrams.
+type NgramSelection struct {
+	Ngrams []NgramStat
+}
+
+// NgramStat describes an ngram chosen to find the candidates of a
+// substring atom.
+type NgramStat struct {
+	// Pattern is the substring the ngram was chosen for.
+	Pattern string
+
+	Ngram string
+
+	// Candidates is the number of occurrences of the ngram in the
+	// shard, counting all case variants for case insensitive
+	// patterns. These are the candidates it contributes before they
+	// are intersected with the other ngram and verified.
+	Candidates int
 }
 
+// LimitReason describes why a search returned incomplete results.
+type LimitReason string
+
+const (
+	// LimitMaxMatches means a match count limit, such as
+	// ShardMaxMatchCount or TotalMaxMatchCount, was hit.
+	LimitMaxMatches LimitReason = "MaxMatches"
+
+	// LimitMaxDocDisplayCount means files were dropped to honor
+	// MaxDocDisplayCount.
+	LimitMaxDocDisplayCount LimitReason = "MaxDocDisplayCount"
+
+	// LimitMaxBytes means ShardMaxContentBytes was hit.
+	LimitMaxBytes LimitReason = "MaxBytes"
+
+	// LimitRegexpBudget means ShardMaxRegexpsConsidered was hit.
+	LimitRegexpBudget LimitReason = "RegexpBudget"
+
+	// LimitDeadline means the search ran out of time, for example
+	// because of MaxWallTime.
+	LimitDeadline LimitReason = "Deadline"
+
+	// LimitCanceled means the search was canceled.
+	LimitCanceled LimitReason = "Canceled"
+)
+
 func (s *Stats) Add(o Stats) {
 	s.ContentBytesLoaded += o.ContentBytesLoaded
 	s.IndexBytesLoaded += o.IndexBytesLoaded
@@ -178,12 +378,30 @@ func (s *Stats) Add(o Stats) {
 	s.FilesSkipped += o.FilesSkipped
 	s.MatchCount += o.MatchCount
 	s.NgramMatches += o.NgramMatches
+	if o.NgramSelection != nil {
+		// Copy, since Stats values share the selection.
+		sel := &NgramSelection{}
+		if s.NgramSelection != nil {
+			sel.Ngrams = append(sel.Ngrams, s.NgramSelection.Ngrams...)
+		}
+		sel.Ngrams = append(sel.Ngrams, o.NgramSelection.Ngrams...)
+		s.NgramSelection = sel
+	}
+	s.SubstringsBruteForced += o.SubstringsBruteForced
+	s.OrChildrenSkipped += o.OrChildrenSkipped
+	s.OrContentBytesSkipped += o.OrContentBytesSkipped
 	s.ShardFilesConsidered += o.ShardFilesConsidered
 	s.ShardsScanned += o.ShardsScanned
 	s.ShardsSkipped += o.ShardsSkipped
 	s.ShardsSkippedFilter += o.ShardsSkippedFilter
+	s.ShardsBloomFalsePositive += o.ShardsBloomFalsePositive
 	s.Wait += o.Wait
 	s.RegexpsConsidered += o.RegexpsConsidered
+	s.FilesDeduplicated += o.FilesDeduplicated
+	s.EstimatedTotalMatches += o.EstimatedTotalMatches
+	if s.LimitReason == "" {
+		s.LimitReason = o.LimitReason
+	}
 }
 
 // Zero returns true if stats is empty.
@@ -201,12 +419,20 @@ func (s *Stats) Zero() bool {
 		s.FilesSkipped > 0 ||
 		s.MatchCount > 0 ||
 		s.NgramMatches > 0 ||
+		s.NgramSelection != nil ||
+		s.SubstringsBruteForced > 0 ||
+		s.OrChildrenSkipped > 0 ||
+		s.OrContentBytesSkipped > 0 ||
 		s.ShardFilesConsidered > 0 ||
 		s.ShardsScanned > 0 ||
 		s.ShardsSkipped > 0 ||
 		s.ShardsSkippedFilter > 0 ||
+		s.ShardsBloomFalsePositive > 0 ||
 		s.Wait > 0 ||
-		s.RegexpsConsidered > 0)
+		s.RegexpsConsidered > 0 ||
+		s.FilesDeduplicated > 0 ||
+		s.EstimatedTotalMatches > 0 ||
+		s.LimitReason != "")
 }
 
 // Progress contains information about the global progress of the running search query.
@@ -236,6 +462,45 @@ type SearchResult struct {
 	// FragmentNames holds a repo => template string map, for
 	// the line number fragment.
 	LineFragments map[string]string
+
+	// RepoAggregates holds a repo => match totals map, if
+	// SearchOptions.ReportRepoAggregates is set.
+	RepoAggregates map[string]RepoAggregate
+
+	// LanguageFacet holds a language => file count map of the
+	// matching files, if SearchOptions.ReportLanguageFacet is set.
+	// Files without a detected language are counted under "".
+	LanguageFacet map[string]int
+
+	// ShardErrors holds the shards that failed to search, if
+	// SearchOptions.BestEffort is set.
+	ShardErrors []ShardError
+
+	// FeatureVersion is the IndexFeatureVersion of the shard that
+	// produced the result. For results combined from several shards,
+	// it is the lowest version among them, so clients can rely on
+	// the features it implies.
+	FeatureVersion int
+}
+
+// RepoAggregate sums up the results in one repository.
+type RepoAggregate struct {
+	// Files is the number of matching files.
+	Files int
+
+	// Matches is the number of matches, counted as in
+	// Stats.MatchCount.
+	Matches int
+}
+
+// ShardError describes a shard whose search failed.
+type ShardError struct {
+	// Shard names the shard, as returned by its String method.
+	Shard string
+
+	// Err is the error message. It is a string so it survives
+	// serialization.
+	Err string
 }
 
 // RepositoryBranch describes an indexed branch, which is a name
@@ -388,6 +653,22 @@ type IndexMetadata struct {
 	LanguageMap           map[string]uint16
 	ZoektVersion          string
 	ID                    string
+
+	// NgramsDropped is set if some content ngrams were left out of the
+	// index because of IndexBuilder.MaxNgrams. A missing ngram then does
+	// not imply that the shard has no match.
+	NgramsDropped bool `json:",omitempty"`
+
+	// MaxNgrams is the cap on the number of content ngrams the shard
+	// was built with, see IndexBuilder.MaxNgrams.
+	MaxNgrams int `json:",omitempty"`
+
+	// PostingsCodec is the encoding of the posting lists.
+	PostingsCodec PostingsCodec `json:",omitempty"`
+
+	// LineMax is the length in bytes beyond which lines are
+	// soft-wrapped in search results, see IndexBuilder.LineMax.
+	LineMax int `json:",omitempty"`
 }
 
 // Statistics of a (collection of) repositories.
@@ -474,9 +755,53 @@ type RepoList struct {
 type Searcher interface {
 	Search(ctx context.Context, q query.Q, opts *SearchOptions) (*SearchResult, error)
 
-	// List lists repositories. The query `q` can only contain
-	// query.Repo atoms.
+	// List lists repositories that have a document matching q. For
+	// example, a filename query lists the repositories containing a
+	// matching file. A nil q lists all repositories, with their
+	// branches, without searching.
 	List(ctx context.Context, q query.Q, opts *ListOptions) (*RepoList, error)
+
+	// FileNames returns the names of the files matching q. File
+	// contents are only read if q has atoms that need them.
+	FileNames(ctx context.Context, q query.Q) ([]string, error)
+
+	// Count returns the number of line matches Search would report in
+	// Stats.MatchCount, without materializing the matches.
+	Count(ctx context.Context, q query.Q, opts *SearchOptions) (int64, Stats, error)
+
+	// FileBranches returns the branches, with their versions and
+	// repositories, that contain a file named fileName.
+	FileBranches(ctx context.Context, fileName string) ([]FileBranch, error)
+
+	// Suggest proposes corrections for queries that find nothing. It
+	// returns words from the indexed content that are a few edits
+	// away from the content substrings of q, for example "needle" for
+	// "needel". It only looks at documents that share ngrams with the
+	// substrings, so it is cheap for queries that have no results.
+	Suggest(ctx context.Context, q query.Q) ([]string, error)
+
+	// ContentWindow returns the bytes [start, end) of the content of
+	// fileName, for example to show more context around a match,
+	// without reading the whole file. The window is truncated at the
+	// end of the file. If several repositories have a file of that
+	// name, the first one is used. It returns ErrFileNotFound if no
+	// file has that name.
+	ContentWindow(ctx context.Context, fileName string, start, end uint32) ([]byte, error)
+
+	// DuplicateGroups reports copies of files, for example for
+	// deduplication analysis. It returns the files that have the same
+	// content as another file of the same repository, grouped by
+	// content checksum. Groups and the files within them are in index
+	// order. Files added with a SkipReason are left out.
+	DuplicateGroups(ctx context.Context) ([][]DuplicateFile, error)
+
+	// RawConfig lets operators audit the repository flags that
+	// query.RawConfig filters on. It returns the RawConfig of each
+	// repository, keyed by repository name. The flags used by
+	// query.RawConfig, "public", "fork" and "archived", are decoded
+	// from the index and always set, to "1" or "0".
+	RawConfig(ctx context.Context) (map[string]map[string]string, error)
+
 	Close()
 
 	// Describe the searcher for debug messages.
@@ -522,11 +847,31 @@ type SearchOptions struct {
 	// Maximum number of important matches across shards.
 	TotalMaxImportantMatch int
 
+	// Maximum number of content bytes to load: skip processing an
+	// index shard after it loaded this many bytes, see
+	// Stats.ContentBytesLoaded.
+	ShardMaxContentBytes int64
+
+	// Maximum number of regexp evaluations: skip processing an index
+	// shard after it evaluated regexps on this many files, see
+	// Stats.RegexpsConsidered.
+	ShardMaxRegexpsConsidered int
+
 	// Abort the search after this much time has passed.
 	MaxWallTime time.Duration
 
+	// Unordered returns SearchResult.Files in the order in which the
+	// shards finished searching instead of by score, so no result
+	// waits for the ordering. StreamSearch always sends results as
+	// soon as a shard finishes. Search still sorts the files if
+	// DedupeByChecksum or MaxDocDisplayCount is set, since they keep
+	// the highest scoring files.
+	Unordered bool
+
 	// Trim the number of results after collating and sorting the
-	// results
+	// results, keeping the highest scoring files. Stats.FileCount
+	// still counts all matching files, so this can be used to fetch
+	// the first page of results.
 	MaxDocDisplayCount int
 
 	// If set to a number greater than zero then up to this many number
@@ -541,6 +886,168 @@ type SearchOptions struct {
 
 	// SpanContext is the opentracing span context, if it exists, from the zoekt client
 	SpanContext map[string]string
+
+	// If set, FileMatch.Debug and LineMatch.DebugScore describe how the
+	// scores were computed. They list the components the ranking uses,
+	// such as word, symbol, atom and doc-order scores. The ranking has
+	// no ngram frequency or file name boost, so none is reported.
+	DebugScore bool
+
+	// If set, Stats.NgramSelection holds the ngrams chosen for each
+	// substring, to help understand why a query is slow.
+	DebugNgrams bool
+
+	// If set, SearchResult.Files is sorted by repository and file name
+	// instead of by score, and the LineMatches of a file are kept in
+	// document order. MaxDocDisplayCount still keeps the highest scoring
+	// files.
+	SortByPath bool
+
+	// If set, files with equal scores are ordered by the
+	// LatestCommitDate of their repository, most recent first, to
+	// surface actively developed code. Files of the same repository
+	// still tie, as the index does not store per-file dates.
+	// StreamSearch sends the files of each shard unsorted, so it
+	// ignores RecencyTieBreak.
+	RecencyTieBreak bool
+
+	// If set with SortByPath, file names are compared in natural
+	// order, with runs of digits compared by their numeric value, so
+	// "file2" sorts before "file10".
+	NaturalSort bool
+
+	// FileMatch.Language is populated for every match, regardless of
+	// the query. If SkipLanguage is set, the lookup is skipped and
+	// Language is left empty. ReportLanguageFacet still looks up the
+	// languages it counts.
+	SkipLanguage bool
+
+	// DefaultBranchVersion sets FileMatch.DefaultBranchVersion, for
+	// linking to the default branch.
+	DefaultBranchVersion bool
+
+	// If set, LineFragmentMatch.Groups reports the capture groups of
+	// regexp matches. Regexps that are equivalent to a set of
+	// substrings are answered from the index alone and report no
+	// groups.
+	CaptureGroups bool
+
+	// CandidateBatchSize, if non-zero, bounds how many substring
+	// candidates of a document are held before they are confirmed
+	// against the content. This caps the memory spent on
+	// candidates for very common ngrams without changing results.
+	CandidateBatchSize int
+
+	// MaxNgramCandidates, if non-zero, bounds the work spent on the
+	// ngram index for a substring. If the ngrams chosen for a
+	// substring occur more than this many times in a shard, decoding
+	// their postings is likely slower than scanning the content, so
+	// the substring is matched by scanning instead. Such substrings
+	// are counted in Stats.SubstringsBruteForced.
+	MaxNgramCandidates int
+
+	// HeaderBytes, if non-zero, restricts content matches to the first
+	// HeaderBytes bytes of each file, for example to look for license
+	// headers. Only those bytes are loaded to verify matches, and
+	// returned lines, context and Whole content are cut at that
+	// point. File name matches are not affected.
+	HeaderBytes int
+
+	// RestrictDocIDs, if set, limits the search to these document IDs.
+	// Document IDs are local to a shard, so this is only meaningful
+	// when searching a single shard, for example to re-run a different
+	// pattern over the documents of a previous result.
+	RestrictDocIDs []uint32
+
+	// RepoFilter, if set, limits the search to repositories whose
+	// Repository.ID is in the set. Unlike a query.RepoSet, it is cheap
+	// for large sets: shards without such repositories are skipped
+	// before they are searched.
+	RepoFilter *roaring.Bitmap
+
+	// ExcludeChecksums drops files whose content checksum, as reported
+	// in FileMatch.Checksum, is in this list. This can be used to skip
+	// files a client has already seen.
+	ExcludeChecksums [][]byte
+
+	// DedupeByChecksum keeps only the highest ranked of the files with
+	// identical content, such as copies of a file in forks. The number
+	// of files left out is reported in Stats.FilesDeduplicated.
+	DedupeByChecksum bool
+
+	// If set, LineMatch.SymbolPath is filled in from the symbol
+	// metadata.
+	SymbolPaths bool
+
+	// If set, LineFragmentMatch.Token is filled in.
+	MatchTokens bool
+
+	// If set, FileMatch.MatchStart and MatchEnd are filled in.
+	MatchSpan bool
+
+	// If set, LineMatch.MostlyBinary is filled in.
+	FlagBinaryLines bool
+
+	// If set, the Line, Before and After bytes of LineMatches are left
+	// out, for clients that fetch the content themselves. Offsets, line
+	// numbers and fragments are still filled in, but
+	// FileMatch.LineColumn cannot compute columns without the lines.
+	Minimal bool
+
+	// GroupHunks fills in FileMatch.Hunks, grouping the content line
+	// matches of a file whose lines are separated by at most HunkGap
+	// unmatched lines.
+	GroupHunks bool
+	HunkGap    int
+
+	// ReportBloomFalsePositives counts the shards that are searched
+	// because of a bloom filter false positive in
+	// Stats.ShardsBloomFalsePositive, to help size bloom filters.
+	ReportBloomFalsePositives bool
+
+	// ReportRepoAggregates fills in SearchResult.RepoAggregates. The
+	// totals are summed over the results of each shard, so they
+	// include files dropped by MaxDocDisplayCount.
+	ReportRepoAggregates bool
+
+	// ReportLanguageFacet fills in SearchResult.LanguageFacet. Like
+	// the repository aggregates, it includes files dropped by
+	// MaxDocDisplayCount.
+	ReportLanguageFacet bool
+
+	// BestEffort reports shards failing to search in
+	// SearchResult.ShardErrors and returns the results of the other
+	// shards. By default, a failing shard fails the search.
+	BestEffort bool
+
+	// MaxRegexpProgramSize, if non-zero, rejects regexps that compile
+	// to more than this many instructions, before searching. Large
+	// programs, such as nested repetitions, are slow to match.
+	MaxRegexpProgramSize int
+
+	// BoostExactCase ranks files in which a case insensitive
+	// substring also occurs with the exact case of the pattern above
+	// files where it only occurs with a different case.
+	BoostExactCase bool
+
+	// AndTermAdjacencyWeight, if non-zero, boosts files in which
+	// matches of different query terms occur close together on one
+	// line. A file whose closest such matches are d bytes apart
+	// scores an extra AndTermAdjacencyWeight/(1+d).
+	AndTermAdjacencyWeight float64
+
+	// MatchDensityWeight, if non-zero, boosts files with many content
+	// matches relative to their size. A file with n matched fragments
+	// and s bytes of content scores an extra
+	// MatchDensityWeight*n/(1+s/1024), so small files with several
+	// matches rank above large files with the same number.
+	MatchDensityWeight float64
+
+	// PenalizedPaths holds regular expressions for file paths, such as
+	// tests or vendored code, that should rank lower. The score of a
+	// file whose path matches one of them is multiplied by a penalty
+	// factor. The files are still returned.
+	PenalizedPaths []string
 }
 
 func (s *SearchOptions) String() string {
@@ -552,6 +1059,64 @@ type Sender interface {
 	Send(*SearchResult)
 }
 
+// StatsSender can be implemented by a Sender that wants running totals
+// of the Stats of a streamed search. OnStats is called with the sum of
+// the Stats sent so far whenever it changes, and a last time with
+// final set once the search is done. The final Stats match those of
+// the equivalent Search, except for what Search computes on the
+// aggregated results, such as FilesDeduplicated.
+type StatsSender interface {
+	Sender
+	OnStats(stats Stats, final bool)
+}
+
+// PostingsLister is implemented by the Searcher for a single shard. It
+// exposes the posting lists of the index for offline analysis.
+type PostingsLister interface {
+	// Postings returns the sorted IDs of the documents whose content
+	// contains the given 3-rune ngram, compared case sensitively.
+	// Ngrams left out of the index, see IndexBuilder.MaxNgrams, have
+	// no postings.
+	Postings(ngram string) ([]uint32, error)
+}
+
+// DocumentView is a document as stored in a shard. Its content and
+// sections may be backed by the index, and must not be modified.
+type DocumentView struct {
+	// Repository is the repository the document belongs to.
+	Repository *Repository
+
+	Document
+}
+
+// DocumentIterator is implemented by the Searcher for a single shard.
+// It gives access to the indexed documents, for example to reprocess a
+// shard without going back to the source.
+type DocumentIterator interface {
+	// EachDocument calls f for each document in the shard, in index
+	// order, skipping documents of tombstoned repositories. It stops
+	// early if f returns false.
+	EachDocument(f func(DocumentView) bool) error
+}
+
+// FileBranch is a branch containing a file, as reported by
+// Searcher.FileBranches. For a file of a subrepository, Branch is a
+// branch of the subrepository.
+type FileBranch struct {
+	Repository string
+	Branch     RepositoryBranch
+}
+
+// DuplicateFile is a file reported by Searcher.DuplicateGroups.
+type DuplicateFile struct {
+	Repository string
+	FileName   string
+}
+
+// ErrFileNotFound is returned by Searcher.ContentWindow for a file
+// that is not in the index.
+var ErrFileNotFound = errors.New("file not found")
+
 // Streamer adds the method StreamSearch to the Searcher interface.
 type Streamer interface {
 	Searcher
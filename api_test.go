@@ -17,6 +17,7 @@ package zoekt // import "github.com/google/zoekt"
 import (
 	"bytes"
 	"encoding/gob"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -75,3 +76,38 @@ func benchmarkEncoding(data interface{}) func(*testing.B) {
 		}
 	}
 }
+
+func TestStatsAdd(t *testing.T) {
+	a := Stats{
+		MatchCount:     1,
+		NgramSelection: &NgramSelection{Ngrams: []NgramStat{{Pattern: "needle", Ngram: "edl", Candidates: 1}}},
+	}
+	b := Stats{
+		MatchCount:     2,
+		NgramSelection: &NgramSelection{Ngrams: []NgramStat{{Pattern: "hay", Ngram: "hay", Candidates: 3}}},
+	}
+	orig := a
+
+	var sum Stats
+	sum.Add(a)
+	sum.Add(b)
+	sum.Add(Stats{})
+
+	if sum.MatchCount != 3 {
+		t.Errorf("got MatchCount %d, want 3", sum.MatchCount)
+	}
+	want := []NgramStat{
+		{Pattern: "needle", Ngram: "edl", Candidates: 1},
+		{Pattern: "hay", Ngram: "hay", Candidates: 3},
+	}
+	if sum.NgramSelection == nil || !reflect.DeepEqual(sum.NgramSelection.Ngrams, want) {
+		t.Errorf("got NgramSelection %+v, want %+v", sum.NgramSelection, want)
+	}
+	// Adding does not change the selections of the summands.
+	if a != orig || len(a.NgramSelection.Ngrams) != 1 {
+		t.Errorf("Add changed its argument to %+v", a)
+	}
+	if !(&Stats{}).Zero() || sum.Zero() {
+		t.Error("Zero is wrong")
+	}
+}
@@ -16,6 +16,7 @@ package zoekt
 
 import (
 	"encoding/binary"
+	"math/bits"
 	"sort"
 	"unicode"
 	"unicode/utf8"
@@ -94,6 +95,8 @@ func ngramToBytes(n ngram) []byte {
 	return []byte{byte(rs[0]), byte(rs[1]), byte(rs[2])}
 }
 
+// runeMask selects one rune of an ngram. 21 bits hold every code
+// point up to unicode.MaxRune, so the packing is lossless.
 const runeMask = 1<<21 - 1
 
 func ngramToRunes(n ngram) [ngramSize]rune {
@@ -308,6 +311,108 @@ func fromDeltas(data []byte, buf []uint32) []uint32 {
 	return buf
 }
 
+// PostingsCodec identifies an encoding of posting lists, see
+// IndexBuilder.PostingsCodec.
+type PostingsCodec uint8
+
+const (
+	// PostingsDeltaVarint encodes each offset as the varint of its
+	// difference to the previous offset.
+	PostingsDeltaVarint PostingsCodec = iota
+
+	// PostingsBitPacked packs the differences of the offsets in
+	// blocks, using the bit width of the largest difference of each
+	// block. This is smaller than varints if the differences in a
+	// block are of similar size.
+	PostingsBitPacked
+)
+
+// bitPackedBlockSize is the number of offsets in a block of a
+// PostingsBitPacked list.
+const bitPackedBlockSize = 128
+
+// toBitPacked encodes the increasing offsets as their count, followed
+// by blocks of bitPackedBlockSize deltas. A block is a byte with the
+// bit width of its deltas, followed by the deltas with that width,
+// packed starting from the least significant bit.
+func toBitPacked(offsets []uint32) []byte {
+	var enc [8]byte
+	m := binary.PutUvarint(enc[:], uint64(len(offsets)))
+	packed := append(make([]byte, 0, len(offsets)+m), enc[:m]...)
+
+	var last uint32
+	for len(offsets) > 0 {
+		block := offsets
+		if len(block) > bitPackedBlockSize {
+			block = block[:bitPackedBlockSize]
+		}
+		offsets = offsets[len(block):]
+
+		var max uint32
+		prev := last
+		for _, p := range block {
+			max |= p - prev
+			prev = p
+		}
+		width := uint(bits.Len32(max))
+		packed = append(packed, byte(width))
+
+		var acc uint64
+		var n uint
+		for _, p := range block {
+			acc |= uint64(p-last) << n
+			last = p
+			n += width
+			for n >= 8 {
+				packed = append(packed, byte(acc))
+				acc >>= 8
+				n -= 8
+			}
+		}
+		if n > 0 {
+			packed = append(packed, byte(acc))
+		}
+	}
+	return packed
+}
+
+// fromBitPacked decodes a list encoded by toBitPacked.
+func fromBitPacked(data []byte, buf []uint32) []uint32 {
+	sz, m := binary.Uvarint(data)
+	data = data[m:]
+
+	buf = buf[:0]
+	if cap(buf) < int(sz) {
+		buf = make([]uint32, 0, sz)
+	}
+
+	var last uint32
+	for len(buf) < int(sz) && len(data) > 0 {
+		width := uint(data[0])
+		data = data[1:]
+		mask := uint64(1)<<width - 1
+
+		count := int(sz) - len(buf)
+		if count > bitPackedBlockSize {
+			count = bitPackedBlockSize
+		}
+		var acc uint64
+		var n uint
+		for i := 0; i < count; i++ {
+			for n < width {
+				acc |= uint64(data[0]) << n
+				data = data[1:]
+				n += 8
+			}
+			last += uint32(acc & mask)
+			acc >>= width
+			n -= width
+			buf = append(buf, last)
+		}
+	}
+	return buf
+}
+
 type runeOffsetCorrection struct {
 	runeOffset, byteOffset uint32
 }
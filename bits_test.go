@@ -131,6 +131,25 @@ func TestFromDeltas(t *testing.T) {
 	testIncreasingIntCoder(t, toDeltas, decode)
 }
 
+func TestBitPacked(t *testing.T) {
+	decode := func(data []byte) []uint32 {
+		if len(data) == 0 {
+			return nil
+		}
+		return fromBitPacked(data, nil)
+	}
+	testIncreasingIntCoder(t, toBitPacked, decode)
+
+	// More than one block, with different widths.
+	var nums []uint32
+	for i := uint32(0); i < 3*bitPackedBlockSize+5; i++ {
+		nums = append(nums, i*i)
+	}
+	if got := fromBitPacked(toBitPacked(nums), nil); !reflect.DeepEqual(got, nums) {
+		t.Errorf("got %v, want %v", got, nums)
+	}
+}
+
 func TestCompressedPostingIterator(t *testing.T) {
 	decode := func(data []byte) []uint32 {
 		if len(data) == 0 {
@@ -43,6 +43,7 @@ import (
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/ctags"
 	"github.com/rs/xid"
+	"golang.org/x/text/encoding/htmlindex"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -71,6 +72,25 @@ type Options struct {
 	// TrigramMax sets the maximum number of distinct trigrams per document.
 	TrigramMax int
 
+	// LineMax, if non-zero, soft-wraps lines longer than LineMax bytes
+	// for matching purposes. See zoekt.IndexBuilder.LineMax.
+	LineMax int
+
+	// NgramMax, if non-zero, caps the number of distinct ngrams per
+	// shard. See zoekt.IndexBuilder.MaxNgrams.
+	NgramMax int
+
+	// IndexComments records the comment spans of documents, so
+	// searches can match only in code or only in comments. See
+	// zoekt.ExtractComments.
+	IndexComments bool
+
+	// Encodings names the encodings, such as "iso-8859-1" or
+	// "shift_jis", from which files that are not valid UTF-8 are
+	// transcoded, in the order they are tried. Names are as in the
+	// WHATWG Encoding Standard. See zoekt.IndexBuilder.Encodings.
+	Encodings []string
+
 	// RepositoryDescription holds names and URLs for the repository.
 	RepositoryDescription zoekt.Repository
 
@@ -106,6 +126,20 @@ func (o *Options) HashOptions() string {
 	hasher.Write([]byte(fmt.Sprintf("%q", o.LargeFiles)))
 	hasher.Write([]byte(fmt.Sprintf("%t", o.DisableCTags)))
 
+	// Only hash these if set, so existing indexes stay up to date.
+	if o.LineMax != 0 {
+		hasher.Write([]byte(fmt.Sprintf("%d", o.LineMax)))
+	}
+	if o.NgramMax != 0 {
+		hasher.Write([]byte(fmt.Sprintf("ngrams:%d", o.NgramMax)))
+	}
+	if o.IndexComments {
+		hasher.Write([]byte("comments"))
+	}
+	if len(o.Encodings) > 0 {
+		hasher.Write([]byte(fmt.Sprintf("encodings:%q", o.Encodings)))
+	}
+
 	return fmt.Sprintf("%x", hasher.Sum(nil))
 }
 
@@ -128,12 +162,33 @@ func (f largeFilesFlag) Set(value string) error {
 	return nil
 }
 
+type encodingsFlag struct{ *Options }
+
+func (f encodingsFlag) String() string {
+	if f.Options == nil {
+		return ""
+	}
+	return strings.Join(f.Encodings, ",")
+}
+
+func (f encodingsFlag) Set(value string) error {
+	f.Encodings = nil
+	if value != "" {
+		f.Encodings = strings.Split(value, ",")
+	}
+	return nil
+}
+
 // Flags adds flags for build options to fs. It is the "inverse" of Args.
 func (o *Options) Flags(fs *flag.FlagSet) {
 	x := *o
 	x.SetDefaults()
 	fs.IntVar(&o.SizeMax, "file_limit", x.SizeMax, "maximum file size")
 	fs.IntVar(&o.TrigramMax, "max_trigram_count", x.TrigramMax, "maximum number of trigrams per document")
+	fs.IntVar(&o.LineMax, "line_limit", x.LineMax, "soft-wrap lines longer than this many bytes. 0 means no limit")
+	fs.IntVar(&o.NgramMax, "max_ngram_count", x.NgramMax, "maximum number of distinct ngrams per shard. 0 means no limit")
+	fs.BoolVar(&o.IndexComments, "index_comments", x.IndexComments, "record comment spans, for searching only code or only comments")
+	fs.Var(encodingsFlag{o}, "encodings", "comma separated encodings, such as iso-8859-1, to transcode files that are not valid UTF-8 from")
 	fs.IntVar(&o.ShardMax, "shard_limit", x.ShardMax, "maximum corpus size for a shard")
 	fs.IntVar(&o.Parallelism, "parallelism", x.Parallelism, "maximum number of parallel indexing processes.")
 	fs.StringVar(&o.IndexDir, "index", x.IndexDir, "directory for search indices")
@@ -160,6 +215,22 @@ func (o *Options) Args() []string {
 		args = append(args, "-shard_limit", strconv.Itoa(o.ShardMax))
 	}
 
+	if o.LineMax != 0 {
+		args = append(args, "-line_limit", strconv.Itoa(o.LineMax))
+	}
+
+	if o.NgramMax != 0 {
+		args = append(args, "-max_ngram_count", strconv.Itoa(o.NgramMax))
+	}
+
+	if o.IndexComments {
+		args = append(args, "-index_comments")
+	}
+
+	if len(o.Encodings) > 0 {
+		args = append(args, "-encodings", strings.Join(o.Encodings, ","))
+	}
+
 	if o.Parallelism != 0 {
 		args = append(args, "-parallelism", strconv.Itoa(o.Parallelism))
 	}
@@ -795,6 +866,18 @@ func (b *Builder) newShardBuilder() (*zoekt.IndexBuilder, error) {
 		return nil, err
 	}
 	shardBuilder.IndexTime = b.indexTime
+	shardBuilder.LineMax = b.opts.LineMax
+	shardBuilder.MaxNgrams = b.opts.NgramMax
+	if b.opts.IndexComments {
+		shardBuilder.CommentExtractor = zoekt.ExtractComments
+	}
+	for _, name := range b.opts.Encodings {
+		enc, err := htmlindex.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("encoding %q: %w", name, err)
+		}
+		shardBuilder.Encodings = append(shardBuilder.Encodings, enc)
+	}
 	shardBuilder.ID = b.id
 	return shardBuilder, nil
 }
@@ -112,6 +112,11 @@ func TestFlags(t *testing.T) {
 		want: Options{
 			LargeFiles: []string{"*.md", "*.yaml"},
 		},
+	}, {
+		args: []string{"-encodings", "iso-8859-1,shift_jis"},
+		want: Options{
+			Encodings: []string{"iso-8859-1", "shift_jis"},
+		},
 	}}
 
 	ignored := []cmp.Option{
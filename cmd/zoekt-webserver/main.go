@@ -135,6 +135,8 @@ func main() {
 	templateDir := flag.String("template_dir", "", "set directory from which to load custom .html.tpl template files")
 	dumpTemplates := flag.Bool("dump_templates", false, "dump templates into --template_dir and exit.")
 	version := flag.Bool("version", false, "Print version number")
+	contentCacheBytes := flag.Int64("content_cache_bytes", 0, "cache up to this many bytes of file contents in memory. 0 disables the cache.")
+	languageAliases := flag.String("language_aliases", "", "comma separated list of alias=language pairs, eg. golang=Go, used to resolve language queries on shards without language detection.")
 	flag.Parse()
 
 	if *version {
@@ -171,6 +173,22 @@ func main() {
 
 	mustRegisterDiskMonitor(*index)
 
+	if *contentCacheBytes > 0 {
+		zoekt.SetContentCache(zoekt.NewContentCache(*contentCacheBytes))
+	}
+
+	if *languageAliases != "" {
+		aliases := map[string]string{}
+		for _, pair := range strings.Split(*languageAliases, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				log.Fatalf("bad -language_aliases entry %q, want alias=language", pair)
+			}
+			aliases[kv[0]] = kv[1]
+		}
+		zoekt.SetLanguageAliases(aliases)
+	}
+
 	searcher, err := shards.NewDirectorySearcher(*index)
 	if err != nil {
 		log.Fatal(err)
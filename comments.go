@@ -0,0 +1,127 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import "bytes"
+
+// commentSyntax describes the comments and string literals of a
+// language.
+type commentSyntax struct {
+	line       string
+	blockStart string
+	blockEnd   string
+
+	// quotes start and end string literals, in which comment
+	// markers are ignored. A backslash escapes the next byte.
+	quotes string
+}
+
+var (
+	cComments    = commentSyntax{line: "//", blockStart: "/*", blockEnd: "*/", quotes: `"'`}
+	hashComments = commentSyntax{line: "#", quotes: `"'`}
+	dashComments = commentSyntax{line: "--", quotes: `"'`}
+)
+
+// commentSyntaxes maps go-enry language names to their comment syntax.
+var commentSyntaxes = map[string]commentSyntax{
+	"C":               cComments,
+	"C#":              cComments,
+	"C++":             cComments,
+	"Dart":            cComments,
+	"Go":              {line: "//", blockStart: "/*", blockEnd: "*/", quotes: "\"'`"},
+	"Java":            cComments,
+	"JavaScript":      {line: "//", blockStart: "/*", blockEnd: "*/", quotes: "\"'`"},
+	"Kotlin":          cComments,
+	"Objective-C":     cComments,
+	"PHP":             cComments,
+	"Protocol Buffer": cComments,
+	"Rust":            {line: "//", blockStart: "/*", blockEnd: "*/", quotes: `"`},
+	"Scala":           cComments,
+	"Swift":           cComments,
+	"TypeScript":      {line: "//", blockStart: "/*", blockEnd: "*/", quotes: "\"'`"},
+	"Dockerfile":      hashComments,
+	"Makefile":        hashComments,
+	"Perl":            hashComments,
+	"Python":          hashComments,
+	"R":               hashComments,
+	"Ruby":            hashComments,
+	"Shell":           hashComments,
+	"TOML":            hashComments,
+	"YAML":            hashComments,
+	"Haskell":         {line: "--", blockStart: "{-", blockEnd: "-}", quotes: `"`},
+	"Lua":             dashComments,
+	"SQL":             dashComments,
+	"PLpgSQL":         dashComments,
+	"PLSQL":           dashComments,
+	"TSQL":            dashComments,
+}
+
+// ExtractComments returns the comment spans of content, for use as
+// IndexBuilder.CommentExtractor. It knows the comment syntax of common
+// languages, named as by go-enry, and returns nil for other languages.
+// It does a lexical scan only, so it may be confused by constructs such
+// as regexp literals.
+func ExtractComments(language string, content []byte) []DocumentSection {
+	syn, ok := commentSyntaxes[language]
+	if !ok {
+		return nil
+	}
+
+	var secs []DocumentSection
+	for i := 0; i < len(content); {
+		rest := content[i:]
+		switch {
+		case syn.line != "" && bytes.HasPrefix(rest, []byte(syn.line)):
+			end := bytes.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			secs = append(secs, DocumentSection{Start: uint32(i), End: uint32(i + end)})
+			i += end
+		case syn.blockStart != "" && bytes.HasPrefix(rest, []byte(syn.blockStart)):
+			end := bytes.Index(rest[len(syn.blockStart):], []byte(syn.blockEnd))
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += len(syn.blockStart) + len(syn.blockEnd)
+			}
+			secs = append(secs, DocumentSection{Start: uint32(i), End: uint32(i + end)})
+			i += end
+		case bytes.IndexByte([]byte(syn.quotes), rest[0]) >= 0:
+			i += quotedLen(rest)
+		default:
+			i++
+		}
+	}
+	return secs
+}
+
+// quotedLen returns the length of the string literal at the start of
+// data, which ends at the closing quote or, for unterminated literals
+// other than backquoted ones, at the end of the line.
+func quotedLen(data []byte) int {
+	q := data[0]
+	for i := 1; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == q:
+			return i + 1
+		case c == '\\' && q != '`':
+			i++
+		case c == '\n' && q != '`':
+			return i
+		}
+	}
+	return len(data)
+}
@@ -0,0 +1,159 @@
+package zoekt
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentCache is a size bounded LRU cache for document contents and
+// newlines. It is shared by all searchers, and is safe for concurrent
+// use. Cache hits are not counted in Stats.FilesLoaded and
+// Stats.ContentBytesLoaded.
+type ContentCache struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	lru   *list.List
+	// shards indexes the entries by shard and document, so a shard's
+	// entries can be purged without scanning the others.
+	shards map[uint64]map[uint32]*list.Element
+}
+
+type contentCacheKey struct {
+	shard uint64
+	doc   uint32
+}
+
+type contentCacheEntry struct {
+	key      contentCacheKey
+	content  []byte
+	newlines []uint32
+}
+
+func (e *contentCacheEntry) size() int64 {
+	return int64(len(e.content) + 4*len(e.newlines))
+}
+
+// NewContentCache returns a cache holding at most maxBytes of
+// contents and newlines.
+func NewContentCache(maxBytes int64) *ContentCache {
+	return &ContentCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		shards:   map[uint64]map[uint32]*list.Element{},
+	}
+}
+
+var (
+	contentCacheMu sync.Mutex
+	contentCache   *ContentCache
+
+	// lastShardID is used to key cache entries by shard.
+	lastShardID uint64
+)
+
+// SetContentCache sets the cache used by searchers subsequently
+// returned by NewSearcher. A nil cache disables caching.
+func SetContentCache(c *ContentCache) {
+	contentCacheMu.Lock()
+	defer contentCacheMu.Unlock()
+	contentCache = c
+}
+
+func getContentCache() *ContentCache {
+	contentCacheMu.Lock()
+	defer contentCacheMu.Unlock()
+	return contentCache
+}
+
+func nextShardID() uint64 {
+	return atomic.AddUint64(&lastShardID, 1)
+}
+
+func (c *ContentCache) get(key contentCacheKey) *contentCacheEntry {
+	el, ok := c.shards[key.shard][key.doc]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*contentCacheEntry)
+}
+
+// content returns the cached content of the document, or nil.
+func (c *ContentCache) content(shard uint64, doc uint32) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.get(contentCacheKey{shard, doc}); e != nil {
+		return e.content
+	}
+	return nil
+}
+
+// newlines returns the cached newlines of the document, or nil.
+func (c *ContentCache) newlines(shard uint64, doc uint32) []uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.get(contentCacheKey{shard, doc}); e != nil {
+		return e.newlines
+	}
+	return nil
+}
+
+// addContent adds a copy of content to the cache.
+func (c *ContentCache) addContent(shard uint64, doc uint32, content []byte) {
+	c.add(contentCacheKey{shard, doc}, func(e *contentCacheEntry) {
+		e.content = append([]byte{}, content...)
+	})
+}
+
+// addNewlines adds a copy of newlines to the cache.
+func (c *ContentCache) addNewlines(shard uint64, doc uint32, newlines []uint32) {
+	c.add(contentCacheKey{shard, doc}, func(e *contentCacheEntry) {
+		e.newlines = append([]uint32{}, newlines...)
+	})
+}
+
+func (c *ContentCache) add(key contentCacheKey, set func(*contentCacheEntry)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.get(key)
+	if e == nil {
+		e = &contentCacheEntry{key: key}
+		docs := c.shards[key.shard]
+		if docs == nil {
+			docs = map[uint32]*list.Element{}
+			c.shards[key.shard] = docs
+		}
+		docs[key.doc] = c.lru.PushFront(e)
+	}
+
+	c.bytes -= e.size()
+	set(e)
+	c.bytes += e.size()
+
+	for c.bytes > c.maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *ContentCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*contentCacheEntry)
+	docs := c.shards[e.key.shard]
+	delete(docs, e.key.doc)
+	if len(docs) == 0 {
+		delete(c.shards, e.key.shard)
+	}
+	c.bytes -= e.size()
+}
+
+// purge removes all entries of the shard.
+func (c *ContentCache) purge(shard uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.shards[shard] {
+		c.remove(el)
+	}
+}
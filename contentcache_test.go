@@ -0,0 +1,73 @@
+package zoekt
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/zoekt/query"
+)
+
+func TestContentCache(t *testing.T) {
+	SetContentCache(NewContentCache(1 << 20))
+	defer SetContentCache(nil)
+
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("bla needle bla\nbla")},
+		Document{Name: "f2", Content: []byte("needle\nneedle")},
+	)
+	s := searcherForTest(t, b)
+	defer s.Close()
+
+	q := &query.Substring{Pattern: "needle", Content: true}
+	search := func() Stats {
+		t.Helper()
+		res, err := s.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 2 {
+			t.Fatalf("got %v, want 2 files", res.Files)
+		}
+		return res.Stats
+	}
+
+	first := search()
+	second := search()
+	if first.FilesLoaded != 2 || second.FilesLoaded != 0 {
+		t.Errorf("got FilesLoaded %d and %d, want 2 and 0", first.FilesLoaded, second.FilesLoaded)
+	}
+	if second.ContentBytesLoaded >= first.ContentBytesLoaded {
+		t.Errorf("got ContentBytesLoaded %d for the second search, want less than %d", second.ContentBytesLoaded, first.ContentBytesLoaded)
+	}
+}
+
+func TestContentCacheEviction(t *testing.T) {
+	c := NewContentCache(10)
+	c.addContent(1, 0, []byte("01234"))
+	c.addContent(1, 1, []byte("01234"))
+
+	// Touch doc 0, so doc 1 is evicted next.
+	if got := c.content(1, 0); string(got) != "01234" {
+		t.Fatalf("got %q, want %q", got, "01234")
+	}
+	c.addNewlines(1, 2, []uint32{1})
+
+	if c.content(1, 1) != nil {
+		t.Errorf("doc 1 not evicted")
+	}
+	if c.content(1, 0) == nil || c.newlines(1, 2) == nil {
+		t.Errorf("doc 0 or 2 evicted")
+	}
+	if c.bytes > c.maxBytes {
+		t.Errorf("got %d bytes, want at most %d", c.bytes, c.maxBytes)
+	}
+
+	c.addContent(2, 0, []byte("0"))
+	c.purge(1)
+	if c.lru.Len() != 1 || c.bytes != 1 || len(c.shards) != 1 {
+		t.Errorf("got %d entries, %d bytes, %d shards after purge", c.lru.Len(), c.bytes, len(c.shards))
+	}
+	if c.content(2, 0) == nil {
+		t.Errorf("purge removed another shard")
+	}
+}
@@ -16,8 +16,12 @@ package zoekt
 
 import (
 	"bytes"
+	"fmt"
 	"log"
 	"sort"
+	"strings"
+	"time"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -29,6 +33,10 @@ type contentProvider struct {
 	id    *indexData
 	stats *Stats
 
+	// headerBytes, if non-zero, limits the content to its first
+	// headerBytes bytes, see SearchOptions.HeaderBytes.
+	headerBytes uint32
+
 	// mutable
 	err      error
 	idx      uint32
@@ -37,6 +45,8 @@ type contentProvider struct {
 	_nlBuf   []uint32
 	_sects   []DocumentSection
 	_sectBuf []DocumentSection
+	_cmts    []DocumentSection
+	_cmtsBuf []DocumentSection
 	fileSize uint32
 }
 
@@ -49,9 +59,33 @@ func (p *contentProvider) setDocument(docID uint32) {
 
 	p._nl = nil
 	p._sects = nil
+	p._cmts = nil
 	p._data = nil
 }
 
+// commentSections returns the comment spans of the document, which
+// are empty if the shard was built without them.
+func (p *contentProvider) commentSections() []DocumentSection {
+	if p._cmts == nil {
+		var sz uint32
+		p._cmts, sz, p.err = p.id.readCommentSections(p.idx, p._cmtsBuf)
+		p.stats.ContentBytesLoaded += int64(sz)
+		if p._cmts == nil {
+			p._cmts = []DocumentSection{}
+		} else {
+			p._cmtsBuf = p._cmts
+		}
+	}
+	return p._cmts
+}
+
+// inComment returns whether the byte at offset is in a comment.
+func (p *contentProvider) inComment(offset uint32) bool {
+	secs := p.commentSections()
+	i := sort.Search(len(secs), func(i int) bool { return secs[i].End > offset })
+	return i < len(secs) && secs[i].Start <= offset
+}
+
 func (p *contentProvider) docSections() []DocumentSection {
 	if p._sects == nil {
 		var sz uint32
@@ -64,10 +98,19 @@ func (p *contentProvider) docSections() []DocumentSection {
 
 func (p *contentProvider) newlines() []uint32 {
 	if p._nl == nil {
-		var sz uint32
-		p._nl, sz, p.err = p.id.readNewlines(p.idx, p._nlBuf)
-		p._nlBuf = p._nl
-		p.stats.ContentBytesLoaded += int64(sz)
+		cache := p.id.contentCache
+		if cache != nil {
+			p._nl = cache.newlines(p.id.shardID, p.idx)
+		}
+		if p._nl == nil {
+			var sz uint32
+			p._nl, sz, p.err = p.id.readNewlines(p.idx, p._nlBuf)
+			p._nlBuf = p._nl
+			p.stats.ContentBytesLoaded += int64(sz)
+			if cache != nil && p.err == nil {
+				cache.addNewlines(p.id.shardID, p.idx, p._nl)
+			}
+		}
 	}
 	return p._nl
 }
@@ -77,14 +120,59 @@ func (p *contentProvider) data(fileName bool) []byte {
 		return p.id.fileNameContent[p.id.fileNameIndex[p.idx]:p.id.fileNameIndex[p.idx+1]]
 	}
 
-	if p._data == nil {
+	if p._data == nil && !p.cachedData() {
+		if end := p.contentEnd(); end < p.fileSize {
+			p._data, p.err = p.id.readContentSlice(p.id.boundaries[p.idx], end)
+			p.stats.FilesLoaded++
+			p.stats.ContentBytesLoaded += int64(len(p._data))
+			return p._data
+		}
 		p._data, p.err = p.id.readContents(p.idx)
 		p.stats.FilesLoaded++
 		p.stats.ContentBytesLoaded += int64(len(p._data))
+		if cache := p.id.contentCache; cache != nil && p.err == nil {
+			cache.addContent(p.id.shardID, p.idx, p._data)
+		}
 	}
 	return p._data
 }
 
+// contentEnd returns the end of the content that may match: the file
+// size, or headerBytes if smaller.
+func (p *contentProvider) contentEnd() uint32 {
+	if p.headerBytes > 0 && p.headerBytes < p.fileSize {
+		return p.headerBytes
+	}
+	return p.fileSize
+}
+
+// cachedData sets the content from the content cache, if possible.
+func (p *contentProvider) cachedData() bool {
+	if p.id.contentCache == nil {
+		return false
+	}
+	p._data = p.id.contentCache.content(p.id.shardID, p.idx)
+	if p._data == nil {
+		return false
+	}
+	p._data = p._data[:p.contentEnd()]
+	return true
+}
+
+// contentSlice returns the document content in [start, end). Unlike
+// data, it only reads the requested bytes if the content was not
+// loaded yet.
+func (p *contentProvider) contentSlice(start, end uint32) []byte {
+	if (p._data != nil || p.cachedData()) && end <= uint32(len(p._data)) {
+		return p._data[start:end]
+	}
+
+	var data []byte
+	data, p.err = p.id.readContentSlice(p.id.boundaries[p.idx]+start, end-start)
+	p.stats.ContentBytesLoaded += int64(len(data))
+	return data
+}
+
 // Find offset in bytes (relative to corpus start) for an offset in
 // runes (relative to document start). If filename is set, the corpus
 // is the set of filenames, with the document being the name itself.
@@ -130,7 +218,7 @@ func (p *contentProvider) findOffset(filename bool, r uint32) uint32 {
 	return byteOff
 }
 
-func (p *contentProvider) fillMatches(ms []*candidateMatch, numContextLines int) []LineMatch {
+func (p *contentProvider) fillMatches(ms []*candidateMatch, numContextLines int, debug bool) []LineMatch {
 	var result []LineMatch
 	if ms[0].fileName {
 		// There is only "line" in a filename.
@@ -144,28 +232,328 @@ func (p *contentProvider) fillMatches(ms []*candidateMatch, numContextLines int)
 				LineOffset:  int(m.byteOffset),
 				MatchLength: int(m.byteMatchSz),
 				Offset:      m.byteOffset,
+				Groups:      groupFragments(m, 0, len(res.Line)),
 			})
 
 			result = []LineMatch{res}
 		}
 	} else {
-		ms = breakMatchesOnNewlines(ms, p.data(false))
+		// Symbol matches are confirmed against the sections
+		// alone. Avoid loading the content for them; a
+		// symbol spanning lines still yields a single
+		// LineMatch below.
+		if !onlySymbolMatches(ms) {
+			ms = breakMatchesOnNewlines(ms, p.data(false))
+		}
 		result = p.fillContentMatches(ms, numContextLines)
 	}
 
 	sects := p.docSections()
 	for i, m := range result {
-		result[i].Score = matchScore(sects, &m)
+		result[i].Score, result[i].DebugScore = matchScore(sects, &m, debug)
 	}
 
 	return result
 }
 
+// maxBinaryRatio is the fraction of non-printable runes above which a
+// line is considered mostly binary.
+const maxBinaryRatio = 0.3
+
+// mostlyBinary returns true if more than maxBinaryRatio of the runes of
+// line are control characters, other than tabs, or invalid UTF-8.
+func mostlyBinary(line []byte) bool {
+	total, binary := 0, 0
+	for len(line) > 0 {
+		r, sz := utf8.DecodeRune(line)
+		line = line[sz:]
+		total++
+		if (r == utf8.RuneError && sz == 1) || (unicode.IsControl(r) && r != '\t') {
+			binary++
+		}
+	}
+	return float64(binary) > maxBinaryRatio*float64(total)
+}
+
+// enclosingToken returns line[start:end] extended by the identifier
+// characters, letters, digits and underscores, on either side.
+func enclosingToken(line []byte, start, end int) []byte {
+	for start > 0 {
+		r, sz := utf8.DecodeLastRune(line[:start])
+		if isNotWordRune(r) {
+			break
+		}
+		start -= sz
+	}
+	for end < len(line) {
+		r, sz := utf8.DecodeRune(line[end:])
+		if isNotWordRune(r) {
+			break
+		}
+		end += sz
+	}
+	return line[start:end]
+}
+
+// symbolKind returns the kind of the i-th symbol of the document, or
+// "" if there is no symbol metadata.
+func (p *contentProvider) symbolKind(i uint32) string {
+	if sym := p.id.symbols.data(p.id.fileEndSymbol[p.idx] + i); sym != nil {
+		return sym.Kind
+	}
+	return ""
+}
+
+// symbolPath returns the names of the symbols enclosing offset, from
+// outermost to innermost. Symbol sections only cover the names of
+// definitions, so the innermost symbol is taken to be the last one
+// defined before offset whose scope has not ended, see scopeEncloses.
+// Its enclosing symbols are found by following the Parent links of
+// the symbol metadata.
+func (p *contentProvider) symbolPath(offset uint32) []string {
+	secs := p.docSections()
+	i := sort.Search(len(secs), func(i int) bool {
+		return secs[i].Start > offset
+	}) - 1
+	if i < 0 {
+		return nil
+	}
+
+	start := p.id.fileEndSymbol[p.idx]
+	name := func(j int) string {
+		return string(p.contentSlice(secs[j].Start, secs[j].End))
+	}
+	// parent returns the index of the section defining the parent of
+	// the symbol at section j, or -1.
+	parent := func(j int) int {
+		sym := p.id.symbols.data(start + uint32(j))
+		if sym == nil || sym.Parent == "" {
+			return -1
+		}
+		for k := j - 1; k >= 0; k-- {
+			if name(k) != sym.Parent {
+				continue
+			}
+			if ps := p.id.symbols.data(start + uint32(k)); ps != nil && (sym.ParentKind == "" || ps.Kind == sym.ParentKind) {
+				return k
+			}
+		}
+		return -1
+	}
+
+	// Pop the scopes that ended before offset.
+	data := p.data(false)
+	for i >= 0 && !scopeEncloses(data, secs[i].Start, offset) {
+		i = parent(i)
+	}
+	if i < 0 {
+		return nil
+	}
+
+	var path []string
+	for ; i >= 0; i = parent(i) {
+		path = append(path, name(i))
+	}
+	for l, r := 0, len(path)-1; l < r; l, r = l+1, r-1 {
+		path[l], path[r] = path[r], path[l]
+	}
+	return path
+}
+
+// scopeEncloses returns whether the scope of the symbol defined at
+// byte def still encloses offset. Without scope ends in the index, a
+// scope is taken to end at the first non-blank line that is indented
+// no deeper than the line of the definition, such as the closing
+// brace of a block.
+func scopeEncloses(data []byte, def, offset uint32) bool {
+	lineStart := bytes.LastIndexByte(data[:def], '\n') + 1
+	defIndent := indentation(data[lineStart:])
+
+	pos := bytes.IndexByte(data[def:], '\n')
+	if pos < 0 {
+		return true
+	}
+	for pos += int(def) + 1; pos <= int(offset) && pos < len(data); {
+		line := data[pos:]
+		if end := bytes.IndexByte(line, '\n'); end >= 0 {
+			line = line[:end]
+		}
+		if len(bytes.TrimSpace(line)) > 0 && indentation(line) <= defIndent {
+			return false
+		}
+		pos += len(line) + 1
+	}
+	return true
+}
+
+// indentation returns the number of leading spaces and tabs of line.
+func indentation(line []byte) int {
+	n := 0
+	for n < len(line) && (line[n] == ' ' || line[n] == '\t') {
+		n++
+	}
+	return n
+}
+
+// hasExactCaseMatch returns true if one of the case insensitive
+// substring matches in ms also matches the pattern with its exact
+// case.
+func (p *contentProvider) hasExactCaseMatch(ms []*candidateMatch) bool {
+	for _, m := range ms {
+		if m.caseSensitive || len(m.substrBytes) == 0 || m.byteMatchSz != uint32(len(m.substrBytes)) {
+			continue
+		}
+		data := p.data(m.fileName)
+		if bytes.Equal(data[m.byteOffset:m.byteOffset+m.byteMatchSz], m.substrBytes) {
+			return true
+		}
+	}
+	return false
+}
+
+// atomDistance returns the smallest number of bytes between
+// neighbouring content matches of different atoms of mt on the same
+// line, or -1 if no two atoms match on one line.
+func (p *contentProvider) atomDistance(mt matchTree, known map[matchTree]bool) int {
+	type atomMatch struct {
+		atom int
+		m    *candidateMatch
+	}
+	var ms []atomMatch
+	atoms := 0
+	visitMatches(mt, known, func(mt matchTree) {
+		var cands []*candidateMatch
+		switch t := mt.(type) {
+		case *substrMatchTree:
+			cands = t.current
+		case *regexpMatchTree:
+			cands = t.found
+		}
+		for _, c := range cands {
+			if !c.fileName {
+				ms = append(ms, atomMatch{atoms, c})
+			}
+		}
+		atoms++
+	})
+	if atoms < 2 {
+		return -1
+	}
+
+	sort.Slice(ms, func(i, j int) bool { return ms[i].m.byteOffset < ms[j].m.byteOffset })
+	newlines := p.newlines()
+	best := -1
+	for i := 1; i < len(ms); i++ {
+		a, b := ms[i-1], ms[i]
+		if a.atom == b.atom {
+			continue
+		}
+		_, aStart, _ := a.m.line(newlines, p.fileSize)
+		_, bStart, _ := b.m.line(newlines, p.fileSize)
+		if aStart != bStart {
+			continue
+		}
+		d := 0
+		if end := a.m.byteOffset + a.m.byteMatchSz; b.m.byteOffset > end {
+			d = int(b.m.byteOffset - end)
+		}
+		if best < 0 || d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// countLineMatches returns len(p.fillMatches(ms, 0, false)). The
+// content is only loaded if a match spans lines.
+func (p *contentProvider) countLineMatches(ms []*candidateMatch) int {
+	if ms[0].fileName {
+		return 1
+	}
+
+	newlines := p.newlines()
+	if !onlySymbolMatches(ms) {
+		for _, m := range ms {
+			if _, _, lineEnd := m.line(newlines, p.fileSize); int(m.byteOffset+m.byteMatchSz) > lineEnd {
+				ms = breakMatchesOnNewlines(ms, p.data(false))
+				break
+			}
+		}
+	}
+
+	count := 0
+	if p.id.metaData.LineMax > 0 {
+		// Matches in different parts of a soft-wrapped line are
+		// separate line matches.
+		lineStart := -1
+		for _, m := range ms {
+			_, start, end := m.line(newlines, p.fileSize)
+			if start, _ = p.wrappedLine(start, end, m.byteOffset); count == 0 || start != lineStart {
+				lineStart = start
+				count++
+			}
+		}
+		return count
+	}
+
+	lineEnd := -1
+	for _, m := range ms {
+		if count == 0 || int(m.byteOffset) > lineEnd {
+			_, _, lineEnd = m.line(newlines, p.fileSize)
+			count++
+		}
+	}
+	return count
+}
+
+// wrappedLine returns the part of the line [start, end) that contains
+// offset, if the line is longer than the LineMax of the shard.
+// Otherwise, it returns the whole line.
+func (p *contentProvider) wrappedLine(start, end int, offset uint32) (int, int) {
+	lineMax := p.id.metaData.LineMax
+	if lineMax <= 0 || end-start <= lineMax {
+		return start, end
+	}
+
+	data := p.data(false)
+	if end > len(data) {
+		end = len(data)
+	}
+	for end-start > lineMax {
+		wrap := wrapPoint(data[start:start+lineMax+1]) + start
+		if int(offset) < wrap {
+			return start, wrap
+		}
+		start = wrap
+	}
+	return start, end
+}
+
+// wrapPoint returns the length of the first part of line, which is
+// cut after its last space, or else at its last rune boundary.
+func wrapPoint(line []byte) int {
+	max := len(line) - 1
+	if i := bytes.LastIndexByte(line[:max], ' '); i >= 0 {
+		return i + 1
+	}
+	for i := max; i > 0; i-- {
+		if utf8.RuneStart(line[i]) {
+			return i
+		}
+	}
+	return max
+}
+
 func (p *contentProvider) fillContentMatches(ms []*candidateMatch, numContextLines int) []LineMatch {
 	var result []LineMatch
 	for len(ms) > 0 {
 		m := ms[0]
-		num, lineStart, lineEnd := m.line(p.newlines(), p.fileSize)
+		num, lineStart, realLineEnd := m.line(p.newlines(), p.fileSize)
+		if end := int(p.contentEnd()); realLineEnd > end {
+			// Cut lines at SearchOptions.HeaderBytes.
+			realLineEnd = end
+		}
+		lineStart, lineEnd := p.wrappedLine(lineStart, realLineEnd, m.byteOffset)
 
 		var lineCands []*candidateMatch
 
@@ -173,7 +561,7 @@ func (p *contentProvider) fillContentMatches(ms []*candidateMatch, numContextLin
 
 		for len(ms) > 0 {
 			m := ms[0]
-			if int(m.byteOffset) <= lineEnd {
+			if int(m.byteOffset) < lineEnd || int(m.byteOffset) <= realLineEnd && lineEnd == realLineEnd {
 				endMatch = m.byteOffset + m.byteMatchSz
 				lineCands = append(lineCands, m)
 				ms = ms[1:]
@@ -190,18 +578,25 @@ func (p *contentProvider) fillContentMatches(ms []*candidateMatch, numContextLin
 				m.byteOffset)
 		}
 
-		data := p.data(false)
+		// A match may cross a wrap point. Take the following
+		// parts of the line until we pass the last match.
+		for lineEnd < realLineEnd && endMatch > uint32(lineEnd) {
+			_, lineEnd = p.wrappedLine(lineEnd, realLineEnd, uint32(lineEnd))
+		}
 
 		// Due to merging matches, we may have a match that
 		// crosses a line boundary. Prevent confusion by
 		// taking lines until we pass the last match
-		for lineEnd < len(data) && endMatch > uint32(lineEnd) {
-			next := bytes.IndexByte(data[lineEnd+1:], '\n')
-			if next == -1 {
-				lineEnd = len(data)
-			} else {
-				// TODO(hanwen): test that checks "+1" part here.
-				lineEnd += next + 1
+		if endMatch > uint32(lineEnd) {
+			data := p.data(false)
+			for lineEnd < len(data) && endMatch > uint32(lineEnd) {
+				next := bytes.IndexByte(data[lineEnd+1:], '\n')
+				if next == -1 {
+					lineEnd = len(data)
+				} else {
+					// TODO(hanwen): test that checks "+1" part here.
+					lineEnd += next + 1
+				}
 			}
 		}
 
@@ -210,9 +605,10 @@ func (p *contentProvider) fillContentMatches(ms []*candidateMatch, numContextLin
 			LineEnd:    lineEnd,
 			LineNumber: num,
 		}
-		finalMatch.Line = data[lineStart:lineEnd]
+		finalMatch.Line = p.contentSlice(uint32(lineStart), uint32(lineEnd))
 
 		if numContextLines > 0 {
+			data := p.data(false)
 			finalMatch.Before = getLines(data, p.newlines(), num-numContextLines, num)
 			finalMatch.After = getLines(data, p.newlines(), num+1, num+1+numContextLines)
 		}
@@ -222,13 +618,14 @@ func (p *contentProvider) fillContentMatches(ms []*candidateMatch, numContextLin
 				Offset:      m.byteOffset,
 				LineOffset:  int(m.byteOffset) - lineStart,
 				MatchLength: int(m.byteMatchSz),
+				Groups:      groupFragments(m, lineStart, lineEnd),
 			}
 			if m.symbol {
 				start := p.id.fileEndSymbol[p.idx]
 				fragment.SymbolInfo = p.id.symbols.data(start + m.symbolIdx)
 				if fragment.SymbolInfo != nil {
 					sec := p.docSections()[m.symbolIdx]
-					fragment.SymbolInfo.Sym = string(data[sec.Start:sec.End])
+					fragment.SymbolInfo.Sym = string(p.contentSlice(sec.Start, sec.End))
 				}
 			}
 
@@ -239,6 +636,43 @@ func (p *contentProvider) fillContentMatches(ms []*candidateMatch, numContextLin
 	return result
 }
 
+// groupFragments returns the capture groups of m that start within
+// m. Offsets within the line are relative to lineStart. Groups are
+// clipped to end at lineEnd, so the groups of a match spanning lines
+// stay within the line they start on.
+func groupFragments(m *candidateMatch, lineStart, lineEnd int) []LineFragmentMatch {
+	if len(m.groups) == 0 {
+		return nil
+	}
+
+	groups := make([]LineFragmentMatch, 0, len(m.groups)/2)
+	for i := 0; i+1 < len(m.groups); i += 2 {
+		start, end := m.groups[i], m.groups[i+1]
+		if start < int(m.byteOffset) || start > int(m.byteOffset+m.byteMatchSz) {
+			groups = append(groups, LineFragmentMatch{MatchLength: -1})
+			continue
+		}
+		if end > lineEnd {
+			end = lineEnd
+		}
+		groups = append(groups, LineFragmentMatch{
+			LineOffset:  start - lineStart,
+			Offset:      uint32(start),
+			MatchLength: end - start,
+		})
+	}
+	return groups
+}
+
+func onlySymbolMatches(ms []*candidateMatch) bool {
+	for _, m := range ms {
+		if !m.symbol {
+			return false
+		}
+	}
+	return true
+}
+
 // getLines returns a slice of data containing the lines [low, high).
 // low is 1-based and inclusive. high is exclusive.
 func getLines(data []byte, newLines []uint32, low, high int) []byte {
@@ -257,7 +691,11 @@ func getLines(data []byte, newLines []uint32, low, high int) []byte {
 		startIndex = newLines[low] + 1
 	}
 
-	if high >= len(newLines) {
+	if startIndex > uint32(len(data)) {
+		// data was cut by SearchOptions.HeaderBytes.
+		return nil
+	}
+	if high >= len(newLines) || newLines[high] > uint32(len(data)) {
 		return data[startIndex:]
 	}
 	return data[startIndex:newLines[high]]
@@ -274,6 +712,8 @@ const (
 	scoreShardRankFactor    = 20.0
 	scoreFileOrderFactor    = 10.0
 	scoreLineOrderFactor    = 1.0
+	scorePathPenaltyFactor  = 0.5
+	scoreExactCaseMatch     = 500.0
 )
 
 func findSection(secs []DocumentSection, off, sz uint32) *DocumentSection {
@@ -291,8 +731,11 @@ func findSection(secs []DocumentSection, off, sz uint32) *DocumentSection {
 	return nil
 }
 
-func matchScore(secs []DocumentSection, m *LineMatch) float64 {
+// matchScore returns the score of the best fragment in m. If debug is
+// set, it also returns a description of the components of that score.
+func matchScore(secs []DocumentSection, m *LineMatch, debug bool) (float64, string) {
 	var maxScore float64
+	var what string
 	for _, f := range m.LineFragments {
 		startBoundary := f.LineOffset < len(m.Line) && (f.LineOffset == 0 || byteClass(m.Line[f.LineOffset-1]) != byteClass(m.Line[f.LineOffset]))
 
@@ -300,10 +743,18 @@ func matchScore(secs []DocumentSection, m *LineMatch) float64 {
 		endBoundary := end > 0 && (end == len(m.Line) || byteClass(m.Line[end-1]) != byteClass(m.Line[end]))
 
 		score := 0.0
+		var components []string
+		addScore := func(what string, s float64) {
+			score += s
+			if debug {
+				components = append(components, fmt.Sprintf("%s:%.2f", what, s))
+			}
+		}
+
 		if startBoundary && endBoundary {
-			score = scoreWordMatch
+			addScore("word", scoreWordMatch)
 		} else if startBoundary || endBoundary {
-			score = scorePartialWordMatch
+			addScore("partial-word", scorePartialWordMatch)
 		}
 
 		sec := findSection(secs, f.Offset, uint32(f.MatchLength))
@@ -311,19 +762,20 @@ func matchScore(secs []DocumentSection, m *LineMatch) float64 {
 			startMatch := sec.Start == f.Offset
 			endMatch := sec.End == f.Offset+uint32(f.MatchLength)
 			if startMatch && endMatch {
-				score += scoreSymbol
+				addScore("symbol", scoreSymbol)
 			} else if startMatch || endMatch {
-				score += (scoreSymbol + scorePartialSymbol) / 2
+				addScore("edge-symbol", (scoreSymbol+scorePartialSymbol)/2)
 			} else {
-				score += scorePartialSymbol
+				addScore("partial-symbol", scorePartialSymbol)
 			}
 		}
 
 		if score > maxScore {
 			maxScore = score
+			what = strings.Join(components, ", ")
 		}
 	}
-	return maxScore
+	return maxScore, what
 }
 
 type matchScoreSlice []LineMatch
@@ -342,7 +794,185 @@ func sortMatchesByScore(ms []LineMatch) {
 	sort.Sort(matchScoreSlice(ms))
 }
 
+// onlyFileNameMatches returns whether ms holds file name matches
+// only.
+func onlyFileNameMatches(ms []LineMatch) bool {
+	for _, m := range ms {
+		if !m.FileName {
+			return false
+		}
+	}
+	return len(ms) > 0
+}
+
+// matchSpan returns the smallest start and largest end offset of the
+// content fragments of ms.
+func matchSpan(ms []LineMatch) (start, end uint32) {
+	first := true
+	for _, m := range ms {
+		if m.FileName {
+			continue
+		}
+		for i := range m.LineFragments {
+			f := &m.LineFragments[i]
+			if first || f.Offset < start {
+				start = f.Offset
+			}
+			if first || f.End() > end {
+				end = f.End()
+			}
+			first = false
+		}
+	}
+	return start, end
+}
+
+// groupHunks groups the content matches of ms into hunks of lines
+// that are at most gap unmatched lines apart. The hunks refer to the
+// matches by their index in ms.
+func groupHunks(ms []LineMatch, gap int) []Hunk {
+	var idx []int
+	for i, m := range ms {
+		if !m.FileName {
+			idx = append(idx, i)
+		}
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return ms[idx[i]].LineNumber < ms[idx[j]].LineNumber
+	})
+
+	var hunks []Hunk
+	for _, i := range idx {
+		if n := len(hunks); n > 0 {
+			last := &hunks[n-1]
+			if ms[i].LineNumber-ms[last.LineMatches[len(last.LineMatches)-1]].LineNumber <= gap+1 {
+				last.LineMatches = append(last.LineMatches, i)
+				continue
+			}
+		}
+		hunks = append(hunks, Hunk{StartLine: ms[i].LineNumber, LineMatches: []int{i}})
+	}
+	return hunks
+}
+
 // Sort a slice of results.
 func SortFilesByScore(ms []FileMatch) {
 	sort.Sort(fileMatchSlice(ms))
 }
+
+// SortFilesByScoreAndRecency sorts a slice of results by score, and
+// equally scoring files by the latest commit date of their
+// repository, most recent first. latestCommitDate maps repository
+// names to Repository.LatestCommitDate.
+func SortFilesByScoreAndRecency(ms []FileMatch, latestCommitDate map[string]time.Time) {
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].Score != ms[j].Score {
+			return ms[i].Score > ms[j].Score
+		}
+		return latestCommitDate[ms[i].Repository].After(latestCommitDate[ms[j].Repository])
+	})
+}
+
+// DedupeFilesByChecksum removes files whose content has the same
+// checksum as a higher scoring file, keeping the first of equally
+// scoring ones. The order of the remaining files is unchanged. It
+// returns the remaining files and the number of files removed. Files
+// without a checksum, which were added with a SkipReason, are kept.
+func DedupeFilesByChecksum(ms []FileMatch) ([]FileMatch, int) {
+	best := make(map[string]int, len(ms))
+	for i := range ms {
+		if len(ms[i].Checksum) == 0 {
+			continue
+		}
+		key := string(ms[i].Checksum)
+		if j, ok := best[key]; !ok || ms[i].Score > ms[j].Score {
+			best[key] = i
+		}
+	}
+	if len(best) == len(ms) {
+		return ms, 0
+	}
+
+	out := ms[:0]
+	for i := range ms {
+		if len(ms[i].Checksum) == 0 || best[string(ms[i].Checksum)] == i {
+			out = append(out, ms[i])
+		}
+	}
+	return out, len(ms) - len(out)
+}
+
+// SortFilesByPath sorts a slice of results by repository and file
+// name. The sort is stable.
+func SortFilesByPath(ms []FileMatch) {
+	sort.SliceStable(ms, func(i, j int) bool {
+		if ms[i].Repository != ms[j].Repository {
+			return ms[i].Repository < ms[j].Repository
+		}
+		return ms[i].FileName < ms[j].FileName
+	})
+}
+
+// SortFilesByNaturalPath is like SortFilesByPath, but compares file
+// names in natural order, see SearchOptions.NaturalSort.
+func SortFilesByNaturalPath(ms []FileMatch) {
+	sort.SliceStable(ms, func(i, j int) bool {
+		if ms[i].Repository != ms[j].Repository {
+			return ms[i].Repository < ms[j].Repository
+		}
+		return naturalLess(ms[i].FileName, ms[j].FileName)
+	})
+}
+
+// PathSorter returns the path sort requested by opts, or nil if the
+// results should not be sorted by path.
+func PathSorter(opts *SearchOptions) func([]FileMatch) {
+	if !opts.SortByPath {
+		return nil
+	}
+	if opts.NaturalSort {
+		return SortFilesByNaturalPath
+	}
+	return SortFilesByPath
+}
+
+// naturalLess compares a and b byte by byte, except that runs of
+// digits are compared by their numeric value. Runs with the same
+// value, such as "01" and "1", are ordered by length.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			da, db := digitPrefix(a), digitPrefix(b)
+			na, nb := strings.TrimLeft(da, "0"), strings.TrimLeft(db, "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			if len(da) != len(db) {
+				return len(da) < len(db)
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// digitPrefix returns the leading digits of s.
+func digitPrefix(s string) string {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i]
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+)
+
+// transcode returns content converted to UTF-8 from the first of
+// encodings that decodes it without invalid sequences, and that
+// encoding. It returns content unchanged and a nil encoding if it is
+// valid UTF-8 or no encoding fits.
+func transcode(content []byte, encodings []encoding.Encoding) ([]byte, encoding.Encoding) {
+	if utf8.Valid(content) {
+		return content, nil
+	}
+	for _, enc := range encodings {
+		out, err := enc.NewDecoder().Bytes(content)
+		if err != nil || bytes.ContainsRune(out, utf8.RuneError) {
+			continue
+		}
+		return out, enc
+	}
+	return content, nil
+}
+
+// transcodeSections maps the byte offsets of secs in content to
+// offsets in out, the transcoding of content with enc. It fails if an
+// offset is not at a character boundary, or if enc is stateful, so
+// that content cannot be decoded piecewise.
+func transcodeSections(content, out []byte, enc encoding.Encoding, secs ...[]DocumentSection) error {
+	var offsets []uint32
+	for _, sec := range secs {
+		for _, s := range sec {
+			offsets = append(offsets, s.Start, s.End)
+		}
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	mapped := make(map[uint32]uint32, len(offsets))
+	var start, outStart uint32
+	for _, off := range append(offsets, uint32(len(content))) {
+		if off > uint32(len(content)) {
+			return fmt.Errorf("section offset %d beyond content size %d", off, len(content))
+		}
+		part, err := enc.NewDecoder().Bytes(content[start:off])
+		if err != nil || !bytes.HasPrefix(out[outStart:], part) {
+			return fmt.Errorf("section offset %d does not map to the transcoded content", off)
+		}
+		start = off
+		outStart += uint32(len(part))
+		mapped[off] = outStart
+	}
+	if outStart != uint32(len(out)) {
+		return fmt.Errorf("content cannot be transcoded piecewise")
+	}
+
+	for _, sec := range secs {
+		for i := range sec {
+			sec[i].Start = mapped[sec[i].Start]
+			sec[i].End = mapped[sec[i].End]
+		}
+	}
+	return nil
+}
@@ -15,14 +15,18 @@
 package zoekt
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log"
+	"path/filepath"
 	"regexp"
 	"regexp/syntax"
 	"sort"
 	"strings"
+	"unicode/utf8"
 
+	"github.com/RoaringBitmap/roaring"
 	enry_data "github.com/go-enry/go-enry/v2/data"
 	"github.com/google/zoekt/query"
 )
@@ -31,11 +35,14 @@ const maxUInt16 = 0xffff
 
 // DebugScore controls whether we collect data on match scores are
 // constructed. Intended for use in tests.
+//
+// Deprecated: set SearchOptions.DebugScore instead. If DebugScore is
+// true, it applies to every search.
 var DebugScore = false
 
-func (m *FileMatch) addScore(what string, s float64) {
-	if DebugScore {
-		m.Debug += fmt.Sprintf("%s:%f, ", what, s)
+func (m *FileMatch) addScore(what string, s float64, debug bool) {
+	if debug {
+		m.Debug += fmt.Sprintf("%s:%.2f, ", what, s)
 	}
 	m.Score += s
 }
@@ -104,7 +111,11 @@ func (d *indexData) simplify(in query.Q) query.Q {
 				// For index files that haven't been re-indexed by go-enry,
 				// fall back to file-based matching and continue even if this
 				// repo doesn't have the specific language present.
-				extsForLang := enry_data.ExtensionsByLanguage[r.Language]
+				lang := r.Language
+				if alias, ok := d.languageAliases[lang]; ok {
+					lang = alias
+				}
+				extsForLang := enry_data.ExtensionsByLanguage[lang]
 				if extsForLang != nil {
 					extFrags := make([]string, 0, len(extsForLang))
 					for _, ext := range extsForLang {
@@ -156,13 +167,33 @@ func (o *SearchOptions) SetDefaults() {
 	}
 }
 
+// ctxLimitReason returns the reason for the early termination of a
+// search whose context is done.
+func ctxLimitReason(ctx context.Context) LimitReason {
+	if ctx.Err() == context.DeadlineExceeded {
+		return LimitDeadline
+	}
+	return LimitCanceled
+}
+
 func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions) (sr *SearchResult, err error) {
 	copyOpts := *opts
 	opts = &copyOpts
 	opts.SetDefaults()
+	if DebugScore {
+		opts.DebugScore = true
+	}
 	importantMatchCount := 0
 
-	var res SearchResult
+	var penalizedPaths *regexp.Regexp
+	if len(opts.PenalizedPaths) > 0 {
+		penalizedPaths, err = regexp.Compile("(?:" + strings.Join(opts.PenalizedPaths, ")|(?:") + ")")
+		if err != nil {
+			return nil, fmt.Errorf("PenalizedPaths: %v", err)
+		}
+	}
+
+	res := SearchResult{FeatureVersion: d.metaData.IndexFeatureVersion}
 	if len(d.fileNameIndex) == 0 {
 		return &res, nil
 	}
@@ -170,6 +201,7 @@ func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions)
 	select {
 	case <-ctx.Done():
 		res.Stats.ShardsSkipped++
+		res.Stats.LimitReason = ctxLimitReason(ctx)
 		return &res, nil
 	default:
 	}
@@ -184,32 +216,39 @@ func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions)
 		return &res, nil
 	}
 
-	q = query.Map(q, query.ExpandFileContent)
-
-	mt, err := d.newMatchTree(q)
-	if err != nil {
-		return nil, err
-	}
-
-	mt, err = pruneMatchTree(mt)
+	mt, err := d.newSearchMatchTree(q, opts, &res.Stats)
 	if err != nil {
 		return nil, err
 	}
 	if mt == nil {
-		res.Stats.ShardsSkippedFilter++
 		return &res, nil
 	}
 
 	totalAtomCount := 0
 	visitMatchTree(mt, func(t matchTree) {
 		totalAtomCount++
+		if rt, ok := t.(*regexpMatchTree); ok {
+			rt.captureGroups = opts.CaptureGroups
+		}
+		if st, ok := t.(*substrMatchTree); ok {
+			st.batchSize = opts.CandidateBatchSize
+			if r, ok := st.matchIterator.(*ngramIterationResults); ok && opts.DebugNgrams {
+				if res.Stats.NgramSelection == nil {
+					res.Stats.NgramSelection = &NgramSelection{}
+				}
+				res.Stats.NgramSelection.Ngrams = append(res.Stats.NgramSelection.Ngrams, r.selection...)
+			}
+		}
 	})
 
+	mt = d.filterCandidates(mt, opts)
+
 	res.Stats.ShardsScanned++
 
 	cp := &contentProvider{
-		id:    d,
-		stats: &res.Stats,
+		id:          d,
+		stats:       &res.Stats,
+		headerBytes: uint32(opts.HeaderBytes),
 	}
 
 	// Track the number of documents found in a repository for
@@ -222,6 +261,17 @@ func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions)
 	docCount := uint32(len(d.fileBranchMasks))
 	lastDoc := int(-1)
 
+	// The number of candidate documents left unexamined because a
+	// match limit was hit.
+	var remainingCandidates int
+
+	// iterStats holds the stats of the iterators in mt up to the
+	// match limit, if one was hit.
+	var iterStats *Stats
+
+	// The number of documents rejected after reading their content.
+	contentRejected := 0
+
 nextFileMatch:
 	for {
 		canceled := false
@@ -246,6 +296,7 @@ nextFileMatch:
 			if opts.ShardRepoMaxMatchCount > 0 {
 				if repoMatchCount >= opts.ShardRepoMaxMatchCount && d.repos[nextDoc] == lastRepoID {
 					res.Stats.FilesSkipped++
+					res.Stats.LimitReason = LimitMaxMatches
 					continue
 				}
 			}
@@ -265,9 +316,26 @@ nextFileMatch:
 			repoMatchCount = 0
 		}
 
-		if canceled || (res.Stats.MatchCount >= opts.ShardMaxMatchCount && opts.ShardMaxMatchCount > 0) ||
-			(opts.ShardMaxImportantMatch > 0 && importantMatchCount >= opts.ShardMaxImportantMatch) {
+		var limit LimitReason
+		switch {
+		case canceled:
+			limit = ctxLimitReason(ctx)
+		case (res.Stats.MatchCount >= opts.ShardMaxMatchCount && opts.ShardMaxMatchCount > 0) ||
+			(opts.ShardMaxImportantMatch > 0 && importantMatchCount >= opts.ShardMaxImportantMatch):
+			limit = LimitMaxMatches
+		default:
+			limit = shardBudgetLimit(&res.Stats, opts)
+		}
+		if limit != "" {
 			res.Stats.FilesSkipped += int(docCount - nextDoc)
+			res.Stats.LimitReason = limit
+			if limit == LimitMaxMatches {
+				// Counting the candidates advances the
+				// iterators, which should not add to the stats.
+				iterStats = &Stats{}
+				collectIterStats(mt, iterStats)
+				remainingCandidates = countCandidates(mt, nextDoc, docCount)
+			}
 			break
 		}
 
@@ -283,6 +351,9 @@ nextFileMatch:
 		for cost := costMin; cost <= costMax; cost++ {
 			v, ok := mt.matches(cp, cost, known)
 			if ok && !v {
+				if cost >= costContent {
+					contentRejected++
+				}
 				continue nextFileMatch
 			}
 
@@ -297,8 +368,15 @@ nextFileMatch:
 			RepositoryID:       md.ID,
 			RepositoryPriority: md.priority,
 			FileName:           string(d.fileName(nextDoc)),
-			Checksum:           d.getChecksum(nextDoc),
-			Language:           d.languageMap[d.getLanguage(nextDoc)],
+			ShardName:          filepath.Base(d.file.Name()),
+		}
+		if !d.skipped(nextDoc) {
+			fileMatch.Checksum = d.getChecksum(nextDoc)
+		}
+		// The facet needs the language even with SkipLanguage. It
+		// is cleared again below.
+		if !opts.SkipLanguage || opts.ReportLanguageFacet {
+			fileMatch.Language = d.languageMap[d.getLanguage(nextDoc)]
 		}
 
 		if s := d.subRepos[nextDoc]; s > 0 {
@@ -318,14 +396,32 @@ nextFileMatch:
 				fileMatch.Version = md.Branches[idx].Version
 			}
 		}
+		if opts.DefaultBranchVersion && len(md.Branches) > 0 {
+			fileMatch.DefaultBranchVersion = md.Branches[0].Version
+		}
 
 		atomMatchCount := 0
 		visitMatches(mt, known, func(mt matchTree) {
 			atomMatchCount++
 		})
+		// gatherMatches merges the candidates of the atoms, so
+		// measure their distance first.
+		atomDistance := -1
+		if opts.AndTermAdjacencyWeight > 0 {
+			atomDistance = cp.atomDistance(mt, known)
+		}
 		finalCands := gatherMatches(mt, known)
 
 		if len(finalCands) == 0 {
+			nm := d.fileName(nextDoc)
+			finalCands = gatherFileNameMatches(mt, known, nm, nextDoc)
+		}
+		// Without text atoms, such as for a lang: query, the whole
+		// file name stands in for the match. It is not a file name
+		// match.
+		synthesized := false
+		if len(finalCands) == 0 {
+			synthesized = true
 			nm := d.fileName(nextDoc)
 			finalCands = append(finalCands,
 				&candidateMatch{
@@ -339,12 +435,49 @@ nextFileMatch:
 					byteMatchSz:   uint32(len(nm)),
 				})
 		}
-		fileMatch.LineMatches = cp.fillMatches(finalCands, opts.NumContextLines)
+		exactCase := opts.BoostExactCase && cp.hasExactCaseMatch(finalCands)
+		fileMatch.LineMatches = cp.fillMatches(finalCands, opts.NumContextLines, opts.DebugScore)
+		fileMatch.FileNameMatch = !synthesized && onlyFileNameMatches(fileMatch.LineMatches)
+		if opts.MatchSpan {
+			fileMatch.MatchStart, fileMatch.MatchEnd = matchSpan(fileMatch.LineMatches)
+		}
+		if opts.SymbolPaths {
+			for i := range fileMatch.LineMatches {
+				if lm := &fileMatch.LineMatches[i]; !lm.FileName && len(lm.LineFragments) > 0 {
+					lm.SymbolPath = cp.symbolPath(lm.LineFragments[0].Offset)
+				}
+			}
+		}
+		if opts.MatchTokens {
+			for i := range fileMatch.LineMatches {
+				lm := &fileMatch.LineMatches[i]
+				for j := range lm.LineFragments {
+					f := &lm.LineFragments[j]
+					f.Token = enclosingToken(lm.Line, f.LineOffset, f.LineOffset+f.MatchLength)
+				}
+			}
+		}
+
+		if opts.FlagBinaryLines {
+			for i := range fileMatch.LineMatches {
+				if lm := &fileMatch.LineMatches[i]; !lm.FileName {
+					lm.MostlyBinary = mostlyBinary(lm.Line)
+				}
+			}
+		}
+		if opts.Minimal {
+			for i := range fileMatch.LineMatches {
+				lm := &fileMatch.LineMatches[i]
+				lm.Line, lm.Before, lm.After = nil, nil, nil
+			}
+		}
 
 		maxFileScore := 0.0
+		maxFileScoreDebug := ""
 		for i := range fileMatch.LineMatches {
 			if maxFileScore < fileMatch.LineMatches[i].Score {
 				maxFileScore = fileMatch.LineMatches[i].Score
+				maxFileScoreDebug = fileMatch.LineMatches[i].DebugScore
 			}
 
 			// Order by ordering in file.
@@ -354,18 +487,49 @@ nextFileMatch:
 		// Maintain ordering of input files. This
 		// strictly dominates the in-file ordering of
 		// the matches.
-		fileMatch.addScore("fragment", maxFileScore)
-		fileMatch.addScore("atom", float64(atomMatchCount)/float64(totalAtomCount)*scoreFactorAtomMatch)
+		fragment := "fragment"
+		if opts.DebugScore {
+			fragment = fmt.Sprintf("fragment(%s)", maxFileScoreDebug)
+		}
+		fileMatch.addScore(fragment, maxFileScore, opts.DebugScore)
+		fileMatch.addScore("atom", float64(atomMatchCount)/float64(totalAtomCount)*scoreFactorAtomMatch, opts.DebugScore)
+		if exactCase {
+			fileMatch.addScore("exact-case", scoreExactCaseMatch, opts.DebugScore)
+		}
+		if atomDistance >= 0 {
+			fileMatch.addScore("adjacency", opts.AndTermAdjacencyWeight/float64(1+atomDistance), opts.DebugScore)
+		}
+		if opts.MatchDensityWeight > 0 {
+			n := 0
+			for _, lm := range fileMatch.LineMatches {
+				if !lm.FileName {
+					n += len(lm.LineFragments)
+				}
+			}
+			fileMatch.addScore("density", opts.MatchDensityWeight*float64(n)/(1+float64(cp.fileSize)/1024), opts.DebugScore)
+		}
 
 		// Prefer earlier docs.
-		fileMatch.addScore("doc-order", scoreFileOrderFactor*(1.0-float64(nextDoc)/float64(len(d.boundaries))))
-		fileMatch.addScore("shard-order", scoreShardRankFactor*float64(md.Rank)/maxUInt16)
+		fileMatch.addScore("doc-order", scoreFileOrderFactor*(1.0-float64(nextDoc)/float64(len(d.boundaries))), opts.DebugScore)
+		fileMatch.addScore("shard-order", scoreShardRankFactor*float64(md.Rank)/maxUInt16, opts.DebugScore)
+
+		if penalizedPaths != nil && penalizedPaths.MatchString(fileMatch.FileName) {
+			fileMatch.Score *= scorePathPenaltyFactor
+			if opts.DebugScore {
+				fileMatch.Debug += fmt.Sprintf("path-penalty:x%.2f, ", scorePathPenaltyFactor)
+			}
+		}
 
 		if fileMatch.Score > scoreImportantThreshold {
 			importantMatchCount++
 		}
 		fileMatch.Branches = d.gatherBranches(nextDoc, mt, known)
-		sortMatchesByScore(fileMatch.LineMatches)
+		if !opts.SortByPath {
+			sortMatchesByScore(fileMatch.LineMatches)
+		}
+		if opts.GroupHunks {
+			fileMatch.Hunks = groupHunks(fileMatch.LineMatches, opts.HunkGap)
+		}
 		if opts.Whole {
 			fileMatch.Content = cp.data(false)
 		}
@@ -377,9 +541,49 @@ nextFileMatch:
 		res.Stats.FileCount++
 	}
 
+	res.Stats.EstimatedTotalMatches = int64(res.Stats.MatchCount)
+	if remainingCandidates > 0 && res.Stats.FilesConsidered > 0 {
+		// Assume the unexamined candidates match as often as the
+		// examined ones.
+		res.Stats.EstimatedTotalMatches += int64(remainingCandidates) * int64(res.Stats.MatchCount) / int64(res.Stats.FilesConsidered)
+	}
+
 	// We do not sort Files here, instead we rely on the shards pkg to do file
 	// ranking. If we sorted now, we would break the assumption that results
 	// from the same repo in a shard appear next to each other.
+	//
+	// Deduplication preserves the order of the remaining files.
+	if opts.DedupeByChecksum {
+		var n int
+		res.Files, n = DedupeFilesByChecksum(res.Files)
+		res.Stats.FilesDeduplicated += n
+	}
+
+	// Sorting by path keeps results from the same repo next to each other.
+	if sortFiles := PathSorter(opts); sortFiles != nil {
+		sortFiles(res.Files)
+	}
+
+	if opts.ReportRepoAggregates {
+		res.RepoAggregates = map[string]RepoAggregate{}
+		for _, f := range res.Files {
+			agg := res.RepoAggregates[f.Repository]
+			agg.Files++
+			agg.Matches += len(f.LineMatches)
+			res.RepoAggregates[f.Repository] = agg
+		}
+	}
+	if opts.ReportLanguageFacet {
+		res.LanguageFacet = map[string]int{}
+		for _, f := range res.Files {
+			res.LanguageFacet[f.Language]++
+		}
+		if opts.SkipLanguage {
+			for i := range res.Files {
+				res.Files[i].Language = ""
+			}
+		}
+	}
 
 	for _, md := range d.repoMetaData {
 		r := md
@@ -389,12 +593,58 @@ nextFileMatch:
 		}
 	}
 
+	if iterStats != nil {
+		res.Stats.Add(*iterStats)
+	} else {
+		collectIterStats(mt, &res.Stats)
+	}
+
+	// A shard counts as a bloom false positive only if candidates
+	// got as far as reading content. Candidates rejected by their
+	// ngram positions or other cheap checks are not.
+	if opts.ReportBloomFalsePositives && res.Stats.FileCount == 0 && contentRejected > 0 && res.Stats.LimitReason == "" && bloomAdmitted(mt) {
+		res.Stats.ShardsBloomFalsePositive++
+	}
+	return &res, nil
+}
+
+// bloomAdmitted returns true if a bloom filter let one of the
+// substrings in mt through.
+func bloomAdmitted(mt matchTree) bool {
+	admitted := false
+	visitMatchTree(mt, func(mt matchTree) {
+		if st, ok := mt.(*substrMatchTree); ok {
+			if res, ok := st.matchIterator.(*ngramIterationResults); ok && res.bloomAdmitted {
+				admitted = true
+			}
+		}
+	})
+	return admitted
+}
+
+// collectIterStats adds the stats of the iterators in mt to stats.
+func collectIterStats(mt matchTree, stats *Stats) {
 	visitMatchTree(mt, func(mt matchTree) {
 		if atom, ok := mt.(interface{ updateStats(*Stats) }); ok {
-			atom.updateStats(&res.Stats)
+			atom.updateStats(stats)
 		}
 	})
-	return &res, nil
+}
+
+// countCandidates returns the number of documents from doc onwards
+// that mt does not rule out without looking at their content.
+func countCandidates(mt matchTree, doc, docCount uint32) int {
+	n := 0
+	for doc < docCount {
+		n++
+		mt.prepare(doc)
+		next := mt.nextDoc()
+		if next <= doc {
+			next = doc + 1
+		}
+		doc = next
+	}
+	return n
 }
 
 func addRepo(res *SearchResult, repo *Repository) {
@@ -433,6 +683,9 @@ func gatherMatches(mt matchTree, known map[matchTree]bool) []*candidateMatch {
 		if smt, ok := mt.(*symbolRegexpMatchTree); ok {
 			cands = append(cands, smt.found...)
 		}
+		if lmt, ok := mt.(*lineAndNotMatchTree); ok {
+			cands = append(cands, lmt.current...)
+		}
 	})
 
 	foundContentMatch := false
@@ -476,6 +729,88 @@ func gatherMatches(mt matchTree, known map[matchTree]bool) []*candidateMatch {
 	return res
 }
 
+// gatherFileNameMatches returns the occurrences in name of the
+// patterns below the matching type:filename nodes of mt, so the
+// filename result can be highlighted.
+func gatherFileNameMatches(mt matchTree, known map[matchTree]bool, name []byte, doc uint32) []*candidateMatch {
+	var cands []*candidateMatch
+	add := func(off, sz int) {
+		cands = append(cands, &candidateMatch{
+			fileName:    true,
+			file:        doc,
+			byteOffset:  uint32(off),
+			byteMatchSz: uint32(sz),
+		})
+	}
+
+	visitFileNameMatches(mt, known, func(mt matchTree) {
+		switch s := mt.(type) {
+		case *substrMatchTree:
+			pat := []byte(s.query.Pattern)
+			if s.caseSensitive {
+				for off := 0; ; {
+					i := bytes.Index(name[off:], pat)
+					if i < 0 {
+						break
+					}
+					add(off+i, len(pat))
+					off += i + len(pat)
+				}
+				return
+			}
+			lower := toLower(pat)
+			for off := 0; off < len(name); {
+				if sz, ok := caseFoldingEqualsRunes(lower, name[off:]); ok {
+					add(off, sz)
+					off += sz
+					continue
+				}
+				_, sz := utf8.DecodeRune(name[off:])
+				off += sz
+			}
+		case *regexpMatchTree:
+			for _, loc := range s.regexp.FindAllIndex(name, -1) {
+				if loc[1] > loc[0] {
+					add(loc[0], loc[1]-loc[0])
+				}
+			}
+		}
+	})
+
+	sort.Sort(sortByOffsetSlice(cands))
+	res := cands[:0]
+	for i, c := range cands {
+		if i > 0 && c.byteOffset < res[len(res)-1].byteOffset+res[len(res)-1].byteMatchSz {
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// visitFileNameMatches visits the atoms below the type:filename nodes
+// of t that contributed to the match.
+func visitFileNameMatches(t matchTree, known map[matchTree]bool, f func(matchTree)) {
+	switch s := t.(type) {
+	case *andMatchTree:
+		for _, ch := range s.children {
+			if known[ch] {
+				visitFileNameMatches(ch, known, f)
+			}
+		}
+	case *andLineMatchTree:
+		visitFileNameMatches(&s.andMatchTree, known, f)
+	case *orMatchTree:
+		for _, ch := range s.children {
+			if known[ch] {
+				visitFileNameMatches(ch, known, f)
+			}
+		}
+	case *fileNameMatchTree:
+		visitMatches(s.child, known, f)
+	}
+}
+
 func (d *indexData) branchIndex(docID uint32) int {
 	mask := d.fileBranchMasks[docID]
 	idx := 0
@@ -517,9 +852,332 @@ func (d *indexData) gatherBranches(docID uint32, mt matchTree, known map[matchTr
 	return branches
 }
 
+func (d *indexData) FileNames(ctx context.Context, q query.Q) ([]string, error) {
+	var stats Stats
+	return d.fileNames(ctx, q, &stats)
+}
+
+// fileNames evaluates q like Search, but skips collecting the matches.
+func (d *indexData) fileNames(ctx context.Context, q query.Q, stats *Stats) ([]string, error) {
+	var names []string
+	err := d.matchingDocs(ctx, q, stats, func(doc uint32) bool {
+		names = append(names, string(d.fileName(doc)))
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (d *indexData) FileBranches(ctx context.Context, fileName string) ([]FileBranch, error) {
+	name := []byte(fileName)
+
+	var branches []FileBranch
+	for doc := uint32(0); doc < uint32(len(d.fileBranchMasks)); doc++ {
+		if doc%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		md := &d.repoMetaData[d.repos[doc]]
+		if md.Tombstone || !bytes.Equal(d.fileName(doc), name) {
+			continue
+		}
+
+		repoBranches := md.Branches
+		if s := d.subRepos[doc]; s > 0 {
+			repoBranches = md.SubRepoMap[d.subRepoPaths[d.repos[doc]][s]].Branches
+		}
+
+		mask := d.fileBranchMasks[doc]
+		for i, br := range repoBranches {
+			if mask&(uint64(1)<<uint(i)) != 0 {
+				branches = append(branches, FileBranch{Repository: md.Name, Branch: br})
+			}
+		}
+	}
+	return branches, nil
+}
+
+// Count returns the number of line matches that Search would return
+// for q, without building the FileMatch and LineMatch structures.
+// Only the non-zero match limits of opts are applied.
+func (d *indexData) Count(ctx context.Context, q query.Q, opts *SearchOptions) (int64, Stats, error) {
+	var stats Stats
+	q = d.simplify(q)
+	if c, ok := q.(*query.Const); ok && !c.Value {
+		return 0, stats, nil
+	}
+
+	mt, err := d.newSearchMatchTree(q, opts, &stats)
+	if err != nil {
+		return 0, Stats{}, err
+	}
+	if mt == nil {
+		return 0, stats, nil
+	}
+	mt = d.filterCandidates(mt, opts)
+
+	cp := &contentProvider{
+		id:          d,
+		stats:       &stats,
+		headerBytes: uint32(opts.HeaderBytes),
+	}
+
+	// Track the number of matches in a repository for
+	// ShardRepoMaxMatchCount, like Search.
+	var (
+		lastRepoID     uint16
+		repoMatchCount int
+	)
+	err = d.eachMatchingDoc(ctx, mt, cp, func(doc uint32, mt matchTree, known map[matchTree]bool) bool {
+		if repo := d.repos[doc]; repo != lastRepoID {
+			lastRepoID = repo
+			repoMatchCount = 0
+		}
+		if opts.ShardRepoMaxMatchCount > 0 && repoMatchCount >= opts.ShardRepoMaxMatchCount {
+			stats.FilesSkipped++
+			stats.LimitReason = LimitMaxMatches
+			return true
+		}
+
+		n := 1
+		if cands := gatherMatches(mt, known); len(cands) > 0 {
+			n = cp.countLineMatches(cands)
+		}
+		stats.FileCount++
+		stats.MatchCount += n
+		repoMatchCount += n
+
+		if opts.ShardMaxMatchCount > 0 && stats.MatchCount >= opts.ShardMaxMatchCount {
+			stats.LimitReason = LimitMaxMatches
+			return false
+		}
+		if limit := shardBudgetLimit(&stats, opts); limit != "" {
+			stats.LimitReason = limit
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return 0, Stats{}, err
+	}
+	return int64(stats.MatchCount), stats, nil
+}
+
+// shardBudgetLimit returns the reason to stop searching a shard if
+// stats exceed the content or regexp budget of opts.
+func shardBudgetLimit(stats *Stats, opts *SearchOptions) LimitReason {
+	if opts.ShardMaxContentBytes > 0 && stats.ContentBytesLoaded >= opts.ShardMaxContentBytes {
+		return LimitMaxBytes
+	}
+	if opts.ShardMaxRegexpsConsidered > 0 && stats.RegexpsConsidered >= opts.ShardMaxRegexpsConsidered {
+		return LimitRegexpBudget
+	}
+	return ""
+}
+
+// newSearchMatchTree builds the match tree that Search evaluates for
+// the simplified query q. It returns nil if no document can match.
+func (d *indexData) newSearchMatchTree(q query.Q, opts *SearchOptions, stats *Stats) (matchTree, error) {
+	q = query.Map(q, query.ExpandFileContent)
+
+	if opts.MaxRegexpProgramSize > 0 {
+		if err := checkRegexpProgramSize(q, opts.MaxRegexpProgramSize); err != nil {
+			return nil, err
+		}
+	}
+
+	mt, err := d.newMatchTree(q)
+	if err != nil {
+		return nil, err
+	}
+
+	mt, err = pruneMatchTree(mt)
+	if err != nil {
+		return nil, err
+	}
+	if mt == nil {
+		stats.ShardsSkippedFilter++
+		return nil, nil
+	}
+	if opts.MaxNgramCandidates > 0 {
+		mt, stats.SubstringsBruteForced = bruteForceSubstrings(mt, opts.MaxNgramCandidates)
+	}
+	return mt, nil
+}
+
+// filterCandidates limits mt to the documents selected by
+// RestrictDocIDs, RepoFilter and ExcludeChecksums of opts.
+func (d *indexData) filterCandidates(mt matchTree, opts *SearchOptions) matchTree {
+	if len(opts.RestrictDocIDs) > 0 {
+		mt = d.restrictDocs(mt, opts.RestrictDocIDs)
+	}
+	if opts.RepoFilter != nil {
+		mt = d.filterRepos(mt, opts.RepoFilter)
+	}
+	if len(opts.ExcludeChecksums) > 0 {
+		mt = d.excludeChecksums(mt, opts.ExcludeChecksums)
+	}
+	return mt
+}
+
+// restrictDocs limits mt to the given documents. Like
+// excludeChecksums, it is applied after the atoms are counted so the
+// restriction does not affect scoring.
+func (d *indexData) restrictDocs(mt matchTree, docs []uint32) matchTree {
+	want := make([]bool, d.numDocs())
+	for _, doc := range docs {
+		if doc < uint32(len(want)) {
+			want[doc] = true
+		}
+	}
+	return &andMatchTree{children: []matchTree{
+		&docMatchTree{
+			reason:  "RestrictDocIDs",
+			numDocs: d.numDocs(),
+			predicate: func(docID uint32) bool {
+				return want[docID]
+			},
+		},
+		mt,
+	}}
+}
+
+// filterRepos limits mt to documents of repositories whose ID is in
+// filter.
+func (d *indexData) filterRepos(mt matchTree, filter *roaring.Bitmap) matchTree {
+	allowed := make([]bool, len(d.repoMetaData))
+	for i := range d.repoMetaData {
+		allowed[i] = filter.Contains(d.repoMetaData[i].ID)
+	}
+	return &andMatchTree{children: []matchTree{
+		&docMatchTree{
+			reason:  "RepoFilter",
+			numDocs: d.numDocs(),
+			predicate: func(docID uint32) bool {
+				return allowed[d.repos[docID]]
+			},
+		},
+		mt,
+	}}
+}
+
+// excludeChecksums limits mt to documents whose content checksum is
+// not in checksums. Skipped documents all share the checksum of their
+// SkipReason, so they are never excluded.
+func (d *indexData) excludeChecksums(mt matchTree, checksums [][]byte) matchTree {
+	exclude := make(map[string]struct{}, len(checksums))
+	for _, c := range checksums {
+		exclude[string(c)] = struct{}{}
+	}
+	return &andMatchTree{children: []matchTree{
+		&docMatchTree{
+			reason:  "ExcludeChecksums",
+			numDocs: d.numDocs(),
+			predicate: func(docID uint32) bool {
+				if d.skipped(docID) {
+					return true
+				}
+				_, ok := exclude[string(d.getChecksum(docID))]
+				return !ok
+			},
+		},
+		mt,
+	}}
+}
+
+// matchingDocs calls f for each document matching q, in document
+// order, until f returns false. Only whether the document matches is
+// evaluated, not where.
+func (d *indexData) matchingDocs(ctx context.Context, q query.Q, stats *Stats, f func(doc uint32) bool) error {
+	q = d.simplify(q)
+	if c, ok := q.(*query.Const); ok && !c.Value {
+		return nil
+	}
+
+	q = query.Map(q, query.ExpandFileContent)
+
+	mt, err := d.newMatchTree(q)
+	if err != nil {
+		return err
+	}
+
+	mt, err = pruneMatchTree(mt)
+	if err != nil {
+		return err
+	}
+	if mt == nil {
+		return nil
+	}
+	setLazyOr(mt)
+
+	cp := &contentProvider{
+		id:    d,
+		stats: stats,
+	}
+	return d.eachMatchingDoc(ctx, mt, cp, func(doc uint32, mt matchTree, known map[matchTree]bool) bool {
+		return f(doc)
+	})
+}
+
+// eachMatchingDoc calls f for the documents matching mt, until f
+// returns false.
+func (d *indexData) eachMatchingDoc(ctx context.Context, mt matchTree, cp *contentProvider, f func(doc uint32, mt matchTree, known map[matchTree]bool) bool) error {
+	docCount := uint32(len(d.fileBranchMasks))
+	lastDoc := int(-1)
+
+nextFile:
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		nextDoc := mt.nextDoc()
+		if int(nextDoc) <= lastDoc {
+			nextDoc = uint32(lastDoc + 1)
+		}
+		for nextDoc < docCount && d.repoMetaData[d.repos[nextDoc]].Tombstone {
+			nextDoc++
+		}
+		if nextDoc >= docCount {
+			break
+		}
+		lastDoc = int(nextDoc)
+
+		mt.prepare(nextDoc)
+		cp.setDocument(nextDoc)
+		cp.stats.FilesConsidered++
+
+		known := make(map[matchTree]bool)
+		for cost := costMin; cost <= costMax; cost++ {
+			v, ok := mt.matches(cp, cost, known)
+			if ok && !v {
+				continue nextFile
+			}
+
+			if cost == costMax && !ok {
+				log.Panicf("did not decide. Repo %s, doc %d, known %v",
+					d.repoMetaData[d.repos[nextDoc]].Name, nextDoc, known)
+			}
+		}
+
+		if !f(nextDoc, mt, known) {
+			break
+		}
+	}
+
+	collectIterStats(mt, cp.stats)
+	return nil
+}
+
 func (d *indexData) List(ctx context.Context, q query.Q, opts *ListOptions) (rl *RepoList, err error) {
 	var include func(rle *RepoListEntry) (bool, error)
 
+	if q == nil {
+		q = &query.Const{Value: true}
+	}
 	q = d.simplify(q)
 	if c, ok := q.(*query.Const); ok {
 		if !c.Value {
@@ -657,7 +1315,7 @@ func (d *indexData) regexpToMatchTreeRecursive(r *syntax.Regexp, minTextSize int
 		if len(qs) == 0 {
 			return &noMatchTree{"const"}, isEq, false, nil
 		}
-		return &orMatchTree{qs}, isEq, false, nil
+		return &orMatchTree{children: qs}, isEq, false, nil
 	case syntax.OpStar:
 		if r.Sub[0].Op == syntax.OpAnyCharNotNL {
 			return &bruteForceMatchTree{}, false, true, nil
@@ -665,3 +1323,43 @@ func (d *indexData) regexpToMatchTreeRecursive(r *syntax.Regexp, minTextSize int
 	}
 	return &bruteForceMatchTree{}, false, false, nil
 }
+
+// checkRegexpProgramSize returns an error if a regexp in q compiles to
+// more than max instructions. Globs are checked as the regexps they
+// are searched with.
+func checkRegexpProgramSize(q query.Q, max int) error {
+	var err error
+	query.VisitAtoms(q, func(q query.Q) {
+		if err != nil {
+			return
+		}
+		if g, ok := q.(*query.Glob); ok {
+			q, err = g.Regexp()
+			if err != nil {
+				return
+			}
+		}
+		re, ok := q.(*query.Regexp)
+		if !ok {
+			return
+		}
+		expr := re.Regexp.String()
+		if !re.CaseSensitive {
+			expr = "(?i)" + expr
+		}
+		r, parseErr := syntax.Parse(expr, syntax.Perl)
+		if parseErr != nil {
+			err = parseErr
+			return
+		}
+		prog, compileErr := syntax.Compile(r.Simplify())
+		if compileErr != nil {
+			err = compileErr
+			return
+		}
+		if n := len(prog.Inst); n > max {
+			err = fmt.Errorf("regexp %s is too complex: %d instructions, maximum is %d", re.Regexp, n, max)
+		}
+	})
+	return err
+}
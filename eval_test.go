@@ -76,7 +76,7 @@ func TestRegexpParse(t *testing.T) {
 		{"(foo|)bar", substrMT("bar"), false},
 		{"(foo|)", &bruteForceMatchTree{}, false},
 		{"(foo|bar)baz.*bla", &andMatchTree{[]matchTree{
-			&orMatchTree{[]matchTree{
+			&orMatchTree{children: []matchTree{
 				substrMT("foo"),
 				substrMT("bar"),
 			}},
@@ -93,7 +93,7 @@ func TestRegexpParse(t *testing.T) {
 		{"foo", substrMT("foo"), true},
 		{"^foo", substrMT("foo"), false},
 		{"(foo) (bar)", &andMatchTree{[]matchTree{substrMT("foo"), substrMT("bar")}}, false},
-		{"(thread|needle|haystack)", &orMatchTree{[]matchTree{
+		{"(thread|needle|haystack)", &orMatchTree{children: []matchTree{
 			substrMT("thread"),
 			substrMT("needle"),
 			substrMT("haystack"),
@@ -164,6 +164,9 @@ func TestSearch_ShardRepoMaxMatchCountOpt(t *testing.T) {
 			FilesSkipped:       2,
 			ShardsScanned:      1,
 			MatchCount:         2,
+			LimitReason:        LimitMaxMatches,
+
+			EstimatedTotalMatches: 2,
 		}
 		if diff := cmp.Diff(want, got); diff != "" {
 			t.Errorf("mismatch (-want, +got): %s", diff)
@@ -351,3 +354,30 @@ func hash(name string) uint32 {
 	h.Write([]byte(name))
 	return h.Sum32()
 }
+
+func TestRepoScopedCompoundShard(t *testing.T) {
+	d := compoundReposShard(t, "foo", "bar", "baz")
+
+	for _, repoQ := range []query.Q{
+		&query.Repo{Regexp: regexp.MustCompile("^bar$")},
+		&query.RepoRegexp{Regexp: regexp.MustCompile("^bar$")},
+		query.NewRepoSet("bar"),
+	} {
+		q := query.NewAnd(&query.Substring{Pattern: "content", Content: true}, repoQ)
+		res, err := d.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range res.Files {
+			names = append(names, f.FileName)
+		}
+		if want := []string{"bar.txt", "bar.2.txt"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: got %v, want %v", repoQ, names, want)
+		}
+		// Only the documents of bar are considered.
+		if res.Stats.FilesConsidered != 2 {
+			t.Errorf("%s: got FilesConsidered %d, want 2", repoQ, res.Stats.FilesConsidered)
+		}
+	}
+}
@@ -35,6 +35,7 @@ import (
 
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
 
 	git "github.com/go-git/go-git/v5"
@@ -483,6 +484,21 @@ func IndexGitRepo(opts Options) error {
 
 		for _, key := range keys {
 			brs := branchMap[key]
+			mode := repos[key].Mode
+			if mode == filemode.Submodule {
+				// key.ID is a commit in the submodule, so there
+				// is no content to index.
+				if err := builder.Add(zoekt.Document{
+					SubRepositoryPath: key.SubRepoPath,
+					Name:              key.FullPath(),
+					Branches:          brs,
+					FileMode:          uint32(mode),
+				}); err != nil {
+					return fmt.Errorf("error adding document with name %s: %w", key.FullPath(), err)
+				}
+				continue
+			}
+
 			blob, err := repos[key].Repo.BlobObject(key.ID)
 			if err != nil {
 				return err
@@ -494,6 +510,7 @@ func IndexGitRepo(opts Options) error {
 					Name:              key.FullPath(),
 					Branches:          brs,
 					SubRepositoryPath: key.SubRepoPath,
+					FileMode:          uint32(mode),
 				}); err != nil {
 					return err
 				}
@@ -509,6 +526,7 @@ func IndexGitRepo(opts Options) error {
 				Name:              key.FullPath(),
 				Content:           contents,
 				Branches:          brs,
+				FileMode:          uint32(mode),
 			}); err != nil {
 				return fmt.Errorf("error adding document with name %s: %w", key.FullPath(), err)
 			}
@@ -177,8 +177,10 @@ func (r *repoWalker) handleEntry(p string, e *object.TreeEntry) error {
 		}
 	}
 
+	// Submodules are recorded as entries of their own, so they can
+	// be found with type:submodule. Their ID is the commit hash.
 	switch e.Mode {
-	case filemode.Regular, filemode.Executable, filemode.Symlink:
+	case filemode.Regular, filemode.Executable, filemode.Symlink, filemode.Submodule:
 	default:
 		return nil
 	}
@@ -189,6 +191,7 @@ func (r *repoWalker) handleEntry(p string, e *object.TreeEntry) error {
 	}] = BlobLocation{
 		Repo: r.repo,
 		URL:  r.repoURL,
+		Mode: e.Mode,
 	}
 	return nil
 }
@@ -209,6 +212,9 @@ func (k *fileKey) FullPath() string {
 type BlobLocation struct {
 	Repo *git.Repository
 	URL  *url.URL
+
+	// Mode is the git mode of the tree entry.
+	Mode filemode.FileMode
 }
 
 func (l *BlobLocation) Blob(id *plumbing.Hash) ([]byte, error) {
@@ -34,6 +34,8 @@ import (
 	"github.com/google/zoekt/build"
 	"github.com/google/zoekt/query"
 	"github.com/google/zoekt/shards"
+
+	"github.com/go-git/go-git/v5/plumbing/filemode"
 )
 
 func createSubmoduleRepo(dir string) error {
@@ -177,15 +179,23 @@ func TestTreeToFiles(t *testing.T) {
 	}
 
 	var paths []string
-	for k := range files {
+	modes := map[string]filemode.FileMode{}
+	for k, loc := range files {
 		paths = append(paths, k.FullPath())
+		modes[k.FullPath()] = loc.Mode
 	}
 	sort.Strings(paths)
 
-	want := []string{".gitmodules", "afile", "bname/bfile", "bname/bsymlink", "subdir/sub-file"}
+	want := []string{".gitmodules", "afile", "bname", "bname/bfile", "bname/bsymlink", "subdir/sub-file"}
 	if !reflect.DeepEqual(paths, want) {
 		t.Errorf("got %v, want %v", paths, want)
 	}
+	if got := modes["bname"]; got != filemode.Submodule {
+		t.Errorf("got mode %v for bname, want submodule", got)
+	}
+	if got := modes["bname/bsymlink"]; got != filemode.Symlink {
+		t.Errorf("got mode %v for bname/bsymlink, want symlink", got)
+	}
 }
 
 func TestSubmoduleIndex(t *testing.T) {
@@ -258,6 +268,12 @@ func TestSubmoduleIndex(t *testing.T) {
 	} else if f := results.Files[0]; f.Version == subVersion {
 		t.Errorf("version in super repo matched version is subrepo.")
 	}
+
+	if results, err := searcher.Search(context.Background(), &query.FileType{Type: query.FileTypeSubmodule}, &zoekt.SearchOptions{}); err != nil {
+		t.Fatalf("Search('type:submodule'): %v", err)
+	} else if len(results.Files) != 1 || results.Files[0].FileName != "bname" {
+		t.Errorf("got %v, want the bname submodule", results.Files)
+	}
 }
 
 func createSymlinkRepo(dir string) error {
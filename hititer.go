@@ -120,7 +120,7 @@ func (d *indexData) trigramHitIterator(ng ngram, caseSensitive, fileName bool) (
 		if fileName {
 			blob := d.fileNameNgrams[v]
 			if len(blob) > 0 {
-				iters = append(iters, newCompressedPostingIterator(blob, v))
+				iters = append(iters, d.newPostingIterator(blob, v))
 			}
 			continue
 		}
@@ -131,7 +131,7 @@ func (d *indexData) trigramHitIterator(ng ngram, caseSensitive, fileName bool) (
 			return nil, err
 		}
 		if len(blob) > 0 {
-			iters = append(iters, newCompressedPostingIterator(blob, v))
+			iters = append(iters, d.newPostingIterator(blob, v))
 		}
 	}
 
@@ -173,6 +173,36 @@ func (i *inMemoryIterator) next(limit uint32) {
 	}
 }
 
+// newPostingIterator returns an iterator over the posting list b of
+// ngram w, as encoded by the codec of the shard.
+func (d *indexData) newPostingIterator(b []byte, w ngram) hitIterator {
+	if d.metaData.PostingsCodec == PostingsBitPacked {
+		return &packedPostingIterator{
+			inMemoryIterator: inMemoryIterator{
+				postings: fromBitPacked(b, nil),
+				what:     w,
+			},
+			size: len(b),
+		}
+	}
+	return newCompressedPostingIterator(b, w)
+}
+
+// packedPostingIterator goes over a bit packed posting list, which is
+// decoded as a whole.
+type packedPostingIterator struct {
+	inMemoryIterator
+	size int
+}
+
+func (i *packedPostingIterator) String() string {
+	return fmt.Sprintf("packed(%s, [%d bytes])", i.what, i.size)
+}
+
+func (i *packedPostingIterator) updateStats(s *Stats) {
+	s.IndexBytesLoaded += int64(i.size)
+}
+
 // compressedPostingIterator goes over a delta varint encoded posting
 // list.
 type compressedPostingIterator struct {
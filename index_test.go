@@ -17,19 +17,32 @@ package zoekt
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc64"
 	"os"
+	"path"
 	"reflect"
 	"regexp"
 	"regexp/syntax"
+	"sort"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf8"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/kylelemons/godebug/pretty"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/google/zoekt/query"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
 )
 
 func clearScores(r *SearchResult) {
@@ -37,9 +50,11 @@ func clearScores(r *SearchResult) {
 		r.Files[i].Score = 0.0
 		for j := range r.Files[i].LineMatches {
 			r.Files[i].LineMatches[j].Score = 0.0
+			r.Files[i].LineMatches[j].DebugScore = ""
 		}
 		r.Files[i].Checksum = nil
 		r.Files[i].Debug = ""
+		r.Files[i].ShardName = ""
 	}
 }
 
@@ -72,6 +87,45 @@ func TestBoundary(t *testing.T) {
 	}
 }
 
+func TestAddCtags(t *testing.T) {
+	doc := Document{
+		Name:    "f1.go",
+		Content: []byte("package p\n\ntype Server struct{}\n\nfunc (s *Server) Serve() {}\n"),
+	}
+	if err := doc.AddCtags([]CtagEntry{
+		{Name: "Serve", Kind: "method", Parent: "Server", ParentKind: "type", Line: 5, Column: 18},
+		{Name: "Server", Kind: "type", Line: 3},
+	}); err != nil {
+		t.Fatalf("AddCtags: %v", err)
+	}
+
+	b := testIndexBuilder(t, nil, doc)
+	res := searchForTest(t, b, &query.Symbol{Expr: &query.Substring{Pattern: "Serve", Content: true}}, SearchOptions{SymbolPaths: true})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+	var got []string
+	for _, l := range res.Files[0].LineMatches {
+		got = append(got, fmt.Sprintf("%d:%s", l.LineNumber, strings.Join(l.SymbolPath, ".")))
+	}
+	sort.Strings(got)
+	if want := []string{"3:Server", "5:Server.Serve"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, tag := range []CtagEntry{
+		{Name: "Server", Line: 7},
+		{Name: "Server", Line: 3, Column: 1},
+		{Name: "Client", Line: 3},
+		{Name: "Serve", Line: 3},
+	} {
+		d := Document{Name: doc.Name, Content: doc.Content}
+		if err := d.AddCtags([]CtagEntry{{Name: "Server", Line: 3}, tag}); err == nil {
+			t.Errorf("%+v: got nil error", tag)
+		}
+	}
+}
+
 func TestDocSectionInvalid(t *testing.T) {
 	b, err := NewIndexBuilder(nil)
 	if err != nil {
@@ -98,6 +152,69 @@ func TestDocSectionInvalid(t *testing.T) {
 	}
 }
 
+func TestSkipInvalid(t *testing.T) {
+	docs := []Document{
+		{Name: "valid", Content: []byte("needle in text")},
+		{Name: "binary", Content: []byte("needle\x00binary")},
+		{Name: "overlap", Content: []byte("needle overlap"), Symbols: []DocumentSection{{0, 6}, {3, 9}}},
+		{Name: "large", Content: bytes.Repeat([]byte("needle "), 10)},
+		// The symbol ends inside "é".
+		{Name: "rune", Content: []byte("needle é"), Symbols: []DocumentSection{{0, 8}}},
+		{Name: "subrepo", Content: []byte("needle"), SubRepositoryPath: "/sub"},
+	}
+	newBuilder := func() *IndexBuilder {
+		b, err := NewIndexBuilder(nil)
+		if err != nil {
+			t.Fatalf("NewIndexBuilder: %v", err)
+		}
+		b.SizeMax = 20
+		return b
+	}
+
+	b := newBuilder()
+	for _, d := range docs[2:] {
+		if err := b.Add(d); err == nil {
+			t.Fatalf("Add(%s) should fail", d.Name)
+		} else if docErr, ok := err.(*DocumentError); !ok || docErr.Name != d.Name {
+			t.Fatalf("got %#v, want *DocumentError for %s", err, d.Name)
+		}
+	}
+	// The failed documents left no trace in the builder.
+	if err := b.Add(docs[0]); err != nil {
+		t.Fatal(err)
+	}
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 || res.Files[0].LineMatches[0].LineFragments[0].Offset != 0 {
+		t.Errorf("got %v, want only the match in the valid document", res.Files)
+	}
+
+	b = newBuilder()
+	b.SkipInvalid = true
+	for _, d := range docs {
+		if err := b.Add(d); err != nil {
+			t.Fatalf("Add(%s): %v", d.Name, err)
+		}
+	}
+	got := b.Warnings()
+	if len(got) != len(docs)-1 {
+		t.Fatalf("got warnings %q, want one per invalid document", got)
+	}
+	for i, w := range got {
+		if name := docs[i+1].Name; !strings.Contains(w, fmt.Sprintf("%q", name)) {
+			t.Errorf("got warning %q, want one for %s", w, name)
+		}
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, []string{"valid"}) {
+		t.Errorf("got %v, want only the valid document", got)
+	}
+	res = searchForTest(t, b, &query.Substring{Pattern: "overlap", FileName: true})
+	if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, []string{"overlap"}) {
+		t.Errorf("got %v, want the skipped document by name", got)
+	}
+}
+
 func TestBloomSkip(t *testing.T) {
 	for _, tc := range []struct {
 		skip bool
@@ -121,6 +238,44 @@ func TestBloomSkip(t *testing.T) {
 	}
 }
 
+func TestBloomFalsePositive(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("x1abxdef abcdef abcde abcde abcde")},
+	)
+	s := searcherForTest(t, b)
+
+	for _, tc := range []struct {
+		pattern string
+		report  bool
+		want    int
+	}{
+		// The bloom filter has no probes for words starting with a
+		// digit, so it admits these, and all their trigrams are
+		// indexed. The rare "1ab" and "def" are at the right
+		// distance, so only the content rules out "1abcdef".
+		{"1abcdef", true, 1},
+		{"1abcdef", false, 0},
+		// "abc" does not follow "1ab", which the ngram positions
+		// show without reading the content.
+		{"1abc", true, 0},
+		// Real matches are not false positives.
+		{"abcd", true, 0},
+	} {
+		res, err := s.Search(context.Background(),
+			&query.Substring{Pattern: tc.pattern, Content: true},
+			&SearchOptions{ReportBloomFalsePositives: tc.report})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Stats.ShardsScanned != 1 {
+			t.Fatalf("%q: got ShardsScanned %d, want 1", tc.pattern, res.Stats.ShardsScanned)
+		}
+		if got := res.Stats.ShardsBloomFalsePositive; got != tc.want {
+			t.Errorf("%q report=%v: got ShardsBloomFalsePositive %d, want %d", tc.pattern, tc.report, got, tc.want)
+		}
+	}
+}
+
 func TestBasic(t *testing.T) {
 	b := testIndexBuilder(t, nil,
 		Document{
@@ -226,6 +381,72 @@ func TestQueryNewlines(t *testing.T) {
 	}
 }
 
+func TestGroupHunks(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 12; i++ {
+		line := fmt.Sprintf("line%d", i)
+		if i == 2 || i == 3 || i == 10 {
+			line += " needle"
+		}
+		lines = append(lines, line)
+	}
+	b := testIndexBuilder(t, nil,
+		Document{Name: "filename", Content: []byte(strings.Join(lines, "\n"))})
+
+	hunkLines := func(f FileMatch) [][]int {
+		var got [][]int
+		for _, h := range f.Hunks {
+			var nums []int
+			for _, i := range h.LineMatches {
+				nums = append(nums, f.LineMatches[i].LineNumber)
+			}
+			if nums[0] != h.StartLine {
+				t.Errorf("hunk starts at %d, want %d", h.StartLine, nums[0])
+			}
+			got = append(got, nums)
+		}
+		return got
+	}
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle"}, SearchOptions{GroupHunks: true})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+	if got, want := hunkLines(res.Files[0]), [][]int{{2, 3}, {10}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got hunks %v, want %v", got, want)
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "needle"}, SearchOptions{GroupHunks: true, HunkGap: 6})
+	if got, want := hunkLines(res.Files[0]), [][]int{{2, 3, 10}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("HunkGap 6: got hunks %v, want %v", got, want)
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "needle"})
+	if res.Files[0].Hunks != nil {
+		t.Errorf("got hunks %v without GroupHunks", res.Files[0].Hunks)
+	}
+}
+
+func TestMatchSpan(t *testing.T) {
+	content := "line1\nfoo start\nmiddle\nend bar\nline5"
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte(content)})
+
+	res := searchForTest(t, b, &query.Regexp{Regexp: mustParseRE("start(.|\n)*end"), Content: true},
+		SearchOptions{MatchSpan: true})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+	f := res.Files[0]
+	if len(f.LineMatches) != 3 {
+		t.Fatalf("got %d line matches, want 3", len(f.LineMatches))
+	}
+	start, end := uint32(strings.Index(content, "start")), uint32(strings.Index(content, "end")+len("end"))
+	if f.MatchStart != start || f.MatchEnd != end {
+		t.Errorf("got span [%d, %d), want [%d, %d)", f.MatchStart, f.MatchEnd, start, end)
+	}
+}
+
 func searchForTest(t *testing.T, b *IndexBuilder, q query.Q, o ...SearchOptions) *SearchResult {
 	searcher := searcherForTest(t, b)
 	var opts SearchOptions
@@ -314,6 +535,8 @@ func TestAndSearch(t *testing.T) {
 		FileCount:          1,
 		FilesConsidered:    2,
 		ShardsScanned:      1,
+
+		EstimatedTotalMatches: 1,
 	}
 	if diff := pretty.Compare(wantStats, sres.Stats); diff != "" {
 		t.Errorf("got stats diff %s", diff)
@@ -346,6 +569,32 @@ func TestAndNegateSearch(t *testing.T) {
 	}
 }
 
+func TestLineAndNot(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("error: disk full\nerror: ignored\nok")},
+		Document{Name: "f2", Content: []byte("error: ignored")},
+		Document{Name: "f3", Content: []byte("no problems")})
+	q := &query.LineAndNot{
+		Positive: &query.Substring{Pattern: "error", Content: true},
+		Negative: &query.Substring{Pattern: "ignored", Content: true},
+	}
+
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || res.Files[0].FileName != "f1" {
+		t.Fatalf("got %v, want f1", res.Files)
+	}
+	lms := res.Files[0].LineMatches
+	if len(lms) != 1 || lms[0].LineNumber != 1 || string(lms[0].Line) != "error: disk full" {
+		t.Errorf("got %v, want line 1 only", lms)
+	}
+
+	// A document level negation drops f1 altogether.
+	res = searchForTest(t, b, query.NewAnd(q.Positive, &query.Not{Child: q.Negative}))
+	if len(res.Files) != 0 {
+		t.Errorf("and not: got %v, want no files", res.Files)
+	}
+}
+
 func TestNegativeMatchesOnlyShortcut(t *testing.T) {
 	b := testIndexBuilder(t, nil,
 		Document{Name: "f1", Content: []byte("x banana y")},
@@ -562,6 +811,28 @@ func TestFileNameBoundary(t *testing.T) {
 	}
 }
 
+func TestFileNameExact(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "readme.md", Content: []byte("x apple y")},
+		Document{Name: "docs/readme.md", Content: []byte("x apple y")},
+		Document{Name: "README.md.orig", Content: []byte("x apple y")})
+
+	for _, c := range []struct {
+		q    *query.FileNameExact
+		want []string
+	}{
+		{&query.FileNameExact{Name: "README.md"}, []string{"readme.md"}},
+		{&query.FileNameExact{Name: "README"}, nil},
+		{&query.FileNameExact{Name: "README.md", CaseSensitive: true}, nil},
+		{&query.FileNameExact{Name: "docs/readme.md", CaseSensitive: true}, []string{"docs/readme.md"}},
+	} {
+		res := searchForTest(t, b, c.q)
+		if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.q, got, c.want)
+		}
+	}
+}
+
 func TestDocumentOrder(t *testing.T) {
 	var docs []Document
 	for i := 0; i < 3; i++ {
@@ -615,6 +886,40 @@ func TestBranchMask(t *testing.T) {
 	}
 }
 
+func TestBranchExact(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Branches: []RepositoryBranch{
+			{"master", "v-master"},
+			{"stable", "v-stable"},
+			{"master-2", "v-master-2"},
+		},
+	}, Document{Name: "f1", Content: []byte("needle"), Branches: []string{"master"}},
+		Document{Name: "f2", Content: []byte("needle"), Branches: []string{"stable"}},
+		Document{Name: "f3", Content: []byte("needle"), Branches: []string{"master-2"}},
+	)
+
+	for _, c := range []struct {
+		branch string
+		want   []string
+	}{
+		{"table", nil},
+		{"stable", []string{"f2"}},
+		{"master", []string{"f1"}},
+	} {
+		res := searchForTest(t, b, query.NewAnd(
+			&query.Substring{Pattern: "needle"},
+			&query.Branch{Pattern: c.branch, Exact: true}))
+
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("branch=%s: got %v, want %v", c.branch, got, c.want)
+		}
+	}
+}
+
 func TestBranchLimit(t *testing.T) {
 	for limit := 64; limit <= 65; limit++ {
 		r := &Repository{}
@@ -655,6 +960,69 @@ func TestBranchReport(t *testing.T) {
 	}
 }
 
+func TestBranchCount(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Branches: []RepositoryBranch{
+			{"master", "vm"},
+			{"feature", "vf"},
+		},
+	},
+		Document{Name: "f1", Content: []byte("needle"), Branches: []string{"feature"}},
+		Document{Name: "f2", Content: []byte("needle"), Branches: []string{"master", "feature"}})
+
+	for _, c := range []struct {
+		q    *query.BranchCount
+		want []string
+	}{
+		{&query.BranchCount{Max: 1}, []string{"f1"}},
+		{&query.BranchCount{Min: 2}, []string{"f2"}},
+		{&query.BranchCount{Min: 1, Max: 2}, []string{"f1", "f2"}},
+		{&query.BranchCount{Min: 3}, nil},
+	} {
+		res := searchForTest(t, b, query.NewAnd(c.q, &query.Substring{Pattern: "needle", Content: true}))
+		if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.q, got, c.want)
+		}
+		// Documents on other numbers of branches are skipped before
+		// their content is loaded.
+		if res.Stats.FilesLoaded != len(c.want) {
+			t.Errorf("%s: got FilesLoaded %d, want %d", c.q, res.Stats.FilesLoaded, len(c.want))
+		}
+
+		res = searchForTest(t, b, c.q)
+		if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s alone: got %v, want %v", c.q, got, c.want)
+		}
+	}
+}
+
+func TestFileBranches(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Name: "repo",
+		Branches: []RepositoryBranch{
+			{"stable", "vs"},
+			{"master", "vm"},
+			{"dev", "vd"},
+		},
+	},
+		Document{Name: "f1", Content: []byte("needle"), Branches: []string{"stable", "master"}},
+		Document{Name: "f2", Content: []byte("needle"), Branches: []string{"dev"}})
+	s := searcherForTest(t, b)
+
+	got, err := s.FileBranches(context.Background(), "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FileBranch{{"repo", RepositoryBranch{"stable", "vs"}}, {"repo", RepositoryBranch{"master", "vm"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got, err := s.FileBranches(context.Background(), "f3"); err != nil || len(got) != 0 {
+		t.Errorf("got %v, %v for unknown file, want none", got, err)
+	}
+}
+
 func TestBranchVersions(t *testing.T) {
 	b := testIndexBuilder(t, &Repository{
 		Branches: []RepositoryBranch{
@@ -676,6 +1044,31 @@ func TestBranchVersions(t *testing.T) {
 	}
 }
 
+func TestDefaultBranchVersion(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Branches: []RepositoryBranch{
+			{"master", "v-master"},
+			{"stable", "v-stable"},
+		},
+	}, Document{Name: "f1", Content: []byte("needle"), Branches: []string{"stable"}})
+	s := searcherForTest(t, b)
+
+	for _, want := range []string{"", "v-master"} {
+		opts := &SearchOptions{DefaultBranchVersion: want != ""}
+		res, err := s.Search(context.Background(), &query.Substring{Pattern: "needle"}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 1 {
+			t.Fatalf("got %v, want 1 result", res.Files)
+		}
+		f := res.Files[0]
+		if f.Version != "v-stable" || f.DefaultBranchVersion != want {
+			t.Errorf("%+v: got version %q, default branch version %q, want v-stable, %q", opts, f.Version, f.DefaultBranchVersion, want)
+		}
+	}
+}
+
 func mustParseRE(s string) *syntax.Regexp {
 	r, err := syntax.Parse(s, 0)
 	if err != nil {
@@ -804,6 +1197,61 @@ func TestMergeMatches(t *testing.T) {
 	}
 }
 
+func TestLanguageFacet(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "a.java", Language: "java", Content: []byte("needle")},
+		Document{Name: "b.java", Language: "java", Content: []byte("needle")},
+		Document{Name: "c.cpp", Language: "cpp", Content: []byte("needle")},
+		Document{Name: "d.cpp", Language: "cpp", Content: []byte("hay")},
+		Document{Name: "e", Content: []byte("needle")})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true}, SearchOptions{ReportLanguageFacet: true})
+	want := map[string]int{"java": 2, "cpp": 1, "": 1}
+	if !reflect.DeepEqual(res.LanguageFacet, want) {
+		t.Errorf("got %v, want %v", res.LanguageFacet, want)
+	}
+
+	if res := searchForTest(t, b, &query.Substring{Pattern: "needle"}); res.LanguageFacet != nil {
+		t.Errorf("got %v without ReportLanguageFacet", res.LanguageFacet)
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true}, SearchOptions{ReportLanguageFacet: true, SkipLanguage: true})
+	if !reflect.DeepEqual(res.LanguageFacet, want) {
+		t.Errorf("SkipLanguage: got %v, want %v", res.LanguageFacet, want)
+	}
+	for _, f := range res.Files {
+		if f.Language != "" {
+			t.Errorf("SkipLanguage: got language %q for %s", f.Language, f.FileName)
+		}
+	}
+}
+
+func TestRepoAggregates(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "repoa"},
+		Document{Name: "f1", Content: []byte("needle\nneedle\nhay")},
+		Document{Name: "f2", Content: []byte("needle")},
+		Document{Name: "f3", Content: []byte("hay")})
+	if _, err := b.AddRepository(&Repository{Name: "repob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(Document{Name: "f4", Content: []byte("needle needle")}); err != nil {
+		t.Fatal(err)
+	}
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle"}, SearchOptions{ReportRepoAggregates: true})
+	want := map[string]RepoAggregate{
+		"repoa": {Files: 2, Matches: 3},
+		"repob": {Files: 1, Matches: 1},
+	}
+	if !reflect.DeepEqual(res.RepoAggregates, want) {
+		t.Errorf("got %v, want %v", res.RepoAggregates, want)
+	}
+
+	if res := searchForTest(t, b, &query.Substring{Pattern: "needle"}); res.RepoAggregates != nil {
+		t.Errorf("got %v without ReportRepoAggregates", res.RepoAggregates)
+	}
+}
+
 func TestRepoURL(t *testing.T) {
 	content := []byte("blablabla")
 	b := testIndexBuilder(t, &Repository{
@@ -1116,7 +1564,7 @@ func TestListRepos(t *testing.T) {
 			Stats: RepoStats{
 				Shards:                     1,
 				Documents:                  4,
-				IndexBytes:                 308,
+				IndexBytes:                 324,
 				ContentBytes:               68,
 				NewLinesCount:              4,
 				DefaultBranchNewLinesCount: 2,
@@ -1170,1002 +1618,3696 @@ func TestListReposByContent(t *testing.T) {
 	}
 }
 
-func TestMetadata(t *testing.T) {
-	content := []byte("bla the needle")
-	// ----------------01234567890123
-	b := testIndexBuilder(t, &Repository{
-		Name: "reponame",
-	}, Document{Name: "f1", Content: content},
-		Document{Name: "f2", Content: content})
+func TestEachDocument(t *testing.T) {
+	docs := []Document{
+		{Name: "main.go", Content: []byte("package main\n"), Language: "Go", Branches: []string{"main"}},
+		{Name: "README", Content: []byte("hello\n"), Language: "Text", Branches: []string{"main"}},
+	}
+	b := testIndexBuilder(t, &Repository{Name: "repo", Branches: []RepositoryBranch{{Name: "main", Version: "v1"}}}, docs...)
+	s := searcherForTest(t, b).(DocumentIterator)
 
-	var buf bytes.Buffer
-	if err := b.Write(&buf); err != nil {
+	var got []Document
+	if err := s.EachDocument(func(v DocumentView) bool {
+		if v.Repository.Name != "repo" {
+			t.Errorf("%s: got repository %q, want repo", v.Name, v.Repository.Name)
+		}
+		got = append(got, Document{Name: v.Name, Content: v.Content, Language: v.Language, Branches: v.Branches})
+		return true
+	}); err != nil {
 		t.Fatal(err)
 	}
-	f := &memSeeker{buf.Bytes()}
-
-	rd, _, err := ReadMetadata(f)
-	if err != nil {
-		t.Fatalf("ReadMetadata: %v", err)
+	if !reflect.DeepEqual(got, docs) {
+		t.Errorf("got %+v, want %+v", got, docs)
 	}
 
-	if got, want := rd[0].Name, "reponame"; got != want {
-		t.Fatalf("got %q want %q", got, want)
+	n := 0
+	if err := s.EachDocument(func(DocumentView) bool {
+		n++
+		return false
+	}); err != nil || n != 1 {
+		t.Errorf("got %d calls, %v after stopping, want 1", n, err)
 	}
 }
 
-func TestOr(t *testing.T) {
+func TestPostings(t *testing.T) {
 	b := testIndexBuilder(t, nil,
-		Document{Name: "f1", Content: []byte("needle")},
-		Document{Name: "f2", Content: []byte("banana")})
-	sres := searchForTest(t, b, query.NewOr(
-		&query.Substring{Pattern: "needle"},
-		&query.Substring{Pattern: "banana"}))
+		Document{Name: "f0", Content: []byte("needle in a haystack")},
+		Document{Name: "f1", Content: []byte("needlepoint")},
+		Document{Name: "f2", Content: []byte("haystack")},
+		Document{Name: "f3", Content: []byte("a needle, another needle")},
+	)
+	s := searcherForTest(t, b).(PostingsLister)
 
-	if len(sres.Files) != 2 {
-		t.Fatalf("got %v, want 2 files", sres.Files)
+	var lists [][]uint32
+	for _, ng := range []string{"nee", "eed", "edl", "dle"} {
+		docs, err := s.Postings(ng)
+		if err != nil {
+			t.Fatalf("Postings(%q): %v", ng, err)
+		}
+		lists = append(lists, docs)
 	}
-}
-
-func TestImportantCutoff(t *testing.T) {
-	t.Skip()
-
-	content := []byte("func bla() blub")
-	// ----------------012345678901234
-	b := testIndexBuilder(t, nil,
-		Document{
-			Name:    "f1",
-			Content: content,
-			Symbols: []DocumentSection{{5, 8}},
-		}, Document{
-			Name:    "f2",
-			Content: content,
-		})
-	opts := SearchOptions{
-		ShardMaxImportantMatch: 1,
+	if got, want := IntersectPostings(lists...), []uint32{0, 1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("needle: got %v, want %v", got, want)
 	}
 
-	sres := searchForTest(t, b, &query.Substring{Pattern: "bla"}, opts)
-	if len(sres.Files) != 1 || sres.Files[0].FileName != "f1" {
-		t.Errorf("got %v, wanted 1 match 'f1'", sres.Files)
+	if got, err := s.Postings("hay"); err != nil || !reflect.DeepEqual(got, []uint32{0, 2}) {
+		t.Errorf("hay: got %v, %v, want [0 2]", got, err)
+	}
+	if got, err := s.Postings("HAY"); err != nil || len(got) != 0 {
+		t.Errorf("HAY: got %v, %v, want no postings", got, err)
+	}
+	if _, err := s.Postings("ne"); err == nil {
+		t.Error("got nil error for a 2-rune ngram")
 	}
 }
 
-func TestFrequency(t *testing.T) {
-	content := []byte("sla _Py_HashDouble(double v sla las las shd dot dot")
-	// ----------------012345678901234
+func TestSuggest(t *testing.T) {
 	b := testIndexBuilder(t, nil,
-		Document{
-			Name:    "f1",
-			Content: content,
-		})
+		Document{Name: "f1", Content: []byte("find the needle in the haystack")},
+		Document{Name: "f2", Content: []byte("needles and pins; a needle")},
+		Document{Name: "f3", Content: []byte("unrelated content")},
+	)
+	s := searcherForTest(t, b)
 
-	sres := searchForTest(t, b, &query.Substring{Pattern: "slashdot"})
-	if len(sres.Files) != 0 {
-		t.Errorf("got %v, wanted 0 matches", sres.Files)
+	q := &query.Substring{Pattern: "needel", Content: true}
+	if res, err := s.Search(context.Background(), q, &SearchOptions{}); err != nil || len(res.Files) != 0 {
+		t.Fatalf("got %v, %v, want no results for %s", res, err, q)
 	}
-}
 
-func TestMatchNewline(t *testing.T) {
-	re, err := syntax.Parse("[^a]a", syntax.ClassNL)
+	got, err := s.Suggest(context.Background(), q)
 	if err != nil {
-		t.Fatalf("syntax.Parse: %v", err)
+		t.Fatal(err)
 	}
-
-	content := []byte("pqr\nalex")
-	// ----------------0123 4567
+	if want := []string{"needle", "needles"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExpandSynonyms(t *testing.T) {
 	b := testIndexBuilder(t, nil,
-		Document{
-			Name:    "f1",
-			Content: content,
-		})
+		Document{Name: "f1", Content: []byte("// user authentication")},
+		Document{Name: "f2", Content: []byte("// something else")},
+	)
+	q := query.Expand(&query.Substring{Pattern: "authn", Content: true},
+		map[string][]string{"authn": {"authentication"}})
+	res := searchForTest(t, b, q)
+	if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, []string{"f1"}) {
+		t.Errorf("%s: got %v, want [f1]", q, got)
+	}
+}
 
-	sres := searchForTest(t, b, &query.Regexp{Regexp: re, CaseSensitive: true})
-	if len(sres.Files) != 1 {
-		t.Errorf("got %v, wanted 1 matches", sres.Files)
-	} else if l := sres.Files[0].LineMatches[0].Line; !bytes.Equal(l, content[len("pqr\n"):]) {
-		t.Errorf("got match line %q, want %q", l, content)
+func TestListAllRepos(t *testing.T) {
+	branches := []RepositoryBranch{{Name: "main", Version: "v1"}, {Name: "dev", Version: "v2"}}
+	b := testIndexBuilder(t, &Repository{Name: "repoa", Branches: branches},
+		Document{Name: "f1", Content: []byte("needle"), Branches: []string{"main", "dev"}})
+	if _, err := b.AddRepository(&Repository{Name: "repob"}); err != nil {
+		t.Fatal(err)
+	}
+	searcher := searcherForTest(t, b)
+
+	res, err := searcher.List(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	got := map[string][]RepositoryBranch{}
+	for _, r := range res.Repos {
+		got[r.Repository.Name] = r.Repository.Branches
+	}
+	want := map[string][]RepositoryBranch{"repoa": branches, "repob": nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
 	}
 }
 
-func TestSubRepo(t *testing.T) {
-	subRepos := map[string]*Repository{
-		"sub": {
-			Name:                 "sub-name",
-			LineFragmentTemplate: "sub-line",
-		},
+func TestListReposByFileName(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "repoa"},
+		Document{Name: "api/service.proto", Content: []byte("message Foo {}")},
+		Document{Name: "main.go", Content: []byte("package main")})
+	if _, err := b.AddRepository(&Repository{Name: "repob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(Document{Name: "proto.go", Content: []byte("package proto")}); err != nil {
+		t.Fatal(err)
 	}
+	searcher := searcherForTest(t, b)
 
-	content := []byte("pqr\nalex")
-	// ----------------0123 4567
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: ".proto", FileName: true},
+		&query.Regexp{Regexp: mustParseRE(`\.proto$`), FileName: true},
+	} {
+		res, err := searcher.List(context.Background(), q, nil)
+		if err != nil {
+			t.Fatalf("List(%v): %v", q, err)
+		}
+		if len(res.Repos) != 1 || res.Repos[0].Repository.Name != "repoa" {
+			t.Errorf("List(%v): got %v, want only repoa", q, res.Repos)
+		}
+	}
+}
 
-	b := testIndexBuilder(t, &Repository{
-		SubRepoMap: subRepos,
-	}, Document{
-		Name:              "sub/f1",
-		Content:           content,
-		SubRepositoryPath: "sub",
-	})
+func TestAddRepository(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "repoa", ID: 1},
+		Document{Name: "f1", Content: []byte("bla the needle")},
+		Document{Name: "f2", Content: []byte("bla the haystack")})
+	repob, err := b.AddRepository(&Repository{Name: "repob", ID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddToRepo(repob, Document{Name: "f3", Content: []byte("another needle")}); err != nil {
+		t.Fatal(err)
+	}
+	searcher := searcherForTest(t, b)
 
-	sres := searchForTest(t, b, &query.Substring{Pattern: "alex"})
-	if len(sres.Files) != 1 {
-		t.Fatalf("got %v, wanted 1 matches", sres.Files)
+	fileNames := func(q query.Q) []string {
+		t.Helper()
+		res, err := searcher.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range res.Files {
+			names = append(names, f.Repository+"/"+f.FileName)
+		}
+		return names
 	}
 
-	f := sres.Files[0]
-	if f.SubRepositoryPath != "sub" || f.SubRepositoryName != "sub-name" {
-		t.Errorf("got %#v, want SubRepository{Path,Name} = {'sub', 'sub-name'}", f)
+	needle := &query.Substring{Pattern: "needle"}
+	if got, want := fileNames(needle), []string{"repoa/f1", "repob/f3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for repo, want := range map[string][]string{
+		"repoa": {"repoa/f1"},
+		"repob": {"repob/f3"},
+	} {
+		q := query.NewAnd(needle, &query.Repo{Regexp: regexp.MustCompile("^" + repo + "$")})
+		if got := fileNames(q); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", repo, got, want)
+		}
+	}
+	if got, want := fileNames(&query.Substring{Pattern: "haystack"}), []string{"repoa/f2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
 	}
 
-	if sres.LineFragments["sub-name"] != "sub-line" {
-		t.Errorf("got LineFragmentTemplate %v, want {'sub':'sub-line'}", sres.LineFragments)
+	rl, err := searcher.List(context.Background(), &query.Substring{Pattern: "another"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rl.Repos) != 1 || rl.Repos[0].Repository.Name != "repob" {
+		t.Fatalf("got %v, want only repob", rl.Repos)
+	}
+	if got := rl.Repos[0].Stats.Documents; got != 1 {
+		t.Errorf("got %d documents for repob, want 1", got)
+	}
+
+	// The documents of a repository are contiguous, so repob is closed
+	// once another repository is added.
+	if _, err := b.AddRepository(&Repository{Name: "repoc", ID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddToRepo(repob, Document{Name: "f4"}); err == nil {
+		t.Error("AddToRepo succeeded for repob after adding repoc")
+	}
+	other, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.AddToRepo(repob, Document{Name: "f4"}); err == nil {
+		t.Error("AddToRepo succeeded with a handle of another builder")
 	}
 }
 
-func TestSearchEither(t *testing.T) {
-	b := testIndexBuilder(t, nil,
-		Document{Name: "f1", Content: []byte("bla needle bla")},
-		Document{Name: "needle-file-branch", Content: []byte("bla content")})
+func TestMetadata(t *testing.T) {
+	content := []byte("bla the needle")
+	// ----------------01234567890123
+	b := testIndexBuilder(t, &Repository{
+		Name: "reponame",
+	}, Document{Name: "f1", Content: content},
+		Document{Name: "f2", Content: content})
 
-	sres := searchForTest(t, b, &query.Substring{Pattern: "needle"})
-	if len(sres.Files) != 2 {
-		t.Fatalf("got %v, wanted 2 matches", sres.Files)
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
 	}
+	f := &memSeeker{buf.Bytes()}
 
-	sres = searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
-	if len(sres.Files) != 1 {
-		t.Fatalf("got %v, wanted 1 match", sres.Files)
+	rd, _, err := ReadMetadata(f)
+	if err != nil {
+		t.Fatalf("ReadMetadata: %v", err)
 	}
 
-	if got, want := sres.Files[0].FileName, "f1"; got != want {
-		t.Errorf("got %q, want %q", got, want)
+	if got, want := rd[0].Name, "reponame"; got != want {
+		t.Fatalf("got %q want %q", got, want)
 	}
 }
 
-func TestUnicodeExactMatch(t *testing.T) {
-	needle := "néédlÉ"
-	content := []byte("blá blá " + needle + " blâ")
-	// ----------------01234567    8
-	b := testIndexBuilder(t, nil,
-		Document{Name: "f1", Content: content})
+// readRecorder records the ranges read from an IndexFile.
+type readRecorder struct {
+	IndexFile
+	reads [][2]uint32
+}
 
-	if res := searchForTest(t, b, &query.Substring{Pattern: needle, CaseSensitive: true}); len(res.Files) != 1 {
-		t.Fatalf("case sensitive: got %v, wanted 1 match", res.Files)
-	}
+func (r *readRecorder) Read(off, sz uint32) ([]byte, error) {
+	r.reads = append(r.reads, [2]uint32{off, off + sz})
+	return r.IndexFile.Read(off, sz)
 }
 
-func TestUnicodeCoverContent(t *testing.T) {
-	needle := "néédlÉ"
-	content := []byte("blá blá " + needle + " blâ")
-	b := testIndexBuilder(t, nil,
-		Document{Name: "f1", Content: content})
+func TestReadRepos(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("bla the needle")})
 
-	if res := searchForTest(t, b, &query.Substring{Pattern: "NÉÉDLÉ", CaseSensitive: true}); len(res.Files) != 0 {
-		t.Fatalf("case sensitive: got %v, wanted 0 match", res.Files)
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
 	}
+	f := &readRecorder{IndexFile: &memSeeker{buf.Bytes()}}
 
-	res := searchForTest(t, b, &query.Substring{Pattern: "NÉÉDLÉ"})
-	if len(res.Files) != 1 {
-		t.Fatalf("case insensitive: got %v, wanted 1 match", res.Files)
+	repos, err := ReadRepos(f)
+	if err != nil {
+		t.Fatalf("ReadRepos: %v", err)
+	}
+	if len(repos) != 1 || repos[0].Name != "reponame" {
+		t.Fatalf("got %v, want reponame", repos)
 	}
 
-	if got, want := res.Files[0].LineMatches[0].LineFragments[0].Offset, uint32(strings.Index(string(content), needle)); got != want {
-		t.Errorf("got %d want %d", got, want)
+	var toc indexTOC
+	if err := (&reader{r: &memSeeker{buf.Bytes()}}).readTOC(&toc); err != nil {
+		t.Fatal(err)
+	}
+	content := toc.fileContents.data
+	for _, r := range f.reads {
+		if r[0] < content.off+content.sz && content.off < r[1] {
+			t.Errorf("read %v overlaps the content section at %d+%d", r, content.off, content.sz)
+		}
+	}
+
+	md, err := ReadIndexMetadata(f)
+	if err != nil {
+		t.Fatalf("ReadIndexMetadata: %v", err)
+	}
+	if md.IndexFeatureVersion != FeatureVersion || md.IndexTime.IsZero() {
+		t.Errorf("got %+v, want feature version %d and an index time", md, FeatureVersion)
 	}
 }
 
-func TestUnicodeNonCoverContent(t *testing.T) {
-	needle := "nééáádlÉ"
-	//---------01234567
-	content := []byte("blá blá " + needle + " blâ")
-	// ----------------01234567    8901234   5678
+func TestContentWindow(t *testing.T) {
+	content := []byte("line one\nline two has the needle\nline three\n")
 	b := testIndexBuilder(t, nil,
-		Document{Name: "f1", Content: content})
+		Document{Name: "f1", Content: []byte("other file")},
+		Document{Name: "f2", Content: content})
+	s := searcherForTest(t, b)
+	ctx := context.Background()
 
-	res := searchForTest(t, b, &query.Substring{Pattern: "NÉÉÁÁDLÉ", Content: true})
-	if len(res.Files) != 1 {
-		t.Fatalf("got %v, wanted 1 match", res.Files)
+	for _, w := range [][2]uint32{{0, 0}, {9, 33}, {20, uint32(len(content))}} {
+		got, err := s.ContentWindow(ctx, "f2", w[0], w[1])
+		if err != nil {
+			t.Fatalf("ContentWindow(%v): %v", w, err)
+		}
+		if want := content[w[0]:w[1]]; !bytes.Equal(got, want) {
+			t.Errorf("ContentWindow(%v): got %q, want %q", w, got, want)
+		}
 	}
 
-	if got, want := res.Files[0].LineMatches[0].LineFragments[0].Offset, uint32(strings.Index(string(content), needle)); got != want {
-		t.Errorf("got %d want %d", got, want)
+	if got, err := s.ContentWindow(ctx, "f2", 33, 1000); err != nil || string(got) != "line three\n" {
+		t.Errorf("got %q, %v past the end, want \"line three\\n\"", got, err)
+	}
+	if _, err := s.ContentWindow(ctx, "f3", 0, 1); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("got %v for unknown file, want ErrFileNotFound", err)
+	}
+	if _, err := s.ContentWindow(ctx, "f2", 2, 1); err == nil {
+		t.Error("got no error for start after end")
 	}
 }
 
-const kelvinCodePoint = 8490
-
-func TestUnicodeVariableLength(t *testing.T) {
-	lower := 'k'
-	upper := rune(kelvinCodePoint)
+func TestDuplicateGroups(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "repo"},
+		Document{Name: "a.go", Content: []byte("package copy\n")},
+		Document{Name: "b.go", Content: []byte("package other\n")},
+		Document{Name: "vendor/a.go", Content: []byte("package copy\n")},
+		Document{Name: "big1", SkipReason: "too large"},
+		Document{Name: "big2", SkipReason: "too large"})
+	s := searcherForTest(t, b)
 
-	needle := "nee" + string([]rune{lower}) + "eed"
-	corpus := []byte("nee" + string([]rune{upper}) + "eed" +
-		" ee" + string([]rune{lower}) + "ee" +
-		" ee" + string([]rune{upper}) + "ee")
+	got, err := s.DuplicateGroups(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]DuplicateFile{{{Repository: "repo", FileName: "a.go"}, {Repository: "repo", FileName: "vendor/a.go"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
 
+func TestMatchIter(t *testing.T) {
 	b := testIndexBuilder(t, nil,
-		Document{Name: "f1", Content: []byte(corpus)})
+		Document{Name: "f1", Content: []byte("needle\nneedle\n")},
+		Document{Name: "f2", Content: []byte("needle\n")})
+	s := searcherForTest(t, b)
+	q := &query.Substring{Pattern: "needle"}
 
-	res := searchForTest(t, b, &query.Substring{Pattern: needle, Content: true})
-	if len(res.Files) != 1 {
-		t.Fatalf("got %v, wanted 1 match", res.Files)
+	res, err := s.Search(context.Background(), q, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []LineMatch
+	for _, f := range res.Files {
+		want = append(want, f.LineMatches...)
 	}
+
+	it := NewMatchIter(context.Background(), s, q, &SearchOptions{})
+	var got []LineMatch
+	for it.Next() {
+		_, l := it.Match()
+		got = append(got, l)
+	}
+	it.Close()
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 3 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Closing early stops the search.
+	it = NewMatchIter(context.Background(), s, q, &SearchOptions{})
+	if !it.Next() {
+		t.Fatalf("got no match: %v", it.Err())
+	}
+	it.Close()
 }
 
-func TestUnicodeFileStartOffsets(t *testing.T) {
-	unicode := "世界"
-	wat := "waaaaaat"
+func TestOr(t *testing.T) {
 	b := testIndexBuilder(t, nil,
-		Document{
-			Name:    "f1",
-			Content: []byte(unicode),
-		},
-		Document{
-			Name:    "f2",
-			Content: []byte(wat),
-		},
-	)
-	q := &query.Substring{Pattern: wat, Content: true}
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 {
-		t.Fatalf("got %v, wanted 1 match", res.Files)
+		Document{Name: "f1", Content: []byte("needle")},
+		Document{Name: "f2", Content: []byte("banana")})
+	sres := searchForTest(t, b, query.NewOr(
+		&query.Substring{Pattern: "needle"},
+		&query.Substring{Pattern: "banana"}))
+
+	if len(sres.Files) != 2 {
+		t.Fatalf("got %v, want 2 files", sres.Files)
 	}
 }
 
-func TestLongFileUTF8(t *testing.T) {
-	needle := "neeedle"
+func TestImportantCutoff(t *testing.T) {
+	t.Skip()
 
-	// 6 bytes.
-	unicode := "世界"
-	content := []byte(strings.Repeat(unicode, 100) + needle)
+	content := []byte("func bla() blub")
+	// ----------------012345678901234
 	b := testIndexBuilder(t, nil,
 		Document{
 			Name:    "f1",
-			Content: []byte(strings.Repeat("a", 50)),
-		},
-		Document{
+			Content: content,
+			Symbols: []DocumentSection{{5, 8}},
+		}, Document{
 			Name:    "f2",
 			Content: content,
 		})
+	opts := SearchOptions{
+		ShardMaxImportantMatch: 1,
+	}
 
-	q := &query.Substring{Pattern: needle, Content: true}
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 {
-		t.Errorf("got %v, want 1 result", res)
+	sres := searchForTest(t, b, &query.Substring{Pattern: "bla"}, opts)
+	if len(sres.Files) != 1 || sres.Files[0].FileName != "f1" {
+		t.Errorf("got %v, wanted 1 match 'f1'", sres.Files)
 	}
 }
 
-func TestEstimateDocCount(t *testing.T) {
-	content := []byte("bla needle bla")
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{Name: "f1", Content: content},
-		Document{Name: "f2", Content: content},
-	)
-
-	if sres := searchForTest(t, b,
-		query.NewAnd(
-			&query.Substring{Pattern: "needle"},
-			&query.Repo{Regexp: regexp.MustCompile("reponame")},
-		), SearchOptions{
-			EstimateDocCount: true,
-		}); sres.Stats.ShardFilesConsidered != 2 {
-		t.Errorf("got FilesConsidered = %d, want 2", sres.Stats.FilesConsidered)
-	}
-	if sres := searchForTest(t, b,
-		query.NewAnd(
-			&query.Substring{Pattern: "needle"},
-			&query.Repo{Regexp: regexp.MustCompile("nomatch")},
-		), SearchOptions{
-			EstimateDocCount: true,
-		}); sres.Stats.ShardFilesConsidered != 0 {
-		t.Errorf("got FilesConsidered = %d, want 0", sres.Stats.FilesConsidered)
-	}
-}
-
-func TestUTF8CorrectCorpus(t *testing.T) {
-	needle := "neeedle"
-
-	// 6 bytes.
-	unicode := "世界"
+func TestFrequency(t *testing.T) {
+	content := []byte("sla _Py_HashDouble(double v sla las las shd dot dot")
+	// ----------------012345678901234
 	b := testIndexBuilder(t, nil,
 		Document{
 			Name:    "f1",
-			Content: []byte(strings.Repeat(unicode, 100)),
-		},
-		Document{
-			Name:    "xxxxxneeedle",
-			Content: []byte("hello"),
+			Content: content,
 		})
 
-	q := &query.Substring{Pattern: needle, FileName: true}
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 {
-		t.Errorf("got %v, want 1 result", res)
+	sres := searchForTest(t, b, &query.Substring{Pattern: "slashdot"})
+	if len(sres.Files) != 0 {
+		t.Errorf("got %v, wanted 0 matches", sres.Files)
 	}
 }
 
-func TestBuilderStats(t *testing.T) {
+func TestDebugNgrams(t *testing.T) {
 	b := testIndexBuilder(t, nil,
-		Document{
-			Name:    "f1",
-			Content: []byte(strings.Repeat("abcd", 1024)),
-		})
-	var buf bytes.Buffer
-	if err := b.Write(&buf); err != nil {
-		t.Fatal(err)
+		Document{Name: "f1", Content: []byte("needle needs needs dle")})
+	q := &query.Substring{Pattern: "needle", CaseSensitive: true}
+
+	// The rarest ngram is "edl"; of the others, "dle" is the rarest.
+	res := searchForTest(t, b, q, SearchOptions{DebugNgrams: true})
+	want := []NgramStat{
+		{Pattern: "needle", Ngram: "edl", Candidates: 1},
+		{Pattern: "needle", Ngram: "dle", Candidates: 2},
+	}
+	if res.Stats.NgramSelection == nil || !reflect.DeepEqual(res.Stats.NgramSelection.Ngrams, want) {
+		t.Errorf("got %+v, want %+v", res.Stats.NgramSelection, want)
 	}
 
-	if got, want := b.ContentSize(), uint32(2+4*1024); got != want {
-		t.Errorf("got %d, want %d", got, want)
+	res = searchForTest(t, b, q)
+	if res.Stats.NgramSelection != nil {
+		t.Errorf("got %+v without DebugNgrams", res.Stats.NgramSelection)
 	}
 }
 
-func TestIOStats(t *testing.T) {
-	b := testIndexBuilder(t, nil,
-		Document{
-			Name:    "f1",
-			Content: []byte(strings.Repeat("abcd", 1024)),
+func TestMaxNgramCandidates(t *testing.T) {
+	var docs []Document
+	for i := 0; i < 20; i++ {
+		docs = append(docs, Document{
+			Name:    fmt.Sprintf("f%d", i),
+			Content: []byte(strings.Repeat("the cat and the dog ", i%3)),
 		})
+	}
+	b := testIndexBuilder(t, nil, docs...)
+	q := &query.Substring{Pattern: "the", Content: true}
 
-	q := &query.Substring{Pattern: "abc", CaseSensitive: true, Content: true}
-	res := searchForTest(t, b, q)
+	want := searchForTest(t, b, q)
+	if want.Stats.SubstringsBruteForced != 0 {
+		t.Fatalf("got %d substrings brute forced without limit", want.Stats.SubstringsBruteForced)
+	}
 
-	// 4096 (content) + 2 (overhead: newlines or doc sections)
-	if got, want := res.Stats.ContentBytesLoaded, int64(4098); got != want {
-		t.Errorf("got content I/O %d, want %d", got, want)
+	got := searchForTest(t, b, q, SearchOptions{MaxNgramCandidates: 10})
+	if got.Stats.SubstringsBruteForced != 1 {
+		t.Errorf("got %d substrings brute forced, want 1", got.Stats.SubstringsBruteForced)
+	}
+	if !reflect.DeepEqual(sortedFileNames(got.Files), sortedFileNames(want.Files)) || got.Stats.MatchCount != want.Stats.MatchCount {
+		t.Errorf("got %v with %d matches, want %v with %d matches",
+			sortedFileNames(got.Files), got.Stats.MatchCount, sortedFileNames(want.Files), want.Stats.MatchCount)
 	}
 
-	// 1024 entries, each 4 bytes apart. 4 fits into single byte
-	// delta encoded.
-	if got, want := res.Stats.IndexBytesLoaded, int64(1024); got != want {
-		t.Errorf("got index I/O %d, want %d", got, want)
+	// "dog" is rarer than the limit.
+	res := searchForTest(t, b, &query.Substring{Pattern: "dog"}, SearchOptions{MaxNgramCandidates: 100})
+	if res.Stats.SubstringsBruteForced != 0 {
+		t.Errorf("dog: got %d substrings brute forced, want 0", res.Stats.SubstringsBruteForced)
 	}
 }
 
-func TestStartLineAnchor(t *testing.T) {
-	b := testIndexBuilder(t, nil,
-		Document{
-			Name: "f1",
-			Content: []byte(
-				`hello
-start of middle of line
-`),
-		})
+func TestHeaderBytes(t *testing.T) {
+	content := []byte("// Copyright 2021 Acme\n// License: MIT\n" + strings.Repeat("code\n", 100) + "Copyright in body\n")
+	b := testIndexBuilder(t, nil, Document{Name: "f1", Content: content})
+	opts := SearchOptions{HeaderBytes: 64, NumContextLines: 1}
 
-	q, err := query.Parse("^start")
-	if err != nil {
-		t.Errorf("parse: %v", err)
+	res := searchForTest(t, b, &query.Substring{Pattern: "License", Content: true}, opts)
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("License: got %v, want 1 line match", res.Files)
 	}
-
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 {
-		t.Errorf("got %v, want 1 file", res.Files)
+	full := searchForTest(t, b, &query.Substring{Pattern: "License", Content: true}, SearchOptions{NumContextLines: 1})
+	if got, want := full.Stats.ContentBytesLoaded-res.Stats.ContentBytesLoaded, int64(len(content)-opts.HeaderBytes); got != want {
+		t.Errorf("HeaderBytes saved loading %d content bytes, want %d", got, want)
 	}
 
-	q, err = query.Parse("^middle")
-	if err != nil {
-		t.Errorf("parse: %v", err)
-	}
-	res = searchForTest(t, b, q)
+	res = searchForTest(t, b, &query.Substring{Pattern: "body", Content: true}, opts)
 	if len(res.Files) != 0 {
-		t.Errorf("got %v, want 0 files", res.Files)
+		t.Errorf("body: got %v, want no match past the header", res.Files)
 	}
-}
-
-func TestAndOrUnicode(t *testing.T) {
-	q, err := query.Parse("orange.*apple")
-	if err != nil {
-		t.Errorf("parse: %v", err)
+	res = searchForTest(t, b, &query.Regexp{Regexp: mustParseRE("Copyright.*"), Content: true}, opts)
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 || res.Files[0].LineMatches[0].LineNumber != 1 {
+		t.Errorf("Copyright: got %v, want only the match on line 1", res.Files)
 	}
-	finalQ := query.NewAnd(q,
-		query.NewOr(query.NewAnd(&query.Repo{Regexp: regexp.MustCompile("name")},
-			query.NewOr(&query.Branch{Pattern: "master"}))))
-
-	b := testIndexBuilder(t, &Repository{
-		Name:     "name",
-		Branches: []RepositoryBranch{{"master", "master-version"}},
-	}, Document{
-		Name:    "f2",
-		Content: []byte("orange\u2318apple"),
-		// --------------0123456     78901
-		Branches: []string{"master"},
-	})
 
-	res := searchForTest(t, b, finalQ)
+	// Without the limit, the body matches.
+	res = searchForTest(t, b, &query.Substring{Pattern: "body", Content: true})
 	if len(res.Files) != 1 {
-		t.Errorf("got %v, want 1 result", res.Files)
+		t.Errorf("body: got %v without HeaderBytes, want 1 file", res.Files)
 	}
 }
 
-func TestAndShort(t *testing.T) {
-	content := []byte("bla needle at orange bla")
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{Name: "f1", Content: content},
-		Document{Name: "f2", Content: []byte("xx at xx")},
-		Document{Name: "f3", Content: []byte("yy orange xx")},
-	)
+func TestMaxStartOffset(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "top", Content: []byte("// Copyright 2021 Acme\npackage top\n")},
+		Document{Name: "deep", Content: []byte(strings.Repeat("code\n", 100) + "// Copyright 2021 Acme\n")})
 
-	q := query.NewAnd(&query.Substring{Pattern: "at"},
-		&query.Substring{Pattern: "orange"})
+	for _, pat := range []string{"Copyright", "Co"} {
+		res := searchForTest(t, b, &query.Substring{Pattern: pat, Content: true, CaseSensitive: true})
+		if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, []string{"deep", "top"}) {
+			t.Errorf("%s: got %v without limit, want both files", pat, got)
+		}
 
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 || res.Files[0].FileName != "f1" {
-		t.Errorf("got %v, want 1 result", res.Files)
+		res = searchForTest(t, b, &query.Substring{Pattern: pat, Content: true, CaseSensitive: true, MaxStartOffset: 64})
+		if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, []string{"top"}) {
+			t.Errorf("%s: got %v, want only the file with the match near the top", pat, got)
+		}
+	}
+
+	// Candidates past the limit are dropped before loading the content.
+	res := searchForTest(t, b, &query.Substring{Pattern: "Copyright", Content: true, MaxStartOffset: 64})
+	if res.Stats.FilesLoaded != 1 {
+		t.Errorf("got %d files loaded, want 1", res.Stats.FilesLoaded)
 	}
 }
 
-func TestNoCollectRegexpSubstring(t *testing.T) {
-	content := []byte("bla final bla\nfoo final, foo")
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{Name: "f1", Content: content},
-	)
+func TestMatchNewline(t *testing.T) {
+	re, err := syntax.Parse("[^a]a", syntax.ClassNL)
+	if err != nil {
+		t.Fatalf("syntax.Parse: %v", err)
+	}
 
-	q := &query.Regexp{
-		Regexp: mustParseRE("final[,.]"),
+	content := []byte("pqr\nalex")
+	// ----------------0123 4567
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name:    "f1",
+			Content: content,
+		})
+
+	sres := searchForTest(t, b, &query.Regexp{Regexp: re, CaseSensitive: true})
+	if len(sres.Files) != 1 {
+		t.Errorf("got %v, wanted 1 matches", sres.Files)
+	} else if l := sres.Files[0].LineMatches[0].Line; !bytes.Equal(l, content[len("pqr\n"):]) {
+		t.Errorf("got match line %q, want %q", l, content)
 	}
+}
 
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 {
-		t.Fatalf("got %v, want 1 result", res.Files)
+func TestSubRepo(t *testing.T) {
+	subRepos := map[string]*Repository{
+		"sub": {
+			Name:                 "sub-name",
+			LineFragmentTemplate: "sub-line",
+		},
 	}
-	if f := res.Files[0]; len(f.LineMatches) != 1 {
-		t.Fatalf("got line matches %v, want 1 line match", printLineMatches(f.LineMatches))
+
+	content := []byte("pqr\nalex")
+	// ----------------0123 4567
+
+	b := testIndexBuilder(t, &Repository{
+		SubRepoMap: subRepos,
+	}, Document{
+		Name:              "sub/f1",
+		Content:           content,
+		SubRepositoryPath: "sub",
+	})
+
+	sres := searchForTest(t, b, &query.Substring{Pattern: "alex"})
+	if len(sres.Files) != 1 {
+		t.Fatalf("got %v, wanted 1 matches", sres.Files)
 	}
-}
 
-func printLineMatches(ms []LineMatch) string {
-	var ss []string
-	for _, m := range ms {
-		ss = append(ss, fmt.Sprintf("%d:%q %v", m.LineNumber, m.Line, m.LineFragments))
+	f := sres.Files[0]
+	if f.SubRepositoryPath != "sub" || f.SubRepositoryName != "sub-name" {
+		t.Errorf("got %#v, want SubRepository{Path,Name} = {'sub', 'sub-name'}", f)
 	}
 
-	return strings.Join(ss, ", ")
+	if sres.LineFragments["sub-name"] != "sub-line" {
+		t.Errorf("got LineFragmentTemplate %v, want {'sub':'sub-line'}", sres.LineFragments)
+	}
 }
 
-func TestLang(t *testing.T) {
-	content := []byte("bla needle bla")
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{Name: "f1", Content: content},
-		Document{Name: "f2", Language: "java", Content: content},
-		Document{Name: "f3", Language: "cpp", Content: content},
-	)
-
-	q := query.NewAnd(&query.Substring{Pattern: "needle"},
-		&query.Language{Language: "cpp"})
+func TestSubRepoPath(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		SubRepoMap: map[string]*Repository{
+			"third_party/lib": {Name: "lib"},
+			"tools/gen":       {Name: "gen"},
+		},
+	},
+		Document{Name: "main.go", Content: []byte("needle")},
+		Document{Name: "third_party/lib/a.go", Content: []byte("needle"), SubRepositoryPath: "third_party/lib"},
+		Document{Name: "tools/gen/b.go", Content: []byte("needle"), SubRepositoryPath: "tools/gen"})
 
-	res := searchForTest(t, b, q)
+	res := searchForTest(t, b, query.NewAnd(
+		&query.Substring{Pattern: "needle"},
+		&query.SubRepoPath{Prefix: "third_party/"}))
 	if len(res.Files) != 1 {
-		t.Fatalf("got %v, want 1 result in f3", res.Files)
+		t.Fatalf("got %v, want 1 file", res.Files)
 	}
-	f := res.Files[0]
-	if f.FileName != "f3" || f.Language != "cpp" {
-		t.Fatalf("got %v, want 1 match with language cpp", f)
+	if f := res.Files[0]; f.FileName != "third_party/lib/a.go" || f.SubRepositoryName != "lib" {
+		t.Errorf("got %s in sub-repo %q, want third_party/lib/a.go in lib", f.FileName, f.SubRepositoryName)
 	}
 }
 
-func TestLangShortcut(t *testing.T) {
-	content := []byte("bla needle bla")
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{Name: "f2", Language: "java", Content: content},
-		Document{Name: "f3", Language: "cpp", Content: content},
-	)
+func TestSearchEither(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("bla needle bla")},
+		Document{Name: "needle-file-branch", Content: []byte("bla content")})
 
-	q := query.NewAnd(&query.Substring{Pattern: "needle"},
-		&query.Language{Language: "fortran"})
+	sres := searchForTest(t, b, &query.Substring{Pattern: "needle"})
+	if len(sres.Files) != 2 {
+		t.Fatalf("got %v, wanted 2 matches", sres.Files)
+	}
 
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 0 {
-		t.Fatalf("got %v, want 0 results", res.Files)
+	sres = searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	if len(sres.Files) != 1 {
+		t.Fatalf("got %v, wanted 1 match", sres.Files)
 	}
-	if res.Stats.IndexBytesLoaded > 0 {
-		t.Errorf("got IndexBytesLoaded %d, want 0", res.Stats.IndexBytesLoaded)
+
+	if got, want := sres.Files[0].FileName, "f1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
 	}
 }
 
-func TestNoTextMatchAtoms(t *testing.T) {
-	content := []byte("bla needle bla")
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{Name: "f1", Content: content},
-		Document{Name: "f2", Language: "java", Content: content},
-		Document{Name: "f3", Language: "cpp", Content: content},
-	)
-	q := query.NewAnd(&query.Language{Language: "java"})
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 {
-		t.Fatalf("got %v, want 1 result in f3", res.Files)
+func TestFileNameMatch(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("bla needle bla")},
+		Document{Name: "needle-file-branch", Content: []byte("bla content")},
+		Document{Name: "needle-both", Content: []byte("needle")})
+
+	sres := searchForTest(t, b, &query.Substring{Pattern: "needle"})
+	got := map[string]bool{}
+	for _, f := range sres.Files {
+		got[f.FileName] = f.FileNameMatch
+	}
+	want := map[string]bool{
+		"f1":                 false,
+		"needle-file-branch": true,
+		"needle-both":        false,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Without text atoms nothing matched the file name.
+	sres = searchForTest(t, b, &query.Const{Value: true})
+	for _, f := range sres.Files {
+		if f.FileNameMatch {
+			t.Errorf("%s: got FileNameMatch for a query without text", f.FileName)
+		}
 	}
 }
 
-func TestNoPositiveAtoms(t *testing.T) {
-	content := []byte("bla needle bla")
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{Name: "f1", Content: content},
-		Document{Name: "f2", Content: content},
-	)
+func TestUnicodeExactMatch(t *testing.T) {
+	needle := "néédlÉ"
+	content := []byte("blá blá " + needle + " blâ")
+	// ----------------01234567    8
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: content})
 
-	q := query.NewAnd(
-		&query.Not{Child: &query.Substring{Pattern: "xyz"}},
-		&query.Repo{Regexp: regexp.MustCompile("reponame")})
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 2 {
-		t.Fatalf("got %v, want 2 results in f3", res.Files)
+	if res := searchForTest(t, b, &query.Substring{Pattern: needle, CaseSensitive: true}); len(res.Files) != 1 {
+		t.Fatalf("case sensitive: got %v, wanted 1 match", res.Files)
 	}
 }
 
-func TestSymbolBoundaryStart(t *testing.T) {
-	content := []byte("start\nbla bla\nend")
-	// ----------------012345 67890123 456
+func TestUnicodeCoverContent(t *testing.T) {
+	needle := "néédlÉ"
+	content := []byte("blá blá " + needle + " blâ")
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: content})
 
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{
-			Name:    "f1",
-			Content: content,
-			Symbols: []DocumentSection{{0, 5}, {14, 17}},
-		},
-	)
-	q := &query.Symbol{
-		Expr: &query.Substring{Pattern: "start"},
+	if res := searchForTest(t, b, &query.Substring{Pattern: "NÉÉDLÉ", CaseSensitive: true}); len(res.Files) != 0 {
+		t.Fatalf("case sensitive: got %v, wanted 0 match", res.Files)
 	}
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
-		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "NÉÉDLÉ"})
+	if len(res.Files) != 1 {
+		t.Fatalf("case insensitive: got %v, wanted 1 match", res.Files)
 	}
-	m := res.Files[0].LineMatches[0].LineFragments[0]
-	if m.Offset != 0 {
-		t.Fatalf("got offset %d want 0", m.Offset)
+
+	if got, want := res.Files[0].LineMatches[0].LineFragments[0].Offset, uint32(strings.Index(string(content), needle)); got != want {
+		t.Errorf("got %d want %d", got, want)
 	}
 }
 
-func TestSymbolBoundaryEnd(t *testing.T) {
-	content := []byte("start\nbla bla\nend")
-	// ----------------012345 67890123 456
+func TestUnicodeNonCoverContent(t *testing.T) {
+	needle := "nééáádlÉ"
+	//---------01234567
+	content := []byte("blá blá " + needle + " blâ")
+	// ----------------01234567    8901234   5678
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: content})
 
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{
-			Name:    "f1",
-			Content: content,
-			Symbols: []DocumentSection{{14, 17}},
-		},
-	)
-	q := &query.Symbol{
-		Expr: &query.Substring{Pattern: "end"},
+	res := searchForTest(t, b, &query.Substring{Pattern: "NÉÉÁÁDLÉ", Content: true})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, wanted 1 match", res.Files)
 	}
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
-		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+
+	if got, want := res.Files[0].LineMatches[0].LineFragments[0].Offset, uint32(strings.Index(string(content), needle)); got != want {
+		t.Errorf("got %d want %d", got, want)
 	}
-	m := res.Files[0].LineMatches[0].LineFragments[0]
-	if m.Offset != 14 {
-		t.Fatalf("got offset %d want 0", m.Offset)
+}
+
+const kelvinCodePoint = 8490
+
+func TestUnicodeVariableLength(t *testing.T) {
+	lower := 'k'
+	upper := rune(kelvinCodePoint)
+
+	needle := "nee" + string([]rune{lower}) + "eed"
+	corpus := []byte("nee" + string([]rune{upper}) + "eed" +
+		" ee" + string([]rune{lower}) + "ee" +
+		" ee" + string([]rune{upper}) + "ee")
+
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte(corpus)})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: needle, Content: true})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, wanted 1 match", res.Files)
 	}
 }
 
-func TestSymbolSubstring(t *testing.T) {
-	content := []byte("bla\nsymblabla\nbla")
-	// ----------------0123 456789012
+func TestUnicodeHighCodePoints(t *testing.T) {
+	// Runes of the supplementary planes use all 21 bits of an
+	// ngram's rune slot.
+	tripleRunes := [ngramSize]rune{0x10FFFF, 0x1F600, 0x20000}
+	otherRunes := [ngramSize]rune{0x10FFFE, 0x1F600, 0x20000}
+	if runesToNGram(tripleRunes) == runesToNGram(otherRunes) {
+		t.Fatalf("ngrams for %q and %q collide", tripleRunes, otherRunes)
+	}
+	triple, other := string(tripleRunes[:]), string(otherRunes[:])
 
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{
-			Name:    "f1",
-			Content: content,
-			Symbols: []DocumentSection{{4, 12}},
-		},
-	)
-	q := &query.Symbol{
-		Expr: &query.Substring{Pattern: "bla"},
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("x" + triple + "y")})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: triple, Content: true})
+	if len(res.Files) != 1 {
+		t.Errorf("got %v, want 1 match", res.Files)
 	}
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
-		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+	res = searchForTest(t, b, &query.Substring{Pattern: other, Content: true})
+	if len(res.Files) != 0 {
+		t.Errorf("got %v for %q, want no matches", res.Files, other)
 	}
-	m := res.Files[0].LineMatches[0].LineFragments[0]
-	if m.Offset != 7 || m.MatchLength != 3 {
-		t.Fatalf("got offset %d, size %d want 7 size 3", m.Offset, m.MatchLength)
+	if res.Stats.NgramMatches != 0 {
+		t.Errorf("got %d ngram matches for %q, want 0", res.Stats.NgramMatches, other)
 	}
 }
 
-func TestSymbolSubstringExact(t *testing.T) {
-	content := []byte("bla\nsym\nbla\nsym\nasymb")
-	// ----------------0123 4567 89012
-
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+func TestUnicodeFileStartOffsets(t *testing.T) {
+	unicode := "世界"
+	wat := "waaaaaat"
+	b := testIndexBuilder(t, nil,
 		Document{
 			Name:    "f1",
-			Content: content,
-			Symbols: []DocumentSection{{4, 7}},
+			Content: []byte(unicode),
+		},
+		Document{
+			Name:    "f2",
+			Content: []byte(wat),
 		},
 	)
-	q := &query.Symbol{
-		Expr: &query.Substring{Pattern: "sym"},
-	}
+	q := &query.Substring{Pattern: wat, Content: true}
 	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
-		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
-	}
-	m := res.Files[0].LineMatches[0].LineFragments[0]
-	if m.Offset != 4 {
-		t.Fatalf("got offset %d, want 7", m.Offset)
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, wanted 1 match", res.Files)
 	}
 }
 
-func TestSymbolRegexpExact(t *testing.T) {
-	content := []byte("blah\nbla\nbl")
-	// ----------------01234 5678 90
+func TestLongFileUTF8(t *testing.T) {
+	needle := "neeedle"
 
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+	// 6 bytes.
+	unicode := "世界"
+	content := []byte(strings.Repeat(unicode, 100) + needle)
+	b := testIndexBuilder(t, nil,
 		Document{
 			Name:    "f1",
-			Content: content,
-			Symbols: []DocumentSection{{0, 4}, {5, 8}, {9, 11}},
+			Content: []byte(strings.Repeat("a", 50)),
 		},
-	)
-	q := &query.Symbol{
-		Expr: &query.Regexp{Regexp: mustParseRE("^bla$")},
-	}
+		Document{
+			Name:    "f2",
+			Content: content,
+		})
+
+	q := &query.Substring{Pattern: needle, Content: true}
 	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
-		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
-	}
-	m := res.Files[0].LineMatches[0].LineFragments[0]
-	if m.Offset != 5 {
-		t.Fatalf("got offset %d, want 5", m.Offset)
+	if len(res.Files) != 1 {
+		t.Errorf("got %v, want 1 result", res)
 	}
 }
 
-func TestSymbolRegexpPartial(t *testing.T) {
-	content := []byte("abcdef")
-	// ----------------012345
-
+func TestEstimateDocCount(t *testing.T) {
+	content := []byte("bla needle bla")
 	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{
-			Name:    "f1",
-			Content: content,
-			Symbols: []DocumentSection{{0, 6}},
-		},
+		Document{Name: "f1", Content: content},
+		Document{Name: "f2", Content: content},
 	)
-	q := &query.Symbol{
-		Expr: &query.Regexp{Regexp: mustParseRE("(b|d)c(d|b)")},
-	}
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
-		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
-	}
-	m := res.Files[0].LineMatches[0].LineFragments[0]
-	if m.Offset != 1 {
-		t.Fatalf("got offset %d, want 1", m.Offset)
+
+	if sres := searchForTest(t, b,
+		query.NewAnd(
+			&query.Substring{Pattern: "needle"},
+			&query.Repo{Regexp: regexp.MustCompile("reponame")},
+		), SearchOptions{
+			EstimateDocCount: true,
+		}); sres.Stats.ShardFilesConsidered != 2 {
+		t.Errorf("got FilesConsidered = %d, want 2", sres.Stats.FilesConsidered)
 	}
-	if m.MatchLength != 3 {
-		t.Fatalf("got match length %d, want 3", m.MatchLength)
+	if sres := searchForTest(t, b,
+		query.NewAnd(
+			&query.Substring{Pattern: "needle"},
+			&query.Repo{Regexp: regexp.MustCompile("nomatch")},
+		), SearchOptions{
+			EstimateDocCount: true,
+		}); sres.Stats.ShardFilesConsidered != 0 {
+		t.Errorf("got FilesConsidered = %d, want 0", sres.Stats.FilesConsidered)
 	}
 }
 
-func TestSymbolRegexpAll(t *testing.T) {
-	docs := []Document{
+func TestUTF8CorrectCorpus(t *testing.T) {
+	needle := "neeedle"
+
+	// 6 bytes.
+	unicode := "世界"
+	b := testIndexBuilder(t, nil,
 		Document{
 			Name:    "f1",
-			Content: []byte("Hello Zoekt"),
-			Symbols: []DocumentSection{{0, 5}, {6, 11}},
+			Content: []byte(strings.Repeat(unicode, 100)),
 		},
 		Document{
-			Name:    "f2",
-			Content: []byte("Second Zoekt Third"),
-			Symbols: []DocumentSection{{0, 6}, {7, 12}, {13, 18}},
-		},
-	}
-
-	b := testIndexBuilder(t, &Repository{Name: "reponame"}, docs...)
+			Name:    "xxxxxneeedle",
+			Content: []byte("hello"),
+		})
+
+	q := &query.Substring{Pattern: needle, FileName: true}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 {
+		t.Errorf("got %v, want 1 result", res)
+	}
+}
+
+func TestBuilderStats(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name:    "f1",
+			Content: []byte(strings.Repeat("abcd", 1024)),
+		})
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := b.ContentSize(), uint32(2+4*1024); got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
+
+func TestIOStats(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name:    "f1",
+			Content: []byte(strings.Repeat("abcd", 1024)),
+		})
+
+	q := &query.Substring{Pattern: "abc", CaseSensitive: true, Content: true}
+	res := searchForTest(t, b, q)
+
+	// 4096 (content) + 2 (overhead: newlines or doc sections)
+	if got, want := res.Stats.ContentBytesLoaded, int64(4098); got != want {
+		t.Errorf("got content I/O %d, want %d", got, want)
+	}
+
+	// 1024 entries, each 4 bytes apart. 4 fits into single byte
+	// delta encoded.
+	if got, want := res.Stats.IndexBytesLoaded, int64(1024); got != want {
+		t.Errorf("got index I/O %d, want %d", got, want)
+	}
+}
+
+func TestSymbolIOStats(t *testing.T) {
+	content := []byte("func needle() {}\n" + strings.Repeat("abcd\n", 1024))
+	// ----------------01234567890
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name:    "f1",
+			Content: content,
+			Symbols: []DocumentSection{{5, 11}},
+		})
+
+	for _, q := range []query.Q{
+		&query.Symbol{Expr: &query.Substring{Pattern: "needle", Content: true}},
+		&query.Symbol{Expr: &query.Regexp{Regexp: mustParseRE("ne+dle"), Content: true}},
+	} {
+		res := searchForTest(t, b, q)
+		if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+			t.Fatalf("%s: got %v, want 1 match", q, res.Files)
+		}
+		if got, want := string(res.Files[0].LineMatches[0].Line), "func needle() {}"; got != want {
+			t.Errorf("%s: got line %q, want %q", q, got, want)
+		}
+		if got := res.Stats.ContentBytesLoaded; got >= int64(len(content)) {
+			t.Errorf("%s: got content I/O %d, want less than %d", q, got, len(content))
+		}
+	}
+}
+
+func TestLineMax(t *testing.T) {
+	content := []byte("first line\n" + strings.Repeat("abcdefghi ", 10*1024) + "needle " + strings.Repeat("x", 1000) + "\nlast line\n")
+	b := testIndexBuilder(t, nil)
+	b.LineMax = 100
+	if err := b.Add(Document{Name: "f1", Content: content}); err != nil {
+		t.Fatal(err)
+	}
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 match", res.Files)
+	}
+
+	m := res.Files[0].LineMatches[0]
+	if len(m.Line) > b.LineMax {
+		t.Errorf("got line of %d bytes, want at most %d", len(m.Line), b.LineMax)
+	}
+	if m.LineNumber != 2 {
+		t.Errorf("got line number %d, want 2", m.LineNumber)
+	}
+	if got := string(content[m.LineStart:m.LineEnd]); got != string(m.Line) {
+		t.Errorf("got line %q, want %q", m.Line, got)
+	}
+	f := m.LineFragments[0]
+	if got := string(content[f.Offset : f.Offset+uint32(f.MatchLength)]); got != "needle" {
+		t.Errorf("got match %q at offset %d, want %q", got, f.Offset, "needle")
+	}
+	if got, want := m.LineStart+f.LineOffset, int(f.Offset); got != want {
+		t.Errorf("got line offset %d, want %d", got, want)
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "last", Content: true})
+	if len(res.Files) != 1 || res.Files[0].LineMatches[0].LineNumber != 3 {
+		t.Errorf("got %v, want a match on line 3", res.Files)
+	}
+
+	// The wrap points are not newlines.
+	s := searcherForTest(t, b)
+	rl, err := s.List(context.Background(), &query.Const{Value: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rl.Repos[0].Stats.NewLinesCount; got != 3 {
+		t.Errorf("got NewLinesCount %d, want 3", got)
+	}
+}
+
+func TestLineMaxWrap(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		content string
+		pattern string
+	}{
+		// No space to wrap at: the wrap must not split a rune,
+		// and no byte may be lost at the wrap point.
+		{"runes", strings.Repeat("ééa", 100), "aé"},
+		// A match that spans a wrap point.
+		{"spanning", strings.Repeat("a", 90) + " needle needle " + strings.Repeat("b", 200), "needle needle"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			content := []byte(c.content)
+			b := testIndexBuilder(t, nil)
+			b.LineMax = 100
+			if err := b.Add(Document{Name: "f1", Content: content}); err != nil {
+				t.Fatal(err)
+			}
+
+			res := searchForTest(t, b, &query.Substring{Pattern: c.pattern, Content: true})
+			if len(res.Files) != 1 {
+				t.Fatalf("got %v, want 1 file", res.Files)
+			}
+
+			var fragments int
+			for _, m := range res.Files[0].LineMatches {
+				if len(m.Line) > 2*b.LineMax {
+					t.Errorf("got line of %d bytes, want a bounded line", len(m.Line))
+				}
+				if !utf8.Valid(m.Line) {
+					t.Errorf("got line %q, want valid UTF-8", m.Line)
+				}
+				if got := string(content[m.LineStart:m.LineEnd]); got != string(m.Line) {
+					t.Errorf("got line %q, want %q", m.Line, got)
+				}
+				for _, f := range m.LineFragments {
+					if got := string(m.Line[f.LineOffset : f.LineOffset+f.MatchLength]); got != c.pattern {
+						t.Errorf("got match %q, want %q", got, c.pattern)
+					}
+					fragments++
+				}
+			}
+			if want := strings.Count(c.content, c.pattern); fragments != want {
+				t.Errorf("got %d matches, want %d", fragments, want)
+			}
+		})
+	}
+}
+
+func TestPenalizedPaths(t *testing.T) {
+	content := []byte("func needle() {}")
+	b := testIndexBuilder(t, nil,
+		Document{Name: "foo_test.go", Content: content},
+		Document{Name: "foo.go", Content: content},
+	)
+	s := searcherForTest(t, b)
+
+	scores := func(opts *SearchOptions) map[string]float64 {
+		t.Helper()
+		res, err := s.Search(context.Background(), &query.Substring{Pattern: "needle"}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := map[string]float64{}
+		for _, f := range res.Files {
+			m[f.FileName] = f.Score
+		}
+		return m
+	}
+
+	// Without the penalty, the earlier document wins.
+	got := scores(&SearchOptions{})
+	if got["foo_test.go"] <= got["foo.go"] {
+		t.Errorf("got scores %v, want foo_test.go first", got)
+	}
+
+	got = scores(&SearchOptions{PenalizedPaths: []string{`_test\.go$`, `(^|/)vendor/`}})
+	if len(got) != 2 {
+		t.Fatalf("got %v, want 2 files", got)
+	}
+	if got["foo_test.go"] >= got["foo.go"] {
+		t.Errorf("got scores %v, want foo.go first", got)
+	}
+
+	if _, err := s.Search(context.Background(), &query.Substring{Pattern: "needle"}, &SearchOptions{PenalizedPaths: []string{"("}}); err == nil {
+		t.Errorf("got nil error for invalid pattern")
+	}
+}
+
+func TestLimitReason(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("needle")},
+		Document{Name: "f2", Content: []byte("needle")},
+	)
+	s := searcherForTest(t, b)
+	// The regexp is not a plain substring, so it is evaluated on the
+	// file contents.
+	q := &query.Regexp{Regexp: mustParseRE("ne+dle"), Content: true}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	cases := []struct {
+		name string
+		ctx  context.Context
+		opts SearchOptions
+		want LimitReason
+	}{
+		{"none", context.Background(), SearchOptions{}, ""},
+		{"max matches", context.Background(), SearchOptions{ShardMaxMatchCount: 1}, LimitMaxMatches},
+		{"max bytes", context.Background(), SearchOptions{ShardMaxContentBytes: 1}, LimitMaxBytes},
+		{"regexp budget", context.Background(), SearchOptions{ShardMaxRegexpsConsidered: 1}, LimitRegexpBudget},
+		{"deadline", expired, SearchOptions{}, LimitDeadline},
+	}
+	for _, c := range cases {
+		res, err := s.Search(c.ctx, q, &c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.LimitReason != c.want {
+			t.Errorf("%s: got limit reason %q, want %q", c.name, res.LimitReason, c.want)
+		}
+	}
+}
+
+func TestSymbolNgramIndex(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("func needle() {}"), Symbols: []DocumentSection{{5, 11}}},
+		Document{Name: "f2", Content: []byte("x := needle()"), Symbols: []DocumentSection{{0, 1}}},
+		Document{Name: "f3", Content: []byte("class Needle {}"), Symbols: []DocumentSection{{6, 12}}})
+
+	for _, c := range []struct {
+		q    *query.Substring
+		want []string
+	}{
+		{&query.Substring{Pattern: "needle", Content: true}, []string{"f1", "f3"}},
+		{&query.Substring{Pattern: "Needle", Content: true, CaseSensitive: true}, []string{"f3"}},
+		{&query.Substring{Pattern: "haystack", Content: true}, nil},
+	} {
+		res := searchForTest(t, b, &query.Symbol{Expr: c.q})
+		if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.q, got, c.want)
+		}
+		// f2 has needle in its content, but not in a symbol, so the
+		// symbol ngram index skips it.
+		if res.Stats.FilesConsidered != len(c.want) {
+			t.Errorf("%s: got %d files considered, want %d", c.q, res.Stats.FilesConsidered, len(c.want))
+		}
+	}
+}
+
+func TestStartLineAnchor(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name: "f1",
+			Content: []byte(
+				`hello
+start of middle of line
+`),
+		})
+
+	q, err := query.Parse("^start")
+	if err != nil {
+		t.Errorf("parse: %v", err)
+	}
+
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 {
+		t.Errorf("got %v, want 1 file", res.Files)
+	}
+
+	q, err = query.Parse("^middle")
+	if err != nil {
+		t.Errorf("parse: %v", err)
+	}
+	res = searchForTest(t, b, q)
+	if len(res.Files) != 0 {
+		t.Errorf("got %v, want 0 files", res.Files)
+	}
+}
+
+func TestAndOrUnicode(t *testing.T) {
+	q, err := query.Parse("orange.*apple")
+	if err != nil {
+		t.Errorf("parse: %v", err)
+	}
+	finalQ := query.NewAnd(q,
+		query.NewOr(query.NewAnd(&query.Repo{Regexp: regexp.MustCompile("name")},
+			query.NewOr(&query.Branch{Pattern: "master"}))))
+
+	b := testIndexBuilder(t, &Repository{
+		Name:     "name",
+		Branches: []RepositoryBranch{{"master", "master-version"}},
+	}, Document{
+		Name:    "f2",
+		Content: []byte("orange\u2318apple"),
+		// --------------0123456     78901
+		Branches: []string{"master"},
+	})
+
+	res := searchForTest(t, b, finalQ)
+	if len(res.Files) != 1 {
+		t.Errorf("got %v, want 1 result", res.Files)
+	}
+}
+
+func TestAndShort(t *testing.T) {
+	content := []byte("bla needle at orange bla")
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: content},
+		Document{Name: "f2", Content: []byte("xx at xx")},
+		Document{Name: "f3", Content: []byte("yy orange xx")},
+	)
+
+	q := query.NewAnd(&query.Substring{Pattern: "at"},
+		&query.Substring{Pattern: "orange"})
+
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || res.Files[0].FileName != "f1" {
+		t.Errorf("got %v, want 1 result", res.Files)
+	}
+}
+
+func TestNoCollectRegexpSubstring(t *testing.T) {
+	content := []byte("bla final bla\nfoo final, foo")
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: content},
+	)
+
+	q := &query.Regexp{
+		Regexp: mustParseRE("final[,.]"),
+	}
+
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 result", res.Files)
+	}
+	if f := res.Files[0]; len(f.LineMatches) != 1 {
+		t.Fatalf("got line matches %v, want 1 line match", printLineMatches(f.LineMatches))
+	}
+}
+
+func TestFragmentAbsoluteRanges(t *testing.T) {
+	content := []byte("héllo wörld\nsecond wörld\nthird")
+	b := testIndexBuilder(t, nil, Document{Name: "dir/wörld.txt", Content: content})
+
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "wörld"},
+		&query.Regexp{Regexp: mustParseRE("wörld\nsec"), Content: true},
+		&query.Regexp{Regexp: mustParseRE("ö.*\n.*ö"), Content: true},
+	} {
+		res := searchForTest(t, b, q, SearchOptions{Whole: true})
+		if len(res.Files) != 1 {
+			t.Fatalf("%s: got %v, want 1 file", q, res.Files)
+		}
+		f := res.Files[0]
+		n := 0
+		for _, l := range f.LineMatches {
+			data := content
+			if l.FileName {
+				data = []byte(f.FileName)
+			}
+			for _, m := range l.LineFragments {
+				n++
+				abs := string(data[m.Offset:m.End()])
+				if rel := string(l.Line[m.LineOffset : m.LineOffset+m.MatchLength]); abs != rel {
+					t.Errorf("%s: absolute range gives %q, line range gives %q", q, abs, rel)
+				}
+			}
+		}
+		if n == 0 {
+			t.Errorf("%s: got no fragments", q)
+		}
+	}
+}
+
+func TestRegexpAllMatchesOnLine(t *testing.T) {
+	content := []byte("bla final. and final, bla\nfoo final")
+	// ----------------01234567890123456789
+	b := testIndexBuilder(t, nil, Document{Name: "f1", Content: content})
+
+	res := searchForTest(t, b, &query.Regexp{Regexp: mustParseRE("final[,.]"), Content: true})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line match", res.Files)
+	}
+	var got []int
+	for _, f := range res.Files[0].LineMatches[0].LineFragments {
+		got = append(got, f.LineOffset)
+	}
+	if want := []int{4, 15}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got fragments at %v, want %v", got, want)
+	}
+}
+
+func printLineMatches(ms []LineMatch) string {
+	var ss []string
+	for _, m := range ms {
+		ss = append(ss, fmt.Sprintf("%d:%q %v", m.LineNumber, m.Line, m.LineFragments))
+	}
+
+	return strings.Join(ss, ", ")
+}
+
+func TestLang(t *testing.T) {
+	content := []byte("bla needle bla")
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: content},
+		Document{Name: "f2", Language: "java", Content: content},
+		Document{Name: "f3", Language: "cpp", Content: content},
+	)
+
+	q := query.NewAnd(&query.Substring{Pattern: "needle"},
+		&query.Language{Language: "cpp"})
+
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 result in f3", res.Files)
+	}
+	f := res.Files[0]
+	if f.FileName != "f3" || f.Language != "cpp" {
+		t.Fatalf("got %v, want 1 match with language cpp", f)
+	}
+}
+
+func TestLangWithoutLanguageQuery(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f.cpp", Language: "cpp", Content: []byte("bla needle bla")},
+	)
+
+	q := &query.Substring{Pattern: "needle"}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || res.Files[0].Language != "cpp" {
+		t.Fatalf("got %v, want 1 match with language cpp", res.Files)
+	}
+
+	res = searchForTest(t, b, q, SearchOptions{SkipLanguage: true})
+	if len(res.Files) != 1 || res.Files[0].Language != "" {
+		t.Fatalf("got %v, want 1 match without language", res.Files)
+	}
+}
+
+func TestFileNames(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("bla needle bla")},
+		Document{Name: "f2.java", Language: "java", Content: []byte("bla")},
+		Document{Name: "f3.cpp", Language: "cpp", Content: []byte("needle")},
+	)
+	d := searcherForTest(t, b).(*indexData)
+
+	cases := []struct {
+		q    query.Q
+		want []string
+	}{
+		{&query.Const{Value: true}, []string{"f1", "f2.java", "f3.cpp"}},
+		{&query.Language{Language: "cpp"}, []string{"f3.cpp"}},
+		{&query.Substring{Pattern: "f2", FileName: true}, []string{"f2.java"}},
+		{&query.Repo{Regexp: regexp.MustCompile("banana")}, nil},
+	}
+	for _, c := range cases {
+		var stats Stats
+		got, err := d.fileNames(context.Background(), c.q, &stats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.q, got, c.want)
+		}
+		if stats.ContentBytesLoaded != 0 {
+			t.Errorf("%s: got ContentBytesLoaded %d, want 0", c.q, stats.ContentBytesLoaded)
+		}
+	}
+
+	got, err := d.FileNames(context.Background(), &query.Substring{Pattern: "needle", Content: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"f1", "f3.cpp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFileNamesLazyOr(t *testing.T) {
+	var docs []Document
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("match%d", i)
+		if i == 0 {
+			name = "other"
+		}
+		docs = append(docs, Document{
+			Name:    name,
+			Content: []byte(strings.Repeat("bla ", 100) + "needle"),
+		})
+	}
+	b := testIndexBuilder(t, nil, docs...)
+	d := searcherForTest(t, b).(*indexData)
+
+	q := query.NewOr(
+		&query.Substring{Pattern: "match", FileName: true},
+		&query.Substring{Pattern: "needle", Content: true})
+
+	var stats Stats
+	got, err := d.fileNames(context.Background(), q, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(docs) {
+		t.Errorf("got %v, want all %d files", got, len(docs))
+	}
+	// The content child is skipped once for each file matching by
+	// name.
+	if got, want := stats.OrChildrenSkipped, len(docs)-1; got != want {
+		t.Errorf("got OrChildrenSkipped %d, want %d", got, want)
+	}
+	if got, want := stats.OrContentBytesSkipped, int64((len(docs)-1)*len(docs[1].Content)); got != want {
+		t.Errorf("got OrContentBytesSkipped %d, want %d", got, want)
+	}
+
+	res := searchForTest(t, b, q)
+	if len(res.Files) != len(docs) {
+		t.Errorf("Search: got %d files, want %d", len(res.Files), len(docs))
+	}
+	if res.Stats.OrChildrenSkipped != 0 {
+		t.Errorf("Search: got OrChildrenSkipped %d, want 0", res.Stats.OrChildrenSkipped)
+	}
+	if stats.ContentBytesLoaded >= res.Stats.ContentBytesLoaded {
+		t.Errorf("got ContentBytesLoaded %d, want less than %d for Search",
+			stats.ContentBytesLoaded, res.Stats.ContentBytesLoaded)
+	}
+}
+
+func TestFeatureVersion(t *testing.T) {
+	b := testIndexBuilder(t, nil, Document{Name: "f1", Content: []byte("needle")})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle"})
+	if res.FeatureVersion != FeatureVersion {
+		t.Errorf("got FeatureVersion %d, want %d", res.FeatureVersion, FeatureVersion)
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "banana"})
+	if res.FeatureVersion != FeatureVersion {
+		t.Errorf("no matches: got FeatureVersion %d, want %d", res.FeatureVersion, FeatureVersion)
+	}
+}
+
+func TestLangShortcut(t *testing.T) {
+	content := []byte("bla needle bla")
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f2", Language: "java", Content: content},
+		Document{Name: "f3", Language: "cpp", Content: content},
+	)
+
+	q := query.NewAnd(&query.Substring{Pattern: "needle"},
+		&query.Language{Language: "fortran"})
+
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 0 {
+		t.Fatalf("got %v, want 0 results", res.Files)
+	}
+	if res.Stats.IndexBytesLoaded > 0 {
+		t.Errorf("got IndexBytesLoaded %d, want 0", res.Stats.IndexBytesLoaded)
+	}
+}
+
+func TestNoTextMatchAtoms(t *testing.T) {
+	content := []byte("bla needle bla")
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: content},
+		Document{Name: "f2", Language: "java", Content: content},
+		Document{Name: "f3", Language: "cpp", Content: content},
+	)
+	q := query.NewAnd(&query.Language{Language: "java"})
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 result in f3", res.Files)
+	}
+}
+
+func TestNoPositiveAtoms(t *testing.T) {
+	content := []byte("bla needle bla")
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: content},
+		Document{Name: "f2", Content: content},
+	)
+
+	q := query.NewAnd(
+		&query.Not{Child: &query.Substring{Pattern: "xyz"}},
+		&query.Repo{Regexp: regexp.MustCompile("reponame")})
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 2 {
+		t.Fatalf("got %v, want 2 results in f3", res.Files)
+	}
+}
+
+func TestTopLevelNot(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("bla needle bla")},
+		Document{Name: "f2", Content: []byte("bla xyz bla")},
+		Document{Name: "f3", Content: []byte("needle")},
+	)
+
+	for pat, want := range map[string][]string{
+		"xyz":    {"f1", "f3"},
+		"needle": {"f2"},
+		// Not in the shard at all, so the child is pruned.
+		"banana": {"f1", "f2", "f3"},
+	} {
+		q := &query.Not{Child: &query.Substring{Pattern: pat}}
+		res := searchForTest(t, b, q)
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestSymbolBoundaryStart(t *testing.T) {
+	content := []byte("start\nbla bla\nend")
+	// ----------------012345 67890123 456
+
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{
+			Name:    "f1",
+			Content: content,
+			Symbols: []DocumentSection{{0, 5}, {14, 17}},
+		},
+	)
+	q := &query.Symbol{
+		Expr: &query.Substring{Pattern: "start"},
+	}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+	}
+	m := res.Files[0].LineMatches[0].LineFragments[0]
+	if m.Offset != 0 {
+		t.Fatalf("got offset %d want 0", m.Offset)
+	}
+}
+
+func TestSymbolBoundaryEnd(t *testing.T) {
+	content := []byte("start\nbla bla\nend")
+	// ----------------012345 67890123 456
+
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{
+			Name:    "f1",
+			Content: content,
+			Symbols: []DocumentSection{{14, 17}},
+		},
+	)
+	q := &query.Symbol{
+		Expr: &query.Substring{Pattern: "end"},
+	}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+	}
+	m := res.Files[0].LineMatches[0].LineFragments[0]
+	if m.Offset != 14 {
+		t.Fatalf("got offset %d want 0", m.Offset)
+	}
+}
+
+func TestSymbolSubstring(t *testing.T) {
+	content := []byte("bla\nsymblabla\nbla")
+	// ----------------0123 456789012
+
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{
+			Name:    "f1",
+			Content: content,
+			Symbols: []DocumentSection{{4, 12}},
+		},
+	)
+	q := &query.Symbol{
+		Expr: &query.Substring{Pattern: "bla"},
+	}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+	}
+	m := res.Files[0].LineMatches[0].LineFragments[0]
+	if m.Offset != 7 || m.MatchLength != 3 {
+		t.Fatalf("got offset %d, size %d want 7 size 3", m.Offset, m.MatchLength)
+	}
+}
+
+func TestSymbolSubstringExact(t *testing.T) {
+	content := []byte("bla\nsym\nbla\nsym\nasymb")
+	// ----------------0123 4567 89012
+
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{
+			Name:    "f1",
+			Content: content,
+			Symbols: []DocumentSection{{4, 7}},
+		},
+	)
+	q := &query.Symbol{
+		Expr: &query.Substring{Pattern: "sym"},
+	}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+	}
+	m := res.Files[0].LineMatches[0].LineFragments[0]
+	if m.Offset != 4 {
+		t.Fatalf("got offset %d, want 7", m.Offset)
+	}
+}
+
+func TestSymbolRegexpExact(t *testing.T) {
+	content := []byte("blah\nbla\nbl")
+	// ----------------01234 5678 90
+
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{
+			Name:    "f1",
+			Content: content,
+			Symbols: []DocumentSection{{0, 4}, {5, 8}, {9, 11}},
+		},
+	)
+	q := &query.Symbol{
+		Expr: &query.Regexp{Regexp: mustParseRE("^bla$")},
+	}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+	}
+	m := res.Files[0].LineMatches[0].LineFragments[0]
+	if m.Offset != 5 {
+		t.Fatalf("got offset %d, want 5", m.Offset)
+	}
+}
+
+func TestSymbolRegexpPartial(t *testing.T) {
+	content := []byte("abcdef")
+	// ----------------012345
+
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{
+			Name:    "f1",
+			Content: content,
+			Symbols: []DocumentSection{{0, 6}},
+		},
+	)
+	q := &query.Symbol{
+		Expr: &query.Regexp{Regexp: mustParseRE("(b|d)c(d|b)")},
+	}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+	}
+	m := res.Files[0].LineMatches[0].LineFragments[0]
+	if m.Offset != 1 {
+		t.Fatalf("got offset %d, want 1", m.Offset)
+	}
+	if m.MatchLength != 3 {
+		t.Fatalf("got match length %d, want 3", m.MatchLength)
+	}
+}
+
+func TestSymbolRegexpAll(t *testing.T) {
+	docs := []Document{
+		Document{
+			Name:    "f1",
+			Content: []byte("Hello Zoekt"),
+			Symbols: []DocumentSection{{0, 5}, {6, 11}},
+		},
+		Document{
+			Name:    "f2",
+			Content: []byte("Second Zoekt Third"),
+			Symbols: []DocumentSection{{0, 6}, {7, 12}, {13, 18}},
+		},
+	}
+
+	b := testIndexBuilder(t, &Repository{Name: "reponame"}, docs...)
 	q := &query.Symbol{
 		Expr: &query.Regexp{Regexp: mustParseRE(".*")},
 	}
-	res := searchForTest(t, b, q)
-	if len(res.Files) != len(docs) {
-		t.Fatalf("got %v, want %d file", res.Files, len(docs))
+	res := searchForTest(t, b, q)
+	if len(res.Files) != len(docs) {
+		t.Fatalf("got %v, want %d file", res.Files, len(docs))
+	}
+	for i, want := range docs {
+		got := res.Files[i].LineMatches[0].LineFragments
+		if len(got) != len(want.Symbols) {
+			t.Fatalf("got %d symbols, want %d symbols in doc %s", len(got), len(want.Symbols), want.Name)
+		}
+
+		for j, sec := range want.Symbols {
+			if sec.Start != got[j].Offset {
+				t.Fatalf("got offset %d, want %d in doc %s", got[j].Offset, sec.Start, want.Name)
+			}
+		}
+	}
+}
+
+func TestHitIterTerminate(t *testing.T) {
+	// contrived input: trigram frequencies forces selecting abc +
+	// def for the distance iteration. There is no match, so this
+	// will advance the compressedPostingIterator to beyond the
+	// end.
+	content := []byte("abc bcdbcd cdecde abcabc def efg")
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name:    "f1",
+			Content: content,
+		},
+	)
+	searchForTest(t, b, &query.Substring{Pattern: "abcdef"})
+}
+
+func TestDistanceHitIterBailLast(t *testing.T) {
+	content := []byte("AST AST AST UASH")
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name:    "f1",
+			Content: content,
+		},
+	)
+	res := searchForTest(t, b, &query.Substring{Pattern: "UAST"})
+	if len(res.Files) != 0 {
+		t.Fatalf("got %v, want no results", res.Files)
+	}
+}
+
+func TestDocumentSectionRuneBoundary(t *testing.T) {
+	content := string([]rune{kelvinCodePoint, kelvinCodePoint, kelvinCodePoint})
+	b, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+
+	for i, sec := range []DocumentSection{
+		{2, 6},
+		{3, 7},
+	} {
+		if err := b.Add(Document{
+			Name:    "f1",
+			Content: []byte(content),
+			Symbols: []DocumentSection{sec},
+		}); err == nil {
+			t.Errorf("%d: Add succeeded", i)
+		}
+	}
+}
+
+func TestUnicodeQuery(t *testing.T) {
+	content := string([]rune{kelvinCodePoint, kelvinCodePoint, kelvinCodePoint})
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name:    "f1",
+			Content: []byte(content),
+		},
+	)
+
+	q := &query.Substring{Pattern: content}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 {
+		t.Fatalf("want 1 match, got %v", res.Files)
+	}
+
+	f := res.Files[0]
+	if len(f.LineMatches) != 1 {
+		t.Fatalf("want 1 line, got %v", f.LineMatches)
+	}
+	l := f.LineMatches[0]
+
+	if len(l.LineFragments) != 1 {
+		t.Fatalf("want 1 line fragment, got %v", l.LineFragments)
+	}
+	fr := l.LineFragments[0]
+	if fr.MatchLength != len(content) {
+		t.Fatalf("got MatchLength %d want %d", fr.MatchLength, len(content))
+	}
+}
+
+func TestSkipInvalidContent(t *testing.T) {
+	for _, content := range []string{
+		// Binary
+		"abc def \x00 abc",
+	} {
+
+		b, err := NewIndexBuilder(nil)
+		if err != nil {
+			t.Fatalf("NewIndexBuilder: %v", err)
+		}
+
+		if err := b.Add(Document{
+			Name:    "f1",
+			Content: []byte(content),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		q := &query.Substring{Pattern: "abc def"}
+		res := searchForTest(t, b, q)
+		if len(res.Files) != 0 {
+			t.Fatalf("got %v, want no results", res.Files)
+		}
+
+		q = &query.Substring{Pattern: "NOT-INDEXED"}
+		res = searchForTest(t, b, q)
+		if len(res.Files) != 1 {
+			t.Fatalf("got %v, want 1 result", res.Files)
+		}
+	}
+}
+
+func TestCheckText(t *testing.T) {
+	for _, text := range []string{"", "simple ascii", "símplé unicödé", "\uFEFFwith utf8 'bom'", "with \uFFFD unicode replacement char"} {
+		if err := CheckText([]byte(text), 20000); err != nil {
+			t.Errorf("CheckText(%q): %v", text, err)
+		}
+	}
+	for _, text := range []string{"zero\x00byte", "xx", "0123456789abcdefghi"} {
+		if err := CheckText([]byte(text), 15); err == nil {
+			t.Errorf("CheckText(%q) succeeded", text)
+		}
+	}
+}
+
+func TestLineAnd(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("apple\nbanana\napple banana chocolate apple pudding banana\ngrape")},
+		Document{Name: "f2", Content: []byte("apple orange\nbanana")},
+		Document{Name: "f3", Content: []byte("banana grape")},
+	)
+	pattern := "(apple)(?-s:.)*?(banana)"
+	r, _ := syntax.Parse(pattern, syntax.Perl)
+
+	q := query.Regexp{
+		Regexp:  r,
+		Content: true,
+	}
+	res := searchForTest(t, b, &q)
+	wantRegexpCount := 1
+	if gotRegexpCount := res.RegexpsConsidered; gotRegexpCount != wantRegexpCount {
+		t.Errorf("got %d, wanted %d", gotRegexpCount, wantRegexpCount)
+	}
+	if len(res.Files) != 1 || res.Files[0].FileName != "f1" {
+		t.Errorf("got %v, want 1 result", res.Files)
+	}
+}
+
+func TestCaptureGroups(t *testing.T) {
+	content := []byte("grape apple pie and banana split")
+	// ----------------01234567890123456789012345678901
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: content},
+	)
+
+	r, _ := syntax.Parse("(apple)(?-s:.)*?(banana)", syntax.Perl)
+	q := &query.Regexp{Regexp: r, Content: true}
+
+	res := searchForTest(t, b, q, SearchOptions{CaptureGroups: true})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 match", res.Files)
+	}
+
+	got := res.Files[0].LineMatches[0].LineFragments
+	want := []LineFragmentMatch{{
+		LineOffset:  6,
+		Offset:      6,
+		MatchLength: 20,
+		Groups: []LineFragmentMatch{
+			{LineOffset: 6, Offset: 6, MatchLength: 5},
+			{LineOffset: 20, Offset: 20, MatchLength: 6},
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	res = searchForTest(t, b, q)
+	if groups := res.Files[0].LineMatches[0].LineFragments[0].Groups; groups != nil {
+		t.Errorf("got groups %+v without CaptureGroups", groups)
+	}
+}
+
+func TestCaptureGroupsMultiline(t *testing.T) {
+	content := []byte("apple pie\nbanana split")
+	// ----------------012345678 90123456789012
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: content},
+	)
+
+	r, _ := syntax.Parse("(?s)(apple.*?ban)(ana)", syntax.Perl)
+	q := &query.Regexp{Regexp: r, Content: true}
+
+	res := searchForTest(t, b, q, SearchOptions{CaptureGroups: true})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 2 {
+		t.Fatalf("got %v, want matches on 2 lines", res.Files)
+	}
+
+	// The first group starts on the first line and is cut at its
+	// end, the second is reported on the second line.
+	var got [][]LineFragmentMatch
+	for _, lm := range res.Files[0].LineMatches {
+		got = append(got, lm.LineFragments[0].Groups)
+	}
+	want := [][]LineFragmentMatch{
+		{{LineOffset: 0, Offset: 0, MatchLength: 9}, {MatchLength: -1}},
+		{{MatchLength: -1}, {LineOffset: 3, Offset: 13, MatchLength: 3}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestAllOf(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("apple\nsome text\nbanana\nmore text\ncherry")},
+		Document{Name: "f2", Content: []byte("apple banana")},
+		Document{Name: "f3", Content: []byte("cherry banana apple")},
+	)
+
+	q := &query.AllOf{Patterns: []string{"apple", "banana", "cherry"}}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 2 || res.Files[0].FileName != "f1" || res.Files[1].FileName != "f3" {
+		t.Fatalf("got %v, want f1 and f3", res.Files)
+	}
+	for _, f := range res.Files {
+		if len(f.LineMatches) != 1 || !f.LineMatches[0].FileName {
+			t.Errorf("%s: got %v, want only a file name match", f.FileName, f.LineMatches)
+		}
+	}
+
+	q.CaseSensitive = true
+	q.Patterns = append(q.Patterns, "Apple")
+	if res := searchForTest(t, b, q); len(res.Files) != 0 {
+		t.Errorf("got %v, want no matches", res.Files)
+	}
+
+	if res := searchForTest(t, b, &query.AllOf{}); len(res.Files) != 0 {
+		t.Errorf("got %v for an empty AllOf, want no matches", res.Files)
+	}
+}
+
+func TestLiteralRegexp(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("a Needle\nneedle")},
+		Document{Name: "needle", Content: []byte("haystack")},
+		Document{Name: "f3", Content: []byte("NEEDLE")},
+	)
+
+	for _, caseSensitive := range []bool{false, true} {
+		for _, fileName := range []bool{false, true} {
+			re := &query.Regexp{Regexp: mustParseRE("needle"), CaseSensitive: caseSensitive, FileName: fileName, Content: !fileName}
+			sub := &query.Substring{Pattern: "needle", CaseSensitive: caseSensitive, FileName: fileName, Content: !fileName}
+
+			got := searchForTest(t, b, re)
+			want := searchForTest(t, b, sub)
+			if len(want.Files) == 0 {
+				t.Fatalf("%s: got no matches", sub)
+			}
+			if got.RegexpsConsidered != 0 {
+				t.Errorf("%s: got RegexpsConsidered %d, want 0", re, got.RegexpsConsidered)
+			}
+			if d := cmp.Diff(want.Files, got.Files); d != "" {
+				t.Errorf("%s: mismatch with %s (-want +got):\n%s", re, sub, d)
+			}
+		}
+	}
+}
+
+func TestLineAndFileName(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("apple banana\ngrape")},
+		Document{Name: "f2", Content: []byte("apple banana\norange")},
+		Document{Name: "apple banana", Content: []byte("banana grape")},
+	)
+	pattern := "(apple)(?-s:.)*?(banana)"
+	r, _ := syntax.Parse(pattern, syntax.Perl)
+
+	q := query.Regexp{
+		Regexp:   r,
+		FileName: true,
+	}
+	res := searchForTest(t, b, &q)
+	wantRegexpCount := 1
+	if gotRegexpCount := res.RegexpsConsidered; gotRegexpCount != wantRegexpCount {
+		t.Errorf("got %d, wanted %d", gotRegexpCount, wantRegexpCount)
+	}
+	if len(res.Files) != 1 || res.Files[0].FileName != "apple banana" {
+		t.Errorf("got %v, want 1 result", res.Files)
+	}
+}
+
+func TestMultiLineRegex(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("apple banana\ngrape")},
+		Document{Name: "f2", Content: []byte("apple orange")},
+		Document{Name: "f3", Content: []byte("grape apple")},
+	)
+	pattern := "(apple).*?[[:space:]].*?(grape)"
+	r, _ := syntax.Parse(pattern, syntax.Perl)
+
+	q := query.Regexp{
+		Regexp: r,
+	}
+	res := searchForTest(t, b, &q)
+	wantRegexpCount := 2
+	if gotRegexpCount := res.RegexpsConsidered; gotRegexpCount != wantRegexpCount {
+		t.Errorf("got %d, wanted %d", gotRegexpCount, wantRegexpCount)
+	}
+	if len(res.Files) != 1 || res.Files[0].FileName != "f1" {
+		t.Errorf("got %v, want 1 result", res.Files)
+	}
+}
+
+func TestSearchTypeFileName(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Name: "reponame",
+	},
+		Document{Name: "f1", Content: []byte("bla the needle")},
+		Document{Name: "f2", Content: []byte("another file another\nneedle")})
+
+	wantSingleMatch := func(res *SearchResult, want string) {
+		t.Helper()
+		fmatches := res.Files
+		if len(fmatches) != 1 {
+			t.Errorf("got %v, want 1 matches", len(fmatches))
+			return
+		}
+		if len(fmatches[0].LineMatches) != 1 {
+			t.Errorf("got %d line matches", len(fmatches[0].LineMatches))
+			return
+		}
+		var got string
+		if fmatches[0].LineMatches[0].FileName {
+			got = fmatches[0].FileName
+		} else {
+			got = fmt.Sprintf("%s:%d", fmatches[0].FileName, fmatches[0].LineMatches[0].LineFragments[0].Offset)
+		}
+
+		if got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+
+	// Only return the later match in the second file
+	res := searchForTest(t, b, query.NewAnd(
+		&query.Type{
+			Type:  query.TypeFileName,
+			Child: &query.Substring{Pattern: "needle"},
+		},
+		&query.Substring{Pattern: "file"}))
+	wantSingleMatch(res, "f2:8")
+
+	// Only return a filename result
+	res = searchForTest(t, b,
+		&query.Type{
+			Type:  query.TypeFileName,
+			Child: &query.Substring{Pattern: "file"},
+		})
+	wantSingleMatch(res, "f2")
+}
+
+func TestSearchTypeFileNameFragments(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "src/Needle.go", Content: []byte("the needle")},
+		Document{Name: "other.go", Content: []byte("needle")})
+
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "needle"},
+		&query.Regexp{Regexp: mustParseRE("[Nn]eedle")},
+	} {
+		res := searchForTest(t, b, &query.Type{Type: query.TypeFileName, Child: q})
+		if len(res.Files) != 2 {
+			t.Fatalf("%s: got %d files, want 2", q, len(res.Files))
+		}
+		for _, f := range res.Files {
+			if len(f.LineMatches) != 1 || !f.LineMatches[0].FileName {
+				t.Fatalf("%s: got %v, want a single filename match", q, f.LineMatches)
+			}
+			frags := f.LineMatches[0].LineFragments
+			want := []LineFragmentMatch{{LineOffset: 4, Offset: 4, MatchLength: 6}}
+			if f.FileName == "other.go" {
+				// No occurrence in the name: highlight all of it.
+				want = []LineFragmentMatch{{MatchLength: len(f.FileName)}}
+			}
+			if !reflect.DeepEqual(frags, want) {
+				t.Errorf("%s: %s: got fragments %+v, want %+v", q, f.FileName, frags, want)
+			}
+		}
+	}
+}
+
+func TestFileType(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "regular", Content: []byte("needle")},
+		Document{Name: "link", Content: []byte("needle"), FileMode: 0120000},
+		Document{Name: "exec", Content: []byte("needle"), FileMode: 0100755})
+	s := searcherForTest(t, b)
+
+	for in, want := range map[string][]string{
+		"needle -type:symlink": {"regular", "exec"},
+		"needle type:symlink":  {"link"},
+		"type:regular":         {"regular", "exec"},
+		"type:submodule":       nil,
+	} {
+		q, err := query.Parse(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := s.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestSearchTypeLanguage(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Name: "reponame",
+	},
+		Document{Name: "apex.cls", Content: []byte("public class Car extends Vehicle {")},
+		Document{Name: "tex.cls", Content: []byte(`\DeclareOption*{`)},
+		Document{Name: "hello.h", Content: []byte(`#include <stdio.h>`)},
+	)
+
+	t.Log(b.languageMap)
+
+	wantSingleMatch := func(res *SearchResult, want string) {
+		t.Helper()
+		fmatches := res.Files
+		if len(fmatches) != 1 {
+			t.Errorf("got %v, want 1 matches", len(fmatches))
+			return
+		}
+		if len(fmatches[0].LineMatches) != 1 {
+			t.Errorf("got %d line matches", len(fmatches[0].LineMatches))
+			return
+		}
+		var got string
+		if fmatches[0].LineMatches[0].FileName {
+			got = fmatches[0].FileName
+		} else {
+			got = fmt.Sprintf("%s:%d", fmatches[0].FileName, fmatches[0].LineMatches[0].LineFragments[0].Offset)
+		}
+
+		if got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+
+	res := searchForTest(t, b, &query.Language{Language: "Apex"})
+	wantSingleMatch(res, "apex.cls")
+
+	res = searchForTest(t, b, &query.Language{Language: "TeX"})
+	wantSingleMatch(res, "tex.cls")
+
+	res = searchForTest(t, b, &query.Language{Language: "C"})
+	wantSingleMatch(res, "hello.h")
+
+	// test fallback language search by pretending it's an older index version
+	res = searchForTest(t, b, &query.Language{Language: "C++"})
+	if len(res.Files) != 0 {
+		t.Errorf("got %d results for C++, want 0", len(res.Files))
+	}
+
+	// Negated languages enumerate the files of the other languages.
+	for _, q := range []query.Q{
+		&query.Not{Child: &query.Language{Language: "C"}},
+		&query.Type{Type: query.TypeFileName, Child: &query.Not{Child: &query.Language{Language: "C"}}},
+	} {
+		res = searchForTest(t, b, q)
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		sort.Strings(got)
+		if want := []string{"apex.cls", "tex.cls"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", q, got, want)
+		}
+	}
+	if res = searchForTest(t, b, &query.Not{Child: &query.Language{Language: "Go"}}); len(res.Files) != 3 {
+		t.Errorf("got %d results for -lang:Go, want 3", len(res.Files))
+	}
+
+	b.featureVersion = 11 // force fallback
+	res = searchForTest(t, b, &query.Language{Language: "C++"})
+	wantSingleMatch(res, "hello.h")
+}
+
+func TestLanguageAliases(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "main.go", Content: []byte("package main")},
+		Document{Name: "main.c", Content: []byte("int main() {}")},
+	)
+	b.featureVersion = 11 // force fallback
+
+	q := &query.Language{Language: "golang"}
+	if res := searchForTest(t, b, q); len(res.Files) != 0 {
+		t.Errorf("got %d results without alias, want 0", len(res.Files))
+	}
+
+	SetLanguageAliases(map[string]string{"golang": "Go"})
+	defer SetLanguageAliases(nil)
+
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || res.Files[0].FileName != "main.go" {
+		t.Errorf("got %v, want main.go", res.Files)
+	}
+}
+
+func TestDebugScore(t *testing.T) {
+	content := []byte("func bla() blub")
+	// ----------------012345678901234
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name:    "f1",
+			Content: content,
+			Symbols: []DocumentSection{{5, 8}},
+		})
+
+	searcher := searcherForTest(t, b)
+	q := &query.Substring{Pattern: "bla", Content: true}
+
+	res, err := searcher.Search(context.Background(), q, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+	}
+	if got := res.Files[0].Debug; got != "" {
+		t.Errorf("got debug %q without DebugScore, want empty", got)
+	}
+
+	res, err = searcher.Search(context.Background(), q, &SearchOptions{DebugScore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+	}
+	if got := res.Files[0].LineMatches[0].DebugScore; !strings.Contains(got, "symbol") {
+		t.Errorf("got line debug %q, want mention of symbol", got)
+	}
+	if got := res.Files[0].Debug; !strings.Contains(got, "symbol") || !strings.Contains(got, "atom") {
+		t.Errorf("got file debug %q, want mention of symbol and atom", got)
+	}
+
+	// The deprecated package variable still enables debug output.
+	DebugScore = true
+	defer func() { DebugScore = false }()
+	res, err = searcher.Search(context.Background(), q, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || !strings.Contains(res.Files[0].Debug, "atom") {
+		t.Errorf("got %v with the DebugScore variable set, want file debug output", res.Files)
+	}
+}
+
+func TestSortByPath(t *testing.T) {
+	content := []byte("bla needle bla")
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "c/f1", Content: content},
+		Document{Name: "a/f2", Content: []byte("needle\nfunc needle() {}\nneedle")},
+		Document{Name: "b/f3", Content: content},
+		Document{Name: "a/f1", Content: content},
+	)
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle"}, SearchOptions{SortByPath: true})
+	var got []string
+	for _, f := range res.Files {
+		got = append(got, f.FileName)
+	}
+	want := []string{"a/f1", "a/f2", "b/f3", "c/f1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	lines := res.Files[1].LineMatches
+	if len(lines) != 3 {
+		t.Fatalf("got %v, want 3 line matches", printLineMatches(lines))
+	}
+	for i := 1; i < len(lines); i++ {
+		if lines[i-1].LineNumber > lines[i].LineNumber {
+			t.Errorf("line matches not in document order: %v", printLineMatches(lines))
+		}
+	}
+}
+
+func TestNaturalSort(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "a10", Content: []byte("needle")},
+		Document{Name: "a2", Content: []byte("needle")},
+		Document{Name: "a1", Content: []byte("needle")})
+
+	for _, c := range []struct {
+		natural bool
+		want    []string
+	}{
+		{false, []string{"a1", "a10", "a2"}},
+		{true, []string{"a1", "a2", "a10"}},
+	} {
+		res := searchForTest(t, b, &query.Substring{Pattern: "needle"}, SearchOptions{SortByPath: true, NaturalSort: c.natural})
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("NaturalSort %v: got %v, want %v", c.natural, got, c.want)
+		}
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want bool
+	}{
+		{"a2", "a10", true},
+		{"a10", "a2", false},
+		{"a1b", "a1c", true},
+		{"a01", "a1", false},
+		{"a1", "a01", true},
+		{"v1.9.0", "v1.10.0", true},
+		{"a", "a1", true},
+		{"b1", "a2", false},
+		{"a1", "a1", false},
+	} {
+		if got := naturalLess(c.a, c.b); got != c.want {
+			t.Errorf("naturalLess(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestMaxNgramsCaseVariants(t *testing.T) {
+	// "Needle" has the shortest posting list, so it survives the cap,
+	// but "needle" does not.
+	docs := []Document{{Name: "upper", Content: []byte("Needle")}}
+	for i := 0; i < 50; i++ {
+		docs = append(docs, Document{Name: fmt.Sprintf("f%d", i), Content: []byte("needle")})
+	}
+	docs = append(docs, Document{Name: "rare", Content: []byte("abcdefghijklmnopqrstuvwxyz0123456789")})
+
+	b := testIndexBuilder(t, nil, docs...)
+	b.MaxNgrams = 25
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	if len(res.Files) != 51 {
+		t.Errorf("got %d files, want 51", len(res.Files))
+	}
+}
+
+func TestMergeMaxNgrams(t *testing.T) {
+	shard := func(maxNgrams int, doc Document) *indexData {
+		b := testIndexBuilder(t, &Repository{Name: "repo"}, doc)
+		b.MaxNgrams = maxNgrams
+		return searcherForTest(t, b).(*indexData)
+	}
+	f1 := Document{Name: "f1", Content: []byte("the quick brown fox")}
+	f2 := Document{Name: "f2", Content: []byte("jumps over the lazy dog")}
+
+	for _, c := range []struct {
+		a, b, want int
+	}{
+		{100, 100, 100},
+		{50, 100, 100},
+		{100, 0, 0},
+	} {
+		ib, err := merge(shard(c.a, f1), shard(c.b, f2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ib.MaxNgrams != c.want {
+			t.Errorf("merging MaxNgrams %d and %d: got %d, want %d", c.a, c.b, ib.MaxNgrams, c.want)
+		}
+	}
+}
+
+func TestMaxNgrams(t *testing.T) {
+	docs := []Document{
+		{Name: "f1", Content: []byte("the quick brown fox jumps over the lazy dog")},
+		{Name: "f2", Content: []byte("the the the banana Needle the")},
+		{Name: "f3", Content: []byte("pack my box with five dozen liquor jugs")},
+	}
+
+	capped := testIndexBuilder(t, nil, docs...)
+	capped.MaxNgrams = 10
+	if n := len(capped.contentPostings.postings); n <= capped.MaxNgrams {
+		t.Fatalf("corpus has %d ngrams, want more than %d", n, capped.MaxNgrams)
+	}
+	full := testIndexBuilder(t, nil, docs...)
+
+	s := searcherForTest(t, capped)
+	if md := s.(*indexData).metaData; !md.NgramsDropped || md.IndexMinReaderVersion != ngramsDroppedFeatureVersion {
+		t.Errorf("got NgramsDropped %v, min reader version %d, want true, %d", md.NgramsDropped, md.IndexMinReaderVersion, ngramsDroppedFeatureVersion)
+	}
+
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "the", Content: true},
+		&query.Substring{Pattern: "the lazy", Content: true},
+		&query.Substring{Pattern: "needle", Content: true},
+		&query.Substring{Pattern: "Needle", Content: true, CaseSensitive: true},
+		&query.Substring{Pattern: "needle", Content: true, CaseSensitive: true},
+		&query.Substring{Pattern: "quokka", Content: true},
+		&query.Regexp{Regexp: mustParseRE("b[or]own|box"), Content: true},
+		&query.Substring{Pattern: "f2"},
+	} {
+		res, err := s.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clearScores(res)
+		want := searchForTest(t, full, q)
+		if !reflect.DeepEqual(res.Files, want.Files) {
+			t.Errorf("%s: got %v, want %v", q, res.Files, want.Files)
+		}
+	}
+}
+
+func TestPostingsCodec(t *testing.T) {
+	docs := []Document{
+		{Name: "f1", Content: []byte("the quick brown fox jumps over the lazy dog")},
+		{Name: "f2", Content: []byte(strings.Repeat("the the banana Needle the\n", 200))},
+		{Name: "f3.go", Content: []byte("pack my box with five dozen liquor jugs")},
+	}
+
+	packed := testIndexBuilder(t, nil, docs...)
+	packed.PostingsCodec = PostingsBitPacked
+	def := testIndexBuilder(t, nil, docs...)
+
+	s := searcherForTest(t, packed)
+	md := s.(*indexData).metaData
+	if md.PostingsCodec != PostingsBitPacked || md.IndexMinReaderVersion != postingsCodecFeatureVersion {
+		t.Errorf("got codec %d, min reader version %d, want %d, %d",
+			md.PostingsCodec, md.IndexMinReaderVersion, PostingsBitPacked, postingsCodecFeatureVersion)
+	}
+
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "the", Content: true},
+		&query.Substring{Pattern: "the lazy", Content: true},
+		&query.Substring{Pattern: "Needle", CaseSensitive: true},
+		&query.Substring{Pattern: "quokka"},
+		&query.Regexp{Regexp: mustParseRE("b[or]own|box"), Content: true},
+		&query.Substring{Pattern: ".go", FileName: true},
+	} {
+		res, err := s.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clearScores(res)
+		want := searchForTest(t, def, q)
+		if !reflect.DeepEqual(res.Files, want.Files) {
+			t.Errorf("%s: got %v, want %v", q, res.Files, want.Files)
+		}
+	}
+
+	packed.PostingsCodec = 42
+	var buf bytes.Buffer
+	if err := packed.Write(&buf); err == nil {
+		t.Error("Write succeeded with unknown codec")
+	}
+}
+
+func TestMergePostingsCodec(t *testing.T) {
+	shard := func(codec PostingsCodec, docs ...Document) *indexData {
+		b := testIndexBuilder(t, &Repository{Name: "repo"}, docs...)
+		b.PostingsCodec = codec
+		return searcherForTest(t, b).(*indexData)
+	}
+	docs := []Document{
+		{Name: "f1", Content: []byte("the quick brown fox jumps over the lazy dog")},
+		{Name: "f2", Content: []byte(strings.Repeat("the the banana Needle the\n", 200))},
+	}
+
+	ib, err := merge(shard(PostingsBitPacked, docs[0]), shard(PostingsBitPacked, docs[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ib.PostingsCodec != PostingsBitPacked {
+		t.Errorf("got codec %d, want %d", ib.PostingsCodec, PostingsBitPacked)
+	}
+	s := searcherForTest(t, ib)
+	if got := s.(*indexData).metaData.PostingsCodec; got != PostingsBitPacked {
+		t.Errorf("merged shard has codec %d, want %d", got, PostingsBitPacked)
+	}
+	single := testIndexBuilder(t, &Repository{Name: "repo"}, docs...)
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "the", Content: true},
+		&query.Substring{Pattern: "Needle", CaseSensitive: true},
+		&query.Substring{Pattern: "lazy dog", Content: true},
+	} {
+		res, err := s.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clearScores(res)
+		if want := searchForTest(t, single, q); !reflect.DeepEqual(sortedFileNames(res.Files), sortedFileNames(want.Files)) {
+			t.Errorf("%s: got %v, want %v", q, sortedFileNames(res.Files), sortedFileNames(want.Files))
+		}
+	}
+
+	// Shards with different codecs can be merged too.
+	ib, err = merge(shard(PostingsBitPacked, docs[0]), shard(PostingsDeltaVarint, docs[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := searchForTest(t, ib, &query.Substring{Pattern: "the", Content: true})
+	if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, []string{"f1", "f2"}) {
+		t.Errorf("mixed codecs: got %v, want [f1 f2]", got)
+	}
+}
+
+func TestCount(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte(strings.Repeat("needle needle\nhay\n", 50))},
+		Document{Name: "f2", Content: []byte("needle\nstack\nneedle")},
+		Document{Name: "f3", Content: []byte("hay"),
+			Symbols: []DocumentSection{{Start: 0, End: 3}}},
+	)
+	s := searcherForTest(t, b)
+
+	f2, err := s.Search(context.Background(), &query.Substring{Pattern: "stack"}, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Count filters the candidates like Search.
+	optsList := []*SearchOptions{
+		{},
+		{RestrictDocIDs: []uint32{1, 2}},
+		{RepoFilter: roaring.BitmapOf(1)},
+		{ExcludeChecksums: [][]byte{f2.Files[0].Checksum}},
+		{HeaderBytes: 8},
+		{ShardRepoMaxMatchCount: 3},
+	}
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "needle", Content: true},
+		&query.Substring{Pattern: "f", FileName: true},
+		&query.Substring{Pattern: "hay"},
+		&query.Regexp{Regexp: mustParseRE("needle\nst"), Content: true},
+		&query.Symbol{Expr: &query.Substring{Pattern: "hay"}},
+		&query.Const{Value: true},
+		&query.Substring{Pattern: "quokka"},
+	} {
+		for _, opts := range optsList {
+			res, err := s.Search(context.Background(), q, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			count, stats, err := s.Count(context.Background(), q, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != int64(res.Stats.MatchCount) {
+				t.Errorf("%s %+v: got count %d, want %d", q, opts, count, res.Stats.MatchCount)
+			}
+			if stats.FileCount != res.Stats.FileCount {
+				t.Errorf("%s %+v: got FileCount %d, want %d", q, opts, stats.FileCount, res.Stats.FileCount)
+			}
+		}
+	}
+
+	q := &query.Substring{Pattern: "needle", Content: true}
+	searchAllocs := testing.AllocsPerRun(10, func() {
+		if _, err := s.Search(context.Background(), q, &SearchOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	countAllocs := testing.AllocsPerRun(10, func() {
+		if _, _, err := s.Count(context.Background(), q, &SearchOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if countAllocs >= searchAllocs {
+		t.Errorf("Count made %v allocations, want fewer than Search's %v", countAllocs, searchAllocs)
+	}
+}
+
+func TestCandidateBatchSize(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte(strings.Repeat("abc___def bcXXXde abcXXXdef\n", 20))},
+		Document{Name: "f2", Content: []byte("func abcXXXdef() {}\nabc def"),
+			Symbols: []DocumentSection{{Start: 5, End: 14}}},
+	)
+	s := searcherForTest(t, b)
+
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "abcXXXdef", Content: true},
+		&query.Substring{Pattern: "abc", Content: true},
+		&query.Symbol{Expr: &query.Substring{Pattern: "abcXXX"}},
+		&query.Regexp{Regexp: mustParseRE("abc.*def"), Content: true},
+	} {
+		want, err := s.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clearScores(want)
+		for _, size := range []int{1, 2, 7} {
+			got, err := s.Search(context.Background(), q, &SearchOptions{CandidateBatchSize: size})
+			if err != nil {
+				t.Fatal(err)
+			}
+			clearScores(got)
+			if !reflect.DeepEqual(got.Files, want.Files) {
+				t.Errorf("%s: batch size %d: got %v, want %v", q, size, got.Files, want.Files)
+			}
+		}
+	}
+}
+
+func BenchmarkCandidateBatchSize(b *testing.B) {
+	// Every "abc___def" is a candidate for the pattern, but none
+	// match.
+	content := []byte(strings.Repeat("abc___def bcXXXde ", 50000) + "abcXXXdef")
+	ib, err := NewIndexBuilder(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := ib.Add(Document{Name: "f1", Content: content}); err != nil {
+		b.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ib.Write(&buf); err != nil {
+		b.Fatal(err)
+	}
+	s, err := NewSearcher(&memSeeker{buf.Bytes()})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	q := &query.Substring{Pattern: "abcXXXdef", Content: true, CaseSensitive: true}
+	for _, size := range []int{0, 100} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				res, err := s.Search(context.Background(), q, &SearchOptions{CandidateBatchSize: size})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if res.Stats.MatchCount != 1 {
+					b.Fatalf("got %d matches, want 1", res.Stats.MatchCount)
+				}
+			}
+		})
+	}
+}
+
+func TestRestrictDocIDs(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("needle one")},
+		Document{Name: "f2", Content: []byte("needle two")},
+		Document{Name: "f3", Content: []byte("needle three")},
+	)
+	s := searcherForTest(t, b)
+
+	q := &query.Substring{Pattern: "needle", Content: true}
+	res, err := s.Search(context.Background(), q, &SearchOptions{RestrictDocIDs: []uint32{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || res.Files[0].FileName != "f2" {
+		t.Errorf("got %v, want only f2", res.Files)
+	}
+	if res.Stats.FilesConsidered != 1 {
+		t.Errorf("got FilesConsidered %d, want 1", res.Stats.FilesConsidered)
+	}
+
+	// Out of range IDs are ignored.
+	res, err = s.Search(context.Background(), q, &SearchOptions{RestrictDocIDs: []uint32{7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 0 {
+		t.Errorf("got %v, want no matches", res.Files)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "main.go", Content: []byte("package main\nfunc main() {}")},
+		Document{Name: "cmd/tool/tool.go", Content: []byte("package tool\nfunc run() {}")},
+		Document{Name: "cmd/tool/tool.go.orig", Content: []byte("package tool")},
+		Document{Name: "README.md", Content: []byte("func is a keyword\nmain() is the entry")},
+	)
+	s := searcherForTest(t, b)
+
+	for _, tc := range []struct {
+		glob query.Q
+		re   query.Q
+		want []string
+	}{{
+		glob: &query.Glob{Pattern: "*.go", FileName: true},
+		re:   &query.Regexp{Regexp: mustParseRE(`(^|/)[^/]*\.go$`), FileName: true},
+		want: []string{"cmd/tool/tool.go", "main.go"},
+	}, {
+		glob: &query.Glob{Pattern: "/cmd/**", FileName: true},
+		re:   &query.Regexp{Regexp: mustParseRE(`^cmd/.*`), FileName: true},
+		want: []string{"cmd/tool/tool.go", "cmd/tool/tool.go.orig"},
+	}, {
+		glob: &query.Glob{Pattern: "func ma??()", Content: true},
+		re:   &query.Regexp{Regexp: mustParseRE(`func ma..\(\)`), Content: true},
+		want: []string{"main.go"},
+	}, {
+		glob: &query.Glob{Pattern: "func*()", Content: true},
+		re:   &query.Regexp{Regexp: mustParseRE(`func.*\(\)`), Content: true},
+		want: []string{"cmd/tool/tool.go", "main.go"},
+	}} {
+		got, err := s.Search(context.Background(), tc.glob, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := s.Search(context.Background(), tc.re, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := sortedFileNames(got.Files); !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.glob, names, tc.want)
+		}
+		if g, w := sortedFileNames(got.Files), sortedFileNames(want.Files); !reflect.DeepEqual(g, w) {
+			t.Errorf("%s: got %v, regexp %s got %v", tc.glob, g, tc.re, w)
+		}
+	}
+}
+
+func sortedFileNames(fms []FileMatch) []string {
+	var names []string
+	for _, fm := range fms {
+		names = append(names, fm.FileName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rankedFileNames returns the names of the files matching q, highest
+// scoring first.
+func rankedFileNames(t *testing.T, s Searcher, q query.Q, opts *SearchOptions) []string {
+	t.Helper()
+	res, err := s.Search(context.Background(), q, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SortFilesByScore(res.Files)
+	var names []string
+	for _, f := range res.Files {
+		names = append(names, f.FileName)
+	}
+	return names
+}
+
+func TestEstimatedTotalMatches(t *testing.T) {
+	var docs []Document
+	for i := 0; i < 10; i++ {
+		docs = append(docs, Document{Name: fmt.Sprintf("f%d", i), Content: []byte("needle haystack")})
+	}
+	docs = append(docs, Document{Name: "other", Content: []byte("haystack only")})
+	b := testIndexBuilder(t, nil, docs...)
+	s := searcherForTest(t, b)
+
+	q := &query.Substring{Pattern: "needle", Content: true}
+	res, err := s.Search(context.Background(), q, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.EstimatedTotalMatches != int64(res.MatchCount) {
+		t.Errorf("uncapped: got estimate %d, want MatchCount %d", res.EstimatedTotalMatches, res.MatchCount)
+	}
+
+	res, err = s.Search(context.Background(), q, &SearchOptions{ShardMaxMatchCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 2 {
+		t.Fatalf("got %d files, want 2", len(res.Files))
+	}
+	if res.EstimatedTotalMatches != 10 {
+		t.Errorf("capped: got estimate %d, want 10", res.EstimatedTotalMatches)
+	}
+	// Counting the remaining candidates does not add to the stats.
+	if res.NgramMatches != 2 {
+		t.Errorf("capped: got NgramMatches %d, want 2", res.NgramMatches)
+	}
+}
+
+func TestFileMatchLineColumn(t *testing.T) {
+	// The Kelvin sign takes 3 bytes in UTF-8.
+	content := "first line\nKKelvin K=needle\nlast"
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte(content)})
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line match", res.Files)
+	}
+	fm := &res.Files[0]
+	lm := fm.LineMatches[0]
+
+	for _, tc := range []struct {
+		offset    uint32
+		line, col int
+	}{
+		{lm.LineFragments[0].Offset, 2, 11},
+		{uint32(lm.LineStart), 2, 1},
+		{uint32(lm.LineEnd), 2, 17},
+		{uint32(strings.Index(content, "elvin")), 2, 3},
+		// Not covered by a line match.
+		{0, 0, 0},
+	} {
+		line, col := fm.LineColumn(tc.offset)
+		if line != tc.line || col != tc.col {
+			t.Errorf("offset %d: got %d:%d, want %d:%d", tc.offset, line, col, tc.line, tc.col)
+		}
+	}
+}
+
+func TestExcludeChecksums(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("needle one")},
+		Document{Name: "f2", Content: []byte("needle two")},
+		Document{Name: "f3", Content: []byte("needle one")},
+	)
+	s := searcherForTest(t, b)
+
+	q := &query.Substring{Pattern: "needle", Content: true}
+	res, err := s.Search(context.Background(), q, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []byte
+	for _, fm := range res.Files {
+		if fm.FileName == "f1" {
+			seen = fm.Checksum
+		}
+	}
+
+	res, err = s.Search(context.Background(), q, &SearchOptions{ExcludeChecksums: [][]byte{seen}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// f3 has the same content as f1, so it is excluded too.
+	if got, want := sortedFileNames(res.Files), []string{"f2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExcludeChecksumsSkipped(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "big1", Content: []byte("needle"), SkipReason: "too large"},
+		Document{Name: "big2", Content: []byte("needle"), SkipReason: "too large"},
+	)
+	s := searcherForTest(t, b)
+
+	// Skipped files store only their SkipReason, so they share this
+	// checksum, but do not report it.
+	marker := crc64.Checksum([]byte(notIndexedMarker+"too large"), crc64.MakeTable(crc64.ISO))
+	seen := make([]byte, 8)
+	binary.BigEndian.PutUint64(seen, marker)
+
+	q := &query.Substring{Pattern: "big", FileName: true}
+	res, err := s.Search(context.Background(), q, &SearchOptions{ExcludeChecksums: [][]byte{seen}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedFileNames(res.Files), []string{"big1", "big2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, f := range res.Files {
+		if len(f.Checksum) != 0 {
+			t.Errorf("%s: got checksum %x, want none", f.FileName, f.Checksum)
+		}
+	}
+}
+
+func TestUnterminatedLastLine(t *testing.T) {
+	// ---------01234 567890123
+	content := "first\nlast needle"
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte(content)})
+	s := searcherForTest(t, b)
+
+	for _, opts := range []*SearchOptions{{}, {NumContextLines: 1}} {
+		res, err := s.Search(context.Background(), &query.Substring{Pattern: "needle", Content: true}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+			t.Fatalf("got %v, want 1 line match", res.Files)
+		}
+		lm := res.Files[0].LineMatches[0]
+		if lm.LineNumber != 2 || lm.LineStart != 6 || lm.LineEnd != len(content) || string(lm.Line) != "last needle" {
+			t.Errorf("got line %d [%d,%d) %q, want line 2 [6,%d) %q",
+				lm.LineNumber, lm.LineStart, lm.LineEnd, lm.Line, len(content), "last needle")
+		}
+		if len(lm.After) != 0 {
+			t.Errorf("got After %q, want none past EOF", lm.After)
+		}
+	}
+
+	// A match running into the unterminated last line is split per
+	// line, and the last part ends at EOF.
+	res, err := s.Search(context.Background(), &query.Regexp{Regexp: mustParseRE(`first\nlast`), Content: true}, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 2 {
+		t.Fatalf("got %v, want 2 line matches", res.Files)
+	}
+	if lm := res.Files[0].LineMatches[1]; lm.LineNumber != 2 || lm.LineEnd != len(content) {
+		t.Errorf("got line %d ending at %d, want line 2 ending at %d", lm.LineNumber, lm.LineEnd, len(content))
+	}
+
+	rl, err := s.List(context.Background(), &query.Const{Value: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only terminated lines are counted.
+	if got := rl.Repos[0].Stats.NewLinesCount; got != 1 {
+		t.Errorf("got NewLinesCount %d, want 1", got)
+	}
+}
+
+func TestBoostExactCase(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("func FOOBAR() {}")},
+		Document{Name: "f2", Content: []byte("func FooBar() {}")},
+	)
+	s := searcherForTest(t, b)
+	q := &query.Substring{Pattern: "FooBar", Content: true}
+
+	// Both match case insensitively, so they tie and f1 comes first.
+	if got, want := rankedFileNames(t, s, q, &SearchOptions{}), []string{"f1", "f2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Only f2 has the exact case of the pattern.
+	if got, want := rankedFileNames(t, s, q, &SearchOptions{BoostExactCase: true}), []string{"f2", "f1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with boost: got %v, want %v", got, want)
+	}
+}
+
+func TestAndTermAdjacency(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("apple is a fruit, and so is the banana")},
+		Document{Name: "f2", Content: []byte("apple banana")},
+	)
+	s := searcherForTest(t, b)
+	q := query.NewAnd(
+		&query.Substring{Pattern: "apple", Content: true},
+		&query.Substring{Pattern: "banana", Content: true})
+
+	// The distance between the terms is ignored by default.
+	if got, want := rankedFileNames(t, s, q, &SearchOptions{}), []string{"f1", "f2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// In f2 the terms are next to each other.
+	if got, want := rankedFileNames(t, s, q, &SearchOptions{AndTermAdjacencyWeight: 1000}), []string{"f2", "f1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with adjacency weight: got %v, want %v", got, want)
 	}
-	for i, want := range docs {
-		got := res.Files[i].LineMatches[0].LineFragments
-		if len(got) != len(want.Symbols) {
-			t.Fatalf("got %d symbols, want %d symbols in doc %s", len(got), len(want.Symbols), want.Name)
-		}
+}
 
-		for j, sec := range want.Symbols {
-			if sec.Start != got[j].Offset {
-				t.Fatalf("got offset %d, want %d in doc %s", got[j].Offset, sec.Start, want.Name)
-			}
-		}
+func TestMatchDensity(t *testing.T) {
+	large := append([]byte("needle needle "), bytes.Repeat([]byte("filler "), 2000)...)
+	b := testIndexBuilder(t, nil,
+		Document{Name: "large", Content: large},
+		Document{Name: "small", Content: []byte("needle, needle")},
+	)
+	s := searcherForTest(t, b)
+	q := &query.Substring{Pattern: "needle", Content: true}
+
+	// Both have two matches, so the file size does not count.
+	if got, want := rankedFileNames(t, s, q, &SearchOptions{}), []string{"large", "small"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The matches make up most of small, but little of large.
+	if got, want := rankedFileNames(t, s, q, &SearchOptions{MatchDensityWeight: 100}), []string{"small", "large"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with density weight: got %v, want %v", got, want)
 	}
 }
 
-func TestHitIterTerminate(t *testing.T) {
-	// contrived input: trigram frequencies forces selecting abc +
-	// def for the distance iteration. There is no match, so this
-	// will advance the compressedPostingIterator to beyond the
-	// end.
-	content := []byte("abc bcdbcd cdecde abcabc def efg")
-	b := testIndexBuilder(t, nil,
+func TestSubstringInSymbol(t *testing.T) {
+	content := []byte("bla\nsymblabla\nbla")
+	// ----------------0123 456789012
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
 		Document{
 			Name:    "f1",
 			Content: content,
+			Symbols: []DocumentSection{{4, 12}},
 		},
+		Document{Name: "bla.go", Content: []byte("bla")},
 	)
-	searchForTest(t, b, &query.Substring{Pattern: "abcdef"})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "bla", InSymbol: true})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+	}
+	m := res.Files[0].LineMatches[0].LineFragments[0]
+	if m.Offset != 7 || m.MatchLength != 3 {
+		t.Fatalf("got offset %d, size %d want 7 size 3", m.Offset, m.MatchLength)
+	}
+
+	// Without InSymbol, all occurrences match.
+	res = searchForTest(t, b, &query.Substring{Pattern: "bla", Content: true})
+	if len(res.Files) != 2 {
+		t.Fatalf("got %v, want 2 files", res.Files)
+	}
 }
 
-func TestDistanceHitIterBailLast(t *testing.T) {
-	content := []byte("AST AST AST UASH")
+func TestMatchTokens(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("x := obj.getUserName() + User")})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "User", CaseSensitive: true, Content: true}, SearchOptions{MatchTokens: true})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line match", res.Files)
+	}
+	var got []string
+	for _, f := range res.Files[0].LineMatches[0].LineFragments {
+		got = append(got, string(f.Token))
+	}
+	sort.Strings(got)
+	if want := []string{"User", "getUserName"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got tokens %q, want %q", got, want)
+	}
+}
+
+func TestFlagBinaryLines(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("a needle in text\n\x01\x02needle\x03\x04\x05\x06\x07\x08\x0b\x0e\x0f\n")})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true}, SearchOptions{FlagBinaryLines: true})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 2 {
+		t.Fatalf("got %v, want 2 line matches", res.Files)
+	}
+	got := map[int]bool{}
+	for _, lm := range res.Files[0].LineMatches {
+		got[lm.LineNumber] = lm.MostlyBinary
+	}
+	if want := map[int]bool{1: false, 2: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got MostlyBinary by line %v, want %v", got, want)
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	for _, lm := range res.Files[0].LineMatches {
+		if lm.MostlyBinary {
+			t.Errorf("line %d: got MostlyBinary without FlagBinaryLines", lm.LineNumber)
+		}
+	}
+}
+
+func TestMinimal(t *testing.T) {
+	content := []byte("first line\nthe needle line\nlast line\n")
+	b := testIndexBuilder(t, nil, Document{Name: "f1", Content: content})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true}, SearchOptions{Minimal: true, NumContextLines: 1})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line match", res.Files)
+	}
+	lm := res.Files[0].LineMatches[0]
+	if lm.Line != nil || lm.Before != nil || lm.After != nil {
+		t.Errorf("got line %q, before %q, after %q, want none", lm.Line, lm.Before, lm.After)
+	}
+	if lm.LineNumber != 2 || string(content[lm.LineStart:lm.LineEnd]) != "the needle line" {
+		t.Errorf("got line %d at %d-%d, want line 2 at the needle line", lm.LineNumber, lm.LineStart, lm.LineEnd)
+	}
+	if len(lm.LineFragments) != 1 || lm.LineFragments[0].LineOffset != 4 || lm.LineFragments[0].MatchLength != 6 {
+		t.Errorf("got fragments %+v, want needle at line offset 4", lm.LineFragments)
+	}
+
+	// Without the line bytes, LineColumn cannot compute a column.
+	if line, col := res.Files[0].LineColumn(lm.LineFragments[0].Offset); line != 0 || col != 0 {
+		t.Errorf("got LineColumn %d:%d, want 0:0", line, col)
+	}
+}
+
+func TestSymbolPath(t *testing.T) {
+	content := "class Foo {\n  void bar() {\n    needle();\n  }\n\n  int x = needle2;\n}\nneedle3\n"
+	off := func(s string) uint32 { return uint32(strings.Index(content, s)) }
 	b := testIndexBuilder(t, nil,
 		Document{
 			Name:    "f1",
-			Content: content,
-		},
+			Content: []byte(content),
+			Symbols: []DocumentSection{
+				{Start: off("Foo"), End: off("Foo") + 3},
+				{Start: off("bar"), End: off("bar") + 3},
+			},
+			SymbolsMetaData: []*Symbol{
+				{Kind: "class"},
+				{Kind: "method", Parent: "Foo", ParentKind: "class"},
+			},
+		})
+	s := searcherForTest(t, b)
+
+	q := &query.Substring{Pattern: "needle();", Content: true}
+	res, err := s.Search(context.Background(), q, &SearchOptions{SymbolPaths: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line match", res.Files)
+	}
+	if got, want := res.Files[0].LineMatches[0].SymbolPath, []string{"Foo", "bar"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// bar ends with its closing brace, and Foo with the next one.
+	for pattern, want := range map[string][]string{
+		"needle2": {"Foo"},
+		"needle3": nil,
+	} {
+		res, err := s.Search(context.Background(), &query.Substring{Pattern: pattern, Content: true}, &SearchOptions{SymbolPaths: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+			t.Fatalf("%s: got %v, want 1 line match", pattern, res.Files)
+		}
+		if got := res.Files[0].LineMatches[0].SymbolPath; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", pattern, got, want)
+		}
+	}
+
+	res, err = s.Search(context.Background(), q, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Files[0].LineMatches[0].SymbolPath; got != nil {
+		t.Errorf("got %v without SymbolPaths, want nil", got)
+	}
+}
+
+func TestSymbolKind(t *testing.T) {
+	content := "func foo() {}\nvar foo = 1\nfunc foobar() {}\n"
+	off := func(s string) uint32 { return uint32(strings.Index(content, s)) }
+	b := testIndexBuilder(t, nil,
+		Document{
+			Name:    "f1",
+			Content: []byte(content),
+			Symbols: []DocumentSection{
+				{Start: off("foo()"), End: off("foo()") + 3},
+				{Start: off("foo ="), End: off("foo =") + 3},
+				{Start: off("foobar"), End: off("foobar") + 6},
+			},
+			SymbolsMetaData: []*Symbol{
+				{Kind: "function"},
+				{Kind: "variable"},
+				{Kind: "function"},
+			},
+		})
+
+	lines := func(q query.Q) []int {
+		var got []int
+		for _, f := range searchForTest(t, b, q).Files {
+			for _, lm := range f.LineMatches {
+				got = append(got, lm.LineNumber)
+			}
+		}
+		sort.Ints(got)
+		return got
+	}
+
+	for _, c := range []struct {
+		q    query.Q
+		want []int
+	}{
+		{&query.Symbol{Expr: &query.Substring{Pattern: "foo"}}, []int{1, 2, 3}},
+		{&query.Symbol{Expr: &query.Substring{Pattern: "foo"}, Kind: "function"}, []int{1, 3}},
+		{&query.Symbol{Expr: &query.Substring{Pattern: "foo"}, Kind: "variable"}, []int{2}},
+		{&query.Symbol{Expr: &query.Regexp{Regexp: mustParseRE("^foo$")}, Kind: "function"}, []int{1}},
+		{&query.Symbol{Expr: &query.Substring{Pattern: "foo"}, Kind: "class"}, nil},
+	} {
+		if got := lines(c.q); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got lines %v, want %v", c.q, got, c.want)
+		}
+	}
+}
+
+func TestIgnoreWhitespace(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("sum := a + b")},
+		Document{Name: "f2", Content: []byte("sum := a+b")},
+		Document{Name: "f3", Content: []byte("sum := a\t+    b")},
+		Document{Name: "f4", Content: []byte("sum := a - b")},
+		Document{Name: "f5", Content: []byte("sum := a\n+ b")},
 	)
-	res := searchForTest(t, b, &query.Substring{Pattern: "UAST"})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "a  +  b", Content: true, IgnoreWhitespace: true})
+	if got, want := sortedFileNames(res.Files), []string{"f1", "f2", "f3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "a  +  b", Content: true})
 	if len(res.Files) != 0 {
-		t.Fatalf("got %v, want no results", res.Files)
+		t.Errorf("got %v without IgnoreWhitespace, want no matches", sortedFileNames(res.Files))
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "a\n+ b", Content: true, IgnoreWhitespace: true})
+	if got, want := sortedFileNames(res.Files), []string{"f1", "f2", "f3", "f5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("newline: got %v, want %v", got, want)
 	}
 }
 
-func TestDocumentSectionRuneBoundary(t *testing.T) {
-	content := string([]rune{kelvinCodePoint, kelvinCodePoint, kelvinCodePoint})
+func TestSubwordBoundary(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("func getUserName() {}")},
+		Document{Name: "f2", Content: []byte("user_id := 1")},
+		Document{Name: "f3", Content: []byte("isSuperuser := true")},
+		Document{Name: "f4", Content: []byte("var HTTPUser int")},
+		// "User" in SuperUserX follows a lower case letter, just like
+		// in getUserName, so it starts a camelCase subword and
+		// matches. Only a lower case "user", as in isSuperuser, is
+		// inside a subword.
+		Document{Name: "f5", Content: []byte("type SuperUserX struct{}")},
+	)
+	s := searcherForTest(t, b)
+
+	for _, pat := range []string{"User", "user", "us"} {
+		res, err := s.Search(context.Background(),
+			&query.Substring{Pattern: pat, Content: true, SubwordBoundary: true}, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := sortedFileNames(res.Files), []string{"f1", "f2", "f4", "f5"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %v, want %v", pat, got, want)
+		}
+		for _, f := range res.Files {
+			if f.FileName != "f1" {
+				continue
+			}
+			if off := f.LineMatches[0].LineFragments[0].LineOffset; off != 8 {
+				t.Errorf("%q: got match at %d in getUserName, want 8", pat, off)
+			}
+		}
+
+		res, err = s.Search(context.Background(),
+			&query.Substring{Pattern: pat, Content: true}, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 5 {
+			t.Errorf("%q: got %v without SubwordBoundary, want 5 files", pat, sortedFileNames(res.Files))
+		}
+	}
+}
+
+func TestSubstringComments(t *testing.T) {
+	b := testIndexBuilder(t, nil)
+	b.CommentExtractor = ExtractComments
+	for _, d := range []Document{
+		{Name: "f1.go", Language: "Go", Content: []byte("// limit the rate\nvar limit = \"// limit\"\n")},
+		{Name: "f2", Content: []byte("limit")},
+	} {
+		if err := b.Add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := searcherForTest(t, b)
+
+	lines := func(q query.Q) []string {
+		t.Helper()
+		res, err := s.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range res.Files {
+			for _, l := range f.LineMatches {
+				got = append(got, fmt.Sprintf("%s:%d", f.FileName, l.LineNumber))
+			}
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	// "li" is too short for the ngram index, so it is matched by
+	// scanning content.
+	for _, pat := range []string{"limit", "li"} {
+		if got, want := lines(&query.Substring{Pattern: pat, Content: true, ExcludeComments: true}), []string{"f1.go:2", "f2:1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q ExcludeComments: got %v, want %v", pat, got, want)
+		}
+		if got, want := lines(&query.Substring{Pattern: pat, Content: true, OnlyComments: true}), []string{"f1.go:1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q OnlyComments: got %v, want %v", pat, got, want)
+		}
+	}
+}
+
+func TestExtractComments(t *testing.T) {
+	for _, c := range []struct {
+		lang, in string
+		want     []string
+	}{
+		{"Go", "a // b\nc /* d\ne */ f", []string{"// b", "/* d\ne */"}},
+		{"Go", "s := \"//x\" + `/*y*/` // z", []string{"// z"}},
+		{"Python", "x = '#' # y\n", []string{"# y"}},
+		{"SQL", "select 1 -- one", []string{"-- one"}},
+		{"Unknown", "// x", nil},
+	} {
+		var got []string
+		for _, s := range ExtractComments(c.lang, []byte(c.in)) {
+			got = append(got, c.in[s.Start:s.End])
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %q: got %q, want %q", c.lang, c.in, got, c.want)
+		}
+	}
+}
+
+func TestMaxRegexpProgramSize(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("foo bar")},
+	)
+	s := searcherForTest(t, b)
+	opts := &SearchOptions{MaxRegexpProgramSize: 1000}
+
+	res, err := s.Search(context.Background(), &query.Regexp{Regexp: mustParseRE("foo.*bar"), Content: true}, opts)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Files) != 1 {
+		t.Errorf("got %v, want 1 file", res.Files)
+	}
+
+	q := &query.Regexp{Regexp: mustParseRE("((a|b)*(c|d)*){100}"), Content: true}
+	if _, err := s.Search(context.Background(), q, opts); err == nil {
+		t.Errorf("got nil error for %s", q)
+	}
+	if _, err := s.Search(context.Background(), q, &SearchOptions{}); err != nil {
+		t.Errorf("got %v without MaxRegexpProgramSize, want success", err)
+	}
+
+	// Globs are searched as regexps, so they are limited too.
+	glob := &query.Glob{Pattern: "foo*bar", Content: true}
+	if _, err := s.Search(context.Background(), glob, &SearchOptions{MaxRegexpProgramSize: 5}); err == nil {
+		t.Errorf("got nil error for %s", glob)
+	}
+	if res, err := s.Search(context.Background(), glob, opts); err != nil || len(res.Files) != 1 {
+		t.Errorf("got %v, %v for %s, want 1 file", res, err, glob)
+	}
+}
+
+func TestTranscodeEncodings(t *testing.T) {
+	latin1 := []byte("caf\xe9 cr\xe8me br\xfbl\xe9e")
+	utf := []byte("na\u00efve")
+
+	b := testIndexBuilder(t, nil)
+	b.Encodings = []encoding.Encoding{japanese.ShiftJIS, charmap.ISO8859_1}
+	for _, d := range []Document{
+		{Name: "latin1", Content: latin1},
+		{Name: "sjis", Content: []byte("\x93\xfa\x96\x7b\x8c\xea")},
+		{Name: "utf8", Content: utf},
+	} {
+		if err := b.Add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for pat, want := range map[string]string{
+		"crème": "café crème brûlée",
+		"日本語":   "日本語",
+		"naïve": "naïve",
+	} {
+		res := searchForTest(t, b, &query.Substring{Pattern: pat, Content: true}, SearchOptions{Whole: true})
+		if len(res.Files) != 1 {
+			t.Errorf("%s: got %v, want 1 file", pat, sortedFileNames(res.Files))
+			continue
+		}
+		if got := string(res.Files[0].Content); got != want {
+			t.Errorf("%s: got content %q, want %q", pat, got, want)
+		}
+	}
+}
+
+func TestTranscodeSections(t *testing.T) {
+	b := testIndexBuilder(t, nil)
+	b.Encodings = []encoding.Encoding{charmap.ISO8859_1}
+	sym := []DocumentSection{{Start: 5, End: 11}}
+	if err := b.Add(Document{
+		Name:            "f1",
+		Content:         []byte("caf\xe9 needle // cr\xe8me"),
+		Symbols:         sym,
+		SymbolsMetaData: []*Symbol{{Kind: "function"}},
+		Comments:        []DocumentSection{{Start: 12, End: 20}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sym[0].Start != 5 {
+		t.Errorf("Add changed the caller's symbols to %v", sym)
+	}
+
+	res := searchForTest(t, b, &query.Symbol{Expr: &query.Substring{Pattern: "needle"}})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 symbol match", res.Files)
+	}
+	if f := res.Files[0].LineMatches[0].LineFragments[0]; f.Offset != 6 || f.SymbolInfo == nil || f.SymbolInfo.Sym != "needle" {
+		t.Errorf("got fragment %+v, want symbol needle at offset 6", f)
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "crème", Content: true, OnlyComments: true})
+	if len(res.Files) != 1 {
+		t.Errorf("got %v, want a match in the comment", res.Files)
+	}
+
+	// An offset inside a character cannot be mapped.
+	b.Encodings = []encoding.Encoding{japanese.ShiftJIS}
+	err := b.Add(Document{
+		Name:    "f2",
+		Content: []byte("\x93\xfa\x96\x7b\x8c\xea"),
+		Symbols: []DocumentSection{{Start: 1, End: 4}},
+	})
+	if _, ok := err.(*DocumentError); !ok {
+		t.Errorf("got error %v, want *DocumentError", err)
+	}
+}
+
+func TestSkipContent(t *testing.T) {
 	b, err := NewIndexBuilder(nil)
 	if err != nil {
-		t.Fatalf("NewIndexBuilder: %v", err)
+		t.Fatal(err)
+	}
+	calls := 0
+	b.SkipContent = func(doc *Document) string {
+		calls++
+		if len(doc.Content) > 100 {
+			return "too large"
+		}
+		return ""
+	}
+	b.SkipInvalid = true
+	for _, d := range []Document{
+		{Name: "small.txt", Content: []byte("needle")},
+		{Name: "vendor/large.txt", Content: bytes.Repeat([]byte("needle "), 100)},
+		{Name: "overlap.txt", Content: []byte("needle overlap"), Symbols: []DocumentSection{{0, 6}, {3, 9}}},
+	} {
+		if err := b.Add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// overlap.txt is retried as skipped without asking again.
+	if calls != 3 {
+		t.Errorf("SkipContent called %d times, want 3", calls)
+	}
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "large", FileName: true})
+	if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, []string{"vendor/large.txt"}) {
+		t.Errorf("file name search: got %v", got)
+	}
+	res = searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, []string{"small.txt"}) {
+		t.Errorf("content search: got %v", got)
+	}
+
+	rl, err := searcherForTest(t, b).List(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rl.Repos[0].Stats.Documents; got != 3 {
+		t.Errorf("got %d documents, want 3", got)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	repo := &Repository{Branches: []RepositoryBranch{{Name: "main"}, {Name: "dev"}}}
+	newBuilder := func(mode DuplicateMode) *IndexBuilder {
+		b, err := NewIndexBuilder(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Duplicates = mode
+		if err := b.Add(Document{Name: "f1", Branches: []string{"main"}}); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	b := newBuilder(DuplicatesError)
+	if err := b.Add(Document{Name: "f1", Branches: []string{"dev"}}); err != nil {
+		t.Errorf("same name on another branch: %v", err)
+	}
+	if err := b.Add(Document{Name: "f1", Branches: []string{"main"}}); err == nil {
+		t.Error("duplicate on main: got no error")
+	}
+	if _, err := b.AddRepository(&Repository{Name: "other", Branches: repo.Branches}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(Document{Name: "f1", Branches: []string{"main"}}); err != nil {
+		t.Errorf("same name in another repository: %v", err)
 	}
 
-	for i, sec := range []DocumentSection{
-		{2, 6},
-		{3, 7},
-	} {
-		if err := b.Add(Document{
-			Name:    "f1",
-			Content: []byte(content),
-			Symbols: []DocumentSection{sec},
-		}); err == nil {
-			t.Errorf("%d: Add succeeded", i)
-		}
+	b = newBuilder(DuplicatesWarn)
+	if err := b.Add(Document{Name: "f1", Branches: []string{"main"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Warnings(); len(got) != 1 {
+		t.Errorf("got warnings %q, want 1", got)
+	}
+
+	b = newBuilder(DuplicatesAllow)
+	if err := b.Add(Document{Name: "f1", Branches: []string{"main"}}); err != nil || len(b.Warnings()) != 0 {
+		t.Errorf("got %v, warnings %q by default", err, b.Warnings())
 	}
 }
 
-func TestUnicodeQuery(t *testing.T) {
-	content := string([]rune{kelvinCodePoint, kelvinCodePoint, kelvinCodePoint})
-	b := testIndexBuilder(t, nil,
-		Document{
-			Name:    "f1",
-			Content: []byte(content),
-		},
-	)
+func TestAddTree(t *testing.T) {
+	fsys := fstest.MapFS{
+		"src/main.go":        {Data: []byte("package main\n\nfunc needle() {}\n")},
+		"src/data.bin":       {Data: []byte("needle \x00 needle")},
+		"src/vendor/dep.go":  {Data: []byte("package dep // needle\n")},
+		"src/sub/README.md":  {Data: []byte("# needle\n")},
+		"other/unrelated.go": {Data: []byte("package needle\n")},
+	}
 
-	q := &query.Substring{Pattern: content}
-	res := searchForTest(t, b, q)
-	if len(res.Files) != 1 {
-		t.Fatalf("want 1 match, got %v", res.Files)
+	b := testIndexBuilder(t, nil)
+	if err := b.AddTree(fsys, "src", func(p string) bool { return path.Base(p) != "vendor" }); err != nil {
+		t.Fatalf("AddTree: %v", err)
 	}
 
-	f := res.Files[0]
-	if len(f.LineMatches) != 1 {
-		t.Fatalf("want 1 line, got %v", f.LineMatches)
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	if got, want := sortedFileNames(res.Files), []string{"main.go", "sub/README.md"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, f := range res.Files {
+		if f.FileName == "main.go" && f.Language != "Go" {
+			t.Errorf("got language %q for main.go, want Go", f.Language)
+		}
 	}
-	l := f.LineMatches[0]
 
-	if len(l.LineFragments) != 1 {
-		t.Fatalf("want 1 line fragment, got %v", l.LineFragments)
+	res = searchForTest(t, b, &query.Substring{Pattern: "NOT-INDEXED"})
+	if got, want := sortedFileNames(res.Files), []string{"data.bin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got skipped files %v, want %v", got, want)
 	}
-	fr := l.LineFragments[0]
-	if fr.MatchLength != len(content) {
-		t.Fatalf("got MatchLength %d want %d", fr.MatchLength, len(content))
+
+	if err := b.AddTree(fsys, "missing", nil); err == nil {
+		t.Error("got nil error for a missing root")
 	}
 }
 
-func TestSkipInvalidContent(t *testing.T) {
-	for _, content := range []string{
-		// Binary
-		"abc def \x00 abc",
-	} {
+func TestMaxLineLength(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "short", Content: []byte("short\nlines\n")},
+		Document{Name: "long", Content: []byte("x\n" + strings.Repeat("y", 200) + "\nz")},
+		Document{Name: "last", Content: []byte("x\n" + strings.Repeat("y", 100))},
+	)
+	s := searcherForTest(t, b)
 
-		b, err := NewIndexBuilder(nil)
+	for _, c := range []struct {
+		min  int
+		want []string
+	}{
+		{100, []string{"last", "long"}},
+		{101, []string{"long"}},
+		{1000, nil},
+	} {
+		res, err := s.Search(context.Background(), &query.MaxLineLength{Min: c.min}, &SearchOptions{})
 		if err != nil {
-			t.Fatalf("NewIndexBuilder: %v", err)
-		}
-
-		if err := b.Add(Document{
-			Name:    "f1",
-			Content: []byte(content),
-		}); err != nil {
 			t.Fatal(err)
 		}
-
-		q := &query.Substring{Pattern: "abc def"}
-		res := searchForTest(t, b, q)
-		if len(res.Files) != 0 {
-			t.Fatalf("got %v, want no results", res.Files)
+		if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Min %d: got %v, want %v", c.min, got, c.want)
 		}
-
-		q = &query.Substring{Pattern: "NOT-INDEXED"}
-		res = searchForTest(t, b, q)
-		if len(res.Files) != 1 {
-			t.Fatalf("got %v, want 1 result", res.Files)
+		// Only the (empty) symbol sections of the results are read.
+		if res.Stats.ContentBytesLoaded > int64(len(c.want)) {
+			t.Errorf("Min %d: loaded %d content bytes, want at most %d", c.min, res.Stats.ContentBytesLoaded, len(c.want))
 		}
 	}
-}
 
-func TestCheckText(t *testing.T) {
-	for _, text := range []string{"", "simple ascii", "símplé unicödé", "\uFEFFwith utf8 'bom'", "with \uFFFD unicode replacement char"} {
-		if err := CheckText([]byte(text), 20000); err != nil {
-			t.Errorf("CheckText(%q): %v", text, err)
-		}
+	// Shards without the stored lengths read the newlines.
+	d := s.(*indexData)
+	d.maxLineLengths = nil
+	res, err := s.Search(context.Background(), &query.MaxLineLength{Min: 100}, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
 	}
-	for _, text := range []string{"zero\x00byte", "xx", "0123456789abcdefghi"} {
-		if err := CheckText([]byte(text), 15); err == nil {
-			t.Errorf("CheckText(%q) succeeded", text)
-		}
+	if got, want := sortedFileNames(res.Files), []string{"last", "long"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without stored lengths: got %v, want %v", got, want)
 	}
 }
 
-func TestLineAnd(t *testing.T) {
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{Name: "f1", Content: []byte("apple\nbanana\napple banana chocolate apple pudding banana\ngrape")},
-		Document{Name: "f2", Content: []byte("apple orange\nbanana")},
-		Document{Name: "f3", Content: []byte("banana grape")},
-	)
-	pattern := "(apple)(?-s:.)*?(banana)"
-	r, _ := syntax.Parse(pattern, syntax.Perl)
-
-	q := query.Regexp{
-		Regexp:  r,
-		Content: true,
+func TestMaxLineLengthLineMax(t *testing.T) {
+	b, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatal(err)
 	}
-	res := searchForTest(t, b, &q)
-	wantRegexpCount := 1
-	if gotRegexpCount := res.RegexpsConsidered; gotRegexpCount != wantRegexpCount {
-		t.Errorf("got %d, wanted %d", gotRegexpCount, wantRegexpCount)
+	b.LineMax = 100
+	for _, d := range []Document{
+		{Name: "short", Content: []byte("short\nlines\n")},
+		{Name: "long", Content: []byte("x\n" + strings.Repeat("y", 500) + "\nz")},
+	} {
+		if err := b.Add(d); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if len(res.Files) != 1 || res.Files[0].FileName != "f1" {
-		t.Errorf("got %v, want 1 result", res.Files)
+
+	res := searchForTest(t, b, &query.MaxLineLength{Min: 200})
+	if got, want := sortedFileNames(res.Files), []string{"long"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
 	}
 }
 
-func TestLineAndFileName(t *testing.T) {
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{Name: "f1", Content: []byte("apple banana\ngrape")},
-		Document{Name: "f2", Content: []byte("apple banana\norange")},
-		Document{Name: "apple banana", Content: []byte("banana grape")},
+func TestContentHash(t *testing.T) {
+	content := []byte("the content to look up")
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("other content")},
+		Document{Name: "f2", Content: content},
 	)
-	pattern := "(apple)(?-s:.)*?(banana)"
-	r, _ := syntax.Parse(pattern, syntax.Perl)
 
-	q := query.Regexp{
-		Regexp:   r,
-		FileName: true,
+	h := crc64.New(crc64.MakeTable(crc64.ISO))
+	h.Write(content)
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	for _, prefix := range []string{sum, sum[:6], strings.ToUpper(sum[:6])} {
+		res := searchForTest(t, b, &query.ContentHash{Prefix: prefix})
+		if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, []string{"f2"}) {
+			t.Errorf("%q: got %v, want [f2]", prefix, got)
+		}
 	}
-	res := searchForTest(t, b, &q)
-	wantRegexpCount := 1
-	if gotRegexpCount := res.RegexpsConsidered; gotRegexpCount != wantRegexpCount {
-		t.Errorf("got %d, wanted %d", gotRegexpCount, wantRegexpCount)
+
+	res := searchForTest(t, b, &query.ContentHash{Prefix: ""})
+	if len(res.Files) != 2 {
+		t.Errorf("empty prefix: got %v, want all files", sortedFileNames(res.Files))
 	}
-	if len(res.Files) != 1 || res.Files[0].FileName != "apple banana" {
-		t.Errorf("got %v, want 1 result", res.Files)
+
+	s := searcherForTest(t, b)
+	if _, err := s.Search(context.Background(), &query.ContentHash{Prefix: "xyz"}, &SearchOptions{}); err == nil {
+		t.Error("got nil error for a non-hex prefix")
 	}
 }
 
-func TestMultiLineRegex(t *testing.T) {
-	b := testIndexBuilder(t, &Repository{Name: "reponame"},
-		Document{Name: "f1", Content: []byte("apple banana\ngrape")},
-		Document{Name: "f2", Content: []byte("apple orange")},
-		Document{Name: "f3", Content: []byte("grape apple")},
+func TestWholeFileRetrievalLoadsOnlyThatFile(t *testing.T) {
+	large := strings.Repeat("filler content\n", 1000)
+	want := "package main\n\nfunc main() {}\n"
+	b := testIndexBuilder(t, nil,
+		Document{Name: "large1.txt", Content: []byte(large)},
+		Document{Name: "main.go", Content: []byte(want)},
+		Document{Name: "large2.txt", Content: []byte(large)},
 	)
-	pattern := "(apple).*?[[:space:]].*?(grape)"
-	r, _ := syntax.Parse(pattern, syntax.Perl)
+	s := searcherForTest(t, b)
 
-	q := query.Regexp{
-		Regexp: r,
+	q := &query.Substring{Pattern: "main.go", FileName: true}
+	base, err := s.Search(context.Background(), q, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
 	}
-	res := searchForTest(t, b, &q)
-	wantRegexpCount := 2
-	if gotRegexpCount := res.RegexpsConsidered; gotRegexpCount != wantRegexpCount {
-		t.Errorf("got %d, wanted %d", gotRegexpCount, wantRegexpCount)
+	res, err := s.Search(context.Background(), q, &SearchOptions{Whole: true})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if len(res.Files) != 1 || res.Files[0].FileName != "f1" {
-		t.Errorf("got %v, want 1 result", res.Files)
+	if len(res.Files) != 1 || string(res.Files[0].Content) != want {
+		t.Fatalf("got %v, want main.go with its content", res.Files)
+	}
+
+	// Content is stored uncompressed per document, so retrieving a
+	// file reads just its bytes.
+	if base.Stats.FilesLoaded != 0 || res.Stats.FilesLoaded != 1 {
+		t.Errorf("got FilesLoaded %d and %d with Whole, want 0 and 1", base.Stats.FilesLoaded, res.Stats.FilesLoaded)
+	}
+	if got := res.Stats.ContentBytesLoaded - base.Stats.ContentBytesLoaded; got != int64(len(want)) {
+		t.Errorf("Whole loaded %d more bytes, want %d", got, len(want))
 	}
 }
 
-func TestSearchTypeFileName(t *testing.T) {
-	b := testIndexBuilder(t, &Repository{
-		Name: "reponame",
-	},
-		Document{Name: "f1", Content: []byte("bla the needle")},
-		Document{Name: "f2", Content: []byte("another file another\nneedle")})
+func TestFileNameUnicodeCase(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "CAFÉ.go", Content: []byte("package cafe")},
+		Document{Name: "cafe.go", Content: []byte("package cafe")},
+		Document{Name: "ΣΟΦΊΑ.txt", Content: []byte("wisdom")},
+	)
+	s := searcherForTest(t, b)
 
-	wantSingleMatch := func(res *SearchResult, want string) {
-		t.Helper()
-		fmatches := res.Files
-		if len(fmatches) != 1 {
-			t.Errorf("got %v, want 1 matches", len(fmatches))
-			return
-		}
-		if len(fmatches[0].LineMatches) != 1 {
-			t.Errorf("got %d line matches", len(fmatches[0].LineMatches))
-			return
-		}
-		var got string
-		if fmatches[0].LineMatches[0].FileName {
-			got = fmatches[0].FileName
-		} else {
-			got = fmt.Sprintf("%s:%d", fmatches[0].FileName, fmatches[0].LineMatches[0].LineFragments[0].Offset)
+	for _, tc := range []struct {
+		q    query.Q
+		want []string
+	}{
+		{&query.Substring{Pattern: "café", FileName: true}, []string{"CAFÉ.go"}},
+		{&query.Substring{Pattern: "caf", FileName: true}, []string{"CAFÉ.go", "cafe.go"}},
+		{&query.Substring{Pattern: "σοφία", FileName: true}, []string{"ΣΟΦΊΑ.txt"}},
+		{&query.Substring{Pattern: "café", FileName: true, CaseSensitive: true}, nil},
+		{&query.Regexp{Regexp: mustParseRE("café"), FileName: true}, []string{"CAFÉ.go"}},
+	} {
+		res, err := s.Search(context.Background(), tc.q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
 		}
-
-		if got != want {
-			t.Errorf("got %s, want %s", got, want)
+		if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.q, got, tc.want)
 		}
 	}
-
-	// Only return the later match in the second file
-	res := searchForTest(t, b, query.NewAnd(
-		&query.Type{
-			Type:  query.TypeFileName,
-			Child: &query.Substring{Pattern: "needle"},
-		},
-		&query.Substring{Pattern: "file"}))
-	wantSingleMatch(res, "f2:8")
-
-	// Only return a filename result
-	res = searchForTest(t, b,
-		&query.Type{
-			Type:  query.TypeFileName,
-			Child: &query.Substring{Pattern: "file"},
-		})
-	wantSingleMatch(res, "f2")
 }
 
-func TestSearchTypeLanguage(t *testing.T) {
-	b := testIndexBuilder(t, &Repository{
-		Name: "reponame",
-	},
-		Document{Name: "apex.cls", Content: []byte("public class Car extends Vehicle {")},
-		Document{Name: "tex.cls", Content: []byte(`\DeclareOption*{`)},
-		Document{Name: "hello.h", Content: []byte(`#include <stdio.h>`)},
+func TestRegexpWholeFile(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "gen.go", Content: []byte("GENERATED by tool")},
+		Document{Name: "edited.go", Content: []byte("GENERATED by tool\nfunc edited() {}")},
+		Document{Name: "other.go", Content: []byte("// GENERATED code below")},
 	)
+	s := searcherForTest(t, b)
 
-	t.Log(b.languageMap)
-
-	wantSingleMatch := func(res *SearchResult, want string) {
-		t.Helper()
-		fmatches := res.Files
-		if len(fmatches) != 1 {
-			t.Errorf("got %v, want 1 matches", len(fmatches))
-			return
-		}
-		if len(fmatches[0].LineMatches) != 1 {
-			t.Errorf("got %d line matches", len(fmatches[0].LineMatches))
-			return
-		}
-		var got string
-		if fmatches[0].LineMatches[0].FileName {
-			got = fmatches[0].FileName
-		} else {
-			got = fmt.Sprintf("%s:%d", fmatches[0].FileName, fmatches[0].LineMatches[0].LineFragments[0].Offset)
+	for _, tc := range []struct {
+		re   string
+		want []string
+	}{
+		{`^GENERATED.*$`, []string{"gen.go"}},
+		{`GENERATED`, nil},
+		{`GENERATED(.|\n)*`, []string{"edited.go", "gen.go"}},
+	} {
+		q := &query.Regexp{Regexp: mustParseRE(tc.re), Content: true, WholeFile: true}
+		res, err := s.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
 		}
-
-		if got != want {
-			t.Errorf("got %s, want %s", got, want)
+		if got := sortedFileNames(res.Files); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", q, got, tc.want)
 		}
 	}
 
-	res := searchForTest(t, b, &query.Language{Language: "Apex"})
-	wantSingleMatch(res, "apex.cls")
-
-	res = searchForTest(t, b, &query.Language{Language: "TeX"})
-	wantSingleMatch(res, "tex.cls")
-
-	res = searchForTest(t, b, &query.Language{Language: "C"})
-	wantSingleMatch(res, "hello.h")
-
-	// test fallback language search by pretending it's an older index version
-	res = searchForTest(t, b, &query.Language{Language: "C++"})
-	if len(res.Files) != 0 {
-		t.Errorf("got %d results for C++, want 0", len(res.Files))
+	// Per line, the pattern also matches the first line of edited.go.
+	res, err := s.Search(context.Background(), &query.Regexp{Regexp: mustParseRE(`^GENERATED.*$`), Content: true}, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedFileNames(res.Files), []string{"edited.go", "gen.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
 	}
-
-	b.featureVersion = 11 // force fallback
-	res = searchForTest(t, b, &query.Language{Language: "C++"})
-	wantSingleMatch(res, "hello.h")
 }
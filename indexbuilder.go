@@ -20,13 +20,17 @@ import (
 	"fmt"
 	"hash/crc64"
 	"html/template"
+	"io/fs"
 	"log"
+	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 	"unicode/utf8"
 
 	"github.com/go-enry/go-enry/v2"
+	"golang.org/x/text/encoding"
 )
 
 var _ = log.Println
@@ -194,10 +198,79 @@ type IndexBuilder struct {
 	// language codes, uint16 encoded as little-endian
 	languages []uint8
 
+	// docID => git file mode
+	fileModes []uint32
+
+	// docID => comment spans
+	commentSections [][]DocumentSection
+
+	// ngram => IDs of the documents with a symbol containing it
+	symbolNgrams map[ngram][]uint32
+
+	// CommentExtractor, if set, computes the comment spans of
+	// documents added without Comments. ExtractComments is a
+	// suitable extractor.
+	CommentExtractor func(language string, content []byte) []DocumentSection
+
+	// Encodings, if set, are tried in order to transcode documents
+	// that are not valid UTF-8 to UTF-8, for example
+	// charmap.ISO8859_1 or japanese.ShiftJIS. The transcoded content
+	// is indexed and returned, so offsets in results refer to it
+	// rather than to the original bytes. The Symbols and Comments of
+	// a transcoded document are mapped to the new offsets; if that is
+	// not possible, Add returns a *DocumentError.
+	Encodings []encoding.Encoding
+
+	// SkipContent, if set, decides per document whether to index
+	// its content. If it returns a non-empty reason, the document is
+	// added with that SkipReason: it can still be found by name and
+	// counts as a document, but its content is not indexed.
+	SkipContent func(doc *Document) string
+
+	// LineMax, if non-zero, soft-wraps lines longer than LineMax
+	// bytes when building search results, so LineMatch.Line holds
+	// the part of the line around the match rather than the whole
+	// line. We prefer to wrap after a space, and never split a rune.
+	// The content and line numbers are unchanged.
+	LineMax int
+
+	// MaxNgrams, if non-zero, caps the number of distinct content
+	// ngrams in the index. Beyond the cap, the ngrams occurring most
+	// often are left out; searches for them fall back to scanning
+	// content. The case variants of an ngram are kept or left out
+	// together.
+	MaxNgrams int
+
+	// PostingsCodec sets the encoding of the posting lists. Shards
+	// using another codec than the default PostingsDeltaVarint can
+	// only be read by zoekt versions that know about codecs.
+	PostingsCodec PostingsCodec
+
 	// IndexTime will be used as the time if non-zero. Otherwise
 	// time.Now(). This is useful for doing reproducible builds in tests.
 	IndexTime time.Time
 
+	// SkipInvalid makes Add index documents that fail with a
+	// *DocumentError as if they had a SkipReason, instead of
+	// returning the error, so one bad file does not abort a bulk
+	// build. The skipped documents, including those with binary
+	// content, are listed in Warnings.
+	SkipInvalid bool
+
+	// Duplicates sets what Add does with a document whose name was
+	// already added on one of its branches in the same repository.
+	// By default, duplicates are indexed like any other document.
+	Duplicates DuplicateMode
+
+	// SizeMax, if non-zero, is the largest content, in bytes, that
+	// Add indexes. Add returns a *DocumentError for larger documents.
+	SizeMax int
+
+	// (name, branch) pairs added to the current repository, if
+	// Duplicates is set.
+	seen     map[[2]string]struct{}
+	warnings []string
+
 	// a sortable 20 chars long id.
 	ID string
 }
@@ -232,6 +305,44 @@ func NewIndexBuilder(r *Repository) (*IndexBuilder, error) {
 	return b, nil
 }
 
+// RepoHandle refers to a repository added to an IndexBuilder with
+// AddRepository.
+type RepoHandle struct {
+	b   *IndexBuilder
+	idx int
+}
+
+// AddRepository adds another repository to the shard being built and
+// returns a handle for adding its documents with AddToRepo. Documents
+// passed to Add after this call also belong to r. The documents of a
+// repository are stored contiguously, so all documents of a repository
+// must be added before the next repository is added.
+//
+// Shards containing more than one repository are written in
+// NextIndexFormatVersion.
+func (b *IndexBuilder) AddRepository(r *Repository) (RepoHandle, error) {
+	if len(b.repoList) >= 1<<16 {
+		return RepoHandle{}, fmt.Errorf("too many repos in shard: max is %d", 1<<16)
+	}
+	if err := b.setRepository(r); err != nil {
+		return RepoHandle{}, err
+	}
+	b.indexFormatVersion = NextIndexFormatVersion
+	return RepoHandle{b: b, idx: len(b.repoList) - 1}, nil
+}
+
+// AddToRepo adds doc to the repository of h. It fails if h is not the
+// repository added last.
+func (b *IndexBuilder) AddToRepo(h RepoHandle, doc Document) error {
+	if h.b != b {
+		return fmt.Errorf("repository handle belongs to another builder")
+	}
+	if h.idx != len(b.repoList)-1 {
+		return fmt.Errorf("cannot add %q to repository %q: documents of repository %q were added since", doc.Name, b.repoList[h.idx].Name, b.repoList[len(b.repoList)-1].Name)
+	}
+	return b.Add(doc)
+}
+
 func newIndexBuilder() *IndexBuilder {
 	return &IndexBuilder{
 		indexFormatVersion: IndexFormatVersion,
@@ -245,6 +356,7 @@ func newIndexBuilder() *IndexBuilder {
 		symIndex:        make(map[string]uint32),
 		symKindIndex:    make(map[string]uint32),
 		languageMap:     map[string]uint16{},
+		symbolNgrams:    map[ngram][]uint32{},
 	}
 }
 
@@ -268,10 +380,71 @@ func (b *IndexBuilder) setRepository(desc *Repository) error {
 	}
 
 	b.repoList = append(b.repoList, repo)
+	b.seen = nil
 
 	return b.populateSubRepoIndices()
 }
 
+// DuplicateMode says how IndexBuilder.Add handles duplicate documents.
+type DuplicateMode int
+
+const (
+	// DuplicatesAllow indexes duplicate documents silently.
+	DuplicatesAllow DuplicateMode = iota
+
+	// DuplicatesWarn indexes duplicate documents, and reports them
+	// in IndexBuilder.Warnings.
+	DuplicatesWarn
+
+	// DuplicatesError makes Add return an error for duplicate
+	// documents, which are not indexed.
+	DuplicatesError
+)
+
+// DocumentError is returned by Add for a document whose content
+// cannot be indexed as given, such as one with overlapping symbol
+// sections. Other errors of Add are problems with the builder state,
+// such as an unknown branch.
+type DocumentError struct {
+	Name   string
+	Reason string
+}
+
+func (e *DocumentError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Reason)
+}
+
+// Warnings returns the problems found so far that did not stop
+// documents from being indexed, such as duplicates under
+// DuplicatesWarn, and documents skipped under SkipInvalid.
+func (b *IndexBuilder) Warnings() []string {
+	return b.warnings
+}
+
+// checkDuplicate applies b.Duplicates to doc. It returns the keys to
+// record once doc is added.
+func (b *IndexBuilder) checkDuplicate(doc *Document) ([][2]string, error) {
+	if b.Duplicates == DuplicatesAllow {
+		return nil, nil
+	}
+	branches := doc.Branches
+	if len(branches) == 0 {
+		branches = []string{""}
+	}
+	keys := make([][2]string, 0, len(branches))
+	for _, br := range branches {
+		key := [2]string{doc.Name, br}
+		if _, ok := b.seen[key]; ok {
+			if b.Duplicates == DuplicatesError {
+				return nil, fmt.Errorf("duplicate document %q on branch %q", doc.Name, br)
+			}
+			b.warnings = append(b.warnings, fmt.Sprintf("duplicate document %q on branch %q", doc.Name, br))
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
 type DocumentSection struct {
 	Start, End uint32
 }
@@ -284,6 +457,10 @@ type Document struct {
 	SubRepositoryPath string
 	Language          string
 
+	// FileMode is the git mode of the file, eg. 0100644 or 0120000
+	// for a symlink. Zero means a regular file.
+	FileMode uint32
+
 	// If set, something is wrong with the file contents, and this
 	// is the reason it wasn't indexed.
 	SkipReason string
@@ -291,6 +468,10 @@ type Document struct {
 	// Document sections for symbols. Offsets should use bytes.
 	Symbols         []DocumentSection
 	SymbolsMetaData []*Symbol
+
+	// Document sections for comments, in bytes. If nil, they are
+	// computed by IndexBuilder.CommentExtractor, if set.
+	Comments []DocumentSection
 }
 
 type symbolSlice struct {
@@ -309,11 +490,167 @@ func (s symbolSlice) Less(i, j int) bool {
 	return s.symbols[i].Start < s.symbols[j].Start
 }
 
+// CtagEntry is a symbol definition reported by an external tool, such
+// as ctags or an LSIF indexer.
+type CtagEntry struct {
+	Name       string
+	Kind       string
+	Parent     string
+	ParentKind string
+
+	// Line is the 1-based line number of the definition.
+	Line int
+
+	// Column is the 1-based byte column at which Name starts. If it
+	// is zero, the first occurrence of Name on the line is used.
+	Column int
+}
+
+// AddCtags adds the symbols in tags to d.Symbols and d.SymbolsMetaData.
+// It returns an error if a tag is outside d.Content, if Name does not
+// occur at the tag's position, or if symbols overlap.
+func (d *Document) AddCtags(tags []CtagEntry) error {
+	secs := append([]DocumentSection(nil), d.Symbols...)
+	meta := append([]*Symbol(nil), d.SymbolsMetaData...)
+	for len(meta) < len(secs) {
+		meta = append(meta, &Symbol{})
+	}
+
+	for _, t := range tags {
+		if t.Line < 1 {
+			return fmt.Errorf("ctag %s: invalid line %d", t.Name, t.Line)
+		}
+		lineStart := 0
+		for i := 1; i < t.Line; i++ {
+			nl := bytes.IndexByte(d.Content[lineStart:], '\n')
+			if nl < 0 {
+				return fmt.Errorf("ctag %s: line %d is past the end of %s", t.Name, t.Line, d.Name)
+			}
+			lineStart += nl + 1
+		}
+		line := d.Content[lineStart:]
+		if nl := bytes.IndexByte(line, '\n'); nl >= 0 {
+			line = line[:nl]
+		}
+
+		var col int
+		if t.Column > 0 {
+			col = t.Column - 1
+			if col > len(line) || !bytes.HasPrefix(line[col:], []byte(t.Name)) {
+				return fmt.Errorf("ctag %s: not found at %s:%d:%d", t.Name, d.Name, t.Line, t.Column)
+			}
+		} else if col = bytes.Index(line, []byte(t.Name)); col < 0 {
+			return fmt.Errorf("ctag %s: not found on %s:%d", t.Name, d.Name, t.Line)
+		}
+
+		start := uint32(lineStart + col)
+		secs = append(secs, DocumentSection{Start: start, End: start + uint32(len(t.Name))})
+		meta = append(meta, &Symbol{
+			Sym:        t.Name,
+			Kind:       t.Kind,
+			Parent:     t.Parent,
+			ParentKind: t.ParentKind,
+		})
+	}
+
+	sort.Sort(symbolSlice{secs, meta})
+	for i := 1; i < len(secs); i++ {
+		if secs[i-1].End > secs[i].Start {
+			return fmt.Errorf("ctags for %s overlap at byte %d", d.Name, secs[i].Start)
+		}
+	}
+
+	d.Symbols = secs
+	d.SymbolsMetaData = meta
+	return nil
+}
+
 // AddFile is a convenience wrapper for Add
 func (b *IndexBuilder) AddFile(name string, content []byte) error {
 	return b.Add(Document{Name: name, Content: content})
 }
 
+// addTreeTrigramMax is the maximum number of distinct trigrams in a
+// text file added by AddTree. It matches the default of the build
+// package.
+const addTreeTrigramMax = 20000
+
+// AddTreeError lists the files that AddTree failed to add.
+type AddTreeError struct {
+	// Errors maps file paths to their errors.
+	Errors map[string]error
+}
+
+func (e *AddTreeError) Error() string {
+	var paths []string
+	for p := range e.Errors {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var msgs []string
+	for _, p := range paths {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", p, e.Errors[p]))
+	}
+	return fmt.Sprintf("%d files failed: %s", len(paths), strings.Join(msgs, "; "))
+}
+
+// AddTree adds the regular files below root in fsys. Document names
+// are relative to root. If filter is non-nil, only the files and
+// directories for which it returns true are visited. Files that do
+// not look like text, see CheckText, are added with a SkipReason.
+//
+// AddTree adds as many files as it can. If some fail, it returns an
+// *AddTreeError listing them.
+func (b *IndexBuilder) AddTree(fsys fs.FS, root string, filter func(path string) bool) error {
+	errs := map[string]error{}
+	err := fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			errs[p] = err
+			return nil
+		}
+		if p != root && filter != nil && !filter(p) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		content, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			errs[p] = err
+			return nil
+		}
+
+		name := p
+		if root != "." {
+			name = strings.TrimPrefix(p, path.Clean(root)+"/")
+		}
+		doc := Document{Name: name, Content: content}
+		if err := CheckText(content, addTreeTrigramMax); err != nil {
+			doc.SkipReason = err.Error()
+			doc.Language = "binary"
+		}
+		if err := b.Add(doc); err != nil {
+			errs[p] = err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &AddTreeError{Errors: errs}
+	}
+	return nil
+}
+
 // CheckText returns a reason why the given contents are probably not source texts.
 func CheckText(content []byte, maxTrigramCount int) error {
 	if len(content) == 0 {
@@ -379,6 +716,35 @@ func mkSubRepoIndices(repo Repository) map[string]uint32 {
 
 const notIndexedMarker = "NOT-INDEXED: "
 
+// inSubRepo returns whether name can be in the subrepository at
+// subRepoPath. The empty path is the repository itself.
+func inSubRepo(name, subRepoPath string) bool {
+	if subRepoPath == "" {
+		return true
+	}
+	rel, err := filepath.Rel(subRepoPath, name)
+	return err == nil && rel != name
+}
+
+// checkRuneBoundaries returns an error if a boundary of the sorted
+// secs splits a rune of content, which newSearchableString cannot
+// map to a rune offset.
+func checkRuneBoundaries(content []byte, secs []DocumentSection) error {
+	i := 0
+	for _, s := range secs {
+		for _, off := range []uint32{s.Start, s.End} {
+			for uint32(i) < off {
+				_, sz := utf8.DecodeRune(content[i:])
+				i += sz
+			}
+			if uint32(i) != off {
+				return fmt.Errorf("no rune for section boundary at byte %d", off)
+			}
+		}
+	}
+	return nil
+}
+
 func (b *IndexBuilder) symbolID(sym string) uint32 {
 	if _, ok := b.symIndex[sym]; !ok {
 		b.symIndex[sym] = b.symID
@@ -411,17 +777,74 @@ func (b *IndexBuilder) addSymbols(symbols []*Symbol) {
 
 // Add a file which only occurs in certain branches.
 func (b *IndexBuilder) Add(doc Document) error {
+	seenKeys, err := b.checkDuplicate(&doc)
+	if err != nil {
+		return err
+	}
+
+	// The skip reason is decided once, so a retry below does not
+	// call SkipContent again.
+	err = b.transcode(&doc)
+	if err == nil {
+		if doc.SkipReason == "" && b.SkipContent != nil {
+			doc.SkipReason = b.SkipContent(&doc)
+		}
+		err = b.add(doc, seenKeys)
+	}
+	if docErr, ok := err.(*DocumentError); ok && b.SkipInvalid {
+		doc.SkipReason = docErr.Reason
+		if !inSubRepo(doc.Name, doc.SubRepositoryPath) {
+			// Keep it in the repository itself.
+			doc.SubRepositoryPath = ""
+		}
+		err = b.add(doc, seenKeys)
+	}
+	return err
+}
+
+// transcode converts the content of doc to UTF-8, see Encodings.
+func (b *IndexBuilder) transcode(doc *Document) error {
+	if len(b.Encodings) == 0 {
+		return nil
+	}
+	out, enc := transcode(doc.Content, b.Encodings)
+	if enc != nil && doc.SkipReason == "" {
+		// Copy the sections, which belong to the caller.
+		symbols := append([]DocumentSection(nil), doc.Symbols...)
+		var comments []DocumentSection
+		if doc.Comments != nil {
+			comments = append([]DocumentSection{}, doc.Comments...)
+		}
+		if err := transcodeSections(doc.Content, out, enc, symbols, comments); err != nil {
+			return &DocumentError{Name: doc.Name, Reason: err.Error()}
+		}
+		doc.Symbols, doc.Comments = symbols, comments
+	}
+	doc.Content = out
+	return nil
+}
+
+// add indexes doc. It returns *DocumentError before changing b.
+func (b *IndexBuilder) add(doc Document, seenKeys [][2]string) error {
 	hasher := crc64.New(crc64.MakeTable(crc64.ISO))
 
+	if doc.SkipReason == "" && b.SizeMax > 0 && len(doc.Content) > b.SizeMax {
+		return &DocumentError{doc.Name, fmt.Sprintf("content size %d is too large, maximum is %d", len(doc.Content), b.SizeMax)}
+	}
+
 	if idx := bytes.IndexByte(doc.Content, 0); idx >= 0 {
 		doc.SkipReason = fmt.Sprintf("binary content at byte offset %d", idx)
 		doc.Language = "binary"
 	}
 
 	if doc.SkipReason != "" {
+		if b.SkipInvalid {
+			b.warnings = append(b.warnings, fmt.Sprintf("skipped document %q: %s", doc.Name, doc.SkipReason))
+		}
 		doc.Content = []byte(notIndexedMarker + doc.SkipReason)
 		doc.Symbols = nil
 		doc.SymbolsMetaData = nil
+		doc.Comments = nil
 		if doc.Language == "" {
 			doc.Language = "skipped"
 		}
@@ -441,32 +864,33 @@ func (b *IndexBuilder) Add(doc Document) error {
 	for i, s := range doc.Symbols {
 		if i > 0 {
 			if last.End > s.Start {
-				return fmt.Errorf("sections overlap")
+				return &DocumentError{doc.Name, "sections overlap"}
 			}
 		}
 		last = s
 	}
 	if last.End > uint32(len(doc.Content)) {
-		return fmt.Errorf("section goes past end of content")
+		return &DocumentError{doc.Name, "section goes past end of content"}
+	}
+	if err := checkRuneBoundaries(doc.Content, doc.Symbols); err != nil {
+		return &DocumentError{doc.Name, err.Error()}
 	}
 
-	if doc.SubRepositoryPath != "" {
-		rel, err := filepath.Rel(doc.SubRepositoryPath, doc.Name)
-		if err != nil || rel == doc.Name {
-			return fmt.Errorf("path %q must start subrepo path %q", doc.Name, doc.SubRepositoryPath)
-		}
+	if doc.Comments == nil && doc.SkipReason == "" && b.CommentExtractor != nil {
+		doc.Comments = b.CommentExtractor(doc.Language, doc.Content)
 	}
-	b.contentBloom.addBytes(doc.Content)
-	b.nameBloom.addBytes([]byte(doc.Name))
-	docStr, runeSecs, err := b.contentPostings.newSearchableString(doc.Content, doc.Symbols)
-	if err != nil {
-		return err
+	for i, s := range doc.Comments {
+		if s.Start > s.End || (i > 0 && doc.Comments[i-1].End > s.Start) {
+			return &DocumentError{doc.Name, "comment sections overlap or are unsorted"}
+		}
+		if s.End > uint32(len(doc.Content)) {
+			return &DocumentError{doc.Name, "comment section goes past end of content"}
+		}
 	}
-	nameStr, _, err := b.namePostings.newSearchableString([]byte(doc.Name), nil)
-	if err != nil {
-		return err
+
+	if !inSubRepo(doc.Name, doc.SubRepositoryPath) {
+		return &DocumentError{doc.Name, fmt.Sprintf("path must start subrepo path %q", doc.SubRepositoryPath)}
 	}
-	b.addSymbols(doc.SymbolsMetaData)
 
 	repoIdx := len(b.repoList) - 1
 	subRepoIdx, ok := b.subRepoIndices[repoIdx][doc.SubRepositoryPath]
@@ -487,6 +911,19 @@ func (b *IndexBuilder) Add(doc Document) error {
 		return fmt.Errorf("too many repos in shard: max is %d", 1<<16)
 	}
 
+	b.contentBloom.addBytes(doc.Content)
+	b.nameBloom.addBytes([]byte(doc.Name))
+	docStr, runeSecs, err := b.contentPostings.newSearchableString(doc.Content, doc.Symbols)
+	if err != nil {
+		return err
+	}
+	nameStr, _, err := b.namePostings.newSearchableString([]byte(doc.Name), nil)
+	if err != nil {
+		return err
+	}
+	b.addSymbols(doc.SymbolsMetaData)
+
+	b.addSymbolNgrams(uint32(len(b.contentStrings)), doc.Content, doc.Symbols)
 	b.subRepos = append(b.subRepos, subRepoIdx)
 	b.repos = append(b.repos, uint16(repoIdx))
 
@@ -510,10 +947,32 @@ func (b *IndexBuilder) Add(doc Document) error {
 		b.languageMap[doc.Language] = langCode
 	}
 	b.languages = append(b.languages, uint8(langCode), uint8(langCode>>8))
+	b.fileModes = append(b.fileModes, doc.FileMode)
+	b.commentSections = append(b.commentSections, doc.Comments)
+
+	if len(seenKeys) > 0 && b.seen == nil {
+		b.seen = map[[2]string]struct{}{}
+	}
+	for _, k := range seenKeys {
+		b.seen[k] = struct{}{}
+	}
 
 	return nil
 }
 
+// addSymbolNgrams adds docID to the symbol ngram index for the ngrams
+// of its symbol sections.
+func (b *IndexBuilder) addSymbolNgrams(docID uint32, content []byte, secs []DocumentSection) {
+	for _, s := range secs {
+		for _, g := range splitNGrams(content[s.Start:s.End]) {
+			docs := b.symbolNgrams[g.ngram]
+			if len(docs) == 0 || docs[len(docs)-1] != docID {
+				b.symbolNgrams[g.ngram] = append(docs, docID)
+			}
+		}
+	}
+}
+
 func (b *IndexBuilder) branchMask(br string) uint64 {
 	for i, b := range b.repoList[len(b.repoList)-1].Branches {
 		if b.Name == br {
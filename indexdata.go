@@ -15,6 +15,7 @@
 package zoekt
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"hash/crc64"
@@ -33,6 +34,15 @@ type indexData struct {
 
 	file IndexFile
 
+	// contentCache, if set, caches contents and newlines. Entries
+	// are keyed by shardID.
+	contentCache *ContentCache
+	shardID      uint64
+
+	// languageAliases maps language names to go-enry names for
+	// shards without language detection. See SetLanguageAliases.
+	languageAliases map[string]string
+
 	ngrams combinedNgramOffset
 
 	newlinesStart uint32
@@ -41,6 +51,10 @@ type indexData struct {
 	docSectionsStart uint32
 	docSectionsIndex []uint32
 
+	// Empty for shards without comment spans.
+	commentSectionsStart uint32
+	commentSectionsIndex []uint32
+
 	runeDocSections []byte
 
 	// rune offset=>byte offset mapping, relative to the start of the content corpus
@@ -57,6 +71,11 @@ type indexData struct {
 	fileNameIndex   []uint32
 	fileNameNgrams  map[ngram][]byte
 
+	// symbolNgrams maps ngrams to the IDs of the documents with a
+	// symbol containing them, as sized deltas. It is empty for shards
+	// written before the symbol ngram index was added.
+	symbolNgrams map[ngram][]byte
+
 	// fileEndSymbol[i] is the index of the first symbol for document i.
 	fileEndSymbol []uint32
 
@@ -86,6 +105,14 @@ type indexData struct {
 	// languages for all the files.
 	languages []byte
 
+	// git file modes for all the files. Empty for shards written
+	// before file modes were stored.
+	fileModes []uint32
+
+	// length in bytes of the longest line of all the files. Empty
+	// for shards written before it was stored.
+	maxLineLengths []uint32
+
 	// inverse of LanguageMap in metaData
 	languageMap map[uint16]string
 
@@ -166,6 +193,38 @@ func (d *indexData) getChecksum(idx uint32) []byte {
 	return d.checksums[start : start+crc64.Size]
 }
 
+// skipped returns whether document idx was added with a SkipReason,
+// in which case its content is the reason rather than the file.
+func (d *indexData) skipped(idx uint32) bool {
+	n := uint32(len(notIndexedMarker))
+	if d.boundaries[idx+1]-d.boundaries[idx] < n {
+		return false
+	}
+	prefix, err := d.readContentSlice(d.boundaries[idx], n)
+	return err == nil && string(prefix) == notIndexedMarker
+}
+
+// getMaxLineLength returns the length of the longest line of
+// document idx. For older shards, it reads the newlines of the
+// document.
+func (d *indexData) getMaxLineLength(idx uint32) (uint32, error) {
+	if len(d.maxLineLengths) > 0 {
+		return d.maxLineLengths[idx], nil
+	}
+	nls, _, err := d.readNewlines(idx, nil)
+	if err != nil {
+		return 0, err
+	}
+	return maxLineLength(nls, d.boundaries[idx+1]-d.boundaries[idx]), nil
+}
+
+func (d *indexData) getFileMode(idx uint32) uint32 {
+	if len(d.fileModes) == 0 {
+		return 0
+	}
+	return d.fileModes[idx]
+}
+
 func (d *indexData) getLanguage(idx uint32) uint16 {
 	if d.metaData.IndexFeatureVersion < 12 {
 		// older zoekt files had 8-bit language entries
@@ -306,11 +365,11 @@ func (d *indexData) String() string {
 func (d *indexData) memoryUse() int {
 	sz := 0
 	for _, a := range [][]uint32{
-		d.newlinesIndex, d.docSectionsIndex,
+		d.newlinesIndex, d.docSectionsIndex, d.commentSectionsIndex,
 		d.boundaries, d.fileNameIndex,
 		d.fileEndRunes, d.fileNameEndRunes,
 		d.fileEndSymbol, d.symbols.symKindIndex,
-		d.subRepos,
+		d.subRepos, d.fileModes, d.maxLineLengths,
 	} {
 		sz += 4 * len(a)
 	}
@@ -323,6 +382,7 @@ func (d *indexData) memoryUse() int {
 	sz += 8 * len(d.fileBranchMasks)
 	sz += d.ngrams.SizeBytes()
 	sz += 12 * len(d.fileNameNgrams) // these slices reference mmap-ed memory
+	sz += 12 * len(d.symbolNgrams)
 	return sz
 }
 
@@ -367,14 +427,22 @@ type ngramIterationResults struct {
 	fileName      bool
 	substrBytes   []byte
 	substrLowered []byte
+
+	// bloomAdmitted is set if a bloom filter was consulted and did
+	// not rule out the pattern.
+	bloomAdmitted bool
+
+	// selection lists the ngrams looked up, for
+	// SearchOptions.DebugNgrams.
+	selection []NgramStat
 }
 
 func (r *ngramIterationResults) String() string {
 	return fmt.Sprintf("wrapper(%v)", r.matchIterator)
 }
 
-func (r *ngramIterationResults) candidates() []*candidateMatch {
-	cs := r.matchIterator.candidates()
+func (r *ngramIterationResults) candidates(limit int) []*candidateMatch {
+	cs := r.matchIterator.candidates(limit)
 	for _, c := range cs {
 		c.caseSensitive = r.caseSensitive
 		c.fileName = r.fileName
@@ -384,30 +452,33 @@ func (r *ngramIterationResults) candidates() []*candidateMatch {
 	return cs
 }
 
+// iterateNgrams returns an iterator over the candidate matches of
+// query. It returns nil if none of the query's ngrams are indexed, but
+// may still match, in which case the caller should scan the content.
 func (d *indexData) iterateNgrams(query *query.Substring) (*ngramIterationResults, error) {
 	str := query.Pattern
 
+	var bloomAdmitted bool
 	if len(query.Pattern) >= bloomHashMinWordLength {
 		// test against appropriate content or filename bloom filters
-		pat := []byte(query.Pattern)
-		var match bool
+		b := &d.bloomContents
 		if query.FileName {
-			match = d.bloomNames.maybeHasBytes(pat)
-		} else {
-			match = d.bloomContents.maybeHasBytes(pat)
+			b = &d.bloomNames
 		}
-		if !match {
+		if !b.maybeHasBytes([]byte(query.Pattern)) {
 			return &ngramIterationResults{
 				matchIterator: &noMatchTree{
 					Why: "bloomfilter",
 				},
 			}, nil
 		}
+		bloomAdmitted = b.hasher != nil
 	}
 
 	// Find the 2 least common ngrams from the string.
 	ngramOffs := splitNGrams([]byte(query.Pattern))
 	frequencies := make([]uint32, 0, len(ngramOffs))
+	indexed := 0
 	for _, o := range ngramOffs {
 		var freq uint32
 		if query.CaseSensitive {
@@ -419,24 +490,48 @@ func (d *indexData) iterateNgrams(query *query.Substring) (*ngramIterationResult
 		}
 
 		if freq == 0 {
-			return &ngramIterationResults{
-				matchIterator: &noMatchTree{
-					Why: "freq=0",
-				},
-			}, nil
+			if d.metaData.NgramsDropped && !query.FileName {
+				// The ngram may have been left out of the index, so
+				// it does not rule out a match.
+				freq = maxUInt32
+			} else {
+				return &ngramIterationResults{
+					matchIterator: &noMatchTree{
+						Why: "freq=0",
+					},
+				}, nil
+			}
+		} else {
+			indexed++
 		}
 
 		frequencies = append(frequencies, freq)
 	}
+	if indexed == 0 {
+		return nil, nil
+	}
 	firstI := firstMinarg(frequencies)
+	firstFreq := frequencies[firstI]
 	frequencies[firstI] = maxUInt32
 	lastI := lastMinarg(frequencies)
+	if indexed == 1 {
+		lastI = firstI
+	}
+	lastFreq := frequencies[lastI]
+	if lastI == firstI {
+		lastFreq = firstFreq
+	}
 	if firstI > lastI {
 		lastI, firstI = firstI, lastI
+		firstFreq, lastFreq = lastFreq, firstFreq
 	}
 
 	firstNG := ngramOffs[firstI].ngram
 	lastNG := ngramOffs[lastI].ngram
+	selection := []NgramStat{{Pattern: str, Ngram: firstNG.String(), Candidates: int(firstFreq)}}
+	if firstI != lastI {
+		selection = append(selection, NgramStat{Pattern: str, Ngram: lastNG.String(), Candidates: int(lastFreq)})
+	}
 	iter := &ngramDocIterator{
 		leftPad:  firstI,
 		rightPad: uint32(utf8.RuneCountInString(str)) - firstI,
@@ -471,6 +566,8 @@ func (d *indexData) iterateNgrams(query *query.Substring) (*ngramIterationResult
 		fileName:      query.FileName,
 		substrBytes:   patBytes,
 		substrLowered: lowerPatBytes,
+		bloomAdmitted: bloomAdmitted,
+		selection:     selection,
 	}, nil
 }
 
@@ -478,12 +575,128 @@ func (d *indexData) fileName(i uint32) []byte {
 	return d.fileNameContent[d.fileNameIndex[i]:d.fileNameIndex[i+1]]
 }
 
+// Postings implements PostingsLister.
+func (d *indexData) Postings(ngramStr string) ([]uint32, error) {
+	rs := []rune(ngramStr)
+	if len(rs) != ngramSize {
+		return nil, fmt.Errorf("ngram %q must have %d runes", ngramStr, ngramSize)
+	}
+	return d.ngramDocs(runesToNGram([ngramSize]rune{rs[0], rs[1], rs[2]}), true)
+}
+
+// ngramDocs returns the sorted IDs of the documents whose content
+// contains ng.
+func (d *indexData) ngramDocs(ng ngram, caseSensitive bool) ([]uint32, error) {
+	it, err := d.trigramHitIterator(ng, caseSensitive, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []uint32
+	doc := uint32(0)
+	for off := it.first(); off != maxUInt32; off = it.first() {
+		for doc < uint32(len(d.fileEndRunes)) && d.fileEndRunes[doc] <= off {
+			doc++
+		}
+		if len(docs) == 0 || docs[len(docs)-1] != doc {
+			docs = append(docs, doc)
+		}
+		it.next(off)
+	}
+	return docs, nil
+}
+
+// IntersectPostings returns the document IDs that are in all of the
+// sorted lists, for example those returned by PostingsLister.Postings
+// for the ngrams of a longer term.
+func IntersectPostings(lists ...[]uint32) []uint32 {
+	if len(lists) == 0 {
+		return nil
+	}
+	res := append([]uint32(nil), lists[0]...)
+	for _, l := range lists[1:] {
+		out := res[:0]
+		i, j := 0, 0
+		for i < len(res) && j < len(l) {
+			switch {
+			case res[i] < l[j]:
+				i++
+			case res[i] > l[j]:
+				j++
+			default:
+				out = append(out, res[i])
+				i++
+				j++
+			}
+		}
+		res = out
+	}
+	return res
+}
+
+// symbolDocs returns the sorted IDs of the documents with a symbol
+// that contains all the ngrams of q.Pattern, according to the symbol
+// ngram index. It returns false if the shard has no symbol ngram index
+// or the pattern is shorter than an ngram.
+func (d *indexData) symbolDocs(q *query.Substring) ([]uint32, bool) {
+	if len(d.symbolNgrams) == 0 {
+		return nil, false
+	}
+	ngrams := splitNGrams([]byte(q.Pattern))
+	if len(ngrams) == 0 {
+		return nil, false
+	}
+
+	var docs []uint32
+	for i, g := range ngrams {
+		variants := []ngram{g.ngram}
+		if !q.CaseSensitive {
+			variants = generateCaseNgrams(g.ngram)
+		}
+		var union []uint32
+		for _, v := range variants {
+			if blob, ok := d.symbolNgrams[v]; ok {
+				union = unionPostings(union, fromSizedDeltas(blob, nil))
+			}
+		}
+		if i == 0 {
+			docs = union
+		} else {
+			docs = IntersectPostings(docs, union)
+		}
+		if len(docs) == 0 {
+			break
+		}
+	}
+	return docs, true
+}
+
+// unionPostings merges the sorted lists a and b.
+func unionPostings(a, b []uint32) []uint32 {
+	out := make([]uint32, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			out, a = append(out, a[0]), a[1:]
+		case a[0] > b[0]:
+			out, b = append(out, b[0]), b[1:]
+		default:
+			out, a, b = append(out, a[0]), a[1:], b[1:]
+		}
+	}
+	out = append(out, a...)
+	return append(out, b...)
+}
+
 func (d *indexData) numDocs() uint32 {
 	return uint32(len(d.fileBranchMasks))
 }
 
 func (s *indexData) Close() {
 	s.file.Close()
+	if s.contentCache != nil {
+		s.contentCache.purge(s.shardID)
+	}
 }
 
 const (
@@ -491,10 +704,14 @@ const (
 	rawConfigNo  = 2
 )
 
+// rawConfigFlags are the RawConfig keys encoded by encodeRawConfig, in
+// order of their bits.
+var rawConfigFlags = []string{"public", "fork", "archived"}
+
 // encodeRawConfig encodes a rawConfig map into a uint8 mask.
 func encodeRawConfig(rawConfig map[string]string) uint8 {
 	var encoded uint8
-	for i, f := range []string{"public", "fork", "archived"} {
+	for i, f := range rawConfigFlags {
 		var e uint8
 		v, ok := rawConfig[f]
 		if ok && v == "1" {
@@ -506,3 +723,67 @@ func encodeRawConfig(rawConfig map[string]string) uint8 {
 	}
 	return encoded
 }
+
+// decodeRawConfig sets the flags encoded in mask in rawConfig, to "1"
+// or "0".
+func decodeRawConfig(mask uint8, rawConfig map[string]string) {
+	for i, f := range rawConfigFlags {
+		if (mask>>(2*i))&rawConfigYes != 0 {
+			rawConfig[f] = "1"
+		} else {
+			rawConfig[f] = "0"
+		}
+	}
+}
+
+func (d *indexData) DuplicateGroups(ctx context.Context) ([][]DuplicateFile, error) {
+	type key struct {
+		repo     uint16
+		checksum string
+	}
+	groups := map[key]int{}
+	var all [][]DuplicateFile
+	for i := uint32(0); int(i) < len(d.repos); i++ {
+		repo := d.repos[i]
+		// The content of skipped files is their skip reason, which
+		// is the same for many files.
+		if d.repoMetaData[repo].Tombstone || d.skipped(i) {
+			continue
+		}
+		k := key{repo, string(d.getChecksum(i))}
+		j, ok := groups[k]
+		if !ok {
+			j = len(all)
+			groups[k] = j
+			all = append(all, nil)
+		}
+		all[j] = append(all[j], DuplicateFile{
+			Repository: d.repoMetaData[repo].Name,
+			FileName:   string(d.fileName(i)),
+		})
+	}
+
+	var dups [][]DuplicateFile
+	for _, g := range all {
+		if len(g) > 1 {
+			dups = append(dups, g)
+		}
+	}
+	return dups, nil
+}
+
+func (d *indexData) RawConfig(ctx context.Context) (map[string]map[string]string, error) {
+	res := make(map[string]map[string]string, len(d.repoMetaData))
+	for i, md := range d.repoMetaData {
+		if md.Tombstone {
+			continue
+		}
+		rc := make(map[string]string, len(md.RawConfig)+len(rawConfigFlags))
+		for k, v := range md.RawConfig {
+			rc[k] = v
+		}
+		decodeRawConfig(d.rawConfigMasks[i], rc)
+		res[md.Name] = rc
+	}
+	return res, nil
+}
@@ -14,6 +14,23 @@ type MockSearcher struct {
 
 	WantList query.Q
 	RepoList *zoekt.RepoList
+
+	WantFileNames query.Q
+	FileNameList  []string
+
+	WantCount  query.Q
+	CountValue int64
+
+	Branches map[string][]zoekt.FileBranch
+
+	WantSuggest query.Q
+	Suggestions []string
+
+	Contents map[string][]byte
+
+	Duplicates [][]zoekt.DuplicateFile
+
+	RawConfigs map[string]map[string]string
 }
 
 func (s *MockSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
@@ -30,6 +47,53 @@ func (s *MockSearcher) List(ctx context.Context, q query.Q, opts *zoekt.ListOpti
 	return s.RepoList, nil
 }
 
+func (s *MockSearcher) FileNames(ctx context.Context, q query.Q) ([]string, error) {
+	if q.String() != s.WantFileNames.String() {
+		return nil, fmt.Errorf("got query %s != %s", q.String(), s.WantFileNames.String())
+	}
+	return s.FileNameList, nil
+}
+
+func (s *MockSearcher) Count(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (int64, zoekt.Stats, error) {
+	if q.String() != s.WantCount.String() {
+		return 0, zoekt.Stats{}, fmt.Errorf("got query %s != %s", q.String(), s.WantCount.String())
+	}
+	return s.CountValue, zoekt.Stats{MatchCount: int(s.CountValue)}, nil
+}
+
+func (s *MockSearcher) FileBranches(ctx context.Context, fileName string) ([]zoekt.FileBranch, error) {
+	return s.Branches[fileName], nil
+}
+
+func (s *MockSearcher) Suggest(ctx context.Context, q query.Q) ([]string, error) {
+	if q.String() != s.WantSuggest.String() {
+		return nil, fmt.Errorf("got query %s != %s", q.String(), s.WantSuggest.String())
+	}
+	return s.Suggestions, nil
+}
+
+func (s *MockSearcher) ContentWindow(ctx context.Context, fileName string, start, end uint32) ([]byte, error) {
+	content, ok := s.Contents[fileName]
+	if !ok {
+		return nil, zoekt.ErrFileNotFound
+	}
+	if end > uint32(len(content)) {
+		end = uint32(len(content))
+	}
+	if start > end {
+		start = end
+	}
+	return content[start:end], nil
+}
+
+func (s *MockSearcher) DuplicateGroups(ctx context.Context) ([][]zoekt.DuplicateFile, error) {
+	return s.Duplicates, nil
+}
+
+func (s *MockSearcher) RawConfig(ctx context.Context) (map[string]map[string]string, error) {
+	return s.RawConfigs, nil
+}
+
 func (*MockSearcher) Close() {}
 
 func (*MockSearcher) String() string {
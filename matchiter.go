@@ -36,10 +36,18 @@ type candidateMatch struct {
 	runeOffset  uint32
 	byteOffset  uint32
 	byteMatchSz uint32
+
+	// groups holds the start and end byte offsets of the capture
+	// groups of a regexp match, or -1 for groups that did not match.
+	groups []int
 }
 
 // Matches content against the substring, and populates byteMatchSz on success
 func (m *candidateMatch) matchContent(content []byte) bool {
+	if int(m.byteOffset)+len(m.substrBytes) > len(content) && (m.caseSensitive || int(m.byteOffset) > len(content)) {
+		// The content may be cut by SearchOptions.HeaderBytes.
+		return false
+	}
 	if m.caseSensitive {
 		comp := bytes.Equal(m.substrBytes, content[m.byteOffset:m.byteOffset+uint32(len(m.substrBytes))])
 
@@ -86,7 +94,9 @@ func (m *candidateMatch) line(newlines []uint32, fileSize uint32) (lineNum, line
 type matchIterator interface {
 	docIterator
 
-	candidates() []*candidateMatch
+	// candidates returns the next candidates of the current
+	// document, at most limit of them if limit is non-zero.
+	candidates(limit int) []*candidateMatch
 	updateStats(*Stats)
 }
 
@@ -99,7 +109,7 @@ func (t *noMatchTree) String() string {
 	return fmt.Sprintf("not(%q)", t.Why)
 }
 
-func (t *noMatchTree) candidates() []*candidateMatch {
+func (t *noMatchTree) candidates(limit int) []*candidateMatch {
 	return nil
 }
 
@@ -176,7 +186,7 @@ func (i *ngramDocIterator) updateStats(s *Stats) {
 	s.NgramMatches += i.matchCount
 }
 
-func (i *ngramDocIterator) candidates() []*candidateMatch {
+func (i *ngramDocIterator) candidates(limit int) []*candidateMatch {
 	if i.fileIdx >= uint32(len(i.ends)) {
 		return nil
 	}
@@ -188,7 +198,7 @@ func (i *ngramDocIterator) candidates() []*candidateMatch {
 	fileEnd := i.ends[i.fileIdx]
 
 	var candidates []*candidateMatch
-	for {
+	for limit == 0 || len(candidates) < limit {
 		p1 := i.iter.first()
 		if p1 == maxUInt32 || p1 >= i.ends[i.fileIdx] {
 			break
@@ -15,10 +15,14 @@
 package zoekt
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"math/bits"
 	"regexp"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/google/zoekt/query"
@@ -112,8 +116,23 @@ type andMatchTree struct {
 	children []matchTree
 }
 
+// lineAndNotMatchTree matches the lines on which positive matches and
+// negative does not, see query.LineAndNot.
+type lineAndNotMatchTree struct {
+	positive matchTree
+	negative matchTree
+
+	// mutable
+	current []*candidateMatch
+}
+
 type orMatchTree struct {
 	children []matchTree
+
+	// lazy is set if only whether the document matches is needed, so
+	// the children after the first matching one need not be
+	// evaluated.
+	lazy bool
 }
 
 type notMatchTree struct {
@@ -135,6 +154,22 @@ type regexpMatchTree struct {
 
 	fileName bool
 
+	// captureGroups is set if the matches should report capture groups.
+	captureGroups bool
+
+	// subwordBoundary is set if matches must start at a subword
+	// boundary, see query.Substring.SubwordBoundary.
+	subwordBoundary bool
+
+	// excludeComments and onlyComments restrict matches to code or to
+	// comments, see query.Substring.
+	excludeComments bool
+	onlyComments    bool
+
+	// maxStartOffset, if non-zero, bounds the offset of content
+	// matches, see query.Substring.MaxStartOffset.
+	maxStartOffset uint32
+
 	// mutable
 	reEvaluated bool
 	found       []*candidateMatch
@@ -150,9 +185,17 @@ type substrMatchTree struct {
 	caseSensitive bool
 	fileName      bool
 
+	// batchSize, if non-zero, bounds the number of candidates that
+	// are fetched from the iterator before they are confirmed.
+	batchSize int
+
 	// mutable
 	current       []*candidateMatch
 	contEvaluated bool
+
+	// more is set if the iterator may have more candidates for the
+	// current document than those in current.
+	more bool
 }
 
 type branchQueryMatchTree struct {
@@ -168,7 +211,8 @@ type branchQueryMatchTree struct {
 type symbolRegexpMatchTree struct {
 	matchTree
 	regexp *regexp.Regexp
-	all    bool // skips regex match if .*
+	all    bool   // skips regex match if .*
+	kind   string // if set, only symbols of this kind match
 
 	reEvaluated bool
 	found       []*candidateMatch
@@ -188,15 +232,20 @@ func (t *symbolRegexpMatchTree) matches(cp *contentProvider, cost int, known map
 	}
 
 	sections := cp.docSections()
-	content := cp.data(false)
 
 	found := t.found[:0]
 	for i, sec := range sections {
+		if sec.End > cp.contentEnd() {
+			break
+		}
+		if t.kind != "" && cp.symbolKind(uint32(i)) != t.kind {
+			continue
+		}
 		var idx []int
 		if t.all {
 			idx = []int{0, int(sec.End - sec.Start)}
 		} else {
-			idx = t.regexp.FindIndex(content[sec.Start:sec.End])
+			idx = t.regexp.FindIndex(cp.contentSlice(sec.Start, sec.End))
 			if idx == nil {
 				continue
 			}
@@ -227,10 +276,35 @@ type symbolSubstrMatchTree struct {
 	sections []DocumentSection
 
 	secID uint32
+
+	// if set, only symbols of this kind match.
+	kind string
+
+	// symbolDocs, if useSymbolDocs is set, are the documents left to
+	// visit according to the symbol ngram index.
+	symbolDocs    []uint32
+	useSymbolDocs bool
+}
+
+// nextDoc skips the documents whose symbols cannot contain the
+// pattern, so their content candidates are not confirmed.
+func (t *symbolSubstrMatchTree) nextDoc() uint32 {
+	doc := t.substrMatchTree.nextDoc()
+	if !t.useSymbolDocs {
+		return doc
+	}
+	for len(t.symbolDocs) > 0 && t.symbolDocs[0] < doc {
+		t.symbolDocs = t.symbolDocs[1:]
+	}
+	if len(t.symbolDocs) == 0 {
+		return maxUInt32
+	}
+	return t.symbolDocs[0]
 }
 
 func (t *symbolSubstrMatchTree) prepare(doc uint32) {
 	t.substrMatchTree.prepare(doc)
+	t.substrMatchTree.fetchAll()
 	t.doc = doc
 
 	var fileStart uint32
@@ -313,6 +387,12 @@ func (t *orMatchTree) prepare(doc uint32) {
 	}
 }
 
+func (t *lineAndNotMatchTree) prepare(doc uint32) {
+	t.current = t.current[:0]
+	t.positive.prepare(doc)
+	t.negative.prepare(doc)
+}
+
 func (t *notMatchTree) prepare(doc uint32) {
 	t.child.prepare(doc)
 }
@@ -323,10 +403,26 @@ func (t *fileNameMatchTree) prepare(doc uint32) {
 
 func (t *substrMatchTree) prepare(nextDoc uint32) {
 	t.matchIterator.prepare(nextDoc)
-	t.current = t.matchIterator.candidates()
+	t.current = t.nextCandidates()
 	t.contEvaluated = false
 }
 
+// nextCandidates fetches the next batch of candidates and updates
+// t.more.
+func (t *substrMatchTree) nextCandidates() []*candidateMatch {
+	cands := t.matchIterator.candidates(t.batchSize)
+	t.more = t.batchSize > 0 && len(cands) == t.batchSize
+	return cands
+}
+
+// fetchAll adds the remaining candidates of the document to
+// t.current.
+func (t *substrMatchTree) fetchAll() {
+	for t.more {
+		t.current = append(t.current, t.nextCandidates()...)
+	}
+}
+
 func (t *branchQueryMatchTree) prepare(doc uint32) {
 	t.firstDone = true
 	t.docID = doc
@@ -376,6 +472,13 @@ func (t *orMatchTree) nextDoc() uint32 {
 	return min
 }
 
+func (t *lineAndNotMatchTree) nextDoc() uint32 {
+	return t.positive.nextDoc()
+}
+
+// nextDoc returns 0, since any document may match a negation. The
+// search loop then visits every document, so a Not does not need a
+// positive atom next to it.
 func (t *notMatchTree) nextDoc() uint32 {
 	return 0
 }
@@ -424,6 +527,10 @@ func (t *orMatchTree) String() string {
 	return fmt.Sprintf("or%v", t.children)
 }
 
+func (t *lineAndNotMatchTree) String() string {
+	return fmt.Sprintf("lineAndNot(%v, %v)", t.positive, t.negative)
+}
+
 func (t *notMatchTree) String() string {
 	return fmt.Sprintf("not(%v)", t.child)
 }
@@ -471,6 +578,9 @@ func visitMatchTree(t matchTree, f func(matchTree)) {
 		}
 	case *andLineMatchTree:
 		visitMatchTree(&s.andMatchTree, f)
+	case *lineAndNotMatchTree:
+		visitMatchTree(s.positive, f)
+		visitMatchTree(s.negative, f)
 	case *noVisitMatchTree:
 		visitMatchTree(s.matchTree, f)
 	case *notMatchTree:
@@ -627,8 +737,18 @@ func (t *andMatchTree) matches(cp *contentProvider, cost int, known map[matchTre
 func (t *orMatchTree) matches(cp *contentProvider, cost int, known map[matchTree]bool) (bool, bool) {
 	matches := false
 	sure := true
-	for _, ch := range t.children {
+	for i, ch := range t.children {
 		v, ok := evalMatchTree(cp, cost, known, ch)
+		if ok && v && t.lazy {
+			// The root of the tree is evaluated at every cost
+			// without being cached by evalMatchTree, so count the
+			// skipped children once.
+			if _, ok := known[t]; !ok {
+				known[t] = true
+				t.countSkipped(cp, t.children[i+1:], known)
+			}
+			return true, true
+		}
 		if ok {
 			// we could short-circuit, but we want to use
 			// the other possibilities as a ranking
@@ -641,6 +761,29 @@ func (t *orMatchTree) matches(cp *contentProvider, cost int, known map[matchTree
 	return matches, sure
 }
 
+// countSkipped records the children in rest that are not evaluated in
+// cp.stats, and the content that is not loaded because of them.
+func (t *orMatchTree) countSkipped(cp *contentProvider, rest []matchTree, known map[matchTree]bool) {
+	needsContent := false
+	for _, ch := range rest {
+		if _, ok := known[ch]; ok {
+			continue
+		}
+		cp.stats.OrChildrenSkipped++
+		visitMatchTree(ch, func(mt matchTree) {
+			switch mt := mt.(type) {
+			case *substrMatchTree:
+				needsContent = needsContent || (!mt.fileName && len(mt.current) > 0)
+			case *regexpMatchTree:
+				needsContent = needsContent || !mt.fileName
+			}
+		})
+	}
+	if needsContent && cp._data == nil && !cp.cachedData() {
+		cp.stats.OrContentBytesSkipped += int64(cp.contentEnd())
+	}
+}
+
 func (t *branchQueryMatchTree) matches(cp *contentProvider, cost int, known map[matchTree]bool) (bool, bool) {
 	return t.fileMasks[t.docID]&t.masks[t.repos[t.docID]] != 0, true
 }
@@ -655,14 +798,32 @@ func (t *regexpMatchTree) matches(cp *contentProvider, cost int, known map[match
 	}
 
 	cp.stats.RegexpsConsidered++
-	idxs := t.regexp.FindAllIndex(cp.data(t.fileName), -1)
+	data := cp.data(t.fileName)
+	var idxs [][]int
+	if t.captureGroups {
+		idxs = t.regexp.FindAllSubmatchIndex(data, -1)
+	} else {
+		idxs = t.regexp.FindAllIndex(data, -1)
+	}
 	found := t.found[:0]
 	for _, idx := range idxs {
+		if t.subwordBoundary && !atSubwordBoundary(data, idx[0]) {
+			continue
+		}
+		if !matchesCommentFilter(cp, t.fileName, uint32(idx[0]), t.excludeComments, t.onlyComments) {
+			continue
+		}
+		if !withinStartOffset(t.fileName, uint32(idx[0]), t.maxStartOffset) {
+			continue
+		}
 		cm := &candidateMatch{
 			byteOffset:  uint32(idx[0]),
 			byteMatchSz: uint32(idx[1] - idx[0]),
 			fileName:    t.fileName,
 		}
+		if len(idx) > 2 {
+			cm.groups = idx[2:]
+		}
 
 		found = append(found, cm)
 	}
@@ -720,6 +881,38 @@ func evalMatchTree(cp *contentProvider, cost int, known map[matchTree]bool, mt m
 	return v, ok
 }
 
+// matches keeps the content matches of positive that are not on a
+// line with a match of negative. The result is cached in known, so
+// this runs once per document.
+func (t *lineAndNotMatchTree) matches(cp *contentProvider, cost int, known map[matchTree]bool) (bool, bool) {
+	if v, ok := evalMatchTree(cp, cost, known, t.positive); !ok || !v {
+		return false, ok
+	}
+	neg, ok := evalMatchTree(cp, cost, known, t.negative)
+	if !ok {
+		return false, false
+	}
+
+	excluded := map[int]bool{}
+	if neg {
+		for _, c := range gatherMatches(t.negative, known) {
+			if !c.fileName {
+				line, _, _ := c.line(cp.newlines(), cp.fileSize)
+				excluded[line] = true
+			}
+		}
+	}
+	for _, c := range gatherMatches(t.positive, known) {
+		if c.fileName {
+			continue
+		}
+		if line, _, _ := c.line(cp.newlines(), cp.fileSize); !excluded[line] {
+			t.current = append(t.current, c)
+		}
+	}
+	return len(t.current) > 0, true
+}
+
 func (t *notMatchTree) matches(cp *contentProvider, cost int, known map[matchTree]bool) (bool, bool) {
 	v, ok := evalMatchTree(cp, cost, known, t.child)
 	return !v, ok
@@ -746,12 +939,80 @@ func (t *substrMatchTree) matches(cp *contentProvider, cost int, known map[match
 		return false, false
 	}
 
+	// Confirm the candidates batch by batch, so unconfirmed
+	// candidates don't accumulate.
+	pruned := t.current[:0]
+	for batch := t.current; ; batch = t.nextCandidates() {
+		for _, m := range batch {
+			// The byte offset is at least the rune offset, so this
+			// drops candidates before loading the content.
+			if !withinStartOffset(m.fileName, m.runeOffset, t.query.MaxStartOffset) {
+				continue
+			}
+			if m.byteOffset == 0 && m.runeOffset > 0 {
+				m.byteOffset = cp.findOffset(m.fileName, m.runeOffset)
+			}
+			data := cp.data(m.fileName)
+			if m.matchContent(data) && withinStartOffset(m.fileName, m.byteOffset, t.query.MaxStartOffset) &&
+				(!t.query.SubwordBoundary || atSubwordBoundary(data, int(m.byteOffset))) &&
+				matchesCommentFilter(cp, m.fileName, m.byteOffset, t.query.ExcludeComments, t.query.OnlyComments) {
+				pruned = append(pruned, m)
+			}
+		}
+		if !t.more {
+			break
+		}
+	}
+	t.current = pruned
+	t.contEvaluated = true
+
+	return len(t.current) > 0, true
+}
+
+// matches confirms the candidates against the text of the symbol
+// sections they fall into, so the rest of the file content is not
+// loaded.
+func (t *symbolSubstrMatchTree) matches(cp *contentProvider, cost int, known map[matchTree]bool) (bool, bool) {
+	if t.contEvaluated {
+		return len(t.current) > 0, true
+	}
+
+	if len(t.current) == 0 {
+		return false, true
+	}
+
+	if cost < costContent {
+		return false, false
+	}
+
+	sections := cp.docSections()
 	pruned := t.current[:0]
 	for _, m := range t.current {
 		if m.byteOffset == 0 && m.runeOffset > 0 {
-			m.byteOffset = cp.findOffset(m.fileName, m.runeOffset)
+			m.byteOffset = cp.findOffset(false, m.runeOffset)
+		}
+		if int(m.symbolIdx) >= len(sections) {
+			continue
+		}
+		sec := sections[m.symbolIdx]
+		if m.byteOffset < sec.Start || m.byteOffset > sec.End || sec.End > cp.contentEnd() {
+			continue
+		}
+		if t.kind != "" && cp.symbolKind(m.symbolIdx) != t.kind {
+			continue
+		}
+
+		data := cp.contentSlice(sec.Start, sec.End)
+		if m.caseSensitive && int(m.byteOffset-sec.Start)+len(m.substrBytes) > len(data) {
+			continue
 		}
-		if m.matchContent(cp.data(m.fileName)) {
+
+		// matchContent takes offsets relative to the data it is given.
+		off := m.byteOffset
+		m.byteOffset -= sec.Start
+		ok := m.matchContent(data)
+		m.byteOffset = off
+		if ok {
 			pruned = append(pruned, m)
 		}
 	}
@@ -778,7 +1039,7 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 		}
 		// if the query can be used in place of the regexp
 		// return the subtree
-		if isEq {
+		if isEq && !s.WholeFile {
 			return subMT, nil
 		}
 
@@ -786,9 +1047,13 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 		if !s.CaseSensitive {
 			prefix = "(?i)"
 		}
+		expr := s.Regexp.String()
+		if s.WholeFile {
+			expr = `\A(?:` + expr + `)\z`
+		}
 
 		tr := &regexpMatchTree{
-			regexp:   regexp.MustCompile(prefix + s.Regexp.String()),
+			regexp:   regexp.MustCompile(prefix + expr),
 			fileName: s.FileName,
 		}
 
@@ -797,6 +1062,12 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 				tr, &noVisitMatchTree{subMT},
 			},
 		}, nil
+	case *query.Glob:
+		re, err := s.Regexp()
+		if err != nil {
+			return nil, err
+		}
+		return d.newMatchTree(re)
 	case *query.And:
 		var r []matchTree
 		for _, ch := range s.Children {
@@ -816,7 +1087,38 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 			}
 			r = append(r, ct)
 		}
-		return &orMatchTree{r}, nil
+		return &orMatchTree{children: r}, nil
+	case *query.AllOf:
+		if len(s.Patterns) == 0 {
+			return &noMatchTree{"allof"}, nil
+		}
+		var r []matchTree
+		for _, p := range s.Patterns {
+			ct, err := d.newSubstringMatchTree(&query.Substring{
+				Pattern:       p,
+				CaseSensitive: s.CaseSensitive,
+				Content:       true,
+			})
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, ct)
+		}
+		// Only the document is of interest, so don't collect
+		// the matches of the patterns.
+		return &noVisitMatchTree{&andMatchTree{r}}, nil
+
+	case *query.LineAndNot:
+		pos, err := d.newMatchTree(s.Positive)
+		if err != nil {
+			return nil, err
+		}
+		neg, err := d.newMatchTree(s.Negative)
+		if err != nil {
+			return nil, err
+		}
+		return &lineAndNotMatchTree{positive: pos, negative: neg}, nil
+
 	case *query.Not:
 		ct, err := d.newMatchTree(s.Child)
 		return &notMatchTree{
@@ -838,6 +1140,20 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 		}, nil
 
 	case *query.Substring:
+		if s.IgnoreWhitespace {
+			re, err := s.WhitespaceRegexp()
+			if err != nil {
+				return nil, err
+			}
+			return d.newMatchTree(re)
+		}
+		if s.InSymbol {
+			c := *s
+			c.InSymbol = false
+			c.FileName = false
+			c.Content = true
+			return d.newMatchTree(&query.Symbol{Expr: &c})
+		}
 		return d.newSubstringMatchTree(s)
 
 	case *query.Branch:
@@ -882,6 +1198,98 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 			},
 		}, nil
 
+	case *query.ContentHash:
+		prefix := strings.ToLower(s.Prefix)
+		if strings.Trim(prefix, "0123456789abcdef") != "" {
+			return nil, fmt.Errorf("content hash prefix %q is not hex", s.Prefix)
+		}
+		return &docMatchTree{
+			reason:  "contenthash",
+			numDocs: d.numDocs(),
+			predicate: func(docID uint32) bool {
+				return strings.HasPrefix(hex.EncodeToString(d.getChecksum(docID)), prefix)
+			},
+		}, nil
+
+	case *query.MaxLineLength:
+		return &docMatchTree{
+			reason:  "maxlinelength",
+			numDocs: d.numDocs(),
+			predicate: func(docID uint32) bool {
+				n, err := d.getMaxLineLength(docID)
+				return err == nil && int(n) >= s.Min
+			},
+		}, nil
+
+	case *query.BranchCount:
+		return &docMatchTree{
+			reason:  "branchcount",
+			numDocs: d.numDocs(),
+			predicate: func(docID uint32) bool {
+				n := bits.OnesCount64(d.fileBranchMasks[docID])
+				return n >= s.Min && (s.Max == 0 || n <= s.Max)
+			},
+		}, nil
+
+	case *query.FileNameExact:
+		// The file name index finds the candidates, which are then
+		// compared in full.
+		sub, err := d.newSubstringMatchTree(&query.Substring{
+			Pattern:       s.Name,
+			FileName:      true,
+			CaseSensitive: s.CaseSensitive,
+		})
+		if err != nil {
+			return nil, err
+		}
+		name := []byte(s.Name)
+		return &andMatchTree{[]matchTree{
+			sub,
+			&docMatchTree{
+				reason:  "filenameexact",
+				numDocs: d.numDocs(),
+				predicate: func(docID uint32) bool {
+					if s.CaseSensitive {
+						return bytes.Equal(d.fileName(docID), name)
+					}
+					return bytes.EqualFold(d.fileName(docID), name)
+				},
+			},
+		}}, nil
+
+	case *query.SubRepoPath:
+		// match[repo][subrepo index]
+		match := make([][]bool, len(d.subRepoPaths))
+		for i, paths := range d.subRepoPaths {
+			match[i] = make([]bool, len(paths))
+			for j, p := range paths {
+				match[i][j] = j > 0 && strings.HasPrefix(p, s.Prefix)
+			}
+		}
+		return &docMatchTree{
+			reason:  "subrepo",
+			numDocs: d.numDocs(),
+			predicate: func(docID uint32) bool {
+				m := match[d.repos[docID]]
+				s := d.subRepos[docID]
+				return s < uint32(len(m)) && m[s]
+			},
+		}, nil
+
+	case *query.FileType:
+		switch s.Type {
+		case query.FileTypeRegular, query.FileTypeSymlink, query.FileTypeSubmodule:
+		default:
+			return nil, fmt.Errorf("unknown file type %q", s.Type)
+		}
+		return &docMatchTree{
+			reason:  "filetype",
+			numDocs: d.numDocs(),
+			predicate: func(docID uint32) bool {
+				return fileModeType(d.getFileMode(docID)) == s.Type
+			},
+		}, nil
+
 	case *query.Symbol:
 		subMT, err := d.newMatchTree(s.Expr)
 		if err != nil {
@@ -889,13 +1297,16 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 		}
 
 		if substr, ok := subMT.(*substrMatchTree); ok {
-			return &symbolSubstrMatchTree{
+			st := &symbolSubstrMatchTree{
 				substrMatchTree: substr,
 				patternSize:     uint32(utf8.RuneCountInString(substr.query.Pattern)),
 				fileEndRunes:    d.fileEndRunes,
 				fileEndSymbol:   d.fileEndSymbol,
 				sections:        unmarshalDocSections(d.runeDocSections, nil),
-			}, nil
+				kind:            s.Kind,
+			}
+			st.symbolDocs, st.useSymbolDocs = d.symbolDocs(substr.query)
+			return st, nil
 		}
 
 		var regexp *regexp.Regexp
@@ -911,6 +1322,7 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 		return &symbolRegexpMatchTree{
 			regexp:    regexp,
 			all:       regexp.String() == "(?i)(?-s:.)*",
+			kind:      s.Kind,
 			matchTree: subMT,
 		}, nil
 
@@ -1022,25 +1434,157 @@ func (d *indexData) newSubstringMatchTree(s *query.Substring) (matchTree, error)
 	}
 
 	if utf8.RuneCountInString(s.Pattern) < ngramSize {
-		prefix := ""
-		if !s.CaseSensitive {
-			prefix = "(?i)"
-		}
-		t := &regexpMatchTree{
-			regexp:   regexp.MustCompile(prefix + regexp.QuoteMeta(s.Pattern)),
-			fileName: s.FileName,
-		}
-		return t, nil
+		return newSubstringRegexpMatchTree(s), nil
 	}
 
 	result, err := d.iterateNgrams(s)
 	if err != nil {
 		return nil, err
 	}
+	if result == nil {
+		return newSubstringRegexpMatchTree(s), nil
+	}
 	st.matchIterator = result
 	return st, nil
 }
 
+// newSubstringRegexpMatchTree evaluates s by scanning content, for
+// substrings that the ngram index cannot narrow down.
+func newSubstringRegexpMatchTree(s *query.Substring) matchTree {
+	prefix := ""
+	if !s.CaseSensitive {
+		prefix = "(?i)"
+	}
+	return &regexpMatchTree{
+		regexp:          regexp.MustCompile(prefix + regexp.QuoteMeta(s.Pattern)),
+		fileName:        s.FileName,
+		subwordBoundary: s.SubwordBoundary,
+		excludeComments: s.ExcludeComments,
+		onlyComments:    s.OnlyComments,
+		maxStartOffset:  s.MaxStartOffset,
+	}
+}
+
+// withinStartOffset returns true if a match at offset starts before
+// maxStartOffset, or if there is no limit. File name matches are not
+// limited.
+func withinStartOffset(fileName bool, offset, maxStartOffset uint32) bool {
+	return maxStartOffset == 0 || fileName || offset < maxStartOffset
+}
+
+// matchesCommentFilter returns true if a match at offset is in a
+// comment when onlyComments is set, and outside comments when
+// excludeComments is set. File names have no comments.
+func matchesCommentFilter(cp *contentProvider, fileName bool, offset uint32, excludeComments, onlyComments bool) bool {
+	if !excludeComments && !onlyComments {
+		return true
+	}
+	in := !fileName && cp.inComment(offset)
+	if in {
+		return !excludeComments
+	}
+	return !onlyComments
+}
+
+// atSubwordBoundary returns true if a word or a camelCase or
+// snake_case part of an identifier starts at data[off]. For example,
+// "Name" starts at a boundary in "getName", "name" in "get_name" and
+// "Server" in "HTTPServer", but "name" does not in "rename".
+func atSubwordBoundary(data []byte, off int) bool {
+	if off <= 0 || off >= len(data) {
+		return true
+	}
+	prev, _ := utf8.DecodeLastRune(data[:off])
+	cur, sz := utf8.DecodeRune(data[off:])
+
+	if !unicode.IsLetter(prev) && !unicode.IsDigit(prev) {
+		return true
+	}
+	if !unicode.IsUpper(cur) {
+		return false
+	}
+	if !unicode.IsUpper(prev) {
+		return true
+	}
+	// In an acronym, the last capital starts the next part.
+	next, _ := utf8.DecodeRune(data[off+sz:])
+	return unicode.IsLower(next)
+}
+
+// bruteForceSubstrings replaces the substring atoms of mt whose chosen
+// ngrams occur more than max times by scans of the content. It returns
+// the new tree and the number of atoms replaced.
+func bruteForceSubstrings(mt matchTree, max int) (matchTree, int) {
+	n := 0
+	var rewrite func(mt matchTree) matchTree
+	rewrite = func(mt matchTree) matchTree {
+		switch s := mt.(type) {
+		case *substrMatchTree:
+			res, ok := s.matchIterator.(*ngramIterationResults)
+			if !ok {
+				break
+			}
+			candidates := 0
+			for _, ng := range res.selection {
+				candidates += ng.Candidates
+			}
+			if candidates > max {
+				n++
+				return newSubstringRegexpMatchTree(s.query)
+			}
+		case *andMatchTree:
+			for i, ch := range s.children {
+				s.children[i] = rewrite(ch)
+			}
+		case *orMatchTree:
+			for i, ch := range s.children {
+				s.children[i] = rewrite(ch)
+			}
+		case *andLineMatchTree:
+			for i, ch := range s.children {
+				s.children[i] = rewrite(ch)
+			}
+		case *lineAndNotMatchTree:
+			s.positive = rewrite(s.positive)
+			s.negative = rewrite(s.negative)
+		case *noVisitMatchTree:
+			s.matchTree = rewrite(s.matchTree)
+		case *notMatchTree:
+			s.child = rewrite(s.child)
+		case *fileNameMatchTree:
+			s.child = rewrite(s.child)
+		case *symbolRegexpMatchTree:
+			s.matchTree = rewrite(s.matchTree)
+		}
+		return mt
+	}
+	return rewrite(mt), n
+}
+
+// setLazyOr marks the orMatchTrees of mt as lazy, for evaluations
+// that only decide which documents match. Trees that combine the
+// candidates of their children, such as andLineMatchTree, need all
+// children evaluated and are left alone.
+func setLazyOr(mt matchTree) {
+	switch s := mt.(type) {
+	case *orMatchTree:
+		s.lazy = true
+		for _, ch := range s.children {
+			setLazyOr(ch)
+		}
+	case *andMatchTree:
+		for _, ch := range s.children {
+			setLazyOr(ch)
+		}
+	case *noVisitMatchTree:
+		setLazyOr(s.matchTree)
+	case *notMatchTree:
+		setLazyOr(s.child)
+	case *fileNameMatchTree:
+		setLazyOr(s.child)
+	}
+}
+
 // pruneMatchTree removes impossible branches from the matchTree, as indicated
 // by substrMatchTree having a noMatchTree and the resulting impossible and clauses and so forth.
 func pruneMatchTree(mt matchTree) (matchTree, error) {
@@ -1122,6 +1666,19 @@ func pruneMatchTree(mt matchTree) (matchTree, error) {
 			// not false => true
 			return &bruteForceMatchTree{}, nil
 		}
+	case *lineAndNotMatchTree:
+		mt.positive, err = pruneMatchTree(mt.positive)
+		if err != nil || mt.positive == nil {
+			return nil, err
+		}
+		mt.negative, err = pruneMatchTree(mt.negative)
+		if err != nil {
+			return nil, err
+		}
+		if mt.negative == nil {
+			// no line is excluded.
+			return mt.positive, nil
+		}
 	// unhandled:
 	case *docMatchTree:
 	case *bruteForceMatchTree:
@@ -1129,3 +1686,14 @@ func pruneMatchTree(mt matchTree) (matchTree, error) {
 	}
 	return mt, err
 }
+
+// fileModeType returns the query.FileType type of a git file mode.
+func fileModeType(mode uint32) string {
+	switch mode & 0170000 {
+	case 0120000:
+		return query.FileTypeSymlink
+	case 0160000:
+		return query.FileTypeSubmodule
+	}
+	return query.FileTypeRegular
+}
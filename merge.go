@@ -95,6 +95,21 @@ func merge(ds ...*indexData) (*IndexBuilder, error) {
 
 	ib := newIndexBuilder()
 	ib.indexFormatVersion = NextIndexFormatVersion
+	ib.LineMax = ds[0].metaData.LineMax
+	// The postings are rebuilt from the documents, so the inputs
+	// may use any codec.
+	ib.PostingsCodec = ds[0].metaData.PostingsCodec
+	ib.MaxNgrams = ds[0].metaData.MaxNgrams
+	for _, d := range ds[1:] {
+		if d.metaData.LineMax != ib.LineMax {
+			return nil, fmt.Errorf("cannot merge %s and %s: different LineMax %d and %d", ds[0].String(), d.String(), ib.LineMax, d.metaData.LineMax)
+		}
+		// Use the largest cap, so we do not drop more ngrams than
+		// any of the inputs. 0 means no cap.
+		if m := d.metaData.MaxNgrams; m == 0 || ib.MaxNgrams != 0 && m > ib.MaxNgrams {
+			ib.MaxNgrams = m
+		}
+	}
 
 	for _, d := range ds {
 		lastRepoID := -1
@@ -119,47 +134,82 @@ func merge(ds ...*indexData) (*IndexBuilder, error) {
 				}
 			}
 
-			doc := Document{
-				Name: string(d.fileName(docID)),
-				// Content set below since it can return an error
-				// Branches set below since it requires lookups
-				SubRepositoryPath: d.subRepoPaths[repoID][d.subRepos[docID]],
-				Language:          d.languageMap[d.getLanguage(docID)],
-				// SkipReason not set, will be part of content from original indexer.
-			}
-
-			var err error
-			if doc.Content, err = d.readContents(docID); err != nil {
+			doc, err := d.document(docID)
+			if err != nil {
 				return nil, err
 			}
 
-			if doc.Symbols, _, err = d.readDocSections(docID, nil); err != nil {
+			if err := ib.Add(doc); err != nil {
 				return nil, err
 			}
+		}
+	}
 
-			doc.SymbolsMetaData = make([]*Symbol, len(doc.Symbols))
-			for i := range doc.SymbolsMetaData {
-				doc.SymbolsMetaData[i] = d.symbols.data(d.fileEndSymbol[docID] + uint32(i))
-			}
+	return ib, nil
+}
 
-			// calculate branches
-			{
-				mask := d.fileBranchMasks[docID]
-				id := uint32(1)
-				for mask != 0 {
-					if mask&0x1 != 0 {
-						doc.Branches = append(doc.Branches, d.branchNames[repoID][uint(id)])
-					}
-					id <<= 1
-					mask >>= 1
-				}
-			}
+// document reconstructs the document with the given ID, leaving
+// SkipReason unset, since it is part of the content stored by the
+// original indexer.
+func (d *indexData) document(docID uint32) (Document, error) {
+	repoID := d.repos[docID]
+	doc := Document{
+		Name: string(d.fileName(docID)),
+		// Content set below since it can return an error
+		// Branches set below since it requires lookups
+		SubRepositoryPath: d.subRepoPaths[repoID][d.subRepos[docID]],
+		Language:          d.languageMap[d.getLanguage(docID)],
+		FileMode:          d.getFileMode(docID),
+	}
 
-			if err := ib.Add(doc); err != nil {
-				return nil, err
+	var err error
+	if doc.Content, err = d.readContents(docID); err != nil {
+		return Document{}, err
+	}
+
+	if doc.Symbols, _, err = d.readDocSections(docID, nil); err != nil {
+		return Document{}, err
+	}
+
+	if doc.Comments, _, err = d.readCommentSections(docID, nil); err != nil {
+		return Document{}, err
+	}
+
+	doc.SymbolsMetaData = make([]*Symbol, len(doc.Symbols))
+	for i := range doc.SymbolsMetaData {
+		doc.SymbolsMetaData[i] = d.symbols.data(d.fileEndSymbol[docID] + uint32(i))
+	}
+
+	// calculate branches
+	{
+		mask := d.fileBranchMasks[docID]
+		id := uint32(1)
+		for mask != 0 {
+			if mask&0x1 != 0 {
+				doc.Branches = append(doc.Branches, d.branchNames[repoID][uint(id)])
 			}
+			id <<= 1
+			mask >>= 1
 		}
 	}
 
-	return ib, nil
+	return doc, nil
+}
+
+// EachDocument implements DocumentIterator.
+func (d *indexData) EachDocument(f func(DocumentView) bool) error {
+	for docID := uint32(0); int(docID) < len(d.fileBranchMasks); docID++ {
+		md := &d.repoMetaData[d.repos[docID]]
+		if md.Tombstone {
+			continue
+		}
+		doc, err := d.document(docID)
+		if err != nil {
+			return err
+		}
+		if !f(DocumentView{Repository: md, Document: doc}) {
+			return nil
+		}
+	}
+	return nil
 }
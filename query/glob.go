@@ -0,0 +1,129 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// Glob matches a shell glob pattern. '*' and '?' match any run of
+// characters and any single character, except for '/' in file names
+// and newlines in content. '**' also matches across '/', and "[...]"
+// and "[!...]" match character classes.
+//
+// A file name glob matches the end of the path, starting at the
+// beginning of the path or after a '/', so "*.go" matches "cmd/x.go".
+// A leading '/' anchors the glob to the start of the path. A content
+// glob matches anywhere within a line.
+type Glob struct {
+	Pattern string
+
+	FileName      bool
+	Content       bool
+	CaseSensitive bool
+}
+
+func (q *Glob) String() string {
+	pref := ""
+	if q.FileName {
+		pref = "file_"
+	}
+	if q.CaseSensitive {
+		pref = "case_" + pref
+	}
+	return fmt.Sprintf("%sglob:%q", pref, q.Pattern)
+}
+
+// Regexp returns the regexp query equivalent to the glob. Because file
+// name and content globs translate differently, exactly one of
+// FileName and Content should be set.
+func (q *Glob) Regexp() (*Regexp, error) {
+	re, err := globToRegexp(q.Pattern, q.FileName)
+	if err != nil {
+		return nil, err
+	}
+	return &Regexp{
+		Regexp:        re,
+		FileName:      q.FileName,
+		Content:       q.Content,
+		CaseSensitive: q.CaseSensitive,
+	}, nil
+}
+
+func globToRegexp(pattern string, fileName bool) (*syntax.Regexp, error) {
+	// '*' and '?' do not match the separator.
+	sep := `\n`
+	if fileName {
+		sep = "/"
+	}
+	one := "[^" + sep + "]"
+
+	var b strings.Builder
+	if fileName {
+		if strings.HasPrefix(pattern, "/") {
+			pattern = pattern[1:]
+			b.WriteString("^")
+		} else {
+			b.WriteString("(?:^|/)")
+		}
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if !fileName {
+					b.WriteString(`[^\n]*`)
+				} else if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					b.WriteString(`(?:.*/)?`)
+				} else {
+					b.WriteString(`.*`)
+				}
+			} else {
+				b.WriteString(one + "*")
+			}
+		case '?':
+			b.WriteString(one)
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == 0 {
+				// A ']' right after the '[' is part of the class.
+				end = strings.IndexByte(pattern[i+2:], ']') + 1
+			}
+			if end <= 0 {
+				return nil, fmt.Errorf("glob %q: missing ']'", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			i += end + 1
+
+			b.WriteByte('[')
+			if class[0] == '!' || class[0] == '^' {
+				b.WriteByte('^')
+				b.WriteString(sep)
+				class = class[1:]
+			}
+			for _, r := range class {
+				if r == '\\' || r == '[' || r == ']' {
+					b.WriteByte('\\')
+				}
+				b.WriteRune(r)
+			}
+			b.WriteByte(']')
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	if fileName {
+		b.WriteString("$")
+	}
+	return syntax.Parse(b.String(), regexpFlags)
+}
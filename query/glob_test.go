@@ -0,0 +1,34 @@
+package query
+
+import (
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	for _, tc := range []struct {
+		glob     string
+		fileName bool
+		want     string
+	}{
+		{"*.go", true, `(?m:(?:^|/)[^/]*\.go$)`},
+		{"/cmd/?.go", true, `(?m:^cmd/[^/]\.go$)`},
+		{"src/**/*_test.go", true, `(?m-s:(?:^|/)src/(?:.*/)?[^/]*_test\.go$)`},
+		{"docs/**", true, `(?m-s:(?:^|/)docs/.*$)`},
+		{"[!a-c]x[]]", true, `(?m:(?:^|/)[^/a-c]x\]$)`},
+		{`a\*b`, true, `(?m:(?:^|/)a\*b$)`},
+		{"foo*bar?", false, `foo[^\n]*bar[^\n]`},
+		{"a**b", false, `a[^\n]*b`},
+	} {
+		re, err := globToRegexp(tc.glob, tc.fileName)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.glob, err)
+		}
+		if got := re.String(); got != tc.want {
+			t.Errorf("%q: got %s, want %s", tc.glob, got, tc.want)
+		}
+	}
+
+	if _, err := globToRegexp("a[bc", true); err == nil {
+		t.Error("want error for unterminated class")
+	}
+}
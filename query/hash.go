@@ -0,0 +1,84 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+)
+
+// Hash returns a fingerprint of q, for example to key a cache of
+// search results. Queries that are equal after Simplify have the same
+// hash, regardless of how they were constructed.
+func Hash(q Q) uint64 {
+	h := fnv.New64a()
+	writeHash(h, Simplify(q))
+	return h.Sum64()
+}
+
+// writeHash writes a canonical encoding of q to w. Atoms without
+// pointers are printed with their field names; fmt sorts the keys of
+// maps, such as RepoSet.Set.
+func writeHash(w io.Writer, q Q) {
+	switch s := q.(type) {
+	case *And:
+		fmt.Fprintf(w, "(and %d", len(s.Children))
+		for _, ch := range s.Children {
+			writeHash(w, ch)
+		}
+		io.WriteString(w, ")")
+	case *Or:
+		fmt.Fprintf(w, "(or %d", len(s.Children))
+		for _, ch := range s.Children {
+			writeHash(w, ch)
+		}
+		io.WriteString(w, ")")
+	case *Not:
+		io.WriteString(w, "(not ")
+		writeHash(w, s.Child)
+		io.WriteString(w, ")")
+	case *Type:
+		fmt.Fprintf(w, "(type %d ", s.Type)
+		writeHash(w, s.Child)
+		io.WriteString(w, ")")
+	case *Symbol:
+		fmt.Fprintf(w, "(sym %q ", s.Kind)
+		writeHash(w, s.Expr)
+		io.WriteString(w, ")")
+	case *LineAndNot:
+		io.WriteString(w, "(line_and_not ")
+		writeHash(w, s.Positive)
+		writeHash(w, s.Negative)
+		io.WriteString(w, ")")
+	case *GobCache:
+		writeHash(w, s.Q)
+	case *Regexp:
+		// String renders flags such as case folding inline.
+		fmt.Fprintf(w, "(regexp %q %t %t %t %t)", s.Regexp.String(), s.FileName, s.Content, s.CaseSensitive, s.WholeFile)
+	case *Repo:
+		fmt.Fprintf(w, "(repo %q)", s.Regexp.String())
+	case *RepoRegexp:
+		fmt.Fprintf(w, "(reporegexp %q)", s.Regexp.String())
+	case *BranchesRepos:
+		io.WriteString(w, "(branchesrepos")
+		for _, br := range s.List {
+			fmt.Fprintf(w, " %q %v", br.Branch, br.Repos.ToArray())
+		}
+		io.WriteString(w, ")")
+	default:
+		fmt.Fprintf(w, "(%T %+v)", q, q)
+	}
+}
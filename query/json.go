@@ -0,0 +1,276 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+)
+
+// jsonQ is the JSON encoding of a query. Exactly one field is set.
+type jsonQ struct {
+	And *[]jsonQ `json:",omitempty"`
+	Or  *[]jsonQ `json:",omitempty"`
+	Not *jsonQ   `json:",omitempty"`
+
+	Substring     *Substring      `json:",omitempty"`
+	Regexp        *jsonRegexp     `json:",omitempty"`
+	Glob          *Glob           `json:",omitempty"`
+	Symbol        *jsonQ          `json:",omitempty"`
+	SymbolKind    string          `json:",omitempty"` // qualifies Symbol
+	Type          *jsonType       `json:",omitempty"`
+	LineAndNot    *jsonLineAndNot `json:",omitempty"`
+	Const         *bool           `json:",omitempty"`
+	Language      *Language       `json:",omitempty"`
+	FileType      *FileType       `json:",omitempty"`
+	ContentHash   *ContentHash    `json:",omitempty"`
+	MaxLineLength *MaxLineLength  `json:",omitempty"`
+	BranchCount   *BranchCount    `json:",omitempty"`
+	SubRepoPath   *SubRepoPath    `json:",omitempty"`
+	FileNameExact *FileNameExact  `json:",omitempty"`
+	AllOf         *AllOf          `json:",omitempty"`
+	Branch        *Branch         `json:",omitempty"`
+	Repo          *string         `json:",omitempty"`
+	RepoRegexp    *string         `json:",omitempty"`
+	RepoSet       *[]string       `json:",omitempty"`
+
+	// The Sourcegraph repo list atoms use their binary encoding.
+	RepoBranches  []byte `json:",omitempty"`
+	BranchesRepos []byte `json:",omitempty"`
+}
+
+// jsonRegexp holds the regexp as a string. Like the gob encoding, it
+// relies on String() rendering flags such as case folding inline.
+type jsonRegexp struct {
+	Pattern       string
+	FileName      bool `json:",omitempty"`
+	Content       bool `json:",omitempty"`
+	CaseSensitive bool `json:",omitempty"`
+	WholeFile     bool `json:",omitempty"`
+}
+
+type jsonType struct {
+	Type  uint8
+	Child jsonQ
+}
+
+type jsonLineAndNot struct {
+	Positive jsonQ
+	Negative jsonQ
+}
+
+// MarshalJSON encodes q as JSON. The result can be decoded with
+// UnmarshalJSON.
+func MarshalJSON(q Q) ([]byte, error) {
+	j, err := toJSONQ(q)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes a query encoded by MarshalJSON.
+func UnmarshalJSON(data []byte) (Q, error) {
+	var j jsonQ
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+	return fromJSONQ(&j)
+}
+
+func toJSONQs(qs []Q) ([]jsonQ, error) {
+	js := make([]jsonQ, 0, len(qs))
+	for _, q := range qs {
+		j, err := toJSONQ(q)
+		if err != nil {
+			return nil, err
+		}
+		js = append(js, *j)
+	}
+	return js, nil
+}
+
+func toJSONQ(q Q) (*jsonQ, error) {
+	var (
+		j   jsonQ
+		err error
+	)
+	switch s := q.(type) {
+	case *And:
+		var children []jsonQ
+		children, err = toJSONQs(s.Children)
+		j.And = &children
+	case *Or:
+		var children []jsonQ
+		children, err = toJSONQs(s.Children)
+		j.Or = &children
+	case *Not:
+		j.Not, err = toJSONQ(s.Child)
+	case *Symbol:
+		j.Symbol, err = toJSONQ(s.Expr)
+		j.SymbolKind = s.Kind
+	case *Type:
+		var child *jsonQ
+		child, err = toJSONQ(s.Child)
+		if err == nil {
+			j.Type = &jsonType{Type: s.Type, Child: *child}
+		}
+	case *LineAndNot:
+		var pos, neg *jsonQ
+		pos, err = toJSONQ(s.Positive)
+		if err == nil {
+			neg, err = toJSONQ(s.Negative)
+		}
+		if err == nil {
+			j.LineAndNot = &jsonLineAndNot{Positive: *pos, Negative: *neg}
+		}
+	case *GobCache:
+		return toJSONQ(s.Q)
+	case *Substring:
+		j.Substring = s
+	case *Regexp:
+		j.Regexp = &jsonRegexp{
+			Pattern:       s.Regexp.String(),
+			FileName:      s.FileName,
+			Content:       s.Content,
+			CaseSensitive: s.CaseSensitive,
+			WholeFile:     s.WholeFile,
+		}
+	case *Glob:
+		j.Glob = s
+	case *Const:
+		j.Const = &s.Value
+	case *Language:
+		j.Language = s
+	case *FileType:
+		j.FileType = s
+	case *ContentHash:
+		j.ContentHash = s
+	case *MaxLineLength:
+		j.MaxLineLength = s
+	case *BranchCount:
+		j.BranchCount = s
+	case *SubRepoPath:
+		j.SubRepoPath = s
+	case *FileNameExact:
+		j.FileNameExact = s
+	case *AllOf:
+		j.AllOf = s
+	case *Branch:
+		j.Branch = s
+	case *Repo:
+		re := s.Regexp.String()
+		j.Repo = &re
+	case *RepoRegexp:
+		re := s.Regexp.String()
+		j.RepoRegexp = &re
+	case *RepoSet:
+		repos := make([]string, 0, len(s.Set))
+		for r := range s.Set {
+			repos = append(repos, r)
+		}
+		sort.Strings(repos)
+		j.RepoSet = &repos
+	case *RepoBranches:
+		j.RepoBranches, err = s.MarshalBinary()
+	case *BranchesRepos:
+		j.BranchesRepos, err = s.MarshalBinary()
+	default:
+		return nil, fmt.Errorf("query: cannot encode %T as JSON", q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func fromJSONQs(js []jsonQ) ([]Q, error) {
+	qs := make([]Q, 0, len(js))
+	for i := range js {
+		q, err := fromJSONQ(&js[i])
+		if err != nil {
+			return nil, err
+		}
+		qs = append(qs, q)
+	}
+	return qs, nil
+}
+
+func fromJSONQ(j *jsonQ) (Q, error) {
+	switch {
+	case j.And != nil:
+		qs, err := fromJSONQs(*j.And)
+		return &And{Children: qs}, err
+	case j.Or != nil:
+		qs, err := fromJSONQs(*j.Or)
+		return &Or{Children: qs}, err
+	case j.Not != nil:
+		q, err := fromJSONQ(j.Not)
+		return &Not{Child: q}, err
+	case j.Symbol != nil:
+		q, err := fromJSONQ(j.Symbol)
+		return &Symbol{Expr: q, Kind: j.SymbolKind}, err
+	case j.Type != nil:
+		q, err := fromJSONQ(&j.Type.Child)
+		return &Type{Type: j.Type.Type, Child: q}, err
+	case j.LineAndNot != nil:
+		pos, err := fromJSONQ(&j.LineAndNot.Positive)
+		if err != nil {
+			return nil, err
+		}
+		neg, err := fromJSONQ(&j.LineAndNot.Negative)
+		return &LineAndNot{Positive: pos, Negative: neg}, err
+	case j.Substring != nil:
+		return j.Substring, nil
+	case j.Regexp != nil:
+		re, err := syntax.Parse(j.Regexp.Pattern, regexpFlags)
+		if err != nil {
+			return nil, err
+		}
+		return &Regexp{
+			Regexp:        re,
+			FileName:      j.Regexp.FileName,
+			Content:       j.Regexp.Content,
+			CaseSensitive: j.Regexp.CaseSensitive,
+			WholeFile:     j.Regexp.WholeFile,
+		}, nil
+	case j.Glob != nil:
+		return j.Glob, nil
+	case j.Const != nil:
+		return &Const{Value: *j.Const}, nil
+	case j.Language != nil:
+		return j.Language, nil
+	case j.FileType != nil:
+		return j.FileType, nil
+	case j.ContentHash != nil:
+		return j.ContentHash, nil
+	case j.MaxLineLength != nil:
+		return j.MaxLineLength, nil
+	case j.BranchCount != nil:
+		return j.BranchCount, nil
+	case j.SubRepoPath != nil:
+		return j.SubRepoPath, nil
+	case j.FileNameExact != nil:
+		return j.FileNameExact, nil
+	case j.AllOf != nil:
+		return j.AllOf, nil
+	case j.Branch != nil:
+		return j.Branch, nil
+	case j.Repo != nil:
+		re, err := regexp.Compile(*j.Repo)
+		return &Repo{Regexp: re}, err
+	case j.RepoRegexp != nil:
+		re, err := regexp.Compile(*j.RepoRegexp)
+		return &RepoRegexp{Regexp: re}, err
+	case j.RepoSet != nil:
+		return NewRepoSet(*j.RepoSet...), nil
+	case j.RepoBranches != nil:
+		q := &RepoBranches{}
+		return q, q.UnmarshalBinary(j.RepoBranches)
+	case j.BranchesRepos != nil:
+		q := &BranchesRepos{}
+		return q, q.UnmarshalBinary(j.BranchesRepos)
+	}
+	return nil, fmt.Errorf("query: empty JSON query")
+}
@@ -0,0 +1,69 @@
+package query
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	parsed, err := Parse(`(foo or case:yes Bar) -file:\.go$ lang:go type:file (sym:baz|qux)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []Q{
+		parsed,
+		NewAnd(
+			&Repo{Regexp: regexp.MustCompile("^github.com/foo")},
+			&RepoRegexp{Regexp: regexp.MustCompile("bar$")},
+			&Branch{Pattern: "main", Exact: true},
+			&Not{Child: &Const{Value: false}},
+			&Type{Type: TypeRepo, Child: &Substring{Pattern: "needle", Content: true}},
+			&Regexp{Regexp: mustParseRE("(?i)a+b"), FileName: true, CaseSensitive: true},
+			&Regexp{Regexp: mustParseRE("^GENERATED"), Content: true, WholeFile: true},
+			&AllOf{Patterns: []string{"x", "y"}},
+			&FileType{Type: FileTypeSymlink},
+			&ContentHash{Prefix: "8f3a"},
+			&MaxLineLength{Min: 120},
+			&BranchCount{Min: 2, Max: 3},
+			&SubRepoPath{Prefix: "third_party/"},
+			&FileNameExact{Name: "README.md", CaseSensitive: true},
+			&Symbol{Expr: &Substring{Pattern: "foo"}, Kind: "function"},
+			&LineAndNot{Positive: &Substring{Pattern: "error", Content: true}, Negative: &Substring{Pattern: "ignored", Content: true}},
+			&Glob{Pattern: "*.go", FileName: true},
+			NewRepoSet("r1", "r2"),
+			&RepoBranches{Set: map[string][]string{"r1": {"HEAD"}}},
+			NewSingleBranchesRepos("HEAD", 1, 2),
+			&Or{},
+		),
+	} {
+		data, err := MarshalJSON(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := UnmarshalJSON(data)
+		if err != nil {
+			t.Fatalf("UnmarshalJSON(%s): %v", data, err)
+		}
+		if got.String() != q.String() {
+			t.Errorf("got %s, want %s", got, q)
+		}
+
+		again, err := MarshalJSON(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again) != string(data) {
+			t.Errorf("re-encoding differs: got %s, want %s", again, data)
+		}
+	}
+}
+
+func TestJSONUnknownQuery(t *testing.T) {
+	if _, err := MarshalJSON(&caseQ{Flavor: "yes"}); err == nil {
+		t.Error("got nil error for caseQ")
+	}
+	if _, err := UnmarshalJSON([]byte("{}")); err == nil {
+		t.Error("got nil error for empty query")
+	}
+}
@@ -71,7 +71,36 @@ func isSpace(c byte) bool {
 	return c == ' ' || c == '\t'
 }
 
-// Parse parses a string into a query.
+// ParseError is returned by Parse for malformed queries.
+type ParseError struct {
+	// Pos is the byte offset in the query string of the offending
+	// token.
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s (at offset %d)", e.Msg, e.Pos)
+}
+
+// parseErrorAt converts err into a ParseError at offset pos, or, if it
+// already is one, shifts it by pos. Errors from regexp/syntax are
+// positioned at the offending part of the regular expression if it
+// occurs in input, the input of the token at pos.
+func parseErrorAt(err error, pos int, input []byte) error {
+	if pe, ok := err.(*ParseError); ok {
+		return &ParseError{Pos: pe.Pos + pos, Msg: pe.Msg}
+	}
+	if se, ok := err.(*syntax.Error); ok && se.Expr != "" {
+		if i := bytes.Index(input, []byte(se.Expr)); i >= 0 {
+			pos += i
+		}
+	}
+	return &ParseError{Pos: pos, Msg: err.Error()}
+}
+
+// Parse parses a string into a query. Errors are of type
+// *ParseError.
 func Parse(qStr string) (Q, error) {
 	b := []byte(qStr)
 
@@ -82,7 +111,7 @@ func Parse(qStr string) (Q, error) {
 
 	q, err := parseOperators(qs)
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{Pos: len(b), Msg: err.Error()}
 	}
 
 	return Simplify(q), nil
@@ -97,14 +126,18 @@ func parseExpr(in []byte) (Q, int, error) {
 		b = b[1:]
 	}
 
+	pos := len(in) - len(b)
 	tok, err := nextToken(b)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, parseErrorAt(err, pos, b)
 	}
 	if tok == nil {
 		return nil, 0, nil
 	}
 	b = b[len(tok.Input):]
+	tokErr := func(err error) error {
+		return parseErrorAt(err, pos, tok.Input)
+	}
 
 	text := string(tok.Text)
 	switch tok.Type {
@@ -114,36 +147,36 @@ func parseExpr(in []byte) (Q, int, error) {
 		case "no":
 		case "auto":
 		default:
-			return nil, 0, fmt.Errorf("query: unknown case argument %q, want {yes,no,auto}", text)
+			return nil, 0, tokErr(fmt.Errorf("query: unknown case argument %q, want {yes,no,auto}", text))
 		}
 		expr = &caseQ{text}
 	case tokRepo:
 		r, err := regexp.Compile(text)
 
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, tokErr(err)
 		}
 
 		expr = &Repo{r}
 	case tokBranch:
 		expr = &Branch{Pattern: text}
 	case tokText, tokRegex:
-		q, err := regexpQuery(text, false, false)
+		q, err := textQuery(tok, false, false)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, tokErr(err)
 		}
 		expr = q
 	case tokFile:
-		q, err := regexpQuery(text, false, true)
+		q, err := textQuery(tok, false, true)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, tokErr(err)
 		}
 		expr = q
 
 	case tokContent:
-		q, err := regexpQuery(text, true, false)
+		q, err := textQuery(tok, true, false)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, tokErr(err)
 		}
 		expr = q
 	case tokLang:
@@ -156,46 +189,51 @@ func parseExpr(in []byte) (Q, int, error) {
 
 	case tokSym:
 		if text == "" {
-			return nil, 0, fmt.Errorf("the sym: atom must have an argument")
+			return nil, 0, tokErr(fmt.Errorf("the sym: atom must have an argument"))
 		}
 
-		q, err := regexpQuery(text, false, false)
+		q, err := textQuery(tok, false, false)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, tokErr(err)
 		}
 
-		expr = &Symbol{q}
+		expr = &Symbol{Expr: q}
+	case tokKind:
+		if text == "" {
+			return nil, 0, tokErr(fmt.Errorf("the kind: atom must have an argument"))
+		}
+		expr = &kindQ{text}
 	case tokParenClose:
 		// Caller must consume paren.
 		expr = nil
 
 	case tokParenOpen:
 		qs, n, err := parseExprList(b)
-		b = b[n:]
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, parseErrorAt(err, len(in)-len(b), nil)
 		}
+		b = b[n:]
 
 		pTok, err := nextToken(b)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, parseErrorAt(err, len(in)-len(b), b)
 		}
 		if pTok == nil || pTok.Type != tokParenClose {
-			return nil, 0, fmt.Errorf("query: missing close paren, got token %v", pTok)
+			return nil, 0, tokErr(fmt.Errorf("query: missing close paren, got token %v", pTok))
 		}
 
 		b = b[len(pTok.Input):]
 		expr, err = parseOperators(qs)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, tokErr(err)
 		}
 	case tokNegate:
 		subQ, n, err := parseExpr(b)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, parseErrorAt(err, len(in)-len(b), nil)
 		}
 		if subQ == nil {
-			return nil, 0, fmt.Errorf("query: '-' operator needs an argument")
+			return nil, 0, tokErr(fmt.Errorf("query: '-' operator needs an argument"))
 		}
 		b = b[n:]
 		expr = &Not{subQ}
@@ -209,8 +247,13 @@ func parseExpr(in []byte) (Q, int, error) {
 			t = TypeFileName
 		case "repo":
 			t = TypeRepo
+		case "symbol":
+			return &symbolTypeQ{}, len(in) - len(b), nil
+		case FileTypeRegular, FileTypeSymlink, FileTypeSubmodule:
+			expr = &FileType{Type: text}
+			return expr, len(in) - len(b), nil
 		default:
-			return nil, 0, fmt.Errorf("query: unknown type argument %q, want {filematch,filename,repo}", text)
+			return nil, 0, tokErr(fmt.Errorf("query: unknown type argument %q, want {filematch,filename,repo,symbol,regular,symlink,submodule}", text))
 		}
 		// Later we will lift this into a root, like we do for caseQ
 		expr = &Type{Type: t, Child: nil}
@@ -248,6 +291,19 @@ func regexpQuery(text string, content, file bool) (Q, error) {
 	return expr, nil
 }
 
+// textQuery is like regexpQuery for the text of tok, except that a
+// quoted string is taken literally.
+func textQuery(tok *token, content, file bool) (Q, error) {
+	if tok.Literal {
+		return &Substring{
+			Pattern:  string(tok.Text),
+			FileName: file,
+			Content:  content,
+		}, nil
+	}
+	return regexpQuery(string(tok.Text), content, file)
+}
+
 // parseOperators interprets the orOperator in a list of queries.
 func parseOperators(in []Q) (Q, error) {
 	top := &Or{}
@@ -294,7 +350,7 @@ func parseExprList(in []byte) ([]Q, int, error) {
 
 		q, n, err := parseExpr(b)
 		if err != nil {
-			return nil, 0, err
+			return nil, 0, parseErrorAt(err, len(in)-len(b), nil)
 		}
 
 		if q == nil {
@@ -308,8 +364,14 @@ func parseExprList(in []byte) ([]Q, int, error) {
 	setCase := "auto"
 	newQS := qs[:0]
 	typeT := uint8(100)
+	symbolType := false
+	symbolKind := ""
 	for _, q := range qs {
 		switch s := q.(type) {
+		case *symbolTypeQ:
+			symbolType = true
+		case *kindQ:
+			symbolKind = s.Kind
 		case *caseQ:
 			setCase = s.Flavor
 		case *Type:
@@ -320,6 +382,12 @@ func parseExprList(in []byte) ([]Q, int, error) {
 			newQS = append(newQS, q)
 		}
 	}
+	// kind: only makes sense for symbols, so it implies type:symbol.
+	if symbolType || symbolKind != "" {
+		newQS = mapQueryList(newQS, func(q Q) Q {
+			return toSymbol(q, symbolKind)
+		})
+	}
 	qs = mapQueryList(newQS, func(q Q) Q {
 		if sc, ok := q.(setCaser); ok {
 			sc.setCase(setCase)
@@ -332,6 +400,26 @@ func parseExprList(in []byte) ([]Q, int, error) {
 	return qs, len(in) - len(b), nil
 }
 
+// toSymbol sets kind on q if it is a Symbol. Text atoms, which match
+// either file names or content, become symbol atoms of that kind.
+func toSymbol(q Q, kind string) Q {
+	switch s := q.(type) {
+	case *Symbol:
+		if kind != "" {
+			s.Kind = kind
+		}
+	case *Substring:
+		if !s.FileName && !s.Content {
+			return &Symbol{Expr: s, Kind: kind}
+		}
+	case *Regexp:
+		if !s.FileName && !s.Content {
+			return &Symbol{Expr: s, Kind: kind}
+		}
+	}
+	return q
+}
+
 type token struct {
 	Type int
 	// The value of the token
@@ -339,6 +427,10 @@ type token struct {
 
 	// The input that we consumed to form the token.
 	Input []byte
+
+	// Literal is set if the value of the token is a single quoted
+	// string, eg. "a.b" or file:"a.b", so it is not a regexp.
+	Literal bool
 }
 
 func (t *token) String() string {
@@ -362,6 +454,7 @@ const (
 	tokLang       = 12
 	tokSym        = 13
 	tokType       = 14
+	tokKind       = 15
 )
 
 var tokNames = map[int]string{
@@ -379,6 +472,7 @@ var tokNames = map[int]string{
 	tokLang:       "Language",
 	tokSym:        "Symbol",
 	tokType:       "Type",
+	tokKind:       "Kind",
 }
 
 var prefixes = map[string]int{
@@ -396,6 +490,7 @@ var prefixes = map[string]int{
 	"sym:":     tokSym,
 	"t:":       tokType,
 	"type:":    tokType,
+	"kind:":    tokKind,
 }
 
 var reservedWords = map[string]int{
@@ -420,6 +515,7 @@ func (t *token) setType() {
 		}
 	}
 
+	value := t.Input
 	for pref, typ := range prefixes {
 		if !bytes.HasPrefix(t.Input, []byte(pref)) {
 			continue
@@ -427,8 +523,16 @@ func (t *token) setType() {
 
 		t.Text = t.Text[len(pref):]
 		t.Type = typ
+		value = t.Input[len(pref):]
 		break
 	}
+
+	if t.Type != tokRegex {
+		if len(value) > 0 && value[0] == '"' {
+			_, n, err := parseStringLiteral(value)
+			t.Literal = err == nil && n == len(value)
+		}
+	}
 }
 
 // nextToken returns the next token from the given input.
@@ -54,6 +54,14 @@ func TestParseQuery(t *testing.T) {
 		{"abc", &Substring{Pattern: "abc"}},
 		{"ABC", &Substring{Pattern: "ABC", CaseSensitive: true}},
 		{"\"abc bcd\"", &Substring{Pattern: "abc bcd"}},
+		{`"a.b"`, &Substring{Pattern: "a.b"}},
+		{`"key:value"`, &Substring{Pattern: "key:value"}},
+		{`"file:x.go"`, &Substring{Pattern: "file:x.go"}},
+		{`"http://x"`, &Substring{Pattern: "http://x"}},
+		{`content:"a(b"`, &Substring{Pattern: "a(b", Content: true}},
+		{`file\:bla`, &Substring{Pattern: "file:bla"}},
+		{`"a.b"c`, &Regexp{Regexp: mustParseRE("a.bc")}},
+		{`regex:"a.b"`, &Regexp{Regexp: mustParseRE("a.b")}},
 		{"abc bcd", NewAnd(
 			&Substring{Pattern: "abc"},
 			&Substring{Pattern: "bcd"})},
@@ -87,10 +95,19 @@ func TestParseQuery(t *testing.T) {
 
 		{"lang:c++", &Language{"C++"}},
 		{"lang:cpp", &Language{"C++"}},
-		{"sym:pqr", &Symbol{&Substring{Pattern: "pqr"}}},
-		{"sym:Pqr", &Symbol{&Substring{Pattern: "Pqr", CaseSensitive: true}}},
-		{"sym:.*", &Symbol{&Regexp{Regexp: mustParseRE(".*")}}},
-		{"sym:a(b|d)e", &Symbol{&Regexp{Regexp: mustParseRE("a(b|d)e")}}},
+		{"sym:pqr", &Symbol{Expr: &Substring{Pattern: "pqr"}}},
+		{"sym:Pqr", &Symbol{Expr: &Substring{Pattern: "Pqr", CaseSensitive: true}}},
+		{"sym:.*", &Symbol{Expr: &Regexp{Regexp: mustParseRE(".*")}}},
+		{"sym:a(b|d)e", &Symbol{Expr: &Regexp{Regexp: mustParseRE("a(b|d)e")}}},
+		{"type:symbol kind:function foo", &Symbol{Expr: &Substring{Pattern: "foo"}, Kind: "function"}},
+		{"type:symbol foo file:bar", NewAnd(
+			&Symbol{Expr: &Substring{Pattern: "foo"}},
+			&Substring{Pattern: "bar", FileName: true})},
+		{"sym:foo kind:variable", &Symbol{Expr: &Substring{Pattern: "foo"}, Kind: "variable"}},
+		{"kind:function foo", &Symbol{Expr: &Substring{Pattern: "foo"}, Kind: "function"}},
+		{"kind:function foo file:bar", NewAnd(
+			&Symbol{Expr: &Substring{Pattern: "foo"}, Kind: "function"},
+			&Substring{Pattern: "bar", FileName: true})},
 
 		// case
 		{"abc case:yes", &Substring{Pattern: "abc", CaseSensitive: true}},
@@ -106,6 +123,7 @@ func TestParseQuery(t *testing.T) {
 		{"type:repo abc", &Type{Type: TypeRepo, Child: &Substring{Pattern: "abc"}}},
 		{"type:file abc def", &Type{Type: TypeFileName, Child: NewAnd(&Substring{Pattern: "abc"}, &Substring{Pattern: "def"})}},
 		{"(type:repo abc) def", NewAnd(&Type{Type: TypeRepo, Child: &Substring{Pattern: "abc"}}, &Substring{Pattern: "def"})},
+		{"abc -type:symlink", NewAnd(&Substring{Pattern: "abc"}, &Not{&FileType{Type: FileTypeSymlink}})},
 
 		// errors.
 		{"--", nil},
@@ -172,3 +190,28 @@ func TestTokenize(t *testing.T) {
 		}
 	}
 }
+
+func TestParseErrorPosition(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		pos int
+	}{
+		{"foo file:/a(b", 9},
+		{"foo (bar file:a(b)", 4},
+		{"(foo file:x[a", 11},
+		{"case:maybe", 0},
+		{"foo -", 4},
+		{"foo \"bar", 4},
+		{"foo or", 6},
+	} {
+		_, err := Parse(c.in)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Parse(%q): got error %v, want *ParseError", c.in, err)
+			continue
+		}
+		if pe.Pos != c.pos {
+			t.Errorf("Parse(%q): got position %d (%v), want %d", c.in, pe.Pos, pe, c.pos)
+		}
+	}
+}
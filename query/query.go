@@ -84,11 +84,17 @@ func (r RawConfig) String() string {
 }
 
 // RegexpQuery is a query looking for regular expressions matches.
+// Every non-overlapping match is reported, so a line with several
+// matches has a LineFragment for each.
 type Regexp struct {
 	Regexp        *syntax.Regexp
 	FileName      bool
 	Content       bool
 	CaseSensitive bool
+
+	// WholeFile anchors the regexp to the start and end of the file
+	// content (or name), so it only matches if it matches all of it.
+	WholeFile bool
 }
 
 func (q *Regexp) String() string {
@@ -96,6 +102,9 @@ func (q *Regexp) String() string {
 	if q.FileName {
 		pref = "file_"
 	}
+	if q.WholeFile {
+		pref = "whole_" + pref
+	}
 	if q.CaseSensitive {
 		pref = "case_" + pref
 	}
@@ -135,12 +144,37 @@ func (q *Regexp) GobDecode(data []byte) error {
 // Symbol finds a string that is a symbol.
 type Symbol struct {
 	Expr Q
+
+	// Kind, if set, restricts the match to symbols of this kind,
+	// eg. "function", as reported by ctags.
+	Kind string
 }
 
 func (s *Symbol) String() string {
+	if s.Kind != "" {
+		return fmt.Sprintf("sym(kind:%s):%s", s.Kind, s.Expr)
+	}
 	return fmt.Sprintf("sym:%s", s.Expr)
 }
 
+// kindQ sets Symbol.Kind for the symbol atoms of a query, and implies
+// symbolTypeQ. Like caseQ, it only exists while parsing.
+type kindQ struct {
+	Kind string
+}
+
+func (k *kindQ) String() string {
+	return "kind:" + k.Kind
+}
+
+// symbolTypeQ is type:symbol, which turns the text atoms of a query
+// into symbol atoms. It only exists while parsing.
+type symbolTypeQ struct{}
+
+func (symbolTypeQ) String() string {
+	return "type:symbol"
+}
+
 type caseQ struct {
 	Flavor string
 }
@@ -157,6 +191,82 @@ func (l *Language) String() string {
 	return "lang:" + l.Language
 }
 
+// Values for FileType.Type.
+const (
+	FileTypeRegular   = "regular"
+	FileTypeSymlink   = "symlink"
+	FileTypeSubmodule = "submodule"
+)
+
+// FileType matches documents by the type of their git tree entry.
+// Documents without a stored mode are regular files.
+type FileType struct {
+	Type string
+}
+
+func (q *FileType) String() string {
+	return "type:" + q.Type
+}
+
+// ContentHash matches documents whose content checksum, in lowercase
+// hex, starts with Prefix. The checksum is the CRC-64 (ISO) of the
+// content, as reported in FileMatch.Checksum.
+type ContentHash struct {
+	Prefix string
+}
+
+func (q *ContentHash) String() string {
+	return "hash:" + q.Prefix
+}
+
+// MaxLineLength matches documents whose longest line is at least Min
+// bytes long, such as minified or generated files.
+type MaxLineLength struct {
+	Min int
+}
+
+func (q *MaxLineLength) String() string {
+	return fmt.Sprintf("maxlinelength>=%d", q.Min)
+}
+
+// BranchCount matches documents that are on at least Min and, if Max
+// is non-zero, at most Max branches.
+type BranchCount struct {
+	Min int
+	Max int
+}
+
+func (q *BranchCount) String() string {
+	if q.Max == 0 {
+		return fmt.Sprintf("branchcount>=%d", q.Min)
+	}
+	return fmt.Sprintf("branchcount:%d..%d", q.Min, q.Max)
+}
+
+// FileNameExact matches documents whose whole file name is Name.
+type FileNameExact struct {
+	Name          string
+	CaseSensitive bool
+}
+
+func (q *FileNameExact) String() string {
+	s := fmt.Sprintf("file_exact:%q", q.Name)
+	if q.CaseSensitive {
+		s = "case_" + s
+	}
+	return s
+}
+
+// SubRepoPath matches documents in a sub-repository whose path starts
+// with Prefix. Documents outside sub-repositories never match.
+type SubRepoPath struct {
+	Prefix string
+}
+
+func (q *SubRepoPath) String() string {
+	return "subrepo:" + q.Prefix
+}
+
 type Const struct {
 	Value bool
 }
@@ -370,6 +480,77 @@ type Substring struct {
 
 	// Match only content
 	Content bool
+
+	// InSymbol restricts matches to content within symbol sections,
+	// like wrapping the substring in a Symbol query. It implies
+	// Content.
+	InSymbol bool
+
+	// SubwordBoundary requires matches to start at a word boundary or
+	// at the start of a camelCase or snake_case part of an
+	// identifier, so "user" matches "getUserName" and "user_id" but
+	// not "superuser". The "User" of "SuperUserX" starts a camelCase
+	// part, so it matches as well.
+	SubwordBoundary bool
+
+	// ExcludeComments drops matches inside comments, and OnlyComments
+	// drops matches outside them. Comments are only known for shards
+	// indexed with comment spans; otherwise all content is code.
+	ExcludeComments bool
+	OnlyComments    bool
+
+	// IgnoreWhitespace lets each run of whitespace in Pattern match
+	// any run of spaces and tabs in the content, including none, so
+	// "a + b" matches "a  +  b" and "a+b". A run containing a newline
+	// also matches newlines. The substring is evaluated as the regexp
+	// returned by WhitespaceRegexp, so InSymbol, SubwordBoundary and
+	// the comment options do not apply.
+	IgnoreWhitespace bool
+
+	// MaxStartOffset, if non-zero, requires content matches to start
+	// within the first MaxStartOffset bytes of the file, for example
+	// to look for license headers. Unlike SearchOptions.HeaderBytes, it
+	// only applies to this substring.
+	MaxStartOffset uint32
+}
+
+// WhitespaceRegexp returns the regexp query that evaluates q with
+// IgnoreWhitespace set.
+func (q *Substring) WhitespaceRegexp() (*Regexp, error) {
+	var b strings.Builder
+	for i := 0; i < len(q.Pattern); {
+		c := q.Pattern[i]
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			j := strings.IndexAny(q.Pattern[i:], " \t\n\r")
+			if j < 0 {
+				j = len(q.Pattern) - i
+			}
+			b.WriteString(regexp.QuoteMeta(q.Pattern[i : i+j]))
+			i += j
+			continue
+		}
+
+		newline := false
+		for ; i < len(q.Pattern) && strings.IndexByte(" \t\n\r", q.Pattern[i]) >= 0; i++ {
+			newline = newline || q.Pattern[i] == '\n'
+		}
+		if newline {
+			b.WriteString(`\s*`)
+		} else {
+			b.WriteString(`[ \t]*`)
+		}
+	}
+
+	re, err := syntax.Parse(b.String(), regexpFlags)
+	if err != nil {
+		return nil, err
+	}
+	return &Regexp{
+		Regexp:        re,
+		FileName:      q.FileName,
+		Content:       q.Content,
+		CaseSensitive: q.CaseSensitive,
+	}, nil
 }
 
 func (q *Substring) String() string {
@@ -378,10 +559,28 @@ func (q *Substring) String() string {
 	t := ""
 	if q.FileName {
 		t = "file_"
+	} else if q.InSymbol {
+		t = "symbol_"
 	} else if q.Content {
 		t = "content_"
 	}
 
+	if q.SubwordBoundary {
+		t += "subword_"
+	}
+	if q.ExcludeComments {
+		t += "code_"
+	}
+	if q.OnlyComments {
+		t += "comment_"
+	}
+	if q.IgnoreWhitespace {
+		t += "ws_"
+	}
+	if q.MaxStartOffset > 0 {
+		t += fmt.Sprintf("start%d_", q.MaxStartOffset)
+	}
+
 	s += fmt.Sprintf("%ssubstr:%q", t, q.Pattern)
 	if q.CaseSensitive {
 		s = "case_" + s
@@ -389,6 +588,28 @@ func (q *Substring) String() string {
 	return s
 }
 
+// AllOf matches documents whose content contains all of Patterns,
+// anywhere in the document. Unlike an And of Substrings, only the
+// documents are reported, not the lines holding the patterns, which
+// makes it cheaper to evaluate. An AllOf without patterns matches
+// nothing.
+type AllOf struct {
+	Patterns      []string
+	CaseSensitive bool
+}
+
+func (q *AllOf) String() string {
+	var pats []string
+	for _, p := range q.Patterns {
+		pats = append(pats, fmt.Sprintf("%q", p))
+	}
+	s := fmt.Sprintf("(allof %s)", strings.Join(pats, " "))
+	if q.CaseSensitive {
+		s = "case_" + s
+	}
+	return s
+}
+
 type setCaser interface {
 	setCase(string)
 }
@@ -494,6 +715,20 @@ func (q *Not) String() string {
 	return fmt.Sprintf("(not %s)", q.Child)
 }
 
+// LineAndNot matches the lines on which Positive matches, except
+// those on which Negative also matches. Unlike (and Positive (not
+// Negative)), a file matches if it has any such line, even if
+// Negative matches elsewhere in it. Only content matches are
+// considered.
+type LineAndNot struct {
+	Positive Q
+	Negative Q
+}
+
+func (q *LineAndNot) String() string {
+	return fmt.Sprintf("(line_and_not %s %s)", q.Positive, q.Negative)
+}
+
 // And is matched when all its children are.
 type And struct {
 	Children []Q
@@ -521,7 +756,8 @@ func NewOr(qs ...Q) Q {
 type Branch struct {
 	Pattern string
 
-	// exact is true if we want to Pattern to equal branch.
+	// Exact is true if Pattern must equal the branch name. Otherwise
+	// Pattern matches any branch containing it.
 	Exact bool
 }
 
@@ -583,6 +819,10 @@ func flatten(q Q) (Q, bool) {
 	case *Type:
 		child, changed := flatten(s.Child)
 		return &Type{Child: child, Type: s.Type}, changed
+	case *LineAndNot:
+		pos, posChanged := flatten(s.Positive)
+		neg, negChanged := flatten(s.Negative)
+		return &LineAndNot{Positive: pos, Negative: neg}, posChanged || negChanged
 	default:
 		return q, false
 	}
@@ -654,6 +894,16 @@ func evalConstants(q Q) Q {
 			return ch
 		}
 		return &Type{Child: ch, Type: s.Type}
+	case *LineAndNot:
+		pos := evalConstants(s.Positive)
+		neg := evalConstants(s.Negative)
+		if c, ok := pos.(*Const); ok && !c.Value {
+			return pos
+		}
+		if c, ok := neg.(*Const); ok && !c.Value {
+			return pos
+		}
+		return &LineAndNot{Positive: pos, Negative: neg}
 	case *Substring:
 		if len(s.Pattern) == 0 {
 			return &Const{true}
@@ -670,6 +920,10 @@ func evalConstants(q Q) Q {
 		if len(s.Set) == 0 {
 			return &Const{true}
 		}
+	case *AllOf:
+		if len(s.Patterns) == 0 {
+			return &Const{false}
+		}
 	}
 	return q
 }
@@ -698,15 +952,20 @@ func Map(q Q, f func(q Q) Q) Q {
 		q = &Not{Child: Map(s.Child, f)}
 	case *Type:
 		q = &Type{Type: s.Type, Child: Map(s.Child, f)}
+	case *LineAndNot:
+		q = &LineAndNot{Positive: Map(s.Positive, f), Negative: Map(s.Negative, f)}
 	}
 	return f(q)
 }
 
 // Expand expands Substr queries into (OR file_substr content_substr)
-// queries, and the same for Regexp queries..
+// queries, and the same for Regexp and Glob queries.
 func ExpandFileContent(q Q) Q {
 	switch s := q.(type) {
 	case *Substring:
+		if s.InSymbol {
+			return q
+		}
 		if !s.FileName && !s.Content {
 			f := *s
 			f.FileName = true
@@ -722,10 +981,41 @@ func ExpandFileContent(q Q) Q {
 			c.Content = true
 			return NewOr(&f, &c)
 		}
+	case *Glob:
+		if !s.FileName && !s.Content {
+			f := *s
+			f.FileName = true
+			c := *s
+			c.Content = true
+			return NewOr(&f, &c)
+		}
 	}
 	return q
 }
 
+// Expand rewrites the Substring atoms of q whose pattern is a key of
+// synonyms into an Or of the atom and the same atom for each synonym.
+// Synonyms are not expanded further.
+func Expand(q Q, synonyms map[string][]string) Q {
+	return Map(q, func(q Q) Q {
+		s, ok := q.(*Substring)
+		if !ok {
+			return q
+		}
+		syns := synonyms[s.Pattern]
+		if len(syns) == 0 {
+			return q
+		}
+		qs := []Q{s}
+		for _, syn := range syns {
+			c := *s
+			c.Pattern = syn
+			qs = append(qs, &c)
+		}
+		return NewOr(qs...)
+	})
+}
+
 // VisitAtoms runs `v` on all atom queries within `q`.
 func VisitAtoms(q Q, v func(q Q)) {
 	Map(q, func(iQ Q) Q {
@@ -734,6 +1024,7 @@ func VisitAtoms(q Q, v func(q Q)) {
 		case *Or:
 		case *Not:
 		case *Type:
+		case *LineAndNot:
 		default:
 			v(iQ)
 		}
@@ -63,6 +63,7 @@ func TestSimplify(t *testing.T) {
 		},
 		{in: &And{}, want: &Const{true}},
 		{in: &Or{}, want: &Const{false}},
+		{in: &AllOf{}, want: &Const{false}},
 		{in: NewAnd(&Const{true}, &Const{false}), want: &Const{false}},
 		{in: NewOr(&Const{false}, &Const{true}), want: &Const{true}},
 		{in: &Not{&Const{true}}, want: &Const{false}},
@@ -100,6 +101,39 @@ func TestMap(t *testing.T) {
 	}
 }
 
+func TestExpand(t *testing.T) {
+	synonyms := map[string][]string{
+		"auth":           {"authentication", "authorization"},
+		"authentication": {"authn"},
+	}
+	in := NewAnd(&Substring{Pattern: "auth", Content: true}, &Substring{Pattern: "token"})
+	want := NewAnd(
+		NewOr(
+			&Substring{Pattern: "auth", Content: true},
+			&Substring{Pattern: "authentication", Content: true},
+			&Substring{Pattern: "authorization", Content: true}),
+		&Substring{Pattern: "token"})
+	if got := Expand(in, synonyms); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWhitespaceRegexp(t *testing.T) {
+	for pat, want := range map[string]string{
+		"a  +  b":     `a[\t ]*\+[\t ]*b`,
+		"if (x)\n\t{": `if[\t ]*\(x\)[\t\n\f\r ]*\{`,
+		" abc":        `[\t ]*abc`,
+	} {
+		re, err := (&Substring{Pattern: pat, IgnoreWhitespace: true}).WhitespaceRegexp()
+		if err != nil {
+			t.Fatalf("%q: %v", pat, err)
+		}
+		if got := re.Regexp.String(); got != want {
+			t.Errorf("%q: got %s, want %s", pat, got, want)
+		}
+	}
+}
+
 func TestVisitAtoms(t *testing.T) {
 	in := NewAnd(&Substring{}, &Repo{}, &Not{&Const{}})
 	count := 0
@@ -110,3 +144,45 @@ func TestVisitAtoms(t *testing.T) {
 		t.Errorf("got %d, want 3", count)
 	}
 }
+
+func TestHash(t *testing.T) {
+	build := func() Q {
+		return NewAnd(
+			NewAnd(&Substring{Pattern: "foo", Content: true},
+				&Regexp{Regexp: mustParseRE("ba+r"), CaseSensitive: true}),
+			&Repo{Regexp: regexp.MustCompile("zoekt")},
+			&RepoSet{Set: map[string]bool{"a": true, "b": true, "c": true}},
+			&Const{Value: true})
+	}
+	a, b := build(), build()
+	if Hash(a) != Hash(b) {
+		t.Errorf("equivalent queries %s and %s hash differently", a, b)
+	}
+
+	flat := NewAnd(&Substring{Pattern: "foo", Content: true},
+		&Regexp{Regexp: mustParseRE("ba+r"), CaseSensitive: true},
+		&Repo{Regexp: regexp.MustCompile("zoekt")},
+		&RepoSet{Set: map[string]bool{"c": true, "b": true, "a": true}})
+	if Hash(a) != Hash(flat) {
+		t.Errorf("simplified queries %s and %s hash differently", a, flat)
+	}
+
+	for _, q := range []Q{
+		NewAnd(&Substring{Pattern: "foo", Content: true},
+			&Regexp{Regexp: mustParseRE("ba+r")},
+			&Repo{Regexp: regexp.MustCompile("zoekt")},
+			&RepoSet{Set: map[string]bool{"a": true, "b": true, "c": true}}),
+		NewAnd(&Substring{Pattern: "foo", Content: true},
+			&Regexp{Regexp: mustParseRE("(?i)ba+r"), CaseSensitive: true},
+			&Repo{Regexp: regexp.MustCompile("zoekt")},
+			&RepoSet{Set: map[string]bool{"a": true, "b": true, "c": true}}),
+		NewAnd(&Substring{Pattern: "foo", Content: true},
+			&Regexp{Regexp: mustParseRE("ba+r"), CaseSensitive: true},
+			&Repo{Regexp: regexp.MustCompile("zoekt")},
+			&RepoSet{Set: map[string]bool{"a": true, "b": true}}),
+	} {
+		if Hash(a) == Hash(q) {
+			t.Errorf("different queries %s and %s hash equally", a, q)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package zoekt
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -22,6 +23,7 @@ import (
 	"log"
 	"os"
 	"sort"
+	"sync"
 
 	"github.com/rs/xid"
 )
@@ -249,8 +251,12 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 		return nil, fmt.Errorf("file is feature version %d, want feature version >= %d", d.metaData.IndexFeatureVersion, ReadMinFeatureVersion)
 	}
 
-	if d.metaData.IndexMinReaderVersion > FeatureVersion {
-		return nil, fmt.Errorf("file needs read feature version >= %d, have read feature version %d", d.metaData.IndexMinReaderVersion, FeatureVersion)
+	if d.metaData.IndexMinReaderVersion > ReadFeatureVersion {
+		return nil, fmt.Errorf("file needs read feature version >= %d, have read feature version %d", d.metaData.IndexMinReaderVersion, ReadFeatureVersion)
+	}
+
+	if c := d.metaData.PostingsCodec; c != PostingsDeltaVarint && c != PostingsBitPacked {
+		return nil, fmt.Errorf("unknown posting list codec %d", c)
 	}
 
 	d.boundariesStart = toc.fileContents.data.off
@@ -259,6 +265,8 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 	d.newlinesIndex = toc.newlines.relativeIndex()
 	d.docSectionsStart = toc.fileSections.data.off
 	d.docSectionsIndex = toc.fileSections.relativeIndex()
+	d.commentSectionsStart = toc.commentSections.data.off
+	d.commentSectionsIndex = toc.commentSections.relativeIndex()
 
 	d.symbols.symKindIndex = toc.symbolKindMap.relativeIndex()
 	d.fileEndSymbol, err = readSectionU32(d.file, toc.fileEndSymbol)
@@ -289,6 +297,16 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 		return nil, err
 	}
 
+	d.fileModes, err = readSectionU32(d.file, toc.fileModes)
+	if err != nil {
+		return nil, err
+	}
+
+	d.maxLineLengths, err = readSectionU32(d.file, toc.maxLineLengths)
+	if err != nil {
+		return nil, err
+	}
+
 	d.ngrams, err = d.readNgrams(toc)
 	if err != nil {
 		return nil, err
@@ -323,6 +341,11 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 		return nil, err
 	}
 
+	d.symbolNgrams, err = d.readNgramPostings(toc.symbolNgramText, toc.symbolPostings)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, md := range d.repoMetaData {
 		repoBranchIDs := make(map[string]uint, len(md.Branches))
 		repoBranchNames := make(map[uint]string, len(md.Branches))
@@ -467,28 +490,34 @@ func (d *indexData) readNgrams(toc *indexTOC) (combinedNgramOffset, error) {
 }
 
 func (d *indexData) readFileNameNgrams(toc *indexTOC) (map[ngram][]byte, error) {
-	nameNgramText, err := d.readSectionBlob(toc.nameNgramText)
+	return d.readNgramPostings(toc.nameNgramText, toc.namePostings)
+}
+
+// readNgramPostings maps the ngrams in ngramText to their posting
+// lists in postings.
+func (d *indexData) readNgramPostings(ngramText simpleSection, postings compoundSection) (map[ngram][]byte, error) {
+	text, err := d.readSectionBlob(ngramText)
 	if err != nil {
 		return nil, err
 	}
 
-	fileNamePostingsData, err := d.readSectionBlob(toc.namePostings.data)
+	postingsData, err := d.readSectionBlob(postings.data)
 	if err != nil {
 		return nil, err
 	}
 
-	fileNamePostingsIndex := toc.namePostings.relativeIndex()
+	postingsIndex := postings.relativeIndex()
 
-	fileNameNgrams := make(map[ngram][]byte, len(nameNgramText)/ngramEncoding)
-	for i := 0; i < len(nameNgramText); i += ngramEncoding {
+	ngrams := make(map[ngram][]byte, len(text)/ngramEncoding)
+	for i := 0; i < len(text); i += ngramEncoding {
 		j := i / ngramEncoding
-		off := fileNamePostingsIndex[j]
-		end := fileNamePostingsIndex[j+1]
-		ng := ngram(binary.BigEndian.Uint64(nameNgramText[i : i+ngramEncoding]))
-		fileNameNgrams[ng] = fileNamePostingsData[off:end]
+		off := postingsIndex[j]
+		end := postingsIndex[j+1]
+		ng := ngram(binary.BigEndian.Uint64(text[i : i+ngramEncoding]))
+		ngrams[ng] = postingsData[off:end]
 	}
 
-	return fileNameNgrams, nil
+	return ngrams, nil
 }
 
 func (d *indexData) verify() error {
@@ -514,6 +543,9 @@ func (d *indexData) verify() error {
 	return nil
 }
 
+// readContents returns the content of document i. Contents are stored
+// uncompressed, one after the other, so this reads only the bytes of
+// that document.
 func (d *indexData) readContents(i uint32) ([]byte, error) {
 	return d.readSectionBlob(simpleSection{
 		off: d.boundariesStart + d.boundaries[i],
@@ -530,6 +562,26 @@ func (d *indexData) readContentSlice(off uint32, sz uint32) ([]byte, error) {
 	})
 }
 
+func (d *indexData) ContentWindow(ctx context.Context, fileName string, start, end uint32) ([]byte, error) {
+	if start > end {
+		return nil, fmt.Errorf("window start %d is after end %d", start, end)
+	}
+	for i := uint32(0); int(i)+1 < len(d.fileNameIndex); i++ {
+		if d.repoMetaData[d.repos[i]].Tombstone || string(d.fileName(i)) != fileName {
+			continue
+		}
+		size := d.boundaries[i+1] - d.boundaries[i]
+		if end > size {
+			end = size
+		}
+		if start > end {
+			start = end
+		}
+		return d.readContentSlice(d.boundaries[i]+start, end-start)
+	}
+	return nil, fmt.Errorf("%q: %w", fileName, ErrFileNotFound)
+}
+
 func (d *indexData) readNewlines(i uint32, buf []uint32) ([]uint32, uint32, error) {
 	sec := simpleSection{
 		off: d.newlinesStart + d.newlinesIndex[i],
@@ -556,6 +608,24 @@ func (d *indexData) readDocSections(i uint32, buf []DocumentSection) ([]Document
 	return unmarshalDocSections(blob, buf), sec.sz, nil
 }
 
+// readCommentSections returns the comment spans of document i, or nil
+// if the shard has none.
+func (d *indexData) readCommentSections(i uint32, buf []DocumentSection) ([]DocumentSection, uint32, error) {
+	if len(d.commentSectionsIndex) == 0 {
+		return nil, 0, nil
+	}
+	sec := simpleSection{
+		off: d.commentSectionsStart + d.commentSectionsIndex[i],
+		sz:  d.commentSectionsIndex[i+1] - d.commentSectionsIndex[i],
+	}
+	blob, err := d.readSectionBlob(sec)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return unmarshalDocSections(blob, buf), sec.sz, nil
+}
+
 func (d *indexData) readBloom(sec simpleSection) (bloom, error) {
 	if sec.sz == 0 {
 		// an empty bloom filter is fine
@@ -584,9 +654,34 @@ func NewSearcher(r IndexFile) (Searcher, error) {
 		return nil, err
 	}
 	indexData.file = r
+	indexData.contentCache = getContentCache()
+	indexData.shardID = nextShardID()
+	indexData.languageAliases = getLanguageAliases()
 	return indexData, nil
 }
 
+var (
+	languageAliasesMu sync.Mutex
+	languageAliases   map[string]string
+)
+
+// SetLanguageAliases sets the aliases used by searchers subsequently
+// returned by NewSearcher to resolve language queries on shards that
+// predate go-enry language detection. Such shards are searched by file
+// extension, and aliases maps a language name, eg. "golang", to the
+// go-enry name whose extensions should be used, eg. "Go".
+func SetLanguageAliases(aliases map[string]string) {
+	languageAliasesMu.Lock()
+	defer languageAliasesMu.Unlock()
+	languageAliases = aliases
+}
+
+func getLanguageAliases() map[string]string {
+	languageAliasesMu.Lock()
+	defer languageAliasesMu.Unlock()
+	return languageAliases
+}
+
 // ReadMetadata returns the metadata of index shard without reading
 // the index data. The IndexFile is not closed.
 func ReadMetadata(inf IndexFile) ([]*Repository, *IndexMetadata, error) {
@@ -599,6 +694,23 @@ func ReadMetadata(inf IndexFile) ([]*Repository, *IndexMetadata, error) {
 	return rd.readMetadata(&toc)
 }
 
+// ReadRepos returns the repositories of the index shard. Like
+// ReadMetadata, it only reads the table of contents and the metadata
+// sections, so it is cheap enough to scan many shards. The IndexFile
+// is not closed.
+func ReadRepos(inf IndexFile) ([]*Repository, error) {
+	repos, _, err := ReadMetadata(inf)
+	return repos, err
+}
+
+// ReadIndexMetadata returns the IndexMetadata of the index shard,
+// such as its format versions and build time, without reading the
+// index data. The IndexFile is not closed.
+func ReadIndexMetadata(inf IndexFile) (*IndexMetadata, error) {
+	_, md, err := ReadMetadata(inf)
+	return md, err
+}
+
 // ReadMetadataPathAlive is like ReadMetadataPath except that it only returns
 // alive repositories.
 func ReadMetadataPathAlive(p string) ([]*Repository, *IndexMetadata, error) {
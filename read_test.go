@@ -224,6 +224,11 @@ func TestReadSearch(t *testing.T) {
 				continue
 			}
 
+			// The golden files predate FileMatch.ShardName.
+			for k := range want.FileMatches[j] {
+				want.FileMatches[j][k].ShardName = filepath.Base(path)
+			}
+
 			if d := cmp.Diff(res.Files, want.FileMatches[j]); d != "" {
 				t.Errorf("matches for %s on %s\n%s", q, name, d)
 			}
@@ -274,6 +279,25 @@ func TestEncodeRawConfig(t *testing.T) {
 	}
 }
 
+func TestDecodeRawConfig(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Name:      "repo",
+		RawConfig: map[string]string{"fork": "1", "public": "1", "priority": "10"},
+	})
+	s := searcherForTest(t, b)
+
+	want := map[string]map[string]string{
+		"repo": {"public": "1", "fork": "1", "archived": "0", "priority": "10"},
+	}
+	got, err := s.RawConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
 func TestBackwardsCompat(t *testing.T) {
 	if *update {
 		b, err := NewIndexBuilder(nil)
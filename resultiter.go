@@ -0,0 +1,140 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"context"
+
+	"github.com/google/zoekt/query"
+)
+
+// MatchIter iterates over the line matches of a search one by one,
+// instead of grouped by file.
+type MatchIter interface {
+	// Next advances to the next match. It returns false once all
+	// matches have been returned, or if the search failed.
+	Next() bool
+
+	// Match returns the current match and the file it is in. The
+	// LineMatches and Hunks of the file are not set.
+	Match() (*FileMatch, LineMatch)
+
+	// Err returns the error of the search, if any, once Next has
+	// returned false.
+	Err() error
+
+	// Close stops the search. It must be called if the iterator is
+	// abandoned before Next returns false.
+	Close()
+}
+
+// NewMatchIter starts a search for q and returns an iterator over its
+// line matches, in the order of the files of SearchResult.Files.
+//
+// If s is a Streamer, the matches of each streamed result are
+// returned while the search continues, so the iterator holds one
+// result at a time rather than the whole result set. Results from
+// several shards then come in the order the shards finish. Otherwise
+// the iterator walks the result of Search.
+func NewMatchIter(ctx context.Context, s Searcher, q query.Q, opts *SearchOptions) MatchIter {
+	ctx, cancel := context.WithCancel(ctx)
+	it := &matchIter{
+		cancel:  cancel,
+		results: make(chan *SearchResult),
+	}
+	go it.run(ctx, s, q, opts)
+	return it
+}
+
+type matchIter struct {
+	cancel  context.CancelFunc
+	results chan *SearchResult
+
+	// err is written by run before it closes results.
+	err error
+
+	files   []FileMatch
+	file    FileMatch
+	lines   []LineMatch
+	current LineMatch
+}
+
+// senderFunc adapts a function to the Sender interface.
+type senderFunc func(*SearchResult)
+
+func (f senderFunc) Send(sr *SearchResult) {
+	f(sr)
+}
+
+func (it *matchIter) run(ctx context.Context, s Searcher, q query.Q, opts *SearchOptions) {
+	defer close(it.results)
+
+	send := func(sr *SearchResult) {
+		if len(sr.Files) == 0 {
+			return
+		}
+		select {
+		case it.results <- sr:
+		case <-ctx.Done():
+		}
+	}
+
+	if st, ok := s.(Streamer); ok {
+		it.err = st.StreamSearch(ctx, q, opts, senderFunc(send))
+		return
+	}
+
+	sr, err := s.Search(ctx, q, opts)
+	if err != nil {
+		it.err = err
+		return
+	}
+	send(sr)
+}
+
+func (it *matchIter) Next() bool {
+	for len(it.lines) == 0 {
+		for len(it.files) == 0 {
+			sr, ok := <-it.results
+			if !ok {
+				return false
+			}
+			it.files = sr.Files
+		}
+		it.file = it.files[0]
+		it.files = it.files[1:]
+		it.lines = it.file.LineMatches
+		it.file.LineMatches = nil
+		it.file.Hunks = nil
+	}
+	it.current = it.lines[0]
+	it.lines = it.lines[1:]
+	return true
+}
+
+func (it *matchIter) Match() (*FileMatch, LineMatch) {
+	return &it.file, it.current
+}
+
+func (it *matchIter) Err() error {
+	return it.err
+}
+
+func (it *matchIter) Close() {
+	it.cancel()
+	// Drain, so run can return.
+	for range it.results {
+	}
+}
@@ -30,6 +30,61 @@ type ListReply struct {
 	List *zoekt.RepoList
 }
 
+type FileNamesArgs struct {
+	Q query.Q
+}
+
+type FileNamesReply struct {
+	FileNames []string
+}
+
+type CountArgs struct {
+	Q    query.Q
+	Opts *zoekt.SearchOptions
+}
+
+type CountReply struct {
+	Count int64
+	Stats zoekt.Stats
+}
+
+type FileBranchesArgs struct {
+	FileName string
+}
+
+type FileBranchesReply struct {
+	Branches []zoekt.FileBranch
+}
+
+type SuggestArgs struct {
+	Q query.Q
+}
+
+type SuggestReply struct {
+	Words []string
+}
+
+type ContentWindowArgs struct {
+	FileName   string
+	Start, End uint32
+}
+
+type ContentWindowReply struct {
+	Window []byte
+}
+
+type DuplicateGroupsArgs struct{}
+
+type DuplicateGroupsReply struct {
+	Groups [][]zoekt.DuplicateFile
+}
+
+type RawConfigArgs struct{}
+
+type RawConfigReply struct {
+	RawConfig map[string]map[string]string
+}
+
 type Searcher struct {
 	Searcher zoekt.Searcher
 }
@@ -69,3 +124,104 @@ func (s *Searcher) List(ctx context.Context, args *ListArgs, reply *ListReply) e
 	reply.List = r
 	return nil
 }
+
+func (s *Searcher) FileNames(ctx context.Context, args *FileNamesArgs, reply *FileNamesReply) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	if args.Q != nil {
+		args.Q = query.RPCUnwrap(args.Q)
+	}
+
+	names, err := s.Searcher.FileNames(ctx, args.Q)
+	if err != nil {
+		return err
+	}
+	reply.FileNames = names
+	return nil
+}
+
+func (s *Searcher) Count(ctx context.Context, args *CountArgs, reply *CountReply) error {
+	// Set a timeout if the user hasn't specified one.
+	if args.Opts != nil && args.Opts.MaxWallTime == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+
+	if args.Q != nil {
+		args.Q = query.RPCUnwrap(args.Q)
+	}
+
+	n, stats, err := s.Searcher.Count(ctx, args.Q, args.Opts)
+	if err != nil {
+		return err
+	}
+	reply.Count = n
+	reply.Stats = stats
+	return nil
+}
+
+func (s *Searcher) FileBranches(ctx context.Context, args *FileBranchesArgs, reply *FileBranchesReply) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	branches, err := s.Searcher.FileBranches(ctx, args.FileName)
+	if err != nil {
+		return err
+	}
+	reply.Branches = branches
+	return nil
+}
+
+func (s *Searcher) Suggest(ctx context.Context, args *SuggestArgs, reply *SuggestReply) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	if args.Q != nil {
+		args.Q = query.RPCUnwrap(args.Q)
+	}
+
+	words, err := s.Searcher.Suggest(ctx, args.Q)
+	if err != nil {
+		return err
+	}
+	reply.Words = words
+	return nil
+}
+
+func (s *Searcher) ContentWindow(ctx context.Context, args *ContentWindowArgs, reply *ContentWindowReply) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	window, err := s.Searcher.ContentWindow(ctx, args.FileName, args.Start, args.End)
+	if err != nil {
+		return err
+	}
+	reply.Window = window
+	return nil
+}
+
+func (s *Searcher) DuplicateGroups(ctx context.Context, args *DuplicateGroupsArgs, reply *DuplicateGroupsReply) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	groups, err := s.Searcher.DuplicateGroups(ctx)
+	if err != nil {
+		return err
+	}
+	reply.Groups = groups
+	return nil
+}
+
+func (s *Searcher) RawConfig(ctx context.Context, args *RawConfigArgs, reply *RawConfigReply) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	rc, err := s.Searcher.RawConfig(ctx)
+	if err != nil {
+		return err
+	}
+	reply.RawConfig = rc
+	return nil
+}
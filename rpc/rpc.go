@@ -63,6 +63,48 @@ func (c *client) List(ctx context.Context, q query.Q, opts *zoekt.ListOptions) (
 	return reply.List, err
 }
 
+func (c *client) FileNames(ctx context.Context, q query.Q) ([]string, error) {
+	var reply srv.FileNamesReply
+	err := c.call(ctx, "Searcher.FileNames", &srv.FileNamesArgs{Q: q}, &reply)
+	return reply.FileNames, err
+}
+
+func (c *client) Count(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (int64, zoekt.Stats, error) {
+	var reply srv.CountReply
+	err := c.call(ctx, "Searcher.Count", &srv.CountArgs{Q: q, Opts: opts}, &reply)
+	return reply.Count, reply.Stats, err
+}
+
+func (c *client) FileBranches(ctx context.Context, fileName string) ([]zoekt.FileBranch, error) {
+	var reply srv.FileBranchesReply
+	err := c.call(ctx, "Searcher.FileBranches", &srv.FileBranchesArgs{FileName: fileName}, &reply)
+	return reply.Branches, err
+}
+
+func (c *client) Suggest(ctx context.Context, q query.Q) ([]string, error) {
+	var reply srv.SuggestReply
+	err := c.call(ctx, "Searcher.Suggest", &srv.SuggestArgs{Q: q}, &reply)
+	return reply.Words, err
+}
+
+func (c *client) ContentWindow(ctx context.Context, fileName string, start, end uint32) ([]byte, error) {
+	var reply srv.ContentWindowReply
+	err := c.call(ctx, "Searcher.ContentWindow", &srv.ContentWindowArgs{FileName: fileName, Start: start, End: end}, &reply)
+	return reply.Window, err
+}
+
+func (c *client) DuplicateGroups(ctx context.Context) ([][]zoekt.DuplicateFile, error) {
+	var reply srv.DuplicateGroupsReply
+	err := c.call(ctx, "Searcher.DuplicateGroups", &srv.DuplicateGroupsArgs{}, &reply)
+	return reply.Groups, err
+}
+
+func (c *client) RawConfig(ctx context.Context) (map[string]map[string]string, error) {
+	var reply srv.RawConfigReply
+	err := c.call(ctx, "Searcher.RawConfig", &srv.RawConfigArgs{}, &reply)
+	return reply.RawConfig, err
+}
+
 func (c *client) call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
 	// We try twice. If we fail to dial or fail to call the function we try
 	// again after 100ms. Unrolled to make logic clear
@@ -128,6 +170,15 @@ var once sync.Once
 // once, because calls to gob.Register are protected by a sync.Once.
 func RegisterGob() {
 	once.Do(func() {
+		gob.Register(&query.AllOf{})
+		gob.Register(&query.FileType{})
+		gob.Register(&query.ContentHash{})
+		gob.Register(&query.MaxLineLength{})
+		gob.Register(&query.BranchCount{})
+		gob.Register(&query.SubRepoPath{})
+		gob.Register(&query.FileNameExact{})
+		gob.Register(&query.LineAndNot{})
+		gob.Register(&query.Glob{})
 		gob.Register(&query.And{})
 		gob.Register(&query.BranchRepos{})
 		gob.Register(&query.BranchesRepos{})
@@ -33,6 +33,16 @@ func TestClientServer(t *testing.T) {
 				},
 			},
 		},
+
+		WantSuggest: &query.Substring{Pattern: "needel"},
+		Suggestions: []string{"needle"},
+
+		Contents: map[string][]byte{"f1": []byte("hello")},
+
+		Branches: map[string][]zoekt.FileBranch{"f1": {{Repository: "foo/bar", Branch: zoekt.RepositoryBranch{Name: "HEAD", Version: "v1"}}}},
+
+		RawConfigs: map[string]map[string]string{"foo/bar": {"public": "1"}},
+		Duplicates: [][]zoekt.DuplicateFile{{{Repository: "foo/bar", FileName: "a"}, {Repository: "foo/bar", FileName: "b"}}},
 	}
 
 	ts := httptest.NewServer(rpc.Server(mock))
@@ -65,6 +75,46 @@ func TestClientServer(t *testing.T) {
 		t.Fatalf("got %+v, want %+v", l, mock.RepoList)
 	}
 
+	words, err := client.Suggest(context.Background(), mock.WantSuggest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(words, mock.Suggestions) {
+		t.Fatalf("got %v, want %v", words, mock.Suggestions)
+	}
+
+	window, err := client.ContentWindow(context.Background(), "f1", 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(window) != "el" {
+		t.Fatalf("got window %q, want %q", window, "el")
+	}
+
+	branches, err := client.FileBranches(context.Background(), "f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(branches, mock.Branches["f1"]) {
+		t.Fatalf("got %v, want %v", branches, mock.Branches["f1"])
+	}
+
+	groups, err := client.DuplicateGroups(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(groups, mock.Duplicates) {
+		t.Fatalf("got %v, want %v", groups, mock.Duplicates)
+	}
+
+	rc, err := client.RawConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rc, mock.RawConfigs) {
+		t.Fatalf("got %v, want %v", rc, mock.RawConfigs)
+	}
+
 	// Test closing a client we never dial.
 	noopClient := rpc.Client(u.Host)
 	noopClient.Close()
@@ -84,6 +84,47 @@ func (s *typeRepoSearcher) List(ctx context.Context, r query.Q, opts *zoekt.List
 	return s.Streamer.List(ctx, r, opts)
 }
 
+func (s *typeRepoSearcher) FileNames(ctx context.Context, q query.Q) (names []string, err error) {
+	tr, ctx := trace.New(ctx, "typeRepoSearcher.FileNames", "")
+	tr.LazyLog(q, true)
+	defer func() {
+		tr.LazyPrintf("file names: %d", len(names))
+		if err != nil {
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError(err)
+		}
+		tr.Finish()
+	}()
+
+	q, err = s.eval(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Streamer.FileNames(ctx, q)
+}
+
+func (s *typeRepoSearcher) Count(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (count int64, stats zoekt.Stats, err error) {
+	tr, ctx := trace.New(ctx, "typeRepoSearcher.Count", "")
+	tr.LazyLog(q, true)
+	tr.LazyPrintf("opts: %+v", opts)
+	defer func() {
+		tr.LazyPrintf("count: %d", count)
+		if err != nil {
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError(err)
+		}
+		tr.Finish()
+	}()
+
+	q, err = s.eval(ctx, q)
+	if err != nil {
+		return 0, zoekt.Stats{}, err
+	}
+
+	return s.Streamer.Count(ctx, q, opts)
+}
+
 func (s *typeRepoSearcher) eval(ctx context.Context, q query.Q) (query.Q, error) {
 	var err error
 	q = query.Map(q, func(q query.Q) query.Q {
@@ -16,6 +16,7 @@ package shards
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -30,6 +31,7 @@ import (
 
 	"golang.org/x/sync/semaphore"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/query"
 	"github.com/google/zoekt/stream"
@@ -185,6 +187,10 @@ type shardedSearcher struct {
 	shards map[string]*rankedShard
 
 	ranked atomic.Value
+
+	// commitDates holds the LatestCommitDate of the repositories in
+	// ranked, keyed by name, for RecencyTieBreak.
+	commitDates atomic.Value
 }
 
 func newShardedSearcher(n int64) *shardedSearcher {
@@ -435,6 +441,22 @@ func selectRepoSet(shards []*rankedShard, q query.Q) ([]*rankedShard, query.Q) {
 	return shards, and
 }
 
+// selectRepoFilter returns the shards containing a repository whose ID
+// is in filter. Shards with other repositories as well are filtered
+// further by the shard itself.
+func selectRepoFilter(shards []*rankedShard, filter *roaring.Bitmap) []*rankedShard {
+	var filtered []*rankedShard
+	for _, s := range shards {
+		for _, repo := range s.repos {
+			if filter.Contains(repo.ID) {
+				filtered = append(filtered, s)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
 func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (sr *zoekt.SearchResult, err error) {
 	tr, ctx := trace.New(ctx, "shardedSearcher.Search", "")
 	defer func() {
@@ -464,6 +486,10 @@ func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.Se
 
 	done, err := ss.streamSearch(ctx, proc, q, opts, stream.SenderFunc(func(r *zoekt.SearchResult) {
 		aggregate.Stats.Add(r.Stats)
+		aggregate.ShardErrors = append(aggregate.ShardErrors, r.ShardErrors...)
+		if r.FeatureVersion > 0 && (aggregate.FeatureVersion == 0 || r.FeatureVersion < aggregate.FeatureVersion) {
+			aggregate.FeatureVersion = r.FeatureVersion
+		}
 
 		if len(r.Files) > 0 {
 			aggregate.Files = append(aggregate.Files, r.Files...)
@@ -475,8 +501,27 @@ func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.Se
 				aggregate.LineFragments[k] = v
 			}
 		}
+		for k, v := range r.RepoAggregates {
+			if aggregate.RepoAggregates == nil {
+				aggregate.RepoAggregates = map[string]zoekt.RepoAggregate{}
+			}
+			agg := aggregate.RepoAggregates[k]
+			agg.Files += v.Files
+			agg.Matches += v.Matches
+			aggregate.RepoAggregates[k] = agg
+		}
+		for k, v := range r.LanguageFacet {
+			if aggregate.LanguageFacet == nil {
+				aggregate.LanguageFacet = map[string]int{}
+			}
+			aggregate.LanguageFacet[k] += v
+		}
 
 		if cancel != nil && opts.TotalMaxMatchCount > 0 && aggregate.Stats.MatchCount > opts.TotalMaxMatchCount {
+			// Set the reason before the canceled shards report in.
+			if aggregate.Stats.LimitReason == "" {
+				aggregate.Stats.LimitReason = zoekt.LimitMaxMatches
+			}
 			cancel()
 			cancel = nil
 		}
@@ -486,9 +531,27 @@ func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.Se
 		return nil, err
 	}
 
-	zoekt.SortFilesByScore(aggregate.Files)
+	// DedupeByChecksum and MaxDocDisplayCount keep the highest
+	// scoring files, so they need the files sorted.
+	sorted := !opts.Unordered || opts.DedupeByChecksum || opts.MaxDocDisplayCount > 0
+	if sorted && opts.RecencyTieBreak {
+		zoekt.SortFilesByScoreAndRecency(aggregate.Files, ss.latestCommitDates())
+	} else if sorted {
+		zoekt.SortFilesByScore(aggregate.Files)
+	}
+	if opts.DedupeByChecksum {
+		var n int
+		aggregate.Files, n = zoekt.DedupeFilesByChecksum(aggregate.Files)
+		aggregate.Stats.FilesDeduplicated += n
+	}
 	if max := opts.MaxDocDisplayCount; max > 0 && len(aggregate.Files) > max {
 		aggregate.Files = aggregate.Files[:max]
+		if aggregate.Stats.LimitReason == "" {
+			aggregate.Stats.LimitReason = zoekt.LimitMaxDocDisplayCount
+		}
+	}
+	if sortFiles := zoekt.PathSorter(opts); sortFiles != nil {
+		sortFiles(aggregate.Files)
 	}
 	copyFiles(aggregate)
 
@@ -506,6 +569,17 @@ func (ss *shardedSearcher) StreamSearch(ctx context.Context, q query.Q, opts *zo
 		tr.Finish()
 	}()
 
+	// Keep running totals for senders that want them.
+	statsSender, _ := sender.(zoekt.StatsSender)
+	var total zoekt.Stats
+	send := func(event *zoekt.SearchResult) {
+		sender.Send(event)
+		if statsSender != nil && !event.Stats.Zero() {
+			total.Add(event.Stats)
+			statsSender.OnStats(total, false)
+		}
+	}
+
 	start := time.Now()
 	proc, err := ss.sched.Acquire(ctx)
 	if err != nil {
@@ -513,7 +587,7 @@ func (ss *shardedSearcher) StreamSearch(ctx context.Context, q query.Q, opts *zo
 	}
 	defer proc.Release()
 	tr.LazyPrintf("acquired process")
-	sender.Send(&zoekt.SearchResult{
+	send(&zoekt.SearchResult{
 		Stats: zoekt.Stats{
 			Wait: time.Since(start),
 		},
@@ -521,9 +595,12 @@ func (ss *shardedSearcher) StreamSearch(ctx context.Context, q query.Q, opts *zo
 
 	done, err := ss.streamSearch(ctx, proc, q, opts, stream.SenderFunc(func(event *zoekt.SearchResult) {
 		copyFiles(event)
-		sender.Send(event)
+		send(event)
 	}))
 	done()
+	if statsSender != nil {
+		statsSender.OnStats(total, true)
+	}
 	return err
 }
 
@@ -556,6 +633,10 @@ func (ss *shardedSearcher) streamSearch(ctx context.Context, proc *process, q qu
 	tr.LazyPrintf("before selectRepoSet shards:%d", len(shards))
 	shards, q = selectRepoSet(shards, q)
 	tr.LazyPrintf("after selectRepoSet shards:%d %s", len(shards), q)
+	if opts.RepoFilter != nil {
+		shards = selectRepoFilter(shards, opts.RepoFilter)
+		tr.LazyPrintf("after selectRepoFilter shards:%d", len(shards))
+	}
 
 	if len(shards) == 0 {
 		return func() {}, nil
@@ -577,6 +658,8 @@ func (ss *shardedSearcher) streamSearch(ctx context.Context, proc *process, q qu
 
 	type result struct {
 		priority float64
+		// shard names the shard if err is set.
+		shard string
 		*zoekt.SearchResult
 		err error
 	}
@@ -599,6 +682,9 @@ func (ss *shardedSearcher) streamSearch(ctx context.Context, proc *process, q qu
 			for s := range search {
 				sr, err := searchOneShard(ctx, s, q, opts)
 				r := &result{priority: s.priority, SearchResult: sr, err: err}
+				if err != nil {
+					r.shard = s.String()
+				}
 				results <- r
 			}
 		}()
@@ -658,11 +744,25 @@ search:
 			// delete this result's priority from pending before computing the new max pending priority
 			pending.remove(r.priority)
 
+			if r.err != nil && opts.BestEffort {
+				sender.Send(&zoekt.SearchResult{
+					Progress: zoekt.Progress{
+						Priority:           r.priority,
+						MaxPendingPriority: pending.max(),
+					},
+					ShardErrors: []zoekt.ShardError{{Shard: r.shard, Err: r.err.Error()}},
+				})
+				continue
+			}
 			if r.err != nil {
-				// Set final error and stop searching new shards, but consume any pending
-				// search results.
+				// Set final error, stop searching new shards and cancel the running
+				// ones, but consume any pending search results. The canceled shards
+				// report context errors, which must not replace the first error.
 				stop()
-				err = r.err
+				cancel()
+				if err == nil {
+					err = r.err
+				}
 				continue
 			}
 
@@ -671,7 +771,7 @@ search:
 			r.Priority = r.priority
 			r.MaxPendingPriority = pending.max()
 
-			sendByRepository(r.SearchResult, sender)
+			sendByRepository(r.SearchResult, opts, sender)
 		}
 	}
 
@@ -684,24 +784,35 @@ search:
 //
 // We split by repository instead of by priority because it is easier to set
 // RepoURLs and LineFragments in zoekt.SearchResult.
-func sendByRepository(result *zoekt.SearchResult, sender zoekt.Sender) {
+func sendByRepository(result *zoekt.SearchResult, opts *zoekt.SearchOptions, sender zoekt.Sender) {
+	sortFiles := zoekt.PathSorter(opts)
+	if sortFiles == nil {
+		sortFiles = zoekt.SortFilesByScore
+	}
+
 	if len(result.RepoURLs) <= 1 || len(result.Files) == 0 {
-		zoekt.SortFilesByScore(result.Files)
+		sortFiles(result.Files)
 		sender.Send(result)
 		return
 	}
 
 	send := func(repoName string, a, b int) {
-		zoekt.SortFilesByScore(result.Files[a:b])
+		sortFiles(result.Files[a:b])
+		var aggregates map[string]zoekt.RepoAggregate
+		if agg, ok := result.RepoAggregates[repoName]; ok {
+			aggregates = map[string]zoekt.RepoAggregate{repoName: agg}
+		}
 		sender.Send(&zoekt.SearchResult{
 			// No stats. Stats must be aggregateable, hence we sent them separately.
 			Progress: zoekt.Progress{
 				Priority:           result.Files[a].RepositoryPriority,
 				MaxPendingPriority: result.MaxPendingPriority,
 			},
-			Files:         result.Files[a:b],
-			RepoURLs:      map[string]string{repoName: result.RepoURLs[repoName]},
-			LineFragments: map[string]string{repoName: result.LineFragments[repoName]},
+			Files:          result.Files[a:b],
+			RepoURLs:       map[string]string{repoName: result.RepoURLs[repoName]},
+			LineFragments:  map[string]string{repoName: result.LineFragments[repoName]},
+			RepoAggregates: aggregates,
+			FeatureVersion: result.FeatureVersion,
 		})
 	}
 
@@ -720,7 +831,8 @@ func sendByRepository(result *zoekt.SearchResult, sender zoekt.Sender) {
 		}
 	}
 	send(curRepoName, startIndex, endIndex+1)
-	sender.Send(&zoekt.SearchResult{Stats: result.Stats})
+	// The facet counts all repositories, so it is sent with the stats.
+	sender.Send(&zoekt.SearchResult{Stats: result.Stats, LanguageFacet: result.LanguageFacet})
 }
 
 func observeMetrics(sr *zoekt.SearchResult) {
@@ -751,9 +863,13 @@ func copyFiles(sr *zoekt.SearchResult) {
 		copySlice(&sr.Files[i].Content)
 		copySlice(&sr.Files[i].Checksum)
 		for l := range sr.Files[i].LineMatches {
-			copySlice(&sr.Files[i].LineMatches[l].Line)
-			copySlice(&sr.Files[i].LineMatches[l].Before)
-			copySlice(&sr.Files[i].LineMatches[l].After)
+			lm := &sr.Files[i].LineMatches[l]
+			copySlice(&lm.Line)
+			copySlice(&lm.Before)
+			copySlice(&lm.After)
+			for f := range lm.LineFragments {
+				copySlice(&lm.LineFragments[f].Token)
+			}
 		}
 	}
 }
@@ -797,6 +913,9 @@ func listOneShard(ctx context.Context, s zoekt.Searcher, q query.Q, opts *zoekt.
 }
 
 func (ss *shardedSearcher) List(ctx context.Context, r query.Q, opts *zoekt.ListOptions) (rl *zoekt.RepoList, err error) {
+	if r == nil {
+		r = &query.Const{Value: true}
+	}
 	tr, ctx := trace.New(ctx, "shardedSearcher.List", "")
 	tr.LazyLog(r, true)
 	tr.LazyPrintf("opts: %s", opts)
@@ -893,6 +1012,410 @@ func (ss *shardedSearcher) List(ctx context.Context, r query.Q, opts *zoekt.List
 	return &agg, nil
 }
 
+type shardFileNamesResult struct {
+	names []string
+	err   error
+}
+
+func fileNamesOneShard(ctx context.Context, s zoekt.Searcher, q query.Q, sink chan shardFileNamesResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("crashed shard: %s: %s, %s", s.String(), r, debug.Stack())
+			sink <- shardFileNamesResult{
+				err: fmt.Errorf("shard %s crashed: %v", s.String(), r),
+			}
+		}
+	}()
+
+	names, err := s.FileNames(ctx, q)
+	sink <- shardFileNamesResult{names, err}
+}
+
+// FileNames returns the sorted names of the files matching q across all
+// shards.
+func (ss *shardedSearcher) FileNames(ctx context.Context, q query.Q) (names []string, err error) {
+	tr, ctx := trace.New(ctx, "shardedSearcher.FileNames", "")
+	tr.LazyLog(q, true)
+	defer func() {
+		tr.LazyPrintf("file names: %d", len(names))
+		if err != nil {
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError(err)
+		}
+		tr.Finish()
+	}()
+
+	q = query.Simplify(q)
+
+	proc, err := ss.sched.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer proc.Release()
+	tr.LazyPrintf("acquired process")
+
+	shards := ss.getShards()
+	all := make(chan shardFileNamesResult, len(shards))
+
+	feeder := make(chan zoekt.Searcher, len(shards))
+	for _, s := range shards {
+		feeder <- s
+	}
+	close(feeder)
+
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		go func() {
+			for s := range feeder {
+				fileNamesOneShard(ctx, s, q, all)
+			}
+		}()
+	}
+
+	for range shards {
+		r := <-all
+		if r.err != nil {
+			return nil, r.err
+		}
+		names = append(names, r.names...)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// FileBranches returns the branches containing fileName across all
+// shards, in the order of the shards.
+func (ss *shardedSearcher) FileBranches(ctx context.Context, fileName string) (branches []zoekt.FileBranch, err error) {
+	tr, ctx := trace.New(ctx, "shardedSearcher.FileBranches", "")
+	tr.LazyPrintf("fileName: %s", fileName)
+	defer func() {
+		tr.LazyPrintf("branches: %d", len(branches))
+		if err != nil {
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError(err)
+		}
+		tr.Finish()
+	}()
+
+	proc, err := ss.sched.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer proc.Release()
+	tr.LazyPrintf("acquired process")
+
+	shards := ss.getShards()
+	perShard := make([][]zoekt.FileBranch, len(shards))
+	err = forEachShard(ctx, shards, func(ctx context.Context, i int, s zoekt.Searcher) error {
+		var err error
+		perShard[i], err = s.FileBranches(ctx, fileName)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, brs := range perShard {
+		branches = append(branches, brs...)
+	}
+	return branches, nil
+}
+
+type shardCountResult struct {
+	count int64
+	stats zoekt.Stats
+	err   error
+}
+
+func countOneShard(ctx context.Context, s zoekt.Searcher, q query.Q, opts *zoekt.SearchOptions, sink chan shardCountResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("crashed shard: %s: %s, %s", s.String(), r, debug.Stack())
+			sink <- shardCountResult{
+				stats: zoekt.Stats{Crashes: 1},
+			}
+		}
+	}()
+
+	count, stats, err := s.Count(ctx, q, opts)
+	sink <- shardCountResult{count, stats, err}
+}
+
+// Count returns the sum of the match counts of all shards.
+func (ss *shardedSearcher) Count(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (count int64, stats zoekt.Stats, err error) {
+	tr, ctx := trace.New(ctx, "shardedSearcher.Count", "")
+	tr.LazyLog(q, true)
+	tr.LazyPrintf("opts: %+v", opts)
+	defer func() {
+		tr.LazyPrintf("count: %d", count)
+		tr.LazyPrintf("stats: %+v", stats)
+		if err != nil {
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError(err)
+		}
+		tr.Finish()
+	}()
+
+	if opts.MaxWallTime != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.MaxWallTime)
+		defer cancel()
+	}
+
+	q = query.Simplify(q)
+
+	proc, err := ss.sched.Acquire(ctx)
+	if err != nil {
+		return 0, zoekt.Stats{}, err
+	}
+	defer proc.Release()
+	tr.LazyPrintf("acquired process")
+
+	shards := ss.getShards()
+	all := make(chan shardCountResult, len(shards))
+
+	feeder := make(chan zoekt.Searcher, len(shards))
+	for _, s := range shards {
+		feeder <- s
+	}
+	close(feeder)
+
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		go func() {
+			for s := range feeder {
+				countOneShard(ctx, s, q, opts, all)
+			}
+		}()
+	}
+
+	for range shards {
+		r := <-all
+		if r.err != nil {
+			return 0, zoekt.Stats{}, r.err
+		}
+		count += r.count
+		stats.Add(r.stats)
+	}
+
+	return count, stats, nil
+}
+
+// forEachShard calls f on the shards in parallel, with the position
+// of the shard as i. It returns the first error, and cancels the
+// context passed to the remaining calls when one fails.
+func forEachShard(ctx context.Context, shards []*rankedShard, f func(ctx context.Context, i int, s zoekt.Searcher) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(shards))
+	feeder := make(chan int, len(shards))
+	for i := range shards {
+		feeder <- i
+	}
+	close(feeder)
+
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		go func() {
+			for i := range feeder {
+				errs <- callShard(ctx, i, shards[i], f)
+			}
+		}()
+	}
+
+	var firstErr error
+	for range shards {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	return firstErr
+}
+
+func callShard(ctx context.Context, i int, s zoekt.Searcher, f func(ctx context.Context, i int, s zoekt.Searcher) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("crashed shard: %s: %s, %s", s.String(), r, debug.Stack())
+			err = fmt.Errorf("shard %s crashed: %v", s.String(), r)
+		}
+	}()
+	return f(ctx, i, s)
+}
+
+// Suggest returns the suggestions of all shards. The suggestions of
+// the shards are interleaved, in the order of the shards, so the best
+// suggestion of each shard comes before the second best of any.
+func (ss *shardedSearcher) Suggest(ctx context.Context, q query.Q) (words []string, err error) {
+	tr, ctx := trace.New(ctx, "shardedSearcher.Suggest", "")
+	tr.LazyLog(q, true)
+	defer func() {
+		tr.LazyPrintf("suggestions: %d", len(words))
+		if err != nil {
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError(err)
+		}
+		tr.Finish()
+	}()
+
+	q = query.Simplify(q)
+
+	proc, err := ss.sched.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer proc.Release()
+	tr.LazyPrintf("acquired process")
+
+	shards := ss.getShards()
+	perShard := make([][]string, len(shards))
+	err = forEachShard(ctx, shards, func(ctx context.Context, i int, s zoekt.Searcher) error {
+		var err error
+		perShard[i], err = s.Suggest(ctx, q)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for rank := 0; ; rank++ {
+		more := false
+		for _, ws := range perShard {
+			if rank >= len(ws) {
+				continue
+			}
+			more = true
+			if w := ws[rank]; !seen[w] {
+				seen[w] = true
+				words = append(words, w)
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	return words, nil
+}
+
+// ContentWindow returns the window of the first shard, in priority
+// order, that has a file named fileName.
+func (ss *shardedSearcher) ContentWindow(ctx context.Context, fileName string, start, end uint32) (window []byte, err error) {
+	tr, ctx := trace.New(ctx, "shardedSearcher.ContentWindow", "")
+	tr.LazyPrintf("file: %q [%d, %d)", fileName, start, end)
+	defer func() {
+		if err != nil {
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError(err)
+		}
+		tr.Finish()
+	}()
+
+	proc, err := ss.sched.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer proc.Release()
+	tr.LazyPrintf("acquired process")
+
+	shards := ss.getShards()
+	windows := make([][]byte, len(shards))
+	found := make([]bool, len(shards))
+	err = forEachShard(ctx, shards, func(ctx context.Context, i int, s zoekt.Searcher) error {
+		w, err := s.ContentWindow(ctx, fileName, start, end)
+		if errors.Is(err, zoekt.ErrFileNotFound) {
+			return nil
+		}
+		windows[i], found[i] = w, err == nil
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range shards {
+		if found[i] {
+			return windows[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%q: %w", fileName, zoekt.ErrFileNotFound)
+}
+
+// DuplicateGroups returns the duplicate groups of all shards, in the
+// order of the shards. A repository is only in one shard, so the
+// groups do not overlap.
+func (ss *shardedSearcher) DuplicateGroups(ctx context.Context) (groups [][]zoekt.DuplicateFile, err error) {
+	tr, ctx := trace.New(ctx, "shardedSearcher.DuplicateGroups", "")
+	defer func() {
+		tr.LazyPrintf("groups: %d", len(groups))
+		if err != nil {
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError(err)
+		}
+		tr.Finish()
+	}()
+
+	proc, err := ss.sched.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer proc.Release()
+	tr.LazyPrintf("acquired process")
+
+	shards := ss.getShards()
+	perShard := make([][][]zoekt.DuplicateFile, len(shards))
+	err = forEachShard(ctx, shards, func(ctx context.Context, i int, s zoekt.Searcher) error {
+		var err error
+		perShard[i], err = s.DuplicateGroups(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range perShard {
+		groups = append(groups, g...)
+	}
+	return groups, nil
+}
+
+// RawConfig merges the RawConfig of all shards. If a repository is in
+// several shards, the first shard in search order wins.
+func (ss *shardedSearcher) RawConfig(ctx context.Context) (res map[string]map[string]string, err error) {
+	tr, ctx := trace.New(ctx, "shardedSearcher.RawConfig", "")
+	defer func() {
+		tr.LazyPrintf("repos: %d", len(res))
+		if err != nil {
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError(err)
+		}
+		tr.Finish()
+	}()
+
+	proc, err := ss.sched.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer proc.Release()
+	tr.LazyPrintf("acquired process")
+
+	shards := ss.getShards()
+	perShard := make([]map[string]map[string]string, len(shards))
+	err = forEachShard(ctx, shards, func(ctx context.Context, i int, s zoekt.Searcher) error {
+		var err error
+		perShard[i], err = s.RawConfig(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	res = make(map[string]map[string]string)
+	for _, m := range perShard {
+		for name, rc := range m {
+			if _, ok := res[name]; !ok {
+				res[name] = rc
+			}
+		}
+	}
+	return res, nil
+}
+
 func reportListAllMetrics(repos []*zoekt.RepoListEntry) {
 	var stats zoekt.RepoStats
 	for _, r := range repos {
@@ -916,6 +1439,14 @@ func (s *shardedSearcher) getShards() []*rankedShard {
 	return ranked
 }
 
+// latestCommitDates returns the LatestCommitDate of the repositories
+// in the loaded shards, keyed by name. It is computed when the shards
+// are loaded and should not be mutated.
+func (ss *shardedSearcher) latestCommitDates() map[string]time.Time {
+	dates, _ := ss.commitDates.Load().(map[string]time.Time)
+	return dates
+}
+
 func mkRankedShard(s zoekt.Searcher) *rankedShard {
 	q := query.Const{Value: true}
 	result, err := s.List(context.Background(), &q, nil)
@@ -1015,7 +1546,15 @@ func (s *shardedSearcher) replace(shards map[string]zoekt.Searcher) {
 		return ranked[i].repos[0].Name < ranked[j].repos[0].Name
 	})
 
+	dates := map[string]time.Time{}
+	for _, r := range ranked {
+		for _, repo := range r.repos {
+			dates[repo.Name] = repo.LatestCommitDate
+		}
+	}
+
 	s.ranked.Store(ranked)
+	s.commitDates.Store(dates)
 
 	metricShardsLoaded.Set(float64(len(ranked)))
 }
@@ -17,6 +17,7 @@ package shards
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"log"
@@ -49,6 +50,34 @@ func (s *crashSearcher) List(ctx context.Context, q query.Q, opts *zoekt.ListOpt
 	panic("list")
 }
 
+func (s *crashSearcher) FileNames(ctx context.Context, q query.Q) ([]string, error) {
+	panic("filenames")
+}
+
+func (s *crashSearcher) FileBranches(ctx context.Context, fileName string) ([]zoekt.FileBranch, error) {
+	panic("filebranches")
+}
+
+func (s *crashSearcher) Count(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (int64, zoekt.Stats, error) {
+	panic("count")
+}
+
+func (s *crashSearcher) Suggest(ctx context.Context, q query.Q) ([]string, error) {
+	panic("suggest")
+}
+
+func (s *crashSearcher) ContentWindow(ctx context.Context, fileName string, start, end uint32) ([]byte, error) {
+	panic("contentwindow")
+}
+
+func (s *crashSearcher) DuplicateGroups(ctx context.Context) ([][]zoekt.DuplicateFile, error) {
+	panic("duplicategroups")
+}
+
+func (s *crashSearcher) RawConfig(ctx context.Context) (map[string]map[string]string, error) {
+	panic("rawconfig")
+}
+
 func (s *crashSearcher) Stats() (*zoekt.RepoStats, error) {
 	return &zoekt.RepoStats{}, nil
 }
@@ -77,6 +106,81 @@ func TestCrashResilience(t *testing.T) {
 	} else if res.Crashes != 1 {
 		t.Errorf("got result %#v, want crashes = 1", res)
 	}
+
+	if _, err := ss.FileNames(context.Background(), q); err == nil {
+		t.Errorf("FileNames: got nil error for crashed shard")
+	}
+
+	if _, err := ss.FileBranches(context.Background(), "f1"); err == nil {
+		t.Errorf("FileBranches: got nil error for crashed shard")
+	}
+
+	if _, stats, err := ss.Count(context.Background(), q, &zoekt.SearchOptions{}); err != nil || stats.Crashes != 1 {
+		t.Errorf("Count: got stats %+v, err %v, want 1 crash", stats, err)
+	}
+}
+
+// corruptSearcher fails all searches, like a shard with unreadable
+// contents.
+type corruptSearcher struct {
+	crashSearcher
+}
+
+func (s *corruptSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	return nil, errors.New("corrupt shard")
+}
+
+func (s *corruptSearcher) String() string { return "corruptSearcher" }
+
+func TestBestEffortShardErrors(t *testing.T) {
+	ss := newShardedSearcher(2)
+	good := searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "good"},
+		zoekt.Document{Name: "f", Content: []byte("needle")}))
+	ss.ranked.Store([]*rankedShard{{Searcher: good}, {Searcher: &corruptSearcher{}}})
+
+	q := &query.Substring{Pattern: "needle"}
+	if _, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{}); err == nil {
+		t.Error("got nil error searching a corrupt shard without BestEffort")
+	}
+
+	res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{BestEffort: true})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(res.Files) != 1 || res.Files[0].Repository != "good" {
+		t.Errorf("got files %v, want the match in the good shard", res.Files)
+	}
+	want := []zoekt.ShardError{{Shard: "corruptSearcher", Err: "corrupt shard"}}
+	if !reflect.DeepEqual(res.ShardErrors, want) {
+		t.Errorf("got shard errors %v, want %v", res.ShardErrors, want)
+	}
+}
+
+type blockingSearcher struct {
+	crashSearcher
+}
+
+func (s *blockingSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(time.Minute):
+		return &zoekt.SearchResult{}, nil
+	}
+}
+
+func TestShardErrorCancelsOthers(t *testing.T) {
+	ss := newShardedSearcher(2)
+	ss.ranked.Store([]*rankedShard{{Searcher: &corruptSearcher{}}, {Searcher: &blockingSearcher{}}})
+
+	start := time.Now()
+	_, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err == nil || err.Error() != "corrupt shard" {
+		t.Errorf("got error %v, want the error of the corrupt shard", err)
+	}
+	if d := time.Since(start); d > 30*time.Second {
+		t.Errorf("search took %v, the blocking shard was not canceled", d)
+	}
 }
 
 type rankSearcher struct {
@@ -114,6 +218,34 @@ func (s *rankSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.Search
 	}, nil
 }
 
+func (s *rankSearcher) FileNames(ctx context.Context, q query.Q) ([]string, error) {
+	return []string{fmt.Sprintf("f%d", s.rank)}, nil
+}
+
+func (s *rankSearcher) FileBranches(ctx context.Context, fileName string) ([]zoekt.FileBranch, error) {
+	return nil, nil
+}
+
+func (s *rankSearcher) Count(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (int64, zoekt.Stats, error) {
+	return int64(s.rank), zoekt.Stats{MatchCount: int(s.rank), FileCount: 1}, nil
+}
+
+func (s *rankSearcher) Suggest(ctx context.Context, q query.Q) ([]string, error) {
+	return []string{fmt.Sprintf("w%d", s.rank), "common"}, nil
+}
+
+func (s *rankSearcher) ContentWindow(ctx context.Context, fileName string, start, end uint32) ([]byte, error) {
+	return nil, zoekt.ErrFileNotFound
+}
+
+func (s *rankSearcher) DuplicateGroups(ctx context.Context) ([][]zoekt.DuplicateFile, error) {
+	return nil, nil
+}
+
+func (s *rankSearcher) RawConfig(ctx context.Context) (map[string]map[string]string, error) {
+	return nil, nil
+}
+
 func (s *rankSearcher) List(ctx context.Context, q query.Q, opts *zoekt.ListOptions) (*zoekt.RepoList, error) {
 	r := zoekt.Repository{}
 	if s.repo != nil {
@@ -129,6 +261,433 @@ func (s *rankSearcher) List(ctx context.Context, q query.Q, opts *zoekt.ListOpti
 
 func (s *rankSearcher) Repository() *zoekt.Repository { return s.repo }
 
+func TestFileNames(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i := 3; i > 0; i-- {
+		ss.replace(map[string]zoekt.Searcher{
+			fmt.Sprintf("shard%d", i): &rankSearcher{rank: uint16(i)},
+		})
+	}
+
+	got, err := ss.FileNames(context.Background(), &query.Const{Value: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff([]string{"f1", "f2", "f3"}, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	ss := newShardedSearcher(1)
+	var ranked []*rankedShard
+	for i := 3; i > 0; i-- {
+		ranked = append(ranked, &rankedShard{Searcher: &rankSearcher{rank: uint16(i)}})
+	}
+	ss.ranked.Store(ranked)
+
+	// The best suggestion of each shard comes first, and duplicates
+	// are dropped.
+	got, err := ss.Suggest(context.Background(), &query.Substring{Pattern: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff([]string{"w3", "w2", "w1", "common"}, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+
+	ss.ranked.Store([]*rankedShard{{Searcher: &rankSearcher{rank: 1}}, {Searcher: &crashSearcher{}}})
+	if _, err := ss.Suggest(context.Background(), &query.Substring{Pattern: "x"}); err == nil {
+		t.Error("got nil error with a crashing shard")
+	}
+}
+
+func TestContentWindow(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.replace(map[string]zoekt.Searcher{
+		"a": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "a"},
+			zoekt.Document{Name: "f1", Content: []byte("in repo a")})),
+		"b": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "b"},
+			zoekt.Document{Name: "f2", Content: []byte("in repo b")})),
+	})
+
+	got, err := ss.ContentWindow(context.Background(), "f2", 3, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "repo b" {
+		t.Errorf("got %q, want %q", got, "repo b")
+	}
+	if _, err := ss.ContentWindow(context.Background(), "f3", 0, 1); !errors.Is(err, zoekt.ErrFileNotFound) {
+		t.Errorf("got %v for unknown file, want ErrFileNotFound", err)
+	}
+}
+
+func TestFileBranches(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for _, name := range []string{"a", "b"} {
+		repo := &zoekt.Repository{Name: name, Branches: []zoekt.RepositoryBranch{{Name: "main", Version: "v-" + name}}}
+		ss.replace(map[string]zoekt.Searcher{
+			name: searcherForTest(t, testIndexBuilder(t, repo,
+				zoekt.Document{Name: "f", Content: []byte("x"), Branches: []string{"main"}})),
+		})
+	}
+
+	got, err := ss.FileBranches(context.Background(), "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Repository < got[j].Repository })
+	want := []zoekt.FileBranch{
+		{Repository: "a", Branch: zoekt.RepositoryBranch{Name: "main", Version: "v-a"}},
+		{Repository: "b", Branch: zoekt.RepositoryBranch{Name: "main", Version: "v-b"}},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestDuplicateGroups(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for _, name := range []string{"a", "b"} {
+		ss.replace(map[string]zoekt.Searcher{
+			name: searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: name},
+				zoekt.Document{Name: "f1", Content: []byte("copy")},
+				zoekt.Document{Name: "f2", Content: []byte("copy")})),
+		})
+	}
+
+	got, err := ss.DuplicateGroups(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i][0].Repository < got[j][0].Repository })
+	want := [][]zoekt.DuplicateFile{
+		{{Repository: "a", FileName: "f1"}, {Repository: "a", FileName: "f2"}},
+		{{Repository: "b", FileName: "f1"}, {Repository: "b", FileName: "f2"}},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestRawConfig(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.replace(map[string]zoekt.Searcher{
+		"a": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{
+			Name:      "a",
+			RawConfig: map[string]string{"public": "1"},
+		})),
+		"b": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{
+			Name:      "b",
+			RawConfig: map[string]string{"fork": "1", "priority": "5"},
+		})),
+	})
+
+	got, err := ss.RawConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]string{
+		"a": {"public": "1", "fork": "0", "archived": "0"},
+		"b": {"public": "0", "fork": "1", "archived": "0", "priority": "5"},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestCount(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i := 3; i > 0; i-- {
+		ss.replace(map[string]zoekt.Searcher{
+			fmt.Sprintf("shard%d", i): &rankSearcher{rank: uint16(i)},
+		})
+	}
+
+	count, stats, err := ss.Count(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 || stats.MatchCount != 6 || stats.FileCount != 3 {
+		t.Errorf("got count %d, stats %+v, want 6 matches in 3 files", count, stats)
+	}
+}
+
+func TestLimitReasonMaxDocDisplayCount(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i := 0; i < 3; i++ {
+		ss.replace(map[string]zoekt.Searcher{
+			fmt.Sprintf("shard%d", i): &rankSearcher{rank: uint16(i)},
+		})
+	}
+
+	q := &query.Substring{Pattern: "bla"}
+	res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{MaxDocDisplayCount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.LimitReason != "" {
+		t.Errorf("got limit reason %q, want none", res.LimitReason)
+	}
+
+	res, err = ss.Search(context.Background(), q, &zoekt.SearchOptions{MaxDocDisplayCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.LimitReason != zoekt.LimitMaxDocDisplayCount {
+		t.Errorf("got limit reason %q, want %q", res.LimitReason, zoekt.LimitMaxDocDisplayCount)
+	}
+}
+
+func TestMaxDocDisplayCountTopFiles(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.replace(map[string]zoekt.Searcher{
+		"shard": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "repo"},
+			zoekt.Document{Name: "f1", Content: []byte("needles")},
+			zoekt.Document{Name: "f2", Content: []byte("xneedlex")},
+			zoekt.Document{Name: "f3", Content: []byte("a needle")})),
+	})
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{MaxDocDisplayCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || res.Files[0].FileName != "f3" {
+		t.Errorf("got %v, want only the word match in f3", res.Files)
+	}
+	if res.Stats.FileCount != 3 {
+		t.Errorf("got FileCount %d, want 3", res.Stats.FileCount)
+	}
+}
+
+// slowSearcher delays searches, like a shard on a slow disk.
+type slowSearcher struct {
+	rankSearcher
+	delay time.Duration
+}
+
+func (s *slowSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	time.Sleep(s.delay)
+	return s.rankSearcher.Search(ctx, q, opts)
+}
+
+func TestUnordered(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+
+	ss := newShardedSearcher(1)
+	// The slow shard has the higher score and is searched first.
+	ss.ranked.Store([]*rankedShard{
+		{Searcher: &slowSearcher{rankSearcher{rank: 2}, 100 * time.Millisecond}, priority: 2},
+		{Searcher: &rankSearcher{rank: 1}, priority: 1},
+	})
+	q := &query.Substring{Pattern: "bla"}
+
+	var got []string
+	err := ss.StreamSearch(context.Background(), q, &zoekt.SearchOptions{Unordered: true}, stream.SenderFunc(func(r *zoekt.SearchResult) {
+		for _, f := range r.Files {
+			got = append(got, f.FileName)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"f1", "f2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("StreamSearch: got %v, want %v", got, want)
+	}
+
+	for _, c := range []struct {
+		unordered bool
+		max       int
+		want      []string
+	}{
+		{false, 0, []string{"f2", "f1"}},
+		{true, 0, []string{"f1", "f2"}},
+		// MaxDocDisplayCount keeps the highest scoring files.
+		{true, 1, []string{"f2"}},
+	} {
+		res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{Unordered: c.unordered, MaxDocDisplayCount: c.max})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = nil
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Unordered %v, MaxDocDisplayCount %d: got %v, want %v", c.unordered, c.max, got, c.want)
+		}
+	}
+}
+
+func TestRepoAggregates(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.replace(map[string]zoekt.Searcher{
+		"a": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "a"},
+			zoekt.Document{Name: "f1", Content: []byte("needle\nneedle")},
+			zoekt.Document{Name: "f2", Content: []byte("needle")})),
+		"b": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "b"},
+			zoekt.Document{Name: "f3", Content: []byte("needle")})),
+	})
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{ReportRepoAggregates: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]zoekt.RepoAggregate{
+		"a": {Files: 2, Matches: 3},
+		"b": {Files: 1, Matches: 1},
+	}
+	if !reflect.DeepEqual(res.RepoAggregates, want) {
+		t.Errorf("got %v, want %v", res.RepoAggregates, want)
+	}
+}
+
+func TestLanguageFacet(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.replace(map[string]zoekt.Searcher{
+		"a": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "a"},
+			zoekt.Document{Name: "f1.go", Language: "go", Content: []byte("needle")},
+			zoekt.Document{Name: "f2", Content: []byte("needle")})),
+		"b": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "b"},
+			zoekt.Document{Name: "f3.go", Language: "go", Content: []byte("needle")})),
+	})
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{ReportLanguageFacet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"go": 2, "": 1}; !reflect.DeepEqual(res.LanguageFacet, want) {
+		t.Errorf("got %v, want %v", res.LanguageFacet, want)
+	}
+}
+
+func TestMatchIter(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.replace(map[string]zoekt.Searcher{
+		"a": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "a"},
+			zoekt.Document{Name: "f1", Content: []byte("needle\nhay\nneedle needle\n")},
+			zoekt.Document{Name: "needle.go", Content: []byte("func needle() {}\n")},
+			zoekt.Document{Name: "f3", Content: []byte("hay\n")})),
+	})
+	q := &query.Substring{Pattern: "needle"}
+	opts := &zoekt.SearchOptions{}
+
+	res, err := ss.Search(context.Background(), q, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, f := range res.Files {
+		for _, l := range f.LineMatches {
+			want = append(want, fmt.Sprintf("%s:%d:%s", f.FileName, l.LineNumber, l.Line))
+		}
+	}
+
+	it := zoekt.NewMatchIter(context.Background(), ss, q, opts)
+	defer it.Close()
+	var got []string
+	for it.Next() {
+		f, l := it.Match()
+		if f.LineMatches != nil {
+			t.Errorf("%s: got LineMatches on the file", f.FileName)
+		}
+		got = append(got, fmt.Sprintf("%s:%d:%s", f.FileName, l.LineNumber, l.Line))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(want) < 3 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRecencyTieBreak(t *testing.T) {
+	ss := newShardedSearcher(1)
+	now := time.Now()
+	ss.replace(map[string]zoekt.Searcher{
+		"old": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "old", LatestCommitDate: now.Add(-time.Hour)},
+			zoekt.Document{Name: "f", Content: []byte("needle")})),
+		"recent": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "recent", LatestCommitDate: now},
+			zoekt.Document{Name: "f", Content: []byte("needle")})),
+	})
+
+	for i := 0; i < 10; i++ {
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{RecencyTieBreak: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 2 || res.Files[0].Score != res.Files[1].Score {
+			t.Fatalf("got %v, want 2 files with equal scores", res.Files)
+		}
+		if got := res.Files[0].Repository; got != "recent" {
+			t.Fatalf("got %s first, want the recently committed repository", got)
+		}
+	}
+
+	// The cached dates follow the loaded shards.
+	ss.replace(map[string]zoekt.Searcher{"recent": nil})
+	if _, ok := ss.latestCommitDates()["recent"]; ok {
+		t.Errorf("got a date for the unloaded repository")
+	}
+}
+
+func TestFeatureVersion(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.replace(map[string]zoekt.Searcher{
+		"a": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "a"},
+			zoekt.Document{Name: "f1", Content: []byte("needle")})),
+		"b": searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{Name: "b"},
+			zoekt.Document{Name: "f2", Content: []byte("needle")})),
+	})
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FeatureVersion != zoekt.FeatureVersion {
+		t.Errorf("got FeatureVersion %d, want %d", res.FeatureVersion, zoekt.FeatureVersion)
+	}
+}
+
+func TestRepoFilter(t *testing.T) {
+	ss := newShardedSearcher(1)
+	shards := map[string]zoekt.Searcher{}
+	for id := uint32(1); id <= 3; id++ {
+		name := fmt.Sprintf("repo%d", id)
+		shards[name] = searcherForTest(t, testIndexBuilder(t, &zoekt.Repository{ID: id, Name: name},
+			zoekt.Document{Name: name + "/f", Content: []byte("needle")}))
+	}
+	// A compound shard, of which only one repository is allowed.
+	b := testIndexBuilder(t, &zoekt.Repository{ID: 4, Name: "repo4"},
+		zoekt.Document{Name: "repo4/f", Content: []byte("needle")})
+	if _, err := b.AddRepository(&zoekt.Repository{ID: 5, Name: "repo5"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(zoekt.Document{Name: "repo5/f", Content: []byte("needle")}); err != nil {
+		t.Fatal(err)
+	}
+	shards["compound"] = searcherForTest(t, b)
+	ss.replace(shards)
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"},
+		&zoekt.SearchOptions{RepoFilter: roaring.BitmapOf(1, 3, 5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range res.Files {
+		got = append(got, f.FileName)
+	}
+	sort.Strings(got)
+	if want := []string{"repo1/f", "repo3/f", "repo5/f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if res.Stats.ShardsScanned != 3 {
+		t.Errorf("got %d shards scanned, want 3", res.Stats.ShardsScanned)
+	}
+}
+
 func TestOrderByShard(t *testing.T) {
 	ss := newShardedSearcher(1)
 
@@ -513,6 +1072,107 @@ func searcherForTest(t testing.TB, b *zoekt.IndexBuilder) zoekt.Searcher {
 	return searcher
 }
 
+type namedSeeker struct {
+	memSeeker
+	name string
+}
+
+func (s *namedSeeker) Name() string {
+	return s.name
+}
+
+func TestCopyFiles(t *testing.T) {
+	// data stands in for the mmapped shard.
+	data := []byte("the needle line")
+	sr := &zoekt.SearchResult{Files: []zoekt.FileMatch{{
+		LineMatches: []zoekt.LineMatch{{
+			Line:          data,
+			LineFragments: []zoekt.LineFragmentMatch{{LineOffset: 4, MatchLength: 6, Token: data[4:10]}},
+		}},
+	}}}
+
+	copyFiles(sr)
+	for i := range data {
+		data[i] = 'x'
+	}
+
+	lm := sr.Files[0].LineMatches[0]
+	if got := string(lm.Line); got != "the needle line" {
+		t.Errorf("got line %q after unloading", got)
+	}
+	if got := string(lm.LineFragments[0].Token); got != "needle" {
+		t.Errorf("got token %q after unloading", got)
+	}
+}
+
+func TestShardName(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for _, name := range []string{"repoa", "repob"} {
+		b := testIndexBuilder(t, &zoekt.Repository{Name: name},
+			zoekt.Document{Name: "f", Content: []byte("needle")})
+		var buf bytes.Buffer
+		if err := b.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		s, err := zoekt.NewSearcher(&namedSeeker{memSeeker{buf.Bytes()}, "/data/index/" + name + ".zoekt"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss.replace(map[string]zoekt.Searcher{name: s})
+	}
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 2 {
+		t.Fatalf("got %v, want 2 files", res.Files)
+	}
+	for _, f := range res.Files {
+		if want := f.Repository + ".zoekt"; f.ShardName != want {
+			t.Errorf("got shard %q for %s, want %q", f.ShardName, f.Repository, want)
+		}
+	}
+}
+
+func TestDedupeByChecksum(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for _, name := range []string{"repoa", "repob"} {
+		b := testIndexBuilder(t, &zoekt.Repository{Name: name},
+			zoekt.Document{Name: "f", Content: []byte("needle")},
+			zoekt.Document{Name: "g", Content: []byte("needle from " + name)},
+			// Skipped files are not copies of each other, even though
+			// they store the same content.
+			zoekt.Document{Name: "needle1", SkipReason: "too large"},
+			zoekt.Document{Name: "needle2", SkipReason: "too large"})
+		ss.replace(map[string]zoekt.Searcher{name: searcherForTest(t, b)})
+	}
+
+	for _, dedupe := range []bool{false, true} {
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{DedupeByChecksum: dedupe})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var fs []string
+		for _, f := range res.Files {
+			if f.FileName == "f" {
+				fs = append(fs, f.Repository)
+			}
+		}
+		want, wantDeduped := 2, 0
+		if dedupe {
+			want, wantDeduped = 1, 1
+		}
+		if len(fs) != want || len(res.Files) != want+6 {
+			t.Errorf("dedupe=%v: got %d copies of f in %d files, want %d in %d", dedupe, len(fs), len(res.Files), want, want+6)
+		}
+		if got := res.Stats.FilesDeduplicated; got != wantDeduped {
+			t.Errorf("dedupe=%v: got FilesDeduplicated %d, want %d", dedupe, got, wantDeduped)
+		}
+	}
+}
+
 func reposForTest(n int) (result []*zoekt.Repository) {
 	for i := 0; i < n; i++ {
 		result = append(result, &zoekt.Repository{
@@ -758,7 +1418,7 @@ func TestSendByRepository(t *testing.T) {
 		sr := createMockSearchResult(n1, n2, n3, wantStats)
 
 		mock := &mockSender{}
-		sendByRepository(sr, mock)
+		sendByRepository(sr, &zoekt.SearchOptions{}, mock)
 
 		if diff := cmp.Diff(wantStats, mock.stats); diff != "" {
 			t.Logf("-want,+got\n%s", diff)
@@ -982,3 +1642,63 @@ func testShardedSearch(t *testing.T, q query.Q, ib *zoekt.IndexBuilder) []zoekt.
 	sres, _ := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
 	return sres.Files
 }
+
+type statsSender struct {
+	stats []zoekt.Stats
+	final bool
+}
+
+func (s *statsSender) Send(*zoekt.SearchResult) {}
+
+func (s *statsSender) OnStats(stats zoekt.Stats, final bool) {
+	if s.final {
+		panic("OnStats called after final")
+	}
+	s.stats = append(s.stats, stats)
+	s.final = final
+}
+
+func TestStreamSearchStats(t *testing.T) {
+	ss := newShardedSearcher(2)
+	var shards = map[string]zoekt.Searcher{}
+	for i, content := range []string{"needle\nneedle", "needle haystack", "haystack"} {
+		b := testIndexBuilder(t, &zoekt.Repository{Name: fmt.Sprintf("repo%d", i)},
+			zoekt.Document{Name: "f1", Content: []byte(content)},
+			zoekt.Document{Name: "f2", Content: []byte("needle")})
+		shards[fmt.Sprintf("shard%d", i)] = searcherForTest(t, b)
+	}
+	ss.replace(shards)
+
+	q := &query.Substring{Pattern: "needle", Content: true}
+	opts := &zoekt.SearchOptions{}
+	want, err := ss.Search(context.Background(), q, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &statsSender{}
+	if err := ss.StreamSearch(context.Background(), q, opts, sender); err != nil {
+		t.Fatal(err)
+	}
+	if !sender.final {
+		t.Fatal("got no final stats")
+	}
+	got := sender.stats[len(sender.stats)-1]
+
+	// Timings differ between the two searches.
+	got.Wait, got.Duration = 0, 0
+	want.Stats.Wait, want.Stats.Duration = 0, 0
+	if !reflect.DeepEqual(got, want.Stats) {
+		t.Errorf("got final stats %+v, want %+v", got, want.Stats)
+	}
+	if got.FileCount != 5 || got.MatchCount != 6 {
+		t.Errorf("got FileCount %d MatchCount %d, want 5 and 6", got.FileCount, got.MatchCount)
+	}
+
+	// The running totals only grow.
+	for i := 1; i < len(sender.stats); i++ {
+		if sender.stats[i].MatchCount < sender.stats[i-1].MatchCount {
+			t.Errorf("MatchCount went from %d to %d", sender.stats[i-1].MatchCount, sender.stats[i].MatchCount)
+		}
+	}
+}
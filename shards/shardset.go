@@ -0,0 +1,206 @@
+package shards
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+var errShardSetClosed = errors.New("shards: ShardSet is closed")
+
+// ShardSet holds a Searcher that can be swapped for a new one while
+// searches are running, for example to replace a shard by its
+// reindexed version. Calls started before a Swap complete against the
+// old Searcher, which is closed once they are done.
+type ShardSet struct {
+	// mu serializes Swap and Close.
+	mu sync.Mutex
+
+	// cur holds the *shardSetRef for the active Searcher.
+	cur atomic.Value
+}
+
+// shardSetRef counts the calls in flight against a Searcher.
+type shardSetRef struct {
+	searcher zoekt.Searcher
+
+	mu      sync.Mutex
+	refs    int
+	retired bool
+
+	// drained is closed once the ref is retired and no calls are in
+	// flight.
+	drained chan struct{}
+}
+
+// NewShardSet returns a ShardSet searching s.
+func NewShardSet(s zoekt.Searcher) *ShardSet {
+	ss := &ShardSet{}
+	ss.cur.Store(newShardSetRef(s))
+	return ss
+}
+
+func newShardSetRef(s zoekt.Searcher) *shardSetRef {
+	return &shardSetRef{
+		searcher: s,
+		drained:  make(chan struct{}),
+	}
+}
+
+// acquire returns the active ref. The caller must call release when
+// done with it.
+func (ss *ShardSet) acquire() *shardSetRef {
+	for {
+		r := ss.cur.Load().(*shardSetRef)
+		r.mu.Lock()
+		if !r.retired {
+			r.refs++
+			r.mu.Unlock()
+			return r
+		}
+		// A Swap retired r after we loaded it, so the new ref is
+		// already stored.
+		r.mu.Unlock()
+	}
+}
+
+func (r *shardSetRef) release() {
+	r.mu.Lock()
+	r.refs--
+	if r.retired && r.refs == 0 {
+		close(r.drained)
+	}
+	r.mu.Unlock()
+}
+
+// retire waits for the calls in flight against r and closes its
+// Searcher.
+func (r *shardSetRef) retire() {
+	r.mu.Lock()
+	r.retired = true
+	if r.refs == 0 {
+		close(r.drained)
+	}
+	r.mu.Unlock()
+
+	<-r.drained
+	if r.searcher != nil {
+		r.searcher.Close()
+	}
+}
+
+// Swap makes s the active Searcher. It returns once the calls using
+// the previous Searcher have completed and it has been closed.
+func (ss *ShardSet) Swap(s zoekt.Searcher) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	old := ss.cur.Load().(*shardSetRef)
+	if old.searcher == nil {
+		// Closed. Keep the set closed and drop s.
+		if s != nil {
+			s.Close()
+		}
+		return
+	}
+	ss.cur.Store(newShardSetRef(s))
+	old.retire()
+}
+
+// Close closes the active Searcher once the calls in flight are done.
+// Later calls return an error.
+func (ss *ShardSet) Close() {
+	ss.Swap(nil)
+}
+
+func (ss *ShardSet) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	r := ss.acquire()
+	defer r.release()
+	if r.searcher == nil {
+		return nil, errShardSetClosed
+	}
+	return r.searcher.Search(ctx, q, opts)
+}
+
+func (ss *ShardSet) List(ctx context.Context, q query.Q, opts *zoekt.ListOptions) (*zoekt.RepoList, error) {
+	r := ss.acquire()
+	defer r.release()
+	if r.searcher == nil {
+		return nil, errShardSetClosed
+	}
+	return r.searcher.List(ctx, q, opts)
+}
+
+func (ss *ShardSet) FileNames(ctx context.Context, q query.Q) ([]string, error) {
+	r := ss.acquire()
+	defer r.release()
+	if r.searcher == nil {
+		return nil, errShardSetClosed
+	}
+	return r.searcher.FileNames(ctx, q)
+}
+
+func (ss *ShardSet) Count(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (int64, zoekt.Stats, error) {
+	r := ss.acquire()
+	defer r.release()
+	if r.searcher == nil {
+		return 0, zoekt.Stats{}, errShardSetClosed
+	}
+	return r.searcher.Count(ctx, q, opts)
+}
+
+func (ss *ShardSet) FileBranches(ctx context.Context, fileName string) ([]zoekt.FileBranch, error) {
+	r := ss.acquire()
+	defer r.release()
+	if r.searcher == nil {
+		return nil, errShardSetClosed
+	}
+	return r.searcher.FileBranches(ctx, fileName)
+}
+
+func (ss *ShardSet) Suggest(ctx context.Context, q query.Q) ([]string, error) {
+	r := ss.acquire()
+	defer r.release()
+	if r.searcher == nil {
+		return nil, errShardSetClosed
+	}
+	return r.searcher.Suggest(ctx, q)
+}
+
+func (ss *ShardSet) ContentWindow(ctx context.Context, fileName string, start, end uint32) ([]byte, error) {
+	r := ss.acquire()
+	defer r.release()
+	if r.searcher == nil {
+		return nil, errShardSetClosed
+	}
+	return r.searcher.ContentWindow(ctx, fileName, start, end)
+}
+
+func (ss *ShardSet) DuplicateGroups(ctx context.Context) ([][]zoekt.DuplicateFile, error) {
+	r := ss.acquire()
+	defer r.release()
+	if r.searcher == nil {
+		return nil, errShardSetClosed
+	}
+	return r.searcher.DuplicateGroups(ctx)
+}
+
+func (ss *ShardSet) RawConfig(ctx context.Context) (map[string]map[string]string, error) {
+	r := ss.acquire()
+	defer r.release()
+	if r.searcher == nil {
+		return nil, errShardSetClosed
+	}
+	return r.searcher.RawConfig(ctx)
+}
+
+func (ss *ShardSet) String() string {
+	r := ss.acquire()
+	defer r.release()
+	return fmt.Sprintf("ShardSet(%v)", r.searcher)
+}
@@ -0,0 +1,87 @@
+package shards
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+// closeCheckSearcher reports searches against it after it was closed.
+type closeCheckSearcher struct {
+	rankSearcher
+	closed int32
+}
+
+func (s *closeCheckSearcher) Close() {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		panic(fmt.Sprintf("%d closed twice", s.rank))
+	}
+}
+
+func (s *closeCheckSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return nil, fmt.Errorf("searcher %d: search started after close", s.rank)
+	}
+	res, err := s.rankSearcher.Search(ctx, q, opts)
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return nil, fmt.Errorf("searcher %d: closed during search", s.rank)
+	}
+	return res, err
+}
+
+func TestShardSetSwap(t *testing.T) {
+	var searchers []*closeCheckSearcher
+	for i := 0; i < 20; i++ {
+		searchers = append(searchers, &closeCheckSearcher{rankSearcher: rankSearcher{rank: uint16(i)}})
+	}
+
+	ss := NewShardSet(searchers[0])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				res, err := ss.Search(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(res.Files) != 1 {
+					t.Errorf("got %v, want 1 file", res.Files)
+					return
+				}
+			}
+		}()
+	}
+
+	for _, s := range searchers[1:] {
+		time.Sleep(time.Millisecond)
+		ss.Swap(s)
+	}
+	cancel()
+	wg.Wait()
+
+	// Swap returns after closing the previous searcher.
+	for _, s := range searchers[:len(searchers)-1] {
+		if atomic.LoadInt32(&s.closed) == 0 {
+			t.Errorf("searcher %d was not closed", s.rank)
+		}
+	}
+
+	ss.Close()
+	if atomic.LoadInt32(&searchers[len(searchers)-1].closed) == 0 {
+		t.Error("Close did not close the active searcher")
+	}
+	if _, err := ss.Search(context.Background(), &query.Const{Value: true}, &zoekt.SearchOptions{}); err == nil {
+		t.Error("got nil error searching a closed ShardSet")
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"context"
+	"regexp/syntax"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/zoekt/query"
+)
+
+const (
+	// suggestMaxDocs is the number of documents scanned for words
+	// close to a pattern.
+	suggestMaxDocs = 50
+
+	// suggestMaxDistance is the maximum edit distance between a
+	// pattern and a suggestion.
+	suggestMaxDistance = 2
+
+	// suggestMaxResults is the number of suggestions returned.
+	suggestMaxResults = 5
+)
+
+func (d *indexData) Suggest(ctx context.Context, q query.Q) ([]string, error) {
+	var patterns []*query.Substring
+	query.VisitAtoms(q, func(q query.Q) {
+		switch s := q.(type) {
+		case *query.Substring:
+			if !s.FileName {
+				patterns = append(patterns, s)
+			}
+		case *query.Regexp:
+			if s.Regexp.Op == syntax.OpLiteral && !s.FileName {
+				patterns = append(patterns, &query.Substring{Pattern: string(s.Regexp.Rune), CaseSensitive: s.CaseSensitive})
+			}
+		}
+	})
+
+	var res []string
+	seen := map[string]bool{}
+	for _, p := range patterns {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		words, err := d.suggestWords(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range words {
+			if !seen[w] {
+				seen[w] = true
+				res = append(res, w)
+			}
+		}
+	}
+	return res, nil
+}
+
+// suggestWords returns the words in the documents sharing the most
+// ngrams with the pattern of q that are within suggestMaxDistance
+// edits of it, closest and most frequent first.
+func (d *indexData) suggestWords(q *query.Substring) ([]string, error) {
+	pattern := []rune(q.Pattern)
+	if !q.CaseSensitive {
+		pattern = []rune(string(toLower([]byte(q.Pattern))))
+	}
+
+	// Rank documents by the number of ngrams of the pattern they
+	// contain.
+	shared := map[uint32]int{}
+	for _, ng := range splitNGrams([]byte(q.Pattern)) {
+		docs, err := d.ngramDocs(ng.ngram, q.CaseSensitive)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			shared[doc]++
+		}
+	}
+	docs := make([]uint32, 0, len(shared))
+	for doc := range shared {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if shared[docs[i]] != shared[docs[j]] {
+			return shared[docs[i]] > shared[docs[j]]
+		}
+		return docs[i] < docs[j]
+	})
+	if len(docs) > suggestMaxDocs {
+		docs = docs[:suggestMaxDocs]
+	}
+
+	type suggestion struct {
+		dist, count int
+	}
+	found := map[string]*suggestion{}
+	for _, doc := range docs {
+		content, err := d.readContents(doc)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range bytes.FieldsFunc(content, isNotWordRune) {
+			n := utf8.RuneCount(w)
+			if n < len(pattern)-suggestMaxDistance || n > len(pattern)+suggestMaxDistance {
+				continue
+			}
+			if !q.CaseSensitive {
+				w = toLower(w)
+			}
+			if s, ok := found[string(w)]; ok {
+				s.count++
+				continue
+			}
+			if dist := editDistance(pattern, []rune(string(w))); dist > 0 && dist <= suggestMaxDistance {
+				found[string(w)] = &suggestion{dist: dist, count: 1}
+			}
+		}
+	}
+
+	words := make([]string, 0, len(found))
+	for w := range found {
+		words = append(words, w)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		a, b := found[words[i]], found[words[j]]
+		if a.dist != b.dist {
+			return a.dist < b.dist
+		}
+		if a.count != b.count {
+			return a.count > b.count
+		}
+		return words[i] < words[j]
+	})
+	if len(words) > suggestMaxResults {
+		words = words[:suggestMaxResults]
+	}
+	return words, nil
+}
+
+func isNotWordRune(r rune) bool {
+	return !(r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
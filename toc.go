@@ -43,7 +43,9 @@ const IndexFormatVersion = 16
 // 10: Compound shards; more flexible TOC format.
 // 11: Bloom filters for file names & contents
 // 12: go-enry for identifying file languages
-const FeatureVersion = 12
+// 15: Git file modes, comment spans, maximum line lengths and symbol
+// ngrams. 13 and 14 are taken by ReadFeatureVersion.
+const FeatureVersion = 15
 
 // WriteMinFeatureVersion and ReadMinFeatureVersion constrain forwards and backwards
 // compatibility. For example, if a new way to encode filenameNgrams on disk is
@@ -65,6 +67,23 @@ const WriteMinFeatureVersion = 10
 // load a file with a FeatureVersion below it.
 const ReadMinFeatureVersion = 8
 
+// ReadFeatureVersion is the highest IndexMinReaderVersion of the files
+// this version can load. It is bumped past FeatureVersion when the
+// reader learns an encoding that is only written on request, so
+// existing files need not be reindexed.
+// 13: Posting list codecs
+// 14: Ngrams dropped by IndexBuilder.MaxNgrams
+const ReadFeatureVersion = 14
+
+// postingsCodecFeatureVersion is the IndexMinReaderVersion of files
+// whose posting lists are not encoded with PostingsDeltaVarint.
+const postingsCodecFeatureVersion = 13
+
+// ngramsDroppedFeatureVersion is the IndexMinReaderVersion of files
+// with IndexMetadata.NgramsDropped set. Older readers would take the
+// dropped ngrams for absent ones and miss matches.
+const ngramsDroppedFeatureVersion = 14
+
 // 17: compound shard (multi repo)
 const NextIndexFormatVersion = 17
 
@@ -100,6 +119,15 @@ type indexTOC struct {
 	nameBloom    simpleSection
 
 	repos simpleSection
+
+	fileModes simpleSection
+
+	commentSections compoundSection
+
+	maxLineLengths simpleSection
+
+	symbolNgramText simpleSection
+	symbolPostings  compoundSection
 }
 
 func (t *indexTOC) sections() []section {
@@ -182,6 +210,11 @@ func (t *indexTOC) sectionsTaggedList() []taggedSection {
 		{"repos", &t.repos},
 		{"nameBloom", &t.nameBloom},
 		{"contentBloom", &t.contentBloom},
+		{"fileModes", &t.fileModes},
+		{"commentSections", &t.commentSections},
+		{"maxLineLengths", &t.maxLineLengths},
+		{"symbolNgramText", &t.symbolNgramText},
+		{"symbolPostings", &t.symbolPostings},
 	}
 }
 
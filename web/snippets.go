@@ -99,10 +99,13 @@ func (s *Server) formatResults(result *zoekt.SearchResult, query string, localPr
 			Language: f.Language,
 		}
 
-		if dup, ok := seenFiles[string(f.Checksum)]; ok {
-			fMatch.DuplicateID = dup
-		} else {
-			seenFiles[string(f.Checksum)] = fMatch.ResultID
+		// Skipped files have no checksum and are never duplicates.
+		if len(f.Checksum) > 0 {
+			if dup, ok := seenFiles[string(f.Checksum)]; ok {
+				fMatch.DuplicateID = dup
+			} else {
+				seenFiles[string(f.Checksum)] = fMatch.ResultID
+			}
 		}
 
 		if f.SubRepositoryName != "" {
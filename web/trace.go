@@ -64,5 +64,26 @@ func getTraceContext(
 func (s traceAwareSearcher) List(ctx context.Context, q query.Q, opts *zoekt.ListOptions) (*zoekt.RepoList, error) {
 	return s.Searcher.List(ctx, q, opts)
 }
+func (s traceAwareSearcher) FileNames(ctx context.Context, q query.Q) ([]string, error) {
+	return s.Searcher.FileNames(ctx, q)
+}
+func (s traceAwareSearcher) Count(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (int64, zoekt.Stats, error) {
+	return s.Searcher.Count(ctx, q, opts)
+}
+func (s traceAwareSearcher) FileBranches(ctx context.Context, fileName string) ([]zoekt.FileBranch, error) {
+	return s.Searcher.FileBranches(ctx, fileName)
+}
+func (s traceAwareSearcher) Suggest(ctx context.Context, q query.Q) ([]string, error) {
+	return s.Searcher.Suggest(ctx, q)
+}
+func (s traceAwareSearcher) ContentWindow(ctx context.Context, fileName string, start, end uint32) ([]byte, error) {
+	return s.Searcher.ContentWindow(ctx, fileName, start, end)
+}
+func (s traceAwareSearcher) DuplicateGroups(ctx context.Context) ([][]zoekt.DuplicateFile, error) {
+	return s.Searcher.DuplicateGroups(ctx)
+}
+func (s traceAwareSearcher) RawConfig(ctx context.Context) (map[string]map[string]string, error) {
+	return s.Searcher.RawConfig(ctx)
+}
 func (s traceAwareSearcher) Close()         { s.Searcher.Close() }
 func (s traceAwareSearcher) String() string { return s.Searcher.String() }
@@ -66,14 +66,22 @@ func (s *compoundSection) writeMap(w *writer, m map[string]uint32) {
 	s.writeStrings(w, keys)
 }
 
+// writePostings writes the postings of s, encoded with codec. If
+// maxNgrams is non-zero, only the maxNgrams most selective ngrams are
+// written, and writePostings reports whether any ngrams were dropped.
 func writePostings(w *writer, s *postingsBuilder, ngramText *simpleSection,
-	charOffsets *simpleSection, postings *compoundSection, endRunes *simpleSection) {
+	charOffsets *simpleSection, postings *compoundSection, endRunes *simpleSection, maxNgrams int, codec PostingsCodec) (dropped bool) {
 	keys := make(ngramSlice, 0, len(s.postings))
 	for k := range s.postings {
 		keys = append(keys, k)
 	}
 	sort.Sort(keys)
 
+	if maxNgrams > 0 && len(keys) > maxNgrams {
+		keys = selectNgrams(s.postings, keys, maxNgrams)
+		dropped = true
+	}
+
 	ngramText.start(w)
 	for _, k := range keys {
 		var buf [8]byte
@@ -83,8 +91,15 @@ func writePostings(w *writer, s *postingsBuilder, ngramText *simpleSection,
 	ngramText.end(w)
 
 	postings.start(w)
+	var buf []uint32
 	for _, k := range keys {
-		postings.addItem(w, s.postings[k])
+		// The builder collects delta varint encoded postings.
+		blob := s.postings[k]
+		if codec == PostingsBitPacked {
+			buf = fromDeltas(blob, buf)
+			blob = toBitPacked(buf)
+		}
+		postings.addItem(w, blob)
 	}
 	postings.end(w)
 
@@ -95,9 +110,35 @@ func writePostings(w *writer, s *postingsBuilder, ngramText *simpleSection,
 	endRunes.start(w)
 	w.Write(toSizedDeltas(s.endRunes))
 	endRunes.end(w)
+	return dropped
+}
+
+// writeSymbolNgrams writes the symbol ngram index: the sorted ngrams,
+// and for each the IDs of the documents with a symbol containing it.
+func writeSymbolNgrams(w *writer, docs map[ngram][]uint32, ngramText *simpleSection, postings *compoundSection) {
+	keys := make(ngramSlice, 0, len(docs))
+	for k := range docs {
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+
+	ngramText.start(w)
+	for _, k := range keys {
+		w.U64(uint64(k))
+	}
+	ngramText.end(w)
+
+	postings.start(w)
+	for _, k := range keys {
+		postings.addItem(w, toSizedDeltas(docs[k]))
+	}
+	postings.end(w)
 }
 
 func (b *IndexBuilder) Write(out io.Writer) error {
+	if b.PostingsCodec != PostingsDeltaVarint && b.PostingsCodec != PostingsBitPacked {
+		return fmt.Errorf("unknown posting list codec %d", b.PostingsCodec)
+	}
 	next := b.indexFormatVersion == NextIndexFormatVersion
 
 	buffered := bufio.NewWriterSize(out, 1<<20)
@@ -107,9 +148,12 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 	toc := indexTOC{}
 
 	toc.fileContents.writeStrings(w, b.contentStrings)
+	maxLineLengths := make([]uint32, 0, len(b.contentStrings))
 	toc.newlines.start(w)
 	for _, f := range b.contentStrings {
-		toc.newlines.addItem(w, toSizedDeltas(newLinesIndices(f.data)))
+		nls := newLinesIndices(f.data)
+		toc.newlines.addItem(w, toSizedDeltas(nls))
+		maxLineLengths = append(maxLineLengths, maxLineLength(nls, uint32(len(f.data))))
 	}
 	toc.newlines.end(w)
 
@@ -147,12 +191,12 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 	b.contentBloom.shrinkToSize(bloomDefaultLoad).write(w)
 	toc.contentBloom.end(w)
 
-	writePostings(w, b.contentPostings, &toc.ngramText, &toc.runeOffsets, &toc.postings, &toc.fileEndRunes)
+	ngramsDropped := writePostings(w, b.contentPostings, &toc.ngramText, &toc.runeOffsets, &toc.postings, &toc.fileEndRunes, b.MaxNgrams, b.PostingsCodec)
 
 	// names.
 	toc.fileNames.writeStrings(w, b.nameStrings)
 
-	writePostings(w, b.namePostings, &toc.nameNgramText, &toc.nameRuneOffsets, &toc.namePostings, &toc.nameEndRunes)
+	writePostings(w, b.namePostings, &toc.nameNgramText, &toc.nameRuneOffsets, &toc.namePostings, &toc.nameEndRunes, 0, b.PostingsCodec)
 
 	toc.subRepos.start(w)
 	w.Write(toSizedDeltas(b.subRepos))
@@ -166,10 +210,44 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 	w.Write(b.languages)
 	toc.languages.end(w)
 
+	// Leave the section empty if all files are regular, which is
+	// what readers assume for a missing section.
+	toc.fileModes.start(w)
+	for _, m := range b.fileModes {
+		if m != 0 {
+			for _, m := range b.fileModes {
+				w.U32(m)
+			}
+			break
+		}
+	}
+	toc.fileModes.end(w)
+
+	toc.maxLineLengths.start(w)
+	for _, n := range maxLineLengths {
+		w.U32(n)
+	}
+	toc.maxLineLengths.end(w)
+
+	// As for file modes, leave the section empty if no file has
+	// comment spans.
+	toc.commentSections.start(w)
+	for _, s := range b.commentSections {
+		if len(s) > 0 {
+			for _, s := range b.commentSections {
+				toc.commentSections.addItem(w, marshalDocSections(s))
+			}
+			break
+		}
+	}
+	toc.commentSections.end(w)
+
 	toc.runeDocSections.start(w)
 	w.Write(marshalDocSections(b.runeDocSections))
 	toc.runeDocSections.end(w)
 
+	writeSymbolNgrams(w, b.symbolNgrams, &toc.symbolNgramText, &toc.symbolPostings)
+
 	if next {
 		toc.repos.start(w)
 		w.Write(toSizedDeltas16(b.repos))
@@ -181,15 +259,27 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 		indexTime = time.Now()
 	}
 
+	minReaderVersion := WriteMinFeatureVersion
+	if b.PostingsCodec != PostingsDeltaVarint {
+		minReaderVersion = postingsCodecFeatureVersion
+	}
+	if ngramsDropped {
+		minReaderVersion = ngramsDroppedFeatureVersion
+	}
+
 	if err := b.writeJSON(&IndexMetadata{
 		IndexFormatVersion:    b.indexFormatVersion,
 		IndexTime:             indexTime,
 		IndexFeatureVersion:   b.featureVersion,
-		IndexMinReaderVersion: WriteMinFeatureVersion,
+		IndexMinReaderVersion: minReaderVersion,
 		PlainASCII:            b.contentPostings.isPlainASCII && b.namePostings.isPlainASCII,
 		LanguageMap:           b.languageMap,
 		ZoektVersion:          Version,
 		ID:                    b.ID,
+		NgramsDropped:         ngramsDropped,
+		MaxNgrams:             b.MaxNgrams,
+		PostingsCodec:         b.PostingsCodec,
+		LineMax:               b.LineMax,
 	}, &toc.metaData, w); err != nil {
 		return err
 	}
@@ -227,6 +317,55 @@ func (b *IndexBuilder) writeJSON(data interface{}, sec *simpleSection, w *writer
 	return nil
 }
 
+// selectNgrams returns at most maxNgrams of the sorted keys, in sorted
+// order. It keeps the ngrams with the shortest posting lists; the
+// others are the least useful for narrowing down a search. The case
+// variants of an ngram are kept or dropped together: a case
+// insensitive search sums the frequencies of all variants, so it must
+// not mistake a dropped variant for an absent one.
+func selectNgrams(postings map[ngram][]byte, keys ngramSlice, maxNgrams int) ngramSlice {
+	type ngramGroup struct {
+		ngrams []ngram
+		size   int
+	}
+	byFold := map[ngram]*ngramGroup{}
+	var groups []*ngramGroup
+	for _, k := range keys {
+		f := foldNgram(k)
+		g := byFold[f]
+		if g == nil {
+			g = &ngramGroup{}
+			byFold[f] = g
+			groups = append(groups, g)
+		}
+		g.ngrams = append(g.ngrams, k)
+		g.size += len(postings[k])
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].size < groups[j].size
+	})
+
+	selected := make(ngramSlice, 0, maxNgrams)
+	for _, g := range groups {
+		if len(selected)+len(g.ngrams) <= maxNgrams {
+			selected = append(selected, g.ngrams...)
+		}
+	}
+	sort.Sort(selected)
+	return selected
+}
+
+// foldNgram returns the smallest of the case variants of g.
+func foldNgram(g ngram) ngram {
+	min := g
+	for _, v := range generateCaseNgrams(g) {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
+
 func newLinesIndices(in []byte) []uint32 {
 	out := make([]uint32, 0, bytes.Count(in, []byte{'\n'}))
 	for i, c := range in {
@@ -236,3 +375,19 @@ func newLinesIndices(in []byte) []uint32 {
 	}
 	return out
 }
+
+// maxLineLength returns the length in bytes of the longest line of a
+// document of the given size with line boundaries at newlines.
+func maxLineLength(newlines []uint32, size uint32) uint32 {
+	var max, start uint32
+	for _, nl := range newlines {
+		if nl-start > max {
+			max = nl - start
+		}
+		start = nl + 1
+	}
+	if size > start && size-start > max {
+		max = size - start
+	}
+	return max
+}